@@ -0,0 +1,73 @@
+// Command redix-rdb converts between Redis RDB files and Redix snapshot
+// files offline. The format of the input is told from its header, and the
+// output is written in the other one:
+//
+//	redix-rdb dump.rdb dump.rdx   # move a Redis dataset to Redix
+//	redix-rdb dump.rdx dump.rdb   # move a Redix dataset to Redis
+//
+// A converted snapshot seeds a new data directory; it should not be placed
+// next to an existing WAL.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/storage"
+)
+
+func main() {
+	databases := flag.Int("databases", storage.DefaultDatabases, "Number of databases the input may use")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: redix-rdb [-databases n] input output\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	input, output := flag.Arg(0), flag.Arg(1)
+
+	format, err := detectFormat(input)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbs := storage.NewDatabases(*databases, 1)
+	var keys int
+	switch format {
+	case "REDIS":
+		if keys, err = dbs.LoadRDB(input); err != nil {
+			log.Fatalf("Failed to read RDB file: %v", err)
+		}
+		err = dbs.SaveSnapshotFile(output)
+	default:
+		if keys, err = dbs.LoadSnapshotFile(input); err != nil {
+			log.Fatalf("Failed to read snapshot: %v", err)
+		}
+		err = dbs.SaveRDB(output)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write %s: %v", output, err)
+	}
+	fmt.Printf("Converted %d keys from %s to %s\n", keys, input, output)
+}
+
+// detectFormat returns "REDIS" for an RDB file and "REDIX" for a snapshot.
+func detectFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 5)
+	if _, err := io.ReadFull(file, magic); err != nil || (string(magic) != "REDIS" && string(magic) != "REDIX") {
+		return "", fmt.Errorf("%s is neither an RDB file nor a Redix snapshot", path)
+	}
+	return string(magic), nil
+}
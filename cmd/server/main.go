@@ -5,7 +5,11 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
 	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/network"
 	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/storage"
 )
@@ -17,12 +21,45 @@ type Config struct {
 		ClusterNodes []string `json:"cluster_nodes"`
 	} `json:"server"`
 	Storage struct {
-		Dir string `json:"dir"`
+		Dir              string `json:"dir"`
+		Databases        int    `json:"databases"`
+		Shards           int    `json:"shards"`
+		MaxMemory        string `json:"maxmemory"`
+		MaxMemoryPolicy  string `json:"maxmemory_policy"`
+		MaxMemorySamples int    `json:"maxmemory_samples"`
+		Save             string `json:"save"`
+		AppendOnly       bool   `json:"appendonly"`
+		AppendFsync      string `json:"appendfsync"`
+		// Codec snapshot blocks are compressed with: none, snappy, zstd
+		// or deflate.
+		Compression string `json:"compression"`
+		// Rewrite the AOF once it has grown by this percentage since the
+		// last rewrite, and is at least the minimum size. 0 disables it.
+		AutoAOFRewritePercentage int    `json:"auto_aof_rewrite_percentage"`
+		AutoAOFRewriteMinSize    string `json:"auto_aof_rewrite_min_size"`
+		// Where values are kept: memory, tiered (the working set in
+		// memory, values evicted for maxmemory in the LSM tree) or lsm
+		// (every value in the LSM tree).
+		Engine string `json:"engine"`
+		// Keep every database's keys sorted for KEYRANGE and KEYPREFIX,
+		// which otherwise sort the keyspace on each call.
+		OrderedIndex bool `json:"ordered_index"`
+		// The LSM tree of the tiered and lsm engines, in lsm.dir, by
+		// default "lsm" under dir.
+		LSM struct {
+			Dir             string `json:"dir"`
+			CompactionStyle string `json:"compaction_style"`
+			Compression     string `json:"compression"`
+			BlockCacheSize  string `json:"block_cache_size"`
+		} `json:"lsm"`
+
+		Encoding datastructures.EncodingLimits `json:"encoding"`
 	} `json:"storage"`
 }
 
 func main() {
 	configPath := flag.String("config", "", "Path to configuration file")
+	importRDB := flag.String("import-rdb", "", "Redis RDB file to load on startup")
 	flag.Parse()
 
 	if *configPath == "" {
@@ -35,18 +72,164 @@ func main() {
 	}
 
 	var config Config
+	config.Storage.Encoding = datastructures.DefaultEncodingLimits()
+	config.Storage.AutoAOFRewritePercentage = storage.DefaultAutoRewritePercentage
+	config.Storage.AutoAOFRewriteMinSize = "64mb"
 	if err := json.Unmarshal(configData, &config); err != nil {
 		log.Fatalf("Failed to parse configuration: %v", err)
 	}
 
-	store := storage.NewInMemoryStore()
+	datastructures.SetEncodingLimits(config.Storage.Encoding)
+
+	dbs := storage.NewDatabases(config.Storage.Databases, config.Storage.Shards)
+
+	maxMemory, err := storage.ParseMemory(config.Storage.MaxMemory)
+	if err != nil {
+		log.Fatalf("Invalid maxmemory: %v", err)
+	}
+	policy, err := storage.ParseEvictionPolicy(config.Storage.MaxMemoryPolicy)
+	if err != nil {
+		log.Fatalf("Invalid maxmemory_policy: %v", err)
+	}
+	dbs.ConfigureEviction(maxMemory, policy, config.Storage.MaxMemorySamples)
+	if config.Storage.OrderedIndex {
+		dbs.EnableOrderedIndex()
+	}
+
+	handler := storage.NewCommandHandler(dbs)
+
+	engine, err := storage.ParseEngineKind(config.Storage.Engine)
+	if err != nil {
+		log.Fatalf("Invalid engine: %v", err)
+	}
+	var tier *storage.LSMTree
+	if engine != storage.EngineMemory {
+		if engine == storage.EngineTiered && maxMemory == 0 {
+			log.Fatal("The tiered engine requires maxmemory to be set")
+		}
+		tier = openTier(&config, engine)
+		dbs.UseEngine(engine, tier)
+		handler.EnableLSM(tier)
+	}
+
+	var persistence *storage.PersistenceLayer
+	if config.Storage.Dir != "" {
+		persistence, err = storage.NewPersistenceLayer(config.Storage.Dir)
+		if err != nil {
+			log.Fatalf("Failed to open data directory: %v", err)
+		}
+		stats, err := handler.Recover(persistence)
+		if err != nil {
+			log.Fatalf("Failed to recover data: %v", err)
+		}
+		log.Printf("Loaded %d keys from snapshot and replayed %d commands (%d failed)",
+			stats.SnapshotKeys, stats.Replayed, stats.Failed)
+		if stats.WALRepair != nil {
+			log.Printf("Truncated damaged WAL tail: %s", stats.WALRepair)
+		}
+
+		compression, err := storage.ParseCompression(config.Storage.Compression)
+		if err != nil {
+			log.Fatalf("Invalid compression: %v", err)
+		}
+		persistence.SetCompression(compression)
+
+		rules, err := storage.ParseSaveRules(config.Storage.Save)
+		if err != nil {
+			log.Fatalf("Invalid save rules: %v", err)
+		}
+		handler.EnableSnapshots(persistence, rules)
+
+		if config.Storage.AppendOnly {
+			fsync, err := storage.ParseAppendFsync(config.Storage.AppendFsync)
+			if err != nil {
+				log.Fatalf("Invalid appendfsync: %v", err)
+			}
+			persistence.SetAppendFsync(fsync)
+			minSize, err := storage.ParseMemory(config.Storage.AutoAOFRewriteMinSize)
+			if err != nil {
+				log.Fatalf("Invalid auto_aof_rewrite_min_size: %v", err)
+			}
+			persistence.SetAutoRewrite(config.Storage.AutoAOFRewritePercentage, minSize)
+			handler.EnablePersistence(persistence)
+		}
+	}
+
+	if *importRDB != "" {
+		keys, err := dbs.LoadRDB(*importRDB)
+		if err != nil {
+			log.Fatalf("Failed to import RDB file: %v", err)
+		}
+		log.Printf("Imported %d keys from %s", keys, *importRDB)
+		if persistence != nil {
+			if err := handler.SaveSnapshot(persistence); err != nil {
+				log.Fatalf("Failed to save imported keys: %v", err)
+			}
+		}
+	}
 
-	handler := storage.NewCommandHandler(store)
+	if engine == storage.EngineLSM {
+		pruned, err := dbs.PruneTier()
+		if err != nil {
+			log.Fatalf("Failed to prune LSM tree: %v", err)
+		}
+		log.Printf("Pruned %d values of deleted keys from the LSM tree", pruned)
+	}
 
 	server := network.NewServer(config.Server.Addr, handler)
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Shutdown()
+		if persistence != nil {
+			if err := handler.SaveSnapshot(persistence); err != nil {
+				log.Printf("Failed to save snapshot: %v", err)
+			}
+			persistence.Close()
+		}
+		if tier != nil {
+			tier.Close()
+		}
+		os.Exit(0)
+	}()
+
 	log.Printf("Starting server on %s", config.Server.Addr)
 	if err := server.Start(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// openTier opens the LSM tree that the tiered or lsm engine keeps values
+// in.
+func openTier(config *Config, engine storage.EngineKind) *storage.LSMTree {
+	lsm := config.Storage.LSM
+	dir := lsm.Dir
+	if dir == "" {
+		if config.Storage.Dir == "" {
+			log.Fatal("The tiered and lsm engines require lsm.dir or dir to be set")
+		}
+		dir = filepath.Join(config.Storage.Dir, "lsm")
+	}
+
+	opts := storage.DefaultLSMOptions()
+	var err error
+	if opts.CompactionStyle, err = storage.ParseCompactionStyle(lsm.CompactionStyle); err != nil {
+		log.Fatalf("Invalid lsm compaction_style: %v", err)
+	}
+	if opts.Compression, err = storage.ParseCompression(lsm.Compression); err != nil {
+		log.Fatalf("Invalid lsm compression: %v", err)
+	}
+	if lsm.BlockCacheSize != "" {
+		if opts.BlockCacheSize, err = storage.ParseMemory(lsm.BlockCacheSize); err != nil {
+			log.Fatalf("Invalid lsm block_cache_size: %v", err)
+		}
+	}
+
+	tier, err := storage.OpenTier(dir, engine, opts)
+	if err != nil {
+		log.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	return tier
+}
@@ -6,6 +6,7 @@ toolchain go1.23.7
 
 require (
 	github.com/go-redis/redis/v8 v8.11.5
+	github.com/klauspost/compress v1.18.0
 	golang.org/x/crypto v0.36.0
 )
 
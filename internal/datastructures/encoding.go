@@ -0,0 +1,78 @@
+package datastructures
+
+import (
+	"sync/atomic"
+)
+
+// Encoding names reported for the representations a collection can use.
+const (
+	EncodingListpack  = "listpack"
+	EncodingIntset    = "intset"
+	EncodingHashtable = "hashtable"
+	EncodingSkiplist  = "skiplist"
+	EncodingQuicklist = "quicklist"
+)
+
+// listpackSafetyLimit caps the size of a list listpack when its limit is
+// given as an entry count, so a few huge elements cannot keep it packed.
+const listpackSafetyLimit = 8192
+
+// EncodingLimits are the thresholds past which a collection is converted
+// from its compact encoding to the full one. They mirror the Redis
+// settings of the same names; a *-value limit is the longest string a
+// compact encoding may hold. ListMaxListpackSize is an entry count when
+// positive, and -1 to -5 select a byte limit of 4KB to 64KB.
+type EncodingLimits struct {
+	HashMaxListpackEntries int `json:"hash-max-listpack-entries"`
+	HashMaxListpackValue   int `json:"hash-max-listpack-value"`
+	SetMaxIntsetEntries    int `json:"set-max-intset-entries"`
+	SetMaxListpackEntries  int `json:"set-max-listpack-entries"`
+	SetMaxListpackValue    int `json:"set-max-listpack-value"`
+	ZSetMaxListpackEntries int `json:"zset-max-listpack-entries"`
+	ZSetMaxListpackValue   int `json:"zset-max-listpack-value"`
+	ListMaxListpackSize    int `json:"list-max-listpack-size"`
+}
+
+// DefaultEncodingLimits returns the Redis defaults.
+func DefaultEncodingLimits() EncodingLimits {
+	return EncodingLimits{
+		HashMaxListpackEntries: 128,
+		HashMaxListpackValue:   64,
+		SetMaxIntsetEntries:    512,
+		SetMaxListpackEntries:  128,
+		SetMaxListpackValue:    64,
+		ZSetMaxListpackEntries: 128,
+		ZSetMaxListpackValue:   64,
+		ListMaxListpackSize:    -2,
+	}
+}
+
+var encodingLimits atomic.Pointer[EncodingLimits]
+
+func init() {
+	defaults := DefaultEncodingLimits()
+	encodingLimits.Store(&defaults)
+}
+
+// SetEncodingLimits replaces the thresholds used by every collection. Values
+// already converted to their full encoding are not packed again.
+func SetEncodingLimits(limits EncodingLimits) {
+	encodingLimits.Store(&limits)
+}
+
+func limits() *EncodingLimits {
+	return encodingLimits.Load()
+}
+
+// listFits reports whether a list of n elements taking size bytes when
+// packed may stay a listpack.
+func (l *EncodingLimits) listFits(n, size int) bool {
+	if l.ListMaxListpackSize >= 0 {
+		return n <= l.ListMaxListpackSize && size <= listpackSafetyLimit
+	}
+	level := -l.ListMaxListpackSize
+	if level > 5 {
+		level = 5
+	}
+	return size <= 2048<<level
+}
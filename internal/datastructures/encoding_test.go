@@ -0,0 +1,163 @@
+package datastructures
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// withLimits runs the test with limits in place of the defaults.
+func withLimits(t *testing.T, limits EncodingLimits) {
+	t.Helper()
+	SetEncodingLimits(limits)
+	t.Cleanup(func() { SetEncodingLimits(DefaultEncodingLimits()) })
+}
+
+func smallLimits() EncodingLimits {
+	return EncodingLimits{
+		HashMaxListpackEntries: 4,
+		HashMaxListpackValue:   8,
+		SetMaxIntsetEntries:    4,
+		SetMaxListpackEntries:  6,
+		SetMaxListpackValue:    8,
+		ZSetMaxListpackEntries: 4,
+		ZSetMaxListpackValue:   8,
+		ListMaxListpackSize:    4,
+	}
+}
+
+func expectEncoding(t *testing.T, what string, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("%s is encoded as %s, want %s", what, got, want)
+	}
+}
+
+func TestHashEncoding(t *testing.T) {
+	withLimits(t, smallLimits())
+
+	h := NewHash()
+	for i := 0; i < 4; i++ {
+		h.HSet("f"+strconv.Itoa(i), int64(i))
+	}
+	expectEncoding(t, "a hash at the entry limit", h.Encoding(), EncodingListpack)
+	h.HSet("f0", "replaced")
+	expectEncoding(t, "a hash with a field replaced", h.Encoding(), EncodingListpack)
+	h.HSet("f4", int64(4))
+	expectEncoding(t, "a hash past the entry limit", h.Encoding(), EncodingHashtable)
+	if n := h.HLen(); n != 5 {
+		t.Fatalf("converted hash has %d fields, want 5", n)
+	}
+	if v, _ := h.HGet("f0"); v != "replaced" {
+		t.Fatalf("f0 = %v after converting, want replaced", v)
+	}
+
+	// Values already converted are not packed again.
+	h.HDel("f4")
+	h.HDel("f3")
+	expectEncoding(t, "a shrunk hash", h.Encoding(), EncodingHashtable)
+
+	h = NewHash()
+	h.HSet("short", strings.Repeat("v", 8))
+	expectEncoding(t, "a hash with a value at the length limit", h.Encoding(), EncodingListpack)
+	h.HSet("long", strings.Repeat("v", 9))
+	expectEncoding(t, "a hash with a long value", h.Encoding(), EncodingHashtable)
+
+	h = NewHash()
+	h.HSet(strings.Repeat("f", 9), "v")
+	expectEncoding(t, "a hash with a long field", h.Encoding(), EncodingHashtable)
+}
+
+func TestSetEncoding(t *testing.T) {
+	withLimits(t, smallLimits())
+
+	s := NewSet()
+	for i := int64(0); i < 4; i++ {
+		s.Add(i)
+	}
+	s.Add(int64(0))
+	expectEncoding(t, "a set of integers at the intset limit", s.Encoding(), EncodingIntset)
+	s.Add(int64(4))
+	expectEncoding(t, "a set of integers past the intset limit", s.Encoding(), EncodingListpack)
+	s.Add("five")
+	expectEncoding(t, "a set with a string", s.Encoding(), EncodingListpack)
+	s.Add(int64(6))
+	expectEncoding(t, "a set past the listpack limit", s.Encoding(), EncodingHashtable)
+	if n := s.Cardinality(); n != 7 {
+		t.Fatalf("converted set has %d members, want 7", n)
+	}
+	for _, member := range []interface{}{int64(0), int64(4), "five", int64(6)} {
+		if !s.Contains(member) {
+			t.Fatalf("converted set lost %v", member)
+		}
+	}
+	s.Remove("five")
+	s.Remove(int64(6))
+	expectEncoding(t, "a shrunk set", s.Encoding(), EncodingHashtable)
+
+	s = NewSet()
+	s.Add(int64(1))
+	s.Add("member")
+	expectEncoding(t, "an intset given a short string", s.Encoding(), EncodingListpack)
+	s.Add(strings.Repeat("m", 9))
+	expectEncoding(t, "a set given a long string", s.Encoding(), EncodingHashtable)
+
+	s = NewSet()
+	s.Add(int64(1))
+	s.Add(strings.Repeat("m", 9))
+	expectEncoding(t, "an intset given a long string", s.Encoding(), EncodingHashtable)
+}
+
+func TestSortedSetEncoding(t *testing.T) {
+	withLimits(t, smallLimits())
+
+	z := NewSortedSet()
+	for i := 0; i < 4; i++ {
+		z.Add("m"+strconv.Itoa(i), float64(i))
+	}
+	z.Add("m0", 10)
+	expectEncoding(t, "a sorted set at the entry limit", z.Encoding(), EncodingListpack)
+	z.Add("m4", 4)
+	expectEncoding(t, "a sorted set past the entry limit", z.Encoding(), EncodingSkiplist)
+	if score, _ := z.GetScore("m0"); score != 10 {
+		t.Fatalf("m0 has score %v after converting, want 10", score)
+	}
+	z.Remove("m4")
+	expectEncoding(t, "a shrunk sorted set", z.Encoding(), EncodingSkiplist)
+
+	z = NewSortedSet()
+	z.Add(strings.Repeat("m", 8), 1)
+	expectEncoding(t, "a sorted set with a member at the length limit", z.Encoding(), EncodingListpack)
+	z.Add(strings.Repeat("m", 9), 1)
+	expectEncoding(t, "a sorted set with a long member", z.Encoding(), EncodingSkiplist)
+}
+
+func TestListEncoding(t *testing.T) {
+	withLimits(t, smallLimits())
+
+	l := NewList()
+	for i := 0; i < 4; i++ {
+		l.PushBack(int64(i))
+	}
+	expectEncoding(t, "a list at the entry limit", l.Encoding(), EncodingListpack)
+	l.PushFront("first")
+	expectEncoding(t, "a list past the entry limit", l.Encoding(), EncodingQuicklist)
+	if got := l.Range(0, 5); len(got) != 5 || got[0] != "first" || got[4] != int64(3) {
+		t.Fatalf("converted list holds %v", got)
+	}
+	l.PopBack()
+	l.PopBack()
+	expectEncoding(t, "a shrunk list", l.Encoding(), EncodingQuicklist)
+
+	// A negative size limits the listpack's bytes, not its entries.
+	limits := smallLimits()
+	limits.ListMaxListpackSize = -1
+	withLimits(t, limits)
+	l = NewList()
+	for i := 0; i < 100; i++ {
+		l.PushBack(int64(i))
+	}
+	expectEncoding(t, "a list of 100 integers under a 4KB limit", l.Encoding(), EncodingListpack)
+	l.PushBack(strings.Repeat("v", 4096))
+	expectEncoding(t, "a list past 4KB", l.Encoding(), EncodingQuicklist)
+}
@@ -4,26 +4,88 @@ import (
 	"sync"
 )
 
+// Hash maps fields to values. Small hashes of short strings and integers
+// are packed into a listpack of alternating fields and values, and
+// converted to a map once they outgrow hash-max-listpack-entries or
+// hash-max-listpack-value.
 type Hash struct {
 	mu     sync.RWMutex
-	fields map[string]interface{}
+	packed listpack
+	fields map[string]interface{} // nil while packed
 }
 
 func NewHash() *Hash {
-	return &Hash{
-		fields: make(map[string]interface{}),
+	return &Hash{}
+}
+
+// packedFind returns the positions of field and of its value, or -1.
+func (h *Hash) packedFind(field string) (int, int) {
+	pos := h.packed.find(field, 2)
+	if pos < 0 {
+		return -1, -1
+	}
+	return pos, h.packed.next(pos)
+}
+
+// convert moves the fields out of the listpack into a map.
+func (h *Hash) convert() {
+	h.fields = make(map[string]interface{}, h.packed.n/2+1)
+	for pos := 0; pos < len(h.packed.buf); {
+		valuePos := h.packed.next(pos)
+		h.fields[h.packed.str(pos)] = h.packed.value(valuePos)
+		pos = h.packed.next(valuePos)
+	}
+	h.packed = listpack{}
+}
+
+// each calls fn for every field. The caller must hold h.mu.
+func (h *Hash) each(fn func(field string, value interface{})) {
+	if h.fields != nil {
+		for field, value := range h.fields {
+			fn(field, value)
+		}
+		return
+	}
+	for pos := 0; pos < len(h.packed.buf); {
+		valuePos := h.packed.next(pos)
+		fn(h.packed.str(pos), h.packed.value(valuePos))
+		pos = h.packed.next(valuePos)
 	}
 }
 
 func (h *Hash) HSet(field string, value interface{}) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+
+	if h.fields == nil {
+		l := limits()
+		pos, valuePos := h.packedFind(field)
+		entries := h.packed.n / 2
+		if pos < 0 {
+			entries++
+		}
+		if len(field) <= l.HashMaxListpackValue && packable(value, l.HashMaxListpackValue) && entries <= l.HashMaxListpackEntries {
+			if pos < 0 {
+				h.packed.push(field, value)
+			} else {
+				h.packed.replace(valuePos, h.packed.next(valuePos), 1, value)
+			}
+			return
+		}
+		h.convert()
+	}
 	h.fields[field] = value
 }
 
 func (h *Hash) HGet(field string) (interface{}, bool) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	if h.fields == nil {
+		if _, valuePos := h.packedFind(field); valuePos >= 0 {
+			return h.packed.value(valuePos), true
+		}
+		return nil, false
+	}
 	value, exists := h.fields[field]
 	return value, exists
 }
@@ -31,12 +93,22 @@ func (h *Hash) HGet(field string) (interface{}, bool) {
 func (h *Hash) HDel(field string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	if h.fields == nil {
+		if pos, _ := h.packedFind(field); pos >= 0 {
+			h.packed.remove(pos, 2)
+		}
+		return
+	}
 	delete(h.fields, field)
 }
 
 func (h *Hash) HExists(field string) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	if h.fields == nil {
+		pos, _ := h.packedFind(field)
+		return pos >= 0
+	}
 	_, exists := h.fields[field]
 	return exists
 }
@@ -45,34 +117,104 @@ func (h *Hash) HGetAll() map[string]interface{} {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 	result := make(map[string]interface{})
-	for k, v := range h.fields {
+	h.each(func(k string, v interface{}) {
 		result[k] = v
-	}
+	})
 	return result
 }
 
 func (h *Hash) HKeys() []string {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	keys := make([]string, 0, len(h.fields))
-	for k := range h.fields {
+	keys := make([]string, 0, h.len())
+	h.each(func(k string, _ interface{}) {
 		keys = append(keys, k)
-	}
+	})
 	return keys
 }
 
 func (h *Hash) HVals() []interface{} {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	values := make([]interface{}, 0, len(h.fields))
-	for _, v := range h.fields {
+	values := make([]interface{}, 0, h.len())
+	h.each(func(_ string, v interface{}) {
 		values = append(values, v)
-	}
+	})
 	return values
 }
 
 func (h *Hash) HLen() int {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	return h.len()
+}
+
+func (h *Hash) len() int {
+	if h.fields == nil {
+		return h.packed.n / 2
+	}
 	return len(h.fields)
 }
+
+// Encoding returns "listpack" or "hashtable".
+func (h *Hash) Encoding() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.fields == nil {
+		return EncodingListpack
+	}
+	return EncodingHashtable
+}
+
+// CompactSize returns the size in bytes of the packed representation, and
+// false if the hash is not packed.
+func (h *Hash) CompactSize() (int, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return cap(h.packed.buf), h.fields == nil
+}
+
+// Scan returns the next page of fields and values after cursor, together
+// with the cursor for the following call.
+func (h *Hash) Scan(cursor uint64, count int) ([]string, []interface{}, uint64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	fields := make([]string, 0, h.len())
+	values := make([]interface{}, 0, h.len())
+	h.each(func(field string, value interface{}) {
+		fields = append(fields, field)
+		values = append(values, value)
+	})
+
+	page, next := scanPage(fields, cursor, count)
+	pageFields := make([]string, 0, len(page))
+	pageValues := make([]interface{}, 0, len(page))
+	for _, i := range page {
+		pageFields = append(pageFields, fields[i])
+		pageValues = append(pageValues, values[i])
+	}
+	return pageFields, pageValues, next
+}
+
+// Clone returns an independent copy of the hash.
+func (h *Hash) Clone() *Hash {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.fields == nil {
+		return &Hash{packed: h.packed.clone()}
+	}
+	clone := &Hash{fields: make(map[string]interface{}, len(h.fields))}
+	for k, v := range h.fields {
+		clone.fields[k] = v
+	}
+	return clone
+}
+
+// Clear removes every field, releasing references to the stored values.
+func (h *Hash) Clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.packed = listpack{}
+	h.fields = nil
+}
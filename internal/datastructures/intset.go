@@ -0,0 +1,105 @@
+package datastructures
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// intset is a sorted array of integers stored with the smallest width, 2, 4
+// or 8 bytes, that fits all of them.
+type intset struct {
+	width int
+	data  []byte
+}
+
+func intWidth(v int64) int {
+	switch {
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return 2
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return 4
+	}
+	return 8
+}
+
+func (is *intset) len() int {
+	if is.width == 0 {
+		return 0
+	}
+	return len(is.data) / is.width
+}
+
+func (is *intset) get(i int) int64 {
+	b := is.data[i*is.width:]
+	switch is.width {
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(b)))
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(b)))
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (is *intset) put(b []byte, v int64) {
+	switch is.width {
+	case 2:
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	default:
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	}
+}
+
+// search returns the index of v, or where it would be inserted.
+func (is *intset) search(v int64) (int, bool) {
+	n := is.len()
+	i := sort.Search(n, func(i int) bool { return is.get(i) >= v })
+	return i, i < n && is.get(i) == v
+}
+
+func (is *intset) contains(v int64) bool {
+	_, found := is.search(v)
+	return found
+}
+
+// add inserts v and reports whether it was not already present, widening
+// every element first if v does not fit the current width.
+func (is *intset) add(v int64) bool {
+	if w := intWidth(v); w > is.width {
+		is.upgrade(w)
+	}
+	i, found := is.search(v)
+	if found {
+		return false
+	}
+	data := make([]byte, len(is.data)+is.width)
+	copy(data, is.data[:i*is.width])
+	is.put(data[i*is.width:], v)
+	copy(data[(i+1)*is.width:], is.data[i*is.width:])
+	is.data = data
+	return true
+}
+
+func (is *intset) remove(v int64) bool {
+	i, found := is.search(v)
+	if !found {
+		return false
+	}
+	is.data = append(is.data[:i*is.width:i*is.width], is.data[(i+1)*is.width:]...)
+	return true
+}
+
+func (is *intset) upgrade(width int) {
+	old := *is
+	is.width = width
+	is.data = make([]byte, old.len()*width)
+	for i := 0; i < old.len(); i++ {
+		is.put(is.data[i*width:], old.get(i))
+	}
+}
+
+func (is *intset) clone() intset {
+	return intset{width: is.width, data: append([]byte(nil), is.data...)}
+}
@@ -1,35 +1,76 @@
 package datastructures
 
 import (
+	"math"
 	"sync"
 )
 
+// List is an ordered sequence of values. Small lists of strings and
+// integers are packed into a listpack and converted to a slice once they
+// outgrow list-max-listpack-size.
 type List struct {
 	mu       sync.RWMutex
-	elements []interface{}
+	packed   listpack
+	elements []interface{} // nil while packed
 }
 
 func NewList() *List {
-	return &List{
-		elements: make([]interface{}, 0),
-	}
+	return &List{}
+}
+
+// convert moves the elements out of the listpack into a slice.
+func (l *List) convert() {
+	elements := make([]interface{}, 0, l.packed.n+1)
+	l.packed.each(func(_ int, value interface{}) {
+		elements = append(elements, value)
+	})
+	l.packed = listpack{}
+	l.elements = elements
+}
+
+// fits reports whether value can be added without leaving the listpack
+// encoding. The caller must hold l.mu.
+func (l *List) fits(value interface{}) bool {
+	return packable(value, math.MaxInt) && limits().listFits(l.packed.n+1, len(l.packed.buf)+entryLen(value))
 }
 
 func (l *List) PushFront(value interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.elements == nil {
+		if l.fits(value) {
+			l.packed.insert(0, value)
+			return
+		}
+		l.convert()
+	}
 	l.elements = append([]interface{}{value}, l.elements...)
 }
 
 func (l *List) PushBack(value interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.elements == nil {
+		if l.fits(value) {
+			l.packed.push(value)
+			return
+		}
+		l.convert()
+	}
 	l.elements = append(l.elements, value)
 }
 
 func (l *List) PopFront() (interface{}, bool) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.elements == nil {
+		if l.packed.n == 0 {
+			return nil, false
+		}
+		value := l.packed.value(0)
+		l.packed.remove(0, 1)
+		return value, true
+	}
 	if len(l.elements) == 0 {
 		return nil, false
 	}
@@ -41,6 +82,18 @@ func (l *List) PopFront() (interface{}, bool) {
 func (l *List) PopBack() (interface{}, bool) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.elements == nil {
+		if l.packed.n == 0 {
+			return nil, false
+		}
+		last := 0
+		for pos := 0; pos < len(l.packed.buf); pos = l.packed.next(pos) {
+			last = pos
+		}
+		value := l.packed.value(last)
+		l.packed.remove(last, 1)
+		return value, true
+	}
 	if len(l.elements) == 0 {
 		return nil, false
 	}
@@ -53,14 +106,70 @@ func (l *List) PopBack() (interface{}, bool) {
 func (l *List) Len() int {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	return l.len()
+}
+
+func (l *List) len() int {
+	if l.elements == nil {
+		return l.packed.n
+	}
 	return len(l.elements)
 }
 
 func (l *List) Range(start, stop int) []interface{} {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	if start < 0 || stop > len(l.elements) || start > stop {
+	if start < 0 || stop > l.len() || start > stop {
 		return nil
 	}
+	if l.elements == nil {
+		values := make([]interface{}, 0, stop-start)
+		i := 0
+		for pos := 0; pos < len(l.packed.buf) && i < stop; pos = l.packed.next(pos) {
+			if i >= start {
+				values = append(values, l.packed.value(pos))
+			}
+			i++
+		}
+		return values
+	}
 	return l.elements[start:stop]
 }
+
+// Encoding returns "listpack" or "quicklist".
+func (l *List) Encoding() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.elements == nil {
+		return EncodingListpack
+	}
+	return EncodingQuicklist
+}
+
+// CompactSize returns the size in bytes of the packed representation, and
+// false if the list is not packed.
+func (l *List) CompactSize() (int, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return cap(l.packed.buf), l.elements == nil
+}
+
+// Clone returns an independent copy of the list.
+func (l *List) Clone() *List {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.elements == nil {
+		return &List{packed: l.packed.clone()}
+	}
+	elements := make([]interface{}, len(l.elements))
+	copy(elements, l.elements)
+	return &List{elements: elements}
+}
+
+// Clear removes every element, releasing references to the stored values.
+func (l *List) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.packed = listpack{}
+	l.elements = nil
+}
@@ -0,0 +1,181 @@
+package datastructures
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const (
+	lpString byte = iota
+	lpInt
+	lpFloat
+)
+
+// listpack packs a sequence of strings, integers and floats into a single
+// byte slice. Each entry is a type tag followed by a uvarint length and the
+// string bytes, a varint integer, or the 8 bytes of a float. Operations
+// scan the entries linearly, so listpacks only hold small collections.
+type listpack struct {
+	buf []byte
+	n   int
+}
+
+// packable reports whether value can be stored in a listpack whose strings
+// are limited to maxValue bytes.
+func packable(value interface{}, maxValue int) bool {
+	switch v := value.(type) {
+	case string:
+		return len(v) <= maxValue
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+func appendEntry(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		buf = append(buf, lpString)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		return append(buf, v...)
+	case int64:
+		buf = append(buf, lpInt)
+		return binary.AppendVarint(buf, v)
+	case float64:
+		buf = append(buf, lpFloat)
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	}
+	panic("datastructures: value cannot be packed")
+}
+
+// entryLen returns the encoded size of value.
+func entryLen(value interface{}) int {
+	return len(appendEntry(nil, value))
+}
+
+// bounds returns the tag of the entry at pos, where its payload starts and
+// where the next entry starts.
+func (lp *listpack) bounds(pos int) (byte, int, int) {
+	tag := lp.buf[pos]
+	switch tag {
+	case lpString:
+		n, k := binary.Uvarint(lp.buf[pos+1:])
+		start := pos + 1 + k
+		return tag, start, start + int(n)
+	case lpInt:
+		_, k := binary.Varint(lp.buf[pos+1:])
+		return tag, pos + 1, pos + 1 + k
+	default:
+		return tag, pos + 1, pos + 9
+	}
+}
+
+// next returns the position of the entry following the one at pos.
+func (lp *listpack) next(pos int) int {
+	_, _, end := lp.bounds(pos)
+	return end
+}
+
+// value decodes the entry at pos.
+func (lp *listpack) value(pos int) interface{} {
+	tag, start, end := lp.bounds(pos)
+	switch tag {
+	case lpString:
+		return string(lp.buf[start:end])
+	case lpInt:
+		v, _ := binary.Varint(lp.buf[start:])
+		return v
+	default:
+		return math.Float64frombits(binary.LittleEndian.Uint64(lp.buf[start:end]))
+	}
+}
+
+// str returns the string entry at pos without checking its tag.
+func (lp *listpack) str(pos int) string {
+	_, start, end := lp.bounds(pos)
+	return string(lp.buf[start:end])
+}
+
+// float returns the float entry at pos without checking its tag.
+func (lp *listpack) float(pos int) float64 {
+	_, start, end := lp.bounds(pos)
+	return math.Float64frombits(binary.LittleEndian.Uint64(lp.buf[start:end]))
+}
+
+// equals reports whether the entry at pos holds value, with the same type.
+func (lp *listpack) equals(pos int, value interface{}) bool {
+	tag, start, end := lp.bounds(pos)
+	switch v := value.(type) {
+	case string:
+		return tag == lpString && string(lp.buf[start:end]) == v
+	case int64:
+		if tag != lpInt {
+			return false
+		}
+		n, _ := binary.Varint(lp.buf[start:])
+		return n == v
+	case float64:
+		return tag == lpFloat && math.Float64frombits(binary.LittleEndian.Uint64(lp.buf[start:end])) == v
+	}
+	return false
+}
+
+// find returns the position of the first entry holding value, looking only
+// at every stride-th entry, or -1.
+func (lp *listpack) find(value interface{}, stride int) int {
+	for pos := 0; pos < len(lp.buf); {
+		if lp.equals(pos, value) {
+			return pos
+		}
+		for i := 0; i < stride; i++ {
+			pos = lp.next(pos)
+		}
+	}
+	return -1
+}
+
+// replace swaps the removed entries between from and to for values.
+func (lp *listpack) replace(from, to, removed int, values ...interface{}) {
+	var encoded []byte
+	for _, value := range values {
+		encoded = appendEntry(encoded, value)
+	}
+	buf := make([]byte, 0, len(lp.buf)-(to-from)+len(encoded))
+	buf = append(buf, lp.buf[:from]...)
+	buf = append(buf, encoded...)
+	lp.buf = append(buf, lp.buf[to:]...)
+	lp.n += len(values) - removed
+}
+
+// insert adds values before the entry at pos.
+func (lp *listpack) insert(pos int, values ...interface{}) {
+	lp.replace(pos, pos, 0, values...)
+}
+
+// push appends values.
+func (lp *listpack) push(values ...interface{}) {
+	for _, value := range values {
+		lp.buf = appendEntry(lp.buf, value)
+	}
+	lp.n += len(values)
+}
+
+// remove deletes count entries starting at pos.
+func (lp *listpack) remove(pos, count int) {
+	end := pos
+	for i := 0; i < count; i++ {
+		end = lp.next(end)
+	}
+	lp.replace(pos, end, count)
+}
+
+// each calls fn with the position and value of every entry.
+func (lp *listpack) each(fn func(pos int, value interface{})) {
+	for pos := 0; pos < len(lp.buf); pos = lp.next(pos) {
+		fn(pos, lp.value(pos))
+	}
+}
+
+func (lp *listpack) clone() listpack {
+	return listpack{buf: append([]byte(nil), lp.buf...), n: lp.n}
+}
@@ -0,0 +1,69 @@
+package datastructures
+
+import (
+	"sort"
+)
+
+// ScanHash maps a member to its position in cursor order. Cursors used by
+// the Scan methods are positions in this order, so an iteration returns
+// every member present for its whole duration exactly once, no matter how
+// the collection changes between calls.
+func ScanHash(s string) uint64 {
+	// FNV-1a followed by a murmur3 finalizer so the high bits, which
+	// cursors are ordered by, are well mixed.
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// scanPage returns the indexes of the members that follow cursor in hash
+// order, at least count of them when available, and the cursor to resume
+// from. A returned cursor of 0 means the iteration is complete.
+func scanPage(members []string, cursor uint64, count int) ([]int, uint64) {
+	type candidate struct {
+		hash  uint64
+		index int
+	}
+
+	candidates := make([]candidate, 0, len(members))
+	for i, member := range members {
+		if h := ScanHash(member); h >= cursor {
+			candidates = append(candidates, candidate{h, i})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].hash < candidates[j].hash
+	})
+
+	if count < 1 {
+		count = 1
+	}
+	end := count
+	if end >= len(candidates) {
+		end = len(candidates)
+	} else {
+		// Never split members sharing a hash across two pages.
+		for end < len(candidates) && candidates[end].hash == candidates[end-1].hash {
+			end++
+		}
+	}
+
+	indexes := make([]int, 0, end)
+	for _, c := range candidates[:end] {
+		indexes = append(indexes, c.index)
+	}
+
+	next := uint64(0)
+	if end < len(candidates) {
+		next = candidates[end-1].hash + 1
+	}
+	return indexes, next
+}
@@ -1,53 +1,196 @@
 package datastructures
 
 import (
+	"fmt"
 	"sync"
 )
 
+type setEncoding uint8
+
+const (
+	setIntset setEncoding = iota
+	setListpack
+	setHashtable
+)
+
+// Set is an unordered collection of distinct values. Sets of int64 values
+// are kept in a sorted intset, other small sets of short strings and
+// integers in a listpack, and both are converted to a map once they
+// outgrow the set-max-* limits.
 type Set struct {
 	mu       sync.RWMutex
-	elements map[interface{}]struct{}
+	encoding setEncoding
+	ints     intset
+	packed   listpack
+	elements map[interface{}]struct{} // nil unless hashtable encoded
 }
 
 func NewSet() *Set {
-	return &Set{
-		elements: make(map[interface{}]struct{}),
+	return &Set{}
+}
+
+// toListpack moves the members of the intset into a listpack.
+func (s *Set) toListpack() {
+	for i := 0; i < s.ints.len(); i++ {
+		s.packed.push(s.ints.get(i))
+	}
+	s.ints = intset{}
+	s.encoding = setListpack
+}
+
+// toHashtable moves the members of a compact set into a map.
+func (s *Set) toHashtable() {
+	elements := make(map[interface{}]struct{}, s.len()+1)
+	s.each(func(value interface{}) {
+		elements[value] = struct{}{}
+	})
+	s.ints = intset{}
+	s.packed = listpack{}
+	s.elements = elements
+	s.encoding = setHashtable
+}
+
+// each calls fn for every member. The caller must hold s.mu.
+func (s *Set) each(fn func(value interface{})) {
+	switch s.encoding {
+	case setIntset:
+		for i := 0; i < s.ints.len(); i++ {
+			fn(s.ints.get(i))
+		}
+	case setListpack:
+		s.packed.each(func(_ int, value interface{}) {
+			fn(value)
+		})
+	default:
+		for value := range s.elements {
+			fn(value)
+		}
+	}
+}
+
+// contains reports whether value is a member. The caller must hold s.mu.
+func (s *Set) contains(value interface{}) bool {
+	switch s.encoding {
+	case setIntset:
+		n, ok := value.(int64)
+		return ok && s.ints.contains(n)
+	case setListpack:
+		return s.packed.find(value, 1) >= 0
+	default:
+		_, exists := s.elements[value]
+		return exists
+	}
+}
+
+func (s *Set) len() int {
+	switch s.encoding {
+	case setIntset:
+		return s.ints.len()
+	case setListpack:
+		return s.packed.n
+	default:
+		return len(s.elements)
 	}
 }
 
 func (s *Set) Add(value interface{}) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.add(value)
+}
+
+func (s *Set) add(value interface{}) {
+	l := limits()
+	if s.encoding == setIntset {
+		if n, ok := value.(int64); ok && (s.ints.contains(n) || s.ints.len() < l.SetMaxIntsetEntries) {
+			s.ints.add(n)
+			return
+		}
+		if s.ints.len()+1 <= l.SetMaxListpackEntries && packable(value, l.SetMaxListpackValue) {
+			s.toListpack()
+		} else {
+			s.toHashtable()
+		}
+	}
+	if s.encoding == setListpack {
+		if s.packed.find(value, 1) >= 0 {
+			return
+		}
+		if s.packed.n+1 <= l.SetMaxListpackEntries && packable(value, l.SetMaxListpackValue) {
+			s.packed.push(value)
+			return
+		}
+		s.toHashtable()
+	}
 	s.elements[value] = struct{}{}
 }
 
 func (s *Set) Remove(value interface{}) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.elements, value)
+	switch s.encoding {
+	case setIntset:
+		if n, ok := value.(int64); ok {
+			s.ints.remove(n)
+		}
+	case setListpack:
+		if pos := s.packed.find(value, 1); pos >= 0 {
+			s.packed.remove(pos, 1)
+		}
+	default:
+		delete(s.elements, value)
+	}
 }
 
 func (s *Set) Contains(value interface{}) bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	_, exists := s.elements[value]
-	return exists
+	return s.contains(value)
 }
 
 func (s *Set) Members() []interface{} {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	members := make([]interface{}, 0, len(s.elements))
-	for value := range s.elements {
+	members := make([]interface{}, 0, s.len())
+	s.each(func(value interface{}) {
 		members = append(members, value)
-	}
+	})
 	return members
 }
 
 func (s *Set) Cardinality() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return len(s.elements)
+	return s.len()
+}
+
+// Encoding returns "intset", "listpack" or "hashtable".
+func (s *Set) Encoding() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch s.encoding {
+	case setIntset:
+		return EncodingIntset
+	case setListpack:
+		return EncodingListpack
+	default:
+		return EncodingHashtable
+	}
+}
+
+// CompactSize returns the size in bytes of the intset or listpack, and
+// false if the set uses a map.
+func (s *Set) CompactSize() (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch s.encoding {
+	case setIntset:
+		return cap(s.ints.data), true
+	case setListpack:
+		return cap(s.packed.buf), true
+	default:
+		return 0, false
+	}
 }
 
 func (s *Set) Union(other *Set) *Set {
@@ -57,12 +200,8 @@ func (s *Set) Union(other *Set) *Set {
 	defer s.mu.RUnlock()
 	defer other.mu.RUnlock()
 
-	for value := range s.elements {
-		result.Add(value)
-	}
-	for value := range other.elements {
-		result.Add(value)
-	}
+	s.each(result.add)
+	other.each(result.add)
 
 	return result
 }
@@ -74,11 +213,11 @@ func (s *Set) Intersect(other *Set) *Set {
 	defer s.mu.RUnlock()
 	defer other.mu.RUnlock()
 
-	for value := range s.elements {
-		if _, exists := other.elements[value]; exists {
-			result.Add(value)
+	s.each(func(value interface{}) {
+		if other.contains(value) {
+			result.add(value)
 		}
-	}
+	})
 
 	return result
 }
@@ -90,11 +229,59 @@ func (s *Set) Diff(other *Set) *Set {
 	defer s.mu.RUnlock()
 	defer other.mu.RUnlock()
 
-	for value := range s.elements {
-		if _, exists := other.elements[value]; !exists {
-			result.Add(value)
+	s.each(func(value interface{}) {
+		if !other.contains(value) {
+			result.add(value)
 		}
-	}
+	})
 
 	return result
 }
+
+// Scan returns the next page of members after cursor, together with the
+// cursor for the following call.
+func (s *Set) Scan(cursor uint64, count int) ([]interface{}, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := make([]interface{}, 0, s.len())
+	names := make([]string, 0, s.len())
+	s.each(func(value interface{}) {
+		members = append(members, value)
+		names = append(names, fmt.Sprint(value))
+	})
+
+	page, next := scanPage(names, cursor, count)
+	result := make([]interface{}, 0, len(page))
+	for _, i := range page {
+		result = append(result, members[i])
+	}
+	return result, next
+}
+
+// Clone returns an independent copy of the set.
+func (s *Set) Clone() *Set {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch s.encoding {
+	case setIntset:
+		return &Set{ints: s.ints.clone()}
+	case setListpack:
+		return &Set{encoding: setListpack, packed: s.packed.clone()}
+	}
+	clone := &Set{encoding: setHashtable, elements: make(map[interface{}]struct{}, len(s.elements))}
+	for value := range s.elements {
+		clone.elements[value] = struct{}{}
+	}
+	return clone
+}
+
+// Clear removes every member.
+func (s *Set) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoding = setIntset
+	s.ints = intset{}
+	s.packed = listpack{}
+	s.elements = nil
+}
@@ -5,36 +5,120 @@ import (
 	"sync"
 )
 
+// SortedSet maps members to scores. Small sorted sets of short members are
+// packed into a listpack of alternating members and scores, and converted
+// to a map once they outgrow zset-max-listpack-entries or
+// zset-max-listpack-value.
 type SortedSet struct {
 	mu      sync.RWMutex
-	members map[string]float64
+	packed  listpack
+	members map[string]float64 // nil while packed
 }
 
 func NewSortedSet() *SortedSet {
-	return &SortedSet{
-		members: make(map[string]float64),
+	return &SortedSet{}
+}
+
+// convert moves the members out of the listpack into a map.
+func (s *SortedSet) convert() {
+	members := make(map[string]float64, s.packed.n/2+1)
+	s.each(func(member string, score float64) {
+		members[member] = score
+	})
+	s.packed = listpack{}
+	s.members = members
+}
+
+// each calls fn for every member. The caller must hold s.mu.
+func (s *SortedSet) each(fn func(member string, score float64)) {
+	if s.members != nil {
+		for member, score := range s.members {
+			fn(member, score)
+		}
+		return
+	}
+	for pos := 0; pos < len(s.packed.buf); {
+		scorePos := s.packed.next(pos)
+		fn(s.packed.str(pos), s.packed.float(scorePos))
+		pos = s.packed.next(scorePos)
 	}
 }
 
+func (s *SortedSet) len() int {
+	if s.members == nil {
+		return s.packed.n / 2
+	}
+	return len(s.members)
+}
+
 func (s *SortedSet) Add(member string, score float64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+
+	if s.members == nil {
+		l := limits()
+		pos := s.packed.find(member, 2)
+		entries := s.packed.n / 2
+		if pos < 0 {
+			entries++
+		}
+		if len(member) <= l.ZSetMaxListpackValue && entries <= l.ZSetMaxListpackEntries {
+			if pos < 0 {
+				s.packed.push(member, score)
+			} else {
+				scorePos := s.packed.next(pos)
+				s.packed.replace(scorePos, s.packed.next(scorePos), 1, score)
+			}
+			return
+		}
+		s.convert()
+	}
 	s.members[member] = score
 }
 
 func (s *SortedSet) Remove(member string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.members == nil {
+		if pos := s.packed.find(member, 2); pos >= 0 {
+			s.packed.remove(pos, 2)
+		}
+		return
+	}
 	delete(s.members, member)
 }
 
 func (s *SortedSet) GetScore(member string) (float64, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	if s.members == nil {
+		if pos := s.packed.find(member, 2); pos >= 0 {
+			return s.packed.float(s.packed.next(pos)), true
+		}
+		return 0, false
+	}
 	score, exists := s.members[member]
 	return score, exists
 }
 
+// Encoding returns "listpack" or "skiplist".
+func (s *SortedSet) Encoding() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.members == nil {
+		return EncodingListpack
+	}
+	return EncodingSkiplist
+}
+
+// CompactSize returns the size in bytes of the packed representation, and
+// false if the sorted set is not packed.
+func (s *SortedSet) CompactSize() (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return cap(s.packed.buf), s.members == nil
+}
+
 func (s *SortedSet) Range(min, max float64, offset, count int) []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -45,11 +129,11 @@ func (s *SortedSet) Range(min, max float64, offset, count int) []string {
 	}
 
 	var members []scoredMember
-	for member, score := range s.members {
+	s.each(func(member string, score float64) {
 		if score >= min && score <= max {
 			members = append(members, scoredMember{score, member})
 		}
-	}
+	})
 
 	// Sort by score
 	sort.Slice(members, func(i, j int) bool {
@@ -77,7 +161,7 @@ func (s *SortedSet) Range(min, max float64, offset, count int) []string {
 func (s *SortedSet) ZCard() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return len(s.members)
+	return s.len()
 }
 
 func (s *SortedSet) ZRank(member string) int {
@@ -90,9 +174,9 @@ func (s *SortedSet) ZRank(member string) int {
 	}
 
 	var members []scoredMember
-	for m, score := range s.members {
+	s.each(func(m string, score float64) {
 		members = append(members, scoredMember{score, m})
-	}
+	})
 
 	// Sort by score
 	sort.Slice(members, func(i, j int) bool {
@@ -119,11 +203,11 @@ func (s *SortedSet) ZRevRange(min, max float64, offset, count int) []string {
 	}
 
 	var members []scoredMember
-	for member, score := range s.members {
+	s.each(func(member string, score float64) {
 		if score >= min && score <= max {
 			members = append(members, scoredMember{score, member})
 		}
-	}
+	})
 
 	// Sort by score in descending order
 	sort.Slice(members, func(i, j int) bool {
@@ -203,3 +287,48 @@ func (s *SortedSet) ZIntersect(sets []*SortedSet, weights []float64, aggregate s
 
 	return result
 }
+
+// Scan returns the next page of members and their scores after cursor,
+// together with the cursor for the following call.
+func (s *SortedSet) Scan(cursor uint64, count int) ([]string, []float64, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := make([]string, 0, s.len())
+	memberScores := make([]float64, 0, s.len())
+	s.each(func(member string, score float64) {
+		members = append(members, member)
+		memberScores = append(memberScores, score)
+	})
+
+	page, next := scanPage(members, cursor, count)
+	pageMembers := make([]string, 0, len(page))
+	scores := make([]float64, 0, len(page))
+	for _, i := range page {
+		pageMembers = append(pageMembers, members[i])
+		scores = append(scores, memberScores[i])
+	}
+	return pageMembers, scores, next
+}
+
+// Clone returns an independent copy of the sorted set.
+func (s *SortedSet) Clone() *SortedSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.members == nil {
+		return &SortedSet{packed: s.packed.clone()}
+	}
+	clone := &SortedSet{members: make(map[string]float64, len(s.members))}
+	for member, score := range s.members {
+		clone.members[member] = score
+	}
+	return clone
+}
+
+// Clear removes every member.
+func (s *SortedSet) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packed = listpack{}
+	s.members = nil
+}
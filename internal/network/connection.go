@@ -37,6 +37,8 @@ func (c *Connection) Start(handler CommandHandler) {
 }
 
 func (c *Connection) handleCommands(handler CommandHandler) {
+	connCtx := newConnContext(handler)
+	defer closeConnContext(handler, connCtx)
 	for c.active {
 		line, err := c.reader.ReadString('\n')
 		if err != nil {
@@ -58,10 +60,9 @@ func (c *Connection) handleCommands(handler CommandHandler) {
 			continue
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
+		ctx, cancel := context.WithTimeout(connCtx, 5*time.Second)
 		response, err := handler.HandleCommand(ctx, args)
+		cancel()
 		if err != nil {
 			c.writeError(err.Error())
 			continue
@@ -23,6 +23,31 @@ type CommandHandler interface {
 	HandleCommand(ctx context.Context, args []string) (interface{}, error)
 }
 
+// SessionHandler is implemented by handlers that keep per-connection state,
+// such as the selected database. NewSession is called once per connection
+// and the returned context is the parent of every command's context.
+// CloseSession is called with that context once the connection closes.
+type SessionHandler interface {
+	NewSession(ctx context.Context) context.Context
+	CloseSession(ctx context.Context)
+}
+
+// newConnContext returns the base context for a new client connection.
+func newConnContext(handler CommandHandler) context.Context {
+	ctx := context.Background()
+	if sh, ok := handler.(SessionHandler); ok {
+		ctx = sh.NewSession(ctx)
+	}
+	return ctx
+}
+
+// closeConnContext ends the session of a closed client connection.
+func closeConnContext(handler CommandHandler, ctx context.Context) {
+	if sh, ok := handler.(SessionHandler); ok {
+		sh.CloseSession(ctx)
+	}
+}
+
 func NewServer(addr string, handler CommandHandler) *Server {
 	return &Server{
 		addr:    addr,
@@ -74,6 +99,8 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
+	connCtx := newConnContext(s.handler)
+	defer closeConnContext(s.handler, connCtx)
 
 	for {
 		select {
@@ -93,14 +120,17 @@ func (s *Server) handleConnection(conn net.Conn) {
 			args, err := parseRedisCommand(line)
 			if err != nil {
 				writeError(writer, "Invalid command format")
+				writer.Flush()
+				continue
 			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-
+			ctx, cancel := context.WithTimeout(connCtx, 5*time.Second)
 			response, err := s.handler.HandleCommand(ctx, args)
+			cancel()
 			if err != nil {
 				writeError(writer, err.Error())
+				writer.Flush()
+				continue
 			}
 
 			writeResponse(writer, response)
@@ -152,12 +182,25 @@ func parseRedisCommand(data string) ([]string, error) {
 	return args, nil
 }
 
+// errorCodes lists the error prefixes handlers may return verbatim.
+var errorCodes = map[string]bool{
+	"ERR":       true,
+	"WRONGTYPE": true,
+	"OOM":       true,
+}
+
 func writeBulkString(writer *bufio.Writer, value string) {
 	writer.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
 }
 
 func writeError(writer *bufio.Writer, message string) {
-	writer.WriteString(fmt.Sprintf("-ERR %s\r\n", message))
+	// Messages that already carry an error code such as WRONGTYPE are sent
+	// as is; everything else is reported as a generic ERR.
+	code, _, _ := strings.Cut(message, " ")
+	if !errorCodes[code] {
+		message = "ERR " + message
+	}
+	writer.WriteString(fmt.Sprintf("-%s\r\n", message))
 }
 
 func writeSimpleString(writer *bufio.Writer, message string) {
@@ -173,7 +216,14 @@ func writeArrayStart(writer *bufio.Writer, length int) {
 }
 
 func writeResponse(writer *bufio.Writer, response interface{}) {
+	writeValue(writer, response)
+	writer.Flush()
+}
+
+func writeValue(writer *bufio.Writer, response interface{}) {
 	switch res := response.(type) {
+	case nil:
+		writer.WriteString("$-1\r\n")
 	case string:
 		writeBulkString(writer, res)
 	case int64:
@@ -189,11 +239,14 @@ func writeResponse(writer *bufio.Writer, response interface{}) {
 		for _, item := range res {
 			writeBulkString(writer, item)
 		}
+	case []interface{}:
+		writeArrayStart(writer, len(res))
+		for _, item := range res {
+			writeValue(writer, item)
+		}
 	case error:
 		writeError(writer, res.Error())
 	default:
 		writeError(writer, "Unknown response type")
 	}
-
-	writer.Flush()
 }
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+const keyLockStripes = 256
+
+// keyLocks keeps writes to a key in the same order in the keyspace and in
+// the WAL: a logged write holds the stripes of its keys from applying the
+// command until it has been logged. Keys are striped by name alone, so the
+// same key in different databases shares a stripe.
+type keyLocks struct {
+	stripes [keyLockStripes]sync.Mutex
+}
+
+// lock locks the stripes of keys in ascending order and returns the
+// function that unlocks them.
+func (k *keyLocks) lock(keys []string) func() {
+	indexes := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		i := int(datastructures.ScanHash(key) % keyLockStripes)
+		if !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		k.stripes[i].Lock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			k.stripes[indexes[j]].Unlock()
+		}
+	}
+}
+
+// lockAll locks every stripe, stopping all logged writes.
+func (k *keyLocks) lockAll() func() {
+	for i := range k.stripes {
+		k.stripes[i].Lock()
+	}
+	return func() {
+		for j := len(k.stripes) - 1; j >= 0; j-- {
+			k.stripes[j].Unlock()
+		}
+	}
+}
+
+// EnablePersistence makes every successful write command, and every key
+// evicted for maxmemory, durable in p's WAL. It should be called after
+// Recover and before the server accepts connections.
+func (h *CommandHandler) EnablePersistence(p *PersistenceLayer) {
+	h.aof = p
+	h.dbs.onEvict = func(db int, key string) {
+		p.LogCommand(db, []string{"DEL", key})
+	}
+}
+
+// executeWrite runs a write command while the stripes of its keys are
+// held, so that snapshots and rewrites, which take every stripe, see it
+// either entirely or not at all. With persistence enabled it is appended
+// to the WAL before the stripes are released.
+func (h *CommandHandler) executeWrite(ctx context.Context, command string, info commandInfo, args []string) (interface{}, error) {
+	var unlock func()
+	if info.flags&cmdAllKeys != 0 {
+		unlock = h.dbs.writeLocks.lockAll()
+	} else {
+		unlock = h.dbs.writeLocks.lock(info.keys(args))
+	}
+	defer unlock()
+
+	result, err := h.execute(ctx, command, args)
+	if err != nil {
+		return nil, err
+	}
+	if h.snapshots != nil {
+		h.snapshots.dirty.Add(1)
+	}
+	if h.aof == nil {
+		return result, nil
+	}
+
+	logged, ok := h.loggedArgs(ctx, command, args, result)
+	if !ok {
+		return result, nil
+	}
+	if err := h.aof.LogCommand(h.selectedDB(ctx), logged); err != nil {
+		return nil, fmt.Errorf("write applied but not persisted: %v", err)
+	}
+	if h.aof.rewriteDue() {
+		// The rewrite pauses logged writes, including this one, which
+		// still holds its stripes.
+		go h.StartRewriteAOF(h.aof)
+	}
+	return result, nil
+}
+
+// loggedArgs returns the form in which a successful write is logged, and
+// false if it changed nothing worth logging. Relative expiries are logged
+// as absolute ones so that replaying them later does not extend them.
+func (h *CommandHandler) loggedArgs(ctx context.Context, command string, args []string, result interface{}) ([]string, bool) {
+	switch command {
+	case "EXPIRE":
+		if result != int64(1) {
+			return nil, false
+		}
+		store, err := h.dbs.DB(h.selectedDB(ctx))
+		if err != nil {
+			return nil, false
+		}
+		// An expiry that is not in the future deleted the key.
+		at, ok := store.ExpireTime(args[1])
+		if !ok {
+			return []string{"DEL", args[1]}, true
+		}
+		return []string{"PEXPIREAT", args[1], strconv.FormatInt(at.UnixMilli(), 10)}, true
+
+	case "RESTORE":
+		// An expiry already in the past deletes the key; otherwise the
+		// key is logged with its absolute expiry, and with REPLACE, which
+		// replay needs whenever the original needed it.
+		store, err := h.dbs.DB(h.selectedDB(ctx))
+		if err != nil {
+			return nil, false
+		}
+		if !store.Exists(args[1]) {
+			return []string{"DEL", args[1]}, true
+		}
+		ttl := "0"
+		if at, ok := store.ExpireTime(args[1]); ok {
+			ttl = strconv.FormatInt(at.UnixMilli(), 10)
+		}
+		return []string{"RESTORE", args[1], ttl, args[3], "REPLACE", "ABSTTL"}, true
+	}
+	return args, true
+}
+
+// RecoveryStats describes what Recover loaded.
+type RecoveryStats struct {
+	SnapshotKeys int
+	Replayed     int
+	Failed       int
+	// WALRepair describes the damaged tail cut off the WAL, if any.
+	WALRepair *WALRepair
+}
+
+// Recover loads the snapshot in p's directory and then replays the
+// commands logged after it. It must run before the server accepts
+// connections. Commands that fail on replay are counted and skipped, and
+// a torn or corrupt WAL tail is truncated and reported in the stats.
+func (h *CommandHandler) Recover(p *PersistenceLayer) (RecoveryStats, error) {
+	var stats RecoveryStats
+	seq, err := p.snapshotSeq()
+	if err != nil {
+		return stats, err
+	}
+	// A rewrite base newer than the snapshot holds the whole dataset.
+	if !p.baseReplaces(seq) {
+		if seq, stats.SnapshotKeys, err = p.loadSnapshot(h.dbs); err != nil {
+			return stats, err
+		}
+	}
+
+	ctx := h.NewSession(context.Background())
+	apply := func(db int, args []string) error {
+		if h.replayCommand(ctx, db, args) == nil {
+			stats.Replayed++
+		} else {
+			stats.Failed++
+		}
+		return nil
+	}
+	restore := func(db int, key string, value interface{}, expireAt time.Time) error {
+		store, err := h.dbs.DB(db)
+		if err != nil {
+			stats.Failed++
+			return nil
+		}
+		store.Set(key, value)
+		if !expireAt.IsZero() {
+			store.ExpireAt(key, expireAt)
+		}
+		h.dbs.demoteIfNeeded()
+		stats.Replayed++
+		return nil
+	}
+	stats.WALRepair, err = p.Replay(seq, apply, restore)
+	return stats, err
+}
+
+// replayCommand runs a logged command against database db, in the session
+// of ctx, and returns the error it failed with.
+func (h *CommandHandler) replayCommand(ctx context.Context, db int, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	sessionFrom(ctx).db = db
+	if _, err := h.execute(ctx, strings.ToUpper(args[0]), args); err != nil {
+		return err
+	}
+	h.dbs.demoteIfNeeded()
+	return nil
+}
+
+// SaveSnapshot writes all databases to p's snapshot file and drops the WAL
+// files it supersedes. Logged writes are paused while it runs, so the
+// snapshot matches a point in the WAL.
+func (h *CommandHandler) SaveSnapshot(p *PersistenceLayer) error {
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+	unlock := h.dbs.writeLocks.lockAll()
+	defer unlock()
+
+	seq := p.Seq()
+	if err := p.writeSnapshot(seq, h.dbs.Len(), h.dbs.forEach); err != nil {
+		return err
+	}
+	return p.checkpoint(seq, "")
+}
+
+// StartRewriteAOF starts an AOF rewrite in the background: the current
+// dataset is written to a new WAL base holding the fewest records that
+// rebuild it, which then replaces the WAL files logged so far. As for
+// BackgroundSave, logged writes are paused only while a Snapshot of every
+// database is taken; the base is written from it while writes go on to a
+// new segment.
+func (h *CommandHandler) StartRewriteAOF(p *PersistenceLayer) error {
+	unlock := h.dbs.writeLocks.lockAll()
+	rw, err := p.startRewrite()
+	if err != nil {
+		unlock()
+		return err
+	}
+	snap := h.dbs.OpenSnapshot()
+	unlock()
+
+	go func() {
+		defer snap.Release()
+		p.finishRewrite(rw, snap.Len(), func(i int, fn func(string, interface{}, time.Time) error) error {
+			_, err := snap.drain(i, fn)
+			return err
+		})
+	}()
+	return nil
+}
+
+func (h *CommandHandler) handleBgRewriteAOF(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("wrong number of arguments for BGREWRITEAOF")
+	}
+	if h.aof == nil {
+		return nil, fmt.Errorf("append only file is disabled")
+	}
+	if err := h.StartRewriteAOF(h.aof); err != nil {
+		return nil, err
+	}
+	return "Background append only file rewriting started", nil
+}
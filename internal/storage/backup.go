@@ -0,0 +1,445 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const backupManifestFileName = "backup.manifest"
+
+var (
+	ErrBackupInProgress = errors.New("a backup is already in progress")
+	ErrBackupNeedsAOF   = errors.New("BACKUP needs the append only file to be enabled")
+	// ErrBackupGap is returned when the WAL no longer holds every command
+	// logged since a backup, which then cannot be brought up to date.
+	ErrBackupGap = errors.New("the WAL no longer holds every command since this backup; start a new backup in an empty directory")
+)
+
+// A backup directory holds a snapshot and the WAL segments archived after
+// it, which together rebuild the dataset as of any command logged since
+// the snapshot was taken. Its manifest is a text file with lines
+//
+//	snapshot <file> <seq> <unix nanoseconds>
+//	segment <file>
+//	through <seq>
+//
+// The snapshot includes the commands up to seq and was taken at the time
+// given; the segments follow it in order, and the backup holds every
+// command up to the through sequence number.
+type backupManifest struct {
+	snapshot     string
+	snapshotSeq  uint64
+	snapshotTime time.Time
+	segments     []string
+	through      uint64
+}
+
+// readBackupManifest reads the manifest of the backup in dir, returning
+// nil if there is none.
+func readBackupManifest(dir string) (*backupManifest, error) {
+	file, err := os.Open(filepath.Join(dir, backupManifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	m := &backupManifest{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		invalid := func() error {
+			return fmt.Errorf("%s line %d: invalid entry %q", backupManifestFileName, line, scanner.Text())
+		}
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "snapshot" && len(fields) == 4:
+			seq, err := strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return nil, invalid()
+			}
+			nanos, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return nil, invalid()
+			}
+			m.snapshot, m.snapshotSeq, m.snapshotTime = fields[1], seq, time.Unix(0, nanos)
+		case fields[0] == "segment" && len(fields) == 2:
+			m.segments = append(m.segments, fields[1])
+		case fields[0] == "through" && len(fields) == 2:
+			if m.through, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+				return nil, invalid()
+			}
+		default:
+			return nil, invalid()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.snapshot == "" {
+		return nil, fmt.Errorf("%s: no snapshot", backupManifestFileName)
+	}
+	return m, nil
+}
+
+// write atomically replaces the manifest in dir.
+func (m *backupManifest) write(dir string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "snapshot %s %d %d\n", m.snapshot, m.snapshotSeq, m.snapshotTime.UnixNano())
+	for _, segment := range m.segments {
+		fmt.Fprintf(&b, "segment %s\n", segment)
+	}
+	fmt.Fprintf(&b, "through %d\n", m.through)
+	return replaceFile(filepath.Join(dir, backupManifestFileName), []byte(b.String()))
+}
+
+// BackupResult describes what a BACKUP wrote.
+type BackupResult struct {
+	// Full is set when a new backup was started with a snapshot, and
+	// Segments counts the WAL segments archived otherwise.
+	Full     bool
+	Segments int
+	// Seq is the sequence number of the last command the backup holds.
+	Seq uint64
+}
+
+// Backup writes an online backup of every database to dir. The first
+// backup to a directory writes a snapshot, taken like BGSAVE's while
+// writes continue; each later one archives the WAL segments logged since
+// the previous, so that running it every few minutes bounds how much a
+// restore from dir can lose. From a full backup on, the WAL keeps the
+// segments that are yet to be archived, for one backup directory at a
+// time: a full backup to another directory takes the hold over, and this
+// one can then no longer be brought up to date.
+func (h *CommandHandler) Backup(dir string) (BackupResult, error) {
+	p := h.aof
+	if p == nil {
+		return BackupResult{}, ErrBackupNeedsAOF
+	}
+	if !h.backupMu.TryLock() {
+		return BackupResult{}, ErrBackupInProgress
+	}
+	defer h.backupMu.Unlock()
+
+	m, err := readBackupManifest(dir)
+	if err != nil {
+		return BackupResult{}, err
+	}
+	if m == nil {
+		return h.fullBackup(p, dir)
+	}
+	return p.archiveSegments(dir, m)
+}
+
+// fullBackup starts a backup in dir, which must be empty or not exist, with
+// a snapshot of every database, and holds the WAL segments logged after it.
+func (h *CommandHandler) fullBackup(p *PersistenceLayer, dir string) (BackupResult, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return BackupResult{}, err
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		return BackupResult{}, err
+	} else if len(entries) > 0 {
+		return BackupResult{}, fmt.Errorf("%s is not empty and holds no backup", dir)
+	}
+
+	unlock := h.dbs.writeLocks.lockAll()
+	seq, err := p.holdFrom()
+	if err != nil {
+		unlock()
+		return BackupResult{}, err
+	}
+	snap := h.dbs.OpenSnapshot()
+	unlock()
+	defer snap.Release()
+
+	p.mutex.Lock()
+	codec := p.compression
+	p.mutex.Unlock()
+	err = writeSnapshotFile(filepath.Join(dir, snapshotFileName), codec, seq, snap.Len(), func(i int, fn func(string, interface{}, time.Time) error) error {
+		_, err := snap.drain(i, fn)
+		return err
+	})
+	if err != nil {
+		return BackupResult{}, err
+	}
+	m := &backupManifest{
+		snapshot:     snapshotFileName,
+		snapshotSeq:  seq,
+		snapshotTime: snap.Created(),
+		through:      seq,
+	}
+	if err := m.write(dir); err != nil {
+		return BackupResult{}, err
+	}
+	return BackupResult{Full: true, Seq: seq}, nil
+}
+
+// holdFrom moves the WAL on to a new segment and holds it, and those after
+// it, for BACKUP. It returns the sequence number of the last command
+// logged before it. Logged writes must be paused until the dataset has
+// been captured.
+func (p *PersistenceLayer) holdFrom() (uint64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.rewrite.closed {
+		return 0, ErrPersistenceClosed
+	}
+	if err := p.rotate(); err != nil {
+		return 0, err
+	}
+	previous := *p.manifest
+	p.manifest.hold = p.manifest.segments[len(p.manifest.segments)-1]
+	p.manifest.holdSeq = p.seq
+	if err := p.manifest.write(p.snapshotDir); err != nil {
+		*p.manifest = previous
+		return 0, err
+	}
+	return p.seq, nil
+}
+
+// archiveSegments brings the backup in dir up to date: the WAL moves on to
+// a new segment, and the held segments before it are copied to dir. The
+// hold moves past them only once the copies are durable.
+func (p *PersistenceLayer) archiveSegments(dir string, m *backupManifest) (BackupResult, error) {
+	p.mutex.Lock()
+	if p.rewrite.closed {
+		p.mutex.Unlock()
+		return BackupResult{}, ErrPersistenceClosed
+	}
+	first := -1
+	for i, segment := range p.manifest.segments {
+		if segment == p.manifest.hold {
+			first = i
+			break
+		}
+	}
+	if first < 0 || p.manifest.holdSeq > m.through {
+		p.mutex.Unlock()
+		return BackupResult{}, ErrBackupGap
+	}
+	if err := p.rotate(); err != nil {
+		p.mutex.Unlock()
+		return BackupResult{}, err
+	}
+	seq := p.seq
+	segments := p.manifest.segments
+	closed := append([]string(nil), segments[first:len(segments)-1]...)
+	next := segments[len(segments)-1]
+	p.mutex.Unlock()
+
+	archived := *m
+	archived.segments = append([]string(nil), m.segments...)
+	for _, segment := range closed {
+		name := fmt.Sprintf("wal-%06d.log", len(archived.segments)+1)
+		if err := copyFile(filepath.Join(p.snapshotDir, segment), filepath.Join(dir, name)); err != nil {
+			return BackupResult{}, err
+		}
+		archived.segments = append(archived.segments, name)
+	}
+	archived.through = seq
+	if err := archived.write(dir); err != nil {
+		return BackupResult{}, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	previous := *p.manifest
+	p.manifest.hold, p.manifest.holdSeq = next, seq
+	if err := p.manifest.write(p.snapshotDir); err != nil {
+		*p.manifest = previous
+		return BackupResult{}, err
+	}
+	return BackupResult{Segments: len(closed), Seq: seq}, nil
+}
+
+// ForgetBackup stops holding WAL segments for BACKUP, which can then no
+// longer bring its backup up to date. The segments go at the next
+// checkpoint or rewrite.
+func (h *CommandHandler) ForgetBackup() error {
+	p := h.aof
+	if p == nil {
+		return ErrBackupNeedsAOF
+	}
+	if !h.backupMu.TryLock() {
+		return ErrBackupInProgress
+	}
+	defer h.backupMu.Unlock()
+	return p.releaseHold()
+}
+
+// releaseHold drops the hold on WAL segments for BACKUP.
+func (p *PersistenceLayer) releaseHold() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.manifest.hold == "" {
+		return nil
+	}
+	previous := *p.manifest
+	p.manifest.hold, p.manifest.holdSeq = "", 0
+	if err := p.manifest.write(p.snapshotDir); err != nil {
+		*p.manifest = previous
+		return err
+	}
+	return nil
+}
+
+// copyFile durably copies the file at src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := dst + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// RestoreOptions bounds a point-in-time restore. With neither bound set,
+// every command in the backup is replayed.
+type RestoreOptions struct {
+	// Until stops the restore before the first command logged after it.
+	Until time.Time
+	// UntilSeq stops it after the command with that sequence number.
+	UntilSeq uint64
+}
+
+// maxRestoreFailures bounds the failed commands RestoreStats lists.
+const maxRestoreFailures = 100
+
+// RestoreFailure is a command that failed when a backup was restored.
+type RestoreFailure struct {
+	Seq  uint64
+	DB   int
+	Args []string
+	Err  error
+}
+
+// RestoreStats describes what RestoreBackup loaded.
+type RestoreStats struct {
+	SnapshotKeys int
+	Replayed     int
+	Failed       int
+	// Failures lists the first of the commands that failed, in order.
+	Failures []RestoreFailure
+	// Seq is the sequence number of the last command replayed, or of the
+	// snapshot, and Time when it was logged or the snapshot taken.
+	Seq  uint64
+	Time time.Time
+}
+
+// errRestoreDone stops the replay of a backup at its bound.
+var errRestoreDone = errors.New("restore bound reached")
+
+// RestoreBackup loads the backup in dir into the handler's databases, which
+// should be empty: the snapshot, then the archived commands up to the
+// bounds of opts. Commands that fail are skipped, as in Recover, and
+// listed in the stats; a damaged segment is an error.
+func (h *CommandHandler) RestoreBackup(dir string, opts RestoreOptions) (RestoreStats, error) {
+	var stats RestoreStats
+	m, err := readBackupManifest(dir)
+	if err != nil {
+		return stats, err
+	}
+	if m == nil {
+		return stats, fmt.Errorf("%s holds no backup", dir)
+	}
+	if opts.UntilSeq != 0 && opts.UntilSeq < m.snapshotSeq {
+		return stats, fmt.Errorf("the backup starts at sequence number %d", m.snapshotSeq)
+	}
+	if !opts.Until.IsZero() && opts.Until.Before(m.snapshotTime) {
+		return stats, fmt.Errorf("the backup starts at %s", m.snapshotTime.Format(time.RFC3339Nano))
+	}
+
+	if stats.SnapshotKeys, err = h.dbs.LoadSnapshotFile(filepath.Join(dir, m.snapshot)); err != nil {
+		return stats, err
+	}
+	stats.Seq, stats.Time = m.snapshotSeq, m.snapshotTime
+
+	ctx := h.NewSession(context.Background())
+	for _, segment := range m.segments {
+		_, repair, err := replayWAL(filepath.Join(dir, segment), func(record walRecord) error {
+			if record.op != 'C' || record.seq <= stats.Seq {
+				return nil
+			}
+			logged := time.Unix(0, record.time)
+			if (opts.UntilSeq != 0 && record.seq > opts.UntilSeq) || (!opts.Until.IsZero() && logged.After(opts.Until)) {
+				return errRestoreDone
+			}
+			if err := h.replayCommand(ctx, record.db, record.args); err != nil {
+				stats.Failed++
+				if len(stats.Failures) < maxRestoreFailures {
+					stats.Failures = append(stats.Failures, RestoreFailure{record.seq, record.db, record.args, err})
+				}
+			} else {
+				stats.Replayed++
+			}
+			stats.Seq, stats.Time = record.seq, logged
+			return nil
+		})
+		if err == errRestoreDone {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("%s: %v", segment, err)
+		}
+		if repair != nil {
+			return stats, fmt.Errorf("%s is damaged at offset %d: %s", segment, repair.Offset, repair.Reason)
+		}
+	}
+	return stats, nil
+}
+
+// handleBackup serves BACKUP dir and BACKUP FORGET.
+func (h *CommandHandler) handleBackup(args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("wrong number of arguments for BACKUP")
+	}
+	if strings.EqualFold(args[1], "FORGET") {
+		if err := h.ForgetBackup(); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	}
+	result, err := h.Backup(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if result.Full {
+		return fmt.Sprintf("Backup started with a snapshot at sequence number %d", result.Seq), nil
+	}
+	return fmt.Sprintf("Archived %d WAL segments up to sequence number %d", result.Segments, result.Seq), nil
+}
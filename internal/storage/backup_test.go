@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restoreFrom restores the backup in dir into new databases and returns a
+// function reading a key of database 0.
+func restoreFrom(t *testing.T, dir string, opts RestoreOptions) (RestoreStats, func(key string) interface{}) {
+	t.Helper()
+	h := NewCommandHandler(NewDatabases(4, 4))
+	stats, err := h.RestoreBackup(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := h.dbs.DB(0)
+	return stats, func(key string) interface{} {
+		value, _ := db.Get(key)
+		return value
+	}
+}
+
+func TestBackupAndPointInTimeRestore(t *testing.T) {
+	data, backup := t.TempDir(), filepath.Join(t.TempDir(), "backup")
+	s, _ := openTestServer(t, data)
+	s.do(t, "SET", "a", "0")
+	s.do(t, "SET", "a", "1")
+
+	full, err := s.h.Backup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !full.Full || full.Seq != s.p.Seq() {
+		t.Fatalf("first backup returned %+v at sequence number %d", full, s.p.Seq())
+	}
+	m, err := readBackupManifest(backup)
+	if err != nil || m == nil {
+		t.Fatalf("manifest after a full backup: %+v, %v", m, err)
+	}
+	if m.snapshotSeq != full.Seq || m.through != full.Seq || len(m.segments) != 0 {
+		t.Fatalf("manifest after a full backup: %+v", m)
+	}
+
+	s.do(t, "SET", "b", "1")
+	afterB := s.p.Seq()
+	time.Sleep(5 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	s.do(t, "SET", "c", "1")
+	s.do(t, "DEL", "a")
+
+	incremental, err := s.h.Backup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incremental.Full || incremental.Segments == 0 || incremental.Seq != s.p.Seq() {
+		t.Fatalf("second backup returned %+v at sequence number %d", incremental, s.p.Seq())
+	}
+	if m, err = readBackupManifest(backup); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.segments) != incremental.Segments || m.through != incremental.Seq {
+		t.Fatalf("manifest after an incremental backup: %+v", m)
+	}
+	for _, segment := range m.segments {
+		if _, err := os.Stat(filepath.Join(backup, segment)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name    string
+		opts    RestoreOptions
+		seq     uint64
+		a, b, c interface{}
+	}{
+		{"everything", RestoreOptions{}, incremental.Seq, nil, "1", "1"},
+		{"until a sequence number", RestoreOptions{UntilSeq: afterB}, afterB, "1", "1", nil},
+		{"until a time", RestoreOptions{Until: between}, afterB, "1", "1", nil},
+		{"until the snapshot", RestoreOptions{UntilSeq: full.Seq}, full.Seq, "1", nil, nil},
+	} {
+		stats, get := restoreFrom(t, backup, c.opts)
+		if stats.Seq != c.seq || stats.Failed != 0 || stats.SnapshotKeys != 1 {
+			t.Errorf("restoring %s: stats %+v, want sequence number %d", c.name, stats, c.seq)
+		}
+		for key, want := range map[string]interface{}{"a": c.a, "b": c.b, "c": c.c} {
+			if got := get(key); got != want {
+				t.Errorf("restoring %s: %s = %v, want %v", c.name, key, got, want)
+			}
+		}
+	}
+
+	h := NewCommandHandler(NewDatabases(4, 4))
+	for _, opts := range []RestoreOptions{
+		{UntilSeq: full.Seq - 1},
+		{Until: m.snapshotTime.Add(-time.Second)},
+	} {
+		if _, err := h.RestoreBackup(backup, opts); err == nil {
+			t.Errorf("restoring to %+v, before the snapshot, succeeded", opts)
+		}
+	}
+
+	// The hold outlives a restart, so the backup can still be brought up
+	// to date.
+	s.p.Close()
+	s, _ = openTestServer(t, data)
+	s.do(t, "SET", "d", "1")
+	if _, err := s.h.Backup(backup); err != nil {
+		t.Fatalf("backup after a restart: %v", err)
+	}
+	if _, get := restoreFrom(t, backup, RestoreOptions{}); get("d") != "1" {
+		t.Errorf("the backup after a restart lost d")
+	}
+}
+
+func TestBackupGap(t *testing.T) {
+	s, _ := openTestServer(t, t.TempDir())
+	first, second := filepath.Join(t.TempDir(), "first"), filepath.Join(t.TempDir(), "second")
+	s.do(t, "SET", "key", "1")
+	if _, err := s.h.Backup(first); err != nil {
+		t.Fatal(err)
+	}
+	s.do(t, "SET", "key", "2")
+
+	// A full backup elsewhere takes over the hold.
+	if _, err := s.h.Backup(second); err != nil {
+		t.Fatal(err)
+	}
+	s.do(t, "SET", "key", "3")
+	if _, err := s.h.Backup(first); !errors.Is(err, ErrBackupGap) {
+		t.Fatalf("backup to a directory whose hold was taken over returned %v, want %v", err, ErrBackupGap)
+	}
+	if _, err := s.h.Backup(second); err != nil {
+		t.Fatal(err)
+	}
+
+	s.do(t, "BACKUP", "FORGET")
+	if _, err := s.h.Backup(second); !errors.Is(err, ErrBackupGap) {
+		t.Fatalf("backup after BACKUP FORGET returned %v, want %v", err, ErrBackupGap)
+	}
+
+	// What the first backup held can still be restored.
+	if _, get := restoreFrom(t, first, RestoreOptions{}); get("key") != "1" {
+		t.Errorf("the first backup restored key = %v, want 1", get("key"))
+	}
+
+	other := t.TempDir()
+	if err := os.WriteFile(filepath.Join(other, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.h.Backup(other); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("backup to a directory holding other files returned %v", err)
+	}
+	if _, err := NewCommandHandler(NewDatabases(1, 4)).Backup(other); !errors.Is(err, ErrBackupNeedsAOF) {
+		t.Errorf("backup without a WAL returned %v, want %v", err, ErrBackupNeedsAOF)
+	}
+}
+
+func TestRestoreListsFailedCommands(t *testing.T) {
+	s, _ := openTestServer(t, t.TempDir())
+	backup := filepath.Join(t.TempDir(), "backup")
+	if _, err := s.h.Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+	s.do(t, "SET", "kept", "1")
+	s.do(t, "SELECT", "3")
+	s.do(t, "SET", "lost", "1")
+	if _, err := s.h.Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// Database 3 does not exist in a server with two.
+	h := NewCommandHandler(NewDatabases(2, 4))
+	stats, err := h.RestoreBackup(backup, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Replayed != 1 || stats.Failed != 1 || len(stats.Failures) != 1 {
+		t.Fatalf("restore stats %+v, want 1 command replayed and 1 failed", stats)
+	}
+	f := stats.Failures[0]
+	if f.DB != 3 || strings.Join(f.Args, " ") != "SET lost 1" || !errors.Is(f.Err, ErrDBOutOfRange) || f.Seq != stats.Seq {
+		t.Errorf("failure %+v", f)
+	}
+}
@@ -0,0 +1,676 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// maxBitOffset is the largest bit offset a bitmap may address (512MB).
+const maxBitOffset = 1<<32 - 1
+
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// BitOverflow controls how BITFIELD SET and INCRBY handle values that do
+// not fit in the target integer type.
+type BitOverflow int
+
+const (
+	OverflowWrap BitOverflow = iota
+	OverflowSat
+	OverflowFail
+)
+
+// BitFieldOp is a single GET, SET or INCRBY step of a BITFIELD call.
+type BitFieldOp struct {
+	Op       string // GET, SET or INCRBY
+	Signed   bool
+	Bits     uint
+	Offset   uint64
+	Value    int64
+	Overflow BitOverflow
+}
+
+// stringValue returns the byte representation of a string value. Integers
+// produced by INCR are treated as their decimal form, as Redis does.
+func stringValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	default:
+		return "", false
+	}
+}
+
+// bitmap returns a copy of the string stored at key. The caller must hold
+// sh.mu.
+func (sh *shard) bitmap(key string) ([]byte, bool, error) {
+	value, exists := sh.lookup(key)
+	if !exists {
+		return nil, false, nil
+	}
+	str, ok := stringValue(value)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return []byte(str), true, nil
+}
+
+func (s *InMemoryStore) SetBit(key string, offset uint64, bit int) (int64, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	buf, _, err := sh.bitmap(key)
+	if err != nil {
+		return 0, err
+	}
+
+	byteIndex := int(offset >> 3)
+	if byteIndex >= len(buf) {
+		buf = append(buf, make([]byte, byteIndex-len(buf)+1)...)
+	}
+
+	shift := 7 - uint(offset&7)
+	old := int64(buf[byteIndex]>>shift) & 1
+	if bit == 1 {
+		buf[byteIndex] |= 1 << shift
+	} else {
+		buf[byteIndex] &^= 1 << shift
+	}
+
+	sh.set(key, string(buf))
+	return old, nil
+}
+
+func (s *InMemoryStore) GetBit(key string, offset uint64) (int64, error) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	buf, _, err := sh.bitmap(key)
+	if err != nil {
+		return 0, err
+	}
+	return int64(getBits(buf, offset, 1)), nil
+}
+
+// normalizeBitRange converts a possibly negative inclusive [start, end]
+// range over length units into absolute indexes. ok is false when the
+// range is empty.
+func normalizeBitRange(start, end, length int64) (int64, int64, bool) {
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end || length == 0 {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// BitCount counts set bits. When hasRange is false the whole string is
+// counted; otherwise start and end are interpreted in bytes or, when
+// bitUnit is set, in bits.
+func (s *InMemoryStore) BitCount(key string, start, end int64, hasRange, bitUnit bool) (int64, error) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	buf, exists, err := sh.bitmap(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	if !hasRange {
+		return int64(popcount(buf)), nil
+	}
+
+	if !bitUnit {
+		start, end, ok := normalizeBitRange(start, end, int64(len(buf)))
+		if !ok {
+			return 0, nil
+		}
+		return int64(popcount(buf[start : end+1])), nil
+	}
+
+	start, end, ok := normalizeBitRange(start, end, int64(len(buf))*8)
+	if !ok {
+		return 0, nil
+	}
+	var count int64
+	for i := start; i <= end; i++ {
+		count += int64(getBits(buf, uint64(i), 1))
+	}
+	return count, nil
+}
+
+// BitPos returns the position of the first bit set to bit. When hasEnd is
+// false and a clear bit is searched for, the string is considered padded
+// with zeros on the right, matching Redis.
+func (s *InMemoryStore) BitPos(key string, bit int, start, end int64, hasStart, hasEnd, bitUnit bool) (int64, error) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	buf, exists, err := sh.bitmap(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if bit == 1 {
+			return -1, nil
+		}
+		return 0, nil
+	}
+
+	totalBits := int64(len(buf)) * 8
+	if !hasStart {
+		start = 0
+	}
+	if !hasEnd {
+		end = -1
+	}
+
+	var first, last int64
+	if bitUnit {
+		var ok bool
+		if first, last, ok = normalizeBitRange(start, end, totalBits); !ok {
+			return -1, nil
+		}
+	} else {
+		byteStart, byteEnd, ok := normalizeBitRange(start, end, int64(len(buf)))
+		if !ok {
+			return -1, nil
+		}
+		first, last = byteStart*8, byteEnd*8+7
+	}
+
+	for i := first; i <= last; i++ {
+		if int(getBits(buf, uint64(i), 1)) == bit {
+			return i, nil
+		}
+	}
+
+	if bit == 0 && !hasEnd {
+		return last + 1, nil
+	}
+	return -1, nil
+}
+
+// BitOp performs a bitwise operation between the source keys and stores
+// the result in destKey, returning the length of the result.
+func (s *InMemoryStore) BitOp(op, destKey string, srcKeys []string) (int64, error) {
+	unlock := s.lockKeys(append([]string{destKey}, srcKeys...)...)
+	defer unlock()
+
+	sources := make([][]byte, 0, len(srcKeys))
+	maxLen := 0
+	for _, key := range srcKeys {
+		buf, _, err := s.shardFor(key).bitmap(key)
+		if err != nil {
+			return 0, err
+		}
+		sources = append(sources, buf)
+		if len(buf) > maxLen {
+			maxLen = len(buf)
+		}
+	}
+
+	dest := s.shardFor(destKey)
+	if maxLen == 0 {
+		dest.delete(destKey)
+		return 0, nil
+	}
+
+	result := make([]byte, maxLen)
+	for i := range result {
+		var acc byte
+		for j, src := range sources {
+			var b byte
+			if i < len(src) {
+				b = src[i]
+			}
+			if j == 0 {
+				acc = b
+				continue
+			}
+			switch op {
+			case "AND":
+				acc &= b
+			case "OR":
+				acc |= b
+			case "XOR":
+				acc ^= b
+			}
+		}
+		if op == "NOT" {
+			acc = ^acc
+		}
+		result[i] = acc
+	}
+
+	dest.set(destKey, string(result))
+	delete(dest.ttls, destKey)
+	return int64(maxLen), nil
+}
+
+// BitField runs a sequence of BITFIELD operations atomically. Each result
+// is an int64, or nil when an operation failed under OVERFLOW FAIL.
+func (s *InMemoryStore) BitField(key string, ops []BitFieldOp) ([]interface{}, error) {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	buf, _, err := sh.bitmap(key)
+	if err != nil {
+		return nil, err
+	}
+
+	written := false
+	results := make([]interface{}, 0, len(ops))
+	for _, op := range ops {
+		if op.Op != "GET" {
+			need := int((op.Offset + uint64(op.Bits) + 7) >> 3)
+			if need > len(buf) {
+				buf = append(buf, make([]byte, need-len(buf))...)
+				written = true
+			}
+		}
+
+		raw := getBits(buf, op.Offset, op.Bits)
+		if op.Op == "GET" {
+			if op.Signed {
+				results = append(results, signExtend(raw, op.Bits))
+			} else {
+				results = append(results, int64(raw))
+			}
+			continue
+		}
+
+		var (
+			oldValue, newValue int64
+			overflow           bool
+		)
+		if op.Signed {
+			oldValue = signExtend(raw, op.Bits)
+			if op.Op == "SET" {
+				newValue, overflow = signedOverflow(op.Value, 0, op.Bits, op.Overflow)
+			} else {
+				newValue, overflow = signedOverflow(oldValue, op.Value, op.Bits, op.Overflow)
+			}
+		} else {
+			oldValue = int64(raw)
+			var nv uint64
+			if op.Op == "SET" {
+				nv, overflow = unsignedOverflow(uint64(op.Value), 0, op.Bits, op.Overflow)
+			} else {
+				nv, overflow = unsignedOverflow(raw, op.Value, op.Bits, op.Overflow)
+			}
+			newValue = int64(nv)
+		}
+
+		if overflow && op.Overflow == OverflowFail {
+			results = append(results, nil)
+			continue
+		}
+
+		setBits(buf, op.Offset, op.Bits, uint64(newValue))
+		written = true
+		if op.Op == "SET" {
+			results = append(results, oldValue)
+		} else {
+			results = append(results, newValue)
+		}
+	}
+
+	if written {
+		sh.set(key, string(buf))
+	}
+	return results, nil
+}
+
+// unsignedOverflow applies incr to value as an unsigned integer of the
+// given width, returning the stored result and whether it overflowed.
+func unsignedOverflow(value uint64, incr int64, width uint, policy BitOverflow) (uint64, bool) {
+	max := uint64(math.MaxUint64)
+	if width < 64 {
+		max = 1<<width - 1
+	}
+	maxIncr := int64(max - value)
+	minIncr := -int64(value)
+
+	if value > max || (incr > 0 && incr > maxIncr) {
+		switch policy {
+		case OverflowWrap:
+			return (value + uint64(incr)) & max, true
+		case OverflowSat:
+			return max, true
+		}
+		return value, true
+	}
+	if incr < 0 && incr < minIncr {
+		switch policy {
+		case OverflowWrap:
+			return (value + uint64(incr)) & max, true
+		case OverflowSat:
+			return 0, true
+		}
+		return value, true
+	}
+	return value + uint64(incr), false
+}
+
+// signedOverflow is the two's complement counterpart of unsignedOverflow.
+func signedOverflow(value, incr int64, width uint, policy BitOverflow) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if width < 64 {
+		max = 1<<(width-1) - 1
+	}
+	min := -max - 1
+	maxIncr := max - value
+	minIncr := min - value
+
+	wrap := func() int64 {
+		c := uint64(value) + uint64(incr)
+		if width < 64 {
+			mask := uint64(math.MaxUint64) << width
+			if c&(1<<(width-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c)
+	}
+
+	if value > max || (width != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr) {
+		switch policy {
+		case OverflowWrap:
+			return wrap(), true
+		case OverflowSat:
+			return max, true
+		}
+		return value, true
+	}
+	if value < min || (width != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr) {
+		switch policy {
+		case OverflowWrap:
+			return wrap(), true
+		case OverflowSat:
+			return min, true
+		}
+		return value, true
+	}
+	return value + incr, false
+}
+
+// getBits reads width bits starting at offset, most significant bit first.
+// Bits past the end of buf read as zero.
+func getBits(buf []byte, offset uint64, width uint) uint64 {
+	var value uint64
+	for i := uint64(0); i < uint64(width); i++ {
+		pos := offset + i
+		var bit uint64
+		if byteIndex := pos >> 3; byteIndex < uint64(len(buf)) {
+			bit = uint64(buf[byteIndex]>>(7-pos&7)) & 1
+		}
+		value = value<<1 | bit
+	}
+	return value
+}
+
+// setBits writes the low width bits of value starting at offset. buf must
+// already be large enough.
+func setBits(buf []byte, offset uint64, width uint, value uint64) {
+	for i := uint64(0); i < uint64(width); i++ {
+		pos := offset + i
+		shift := 7 - pos&7
+		if value>>(uint64(width)-1-i)&1 == 1 {
+			buf[pos>>3] |= 1 << shift
+		} else {
+			buf[pos>>3] &^= 1 << shift
+		}
+	}
+}
+
+func signExtend(value uint64, width uint) int64 {
+	if width < 64 && value&(1<<(width-1)) != 0 {
+		value |= math.MaxUint64 << width
+	}
+	return int64(value)
+}
+
+func popcount(buf []byte) int {
+	count := 0
+	for _, b := range buf {
+		count += bits.OnesCount8(b)
+	}
+	return count
+}
+
+func parseBitOffset(arg string, width uint, allowMultiplier bool) (uint64, error) {
+	multiply := false
+	if allowMultiplier && strings.HasPrefix(arg, "#") {
+		multiply = true
+		arg = arg[1:]
+	}
+	offset, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bit offset is not an integer or out of range")
+	}
+	if multiply {
+		offset *= uint64(width)
+	}
+	if offset+uint64(width)-1 > maxBitOffset {
+		return 0, fmt.Errorf("bit offset is not an integer or out of range")
+	}
+	return offset, nil
+}
+
+func parseBitFieldType(arg string) (bool, uint, error) {
+	errType := fmt.Errorf("invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is")
+	if len(arg) < 2 {
+		return false, 0, errType
+	}
+
+	signed := false
+	switch arg[0] {
+	case 'i', 'I':
+		signed = true
+	case 'u', 'U':
+	default:
+		return false, 0, errType
+	}
+
+	width, err := strconv.ParseUint(arg[1:], 10, 8)
+	if err != nil || width == 0 || (signed && width > 64) || (!signed && width > 63) {
+		return false, 0, errType
+	}
+	return signed, uint(width), nil
+}
+
+func (h *CommandHandler) handleSetBit(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, fmt.Errorf("wrong number of arguments for SETBIT")
+	}
+	offset, err := parseBitOffset(args[2], 1, false)
+	if err != nil {
+		return nil, err
+	}
+	if args[3] != "0" && args[3] != "1" {
+		return nil, fmt.Errorf("bit is not an integer or out of range")
+	}
+	return store.SetBit(args[1], offset, int(args[3][0]-'0'))
+}
+
+func (h *CommandHandler) handleGetBit(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments for GETBIT")
+	}
+	offset, err := parseBitOffset(args[2], 1, false)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetBit(args[1], offset)
+}
+
+// parseBitUnit parses the optional BYTE|BIT argument of BITCOUNT and BITPOS.
+func parseBitUnit(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "BYTE":
+		return false, nil
+	case "BIT":
+		return true, nil
+	}
+	return false, fmt.Errorf("syntax error")
+}
+
+func (h *CommandHandler) handleBitCount(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) != 2 && len(args) != 4 && len(args) != 5 {
+		return nil, fmt.Errorf("wrong number of arguments for BITCOUNT")
+	}
+	if len(args) == 2 {
+		return store.BitCount(args[1], 0, 0, false, false)
+	}
+
+	start, err1 := strconv.ParseInt(args[2], 10, 64)
+	end, err2 := strconv.ParseInt(args[3], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("value is not an integer or out of range")
+	}
+	bitUnit := false
+	if len(args) == 5 {
+		if bitUnit, err1 = parseBitUnit(args[4]); err1 != nil {
+			return nil, err1
+		}
+	}
+	return store.BitCount(args[1], start, end, true, bitUnit)
+}
+
+func (h *CommandHandler) handleBitPos(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) < 3 || len(args) > 6 {
+		return nil, fmt.Errorf("wrong number of arguments for BITPOS")
+	}
+	if args[2] != "0" && args[2] != "1" {
+		return nil, fmt.Errorf("the bit argument must be 1 or 0")
+	}
+	bit := int(args[2][0] - '0')
+
+	var (
+		start, end       int64
+		hasStart, hasEnd bool
+		bitUnit          bool
+		err              error
+	)
+	if len(args) > 3 {
+		if start, err = strconv.ParseInt(args[3], 10, 64); err != nil {
+			return nil, fmt.Errorf("value is not an integer or out of range")
+		}
+		hasStart = true
+	}
+	if len(args) > 4 {
+		if end, err = strconv.ParseInt(args[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("value is not an integer or out of range")
+		}
+		hasEnd = true
+	}
+	if len(args) > 5 {
+		if bitUnit, err = parseBitUnit(args[5]); err != nil {
+			return nil, err
+		}
+	}
+	return store.BitPos(args[1], bit, start, end, hasStart, hasEnd, bitUnit)
+}
+
+func (h *CommandHandler) handleBitOp(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) < 4 {
+		return nil, fmt.Errorf("wrong number of arguments for BITOP")
+	}
+	op := strings.ToUpper(args[1])
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 4 {
+			return nil, fmt.Errorf("BITOP NOT must be called with a single source key")
+		}
+	default:
+		return nil, fmt.Errorf("syntax error")
+	}
+	return store.BitOp(op, args[2], args[3:])
+}
+
+func (h *CommandHandler) handleBitField(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("wrong number of arguments for BITFIELD")
+	}
+
+	var ops []BitFieldOp
+	overflow := OverflowWrap
+	for i := 2; i < len(args); {
+		sub := strings.ToUpper(args[i])
+		switch sub {
+		case "OVERFLOW":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("syntax error")
+			}
+			switch strings.ToUpper(args[i+1]) {
+			case "WRAP":
+				overflow = OverflowWrap
+			case "SAT":
+				overflow = OverflowSat
+			case "FAIL":
+				overflow = OverflowFail
+			default:
+				return nil, fmt.Errorf("invalid OVERFLOW type specified")
+			}
+			i += 2
+
+		case "GET", "SET", "INCRBY":
+			argc := 3
+			if sub != "GET" {
+				argc = 4
+			}
+			if i+argc > len(args) {
+				return nil, fmt.Errorf("syntax error")
+			}
+			signed, width, err := parseBitFieldType(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			offset, err := parseBitOffset(args[i+2], width, true)
+			if err != nil {
+				return nil, err
+			}
+			op := BitFieldOp{Op: sub, Signed: signed, Bits: width, Offset: offset, Overflow: overflow}
+			if sub != "GET" {
+				if op.Value, err = strconv.ParseInt(args[i+3], 10, 64); err != nil {
+					return nil, fmt.Errorf("value is not an integer or out of range")
+				}
+			}
+			ops = append(ops, op)
+			i += argc
+
+		default:
+			return nil, fmt.Errorf("syntax error")
+		}
+	}
+
+	return store.BitField(args[1], ops)
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// bitmapCase is a command and the reply expected from it, compared with
+// fmt.Sprint so that nil results of BITFIELD can be written in place.
+type bitmapCase struct {
+	args []string
+	want interface{}
+}
+
+func runBitmapCases(t *testing.T, do func(args ...string) interface{}, cases []bitmapCase) {
+	t.Helper()
+	for _, c := range cases {
+		if got := do(c.args...); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%q = %v, want %v", strings.Join(c.args, " "), got, c.want)
+		}
+	}
+}
+
+func TestSetBit(t *testing.T) {
+	_, do := newTestHandler(t)
+	runBitmapCases(t, do, []bitmapCase{
+		{[]string{"SETBIT", "bits", "100", "1"}, int64(0)},
+		{[]string{"GET", "bits"}, "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x08"},
+		{[]string{"SETBIT", "bits", "100", "1"}, int64(1)},
+		{[]string{"SETBIT", "bits", "100", "0"}, int64(1)},
+		{[]string{"GET", "bits"}, strings.Repeat("\x00", 13)},
+		{[]string{"GETBIT", "bits", "100"}, int64(0)},
+		{[]string{"GETBIT", "bits", "100000"}, int64(0)},
+		{[]string{"GETBIT", "missing", "0"}, int64(0)},
+		{[]string{"EXISTS", "missing"}, int64(0)},
+
+		// Clearing a bit past the end still grows the string.
+		{[]string{"SETBIT", "cleared", "15", "0"}, int64(0)},
+		{[]string{"GET", "cleared"}, "\x00\x00"},
+
+		// Integers are bitmaps of their decimal form.
+		{[]string{"INCRBY", "number", "1"}, int64(1)},
+		{[]string{"GETBIT", "number", "7"}, int64(1)},
+		{[]string{"SETBIT", "number", "6", "1"}, int64(0)},
+		{[]string{"GET", "number"}, "3"},
+	})
+
+	h, _ := newTestHandler(t)
+	db, _ := h.dbs.DB(0)
+	db.Set("hash", datastructures.NewHash())
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"SETBIT", "hash", "0", "1"},
+		{"GETBIT", "hash", "0"},
+		{"BITCOUNT", "hash"},
+		{"BITPOS", "hash", "1"},
+		{"BITOP", "AND", "dest", "hash"},
+		{"BITFIELD", "hash", "GET", "u8", "0"},
+	} {
+		if _, err := h.HandleCommand(ctx, args); !errors.Is(err, ErrWrongType) {
+			t.Errorf("%s returned %v, want %v", strings.Join(args, " "), err, ErrWrongType)
+		}
+	}
+	for _, args := range [][]string{
+		{"SETBIT", "bits", "0", "2"},
+		{"SETBIT", "bits", "-1", "1"},
+		{"SETBIT", "bits", "4294967296", "1"},
+		{"GETBIT", "bits", "x"},
+	} {
+		if _, err := h.HandleCommand(ctx, args); err == nil {
+			t.Errorf("%s succeeded", strings.Join(args, " "))
+		}
+	}
+}
+
+func TestBitCount(t *testing.T) {
+	_, do := newTestHandler(t)
+	do("SET", "key", "foobar")
+	runBitmapCases(t, do, []bitmapCase{
+		{[]string{"BITCOUNT", "key"}, int64(26)},
+		{[]string{"BITCOUNT", "key", "0", "0"}, int64(4)},
+		{[]string{"BITCOUNT", "key", "1", "1"}, int64(6)},
+		{[]string{"BITCOUNT", "key", "1", "1", "BYTE"}, int64(6)},
+		{[]string{"BITCOUNT", "key", "-2", "-1"}, int64(7)},
+		{[]string{"BITCOUNT", "key", "-100", "100"}, int64(26)},
+		{[]string{"BITCOUNT", "key", "3", "1"}, int64(0)},
+		{[]string{"BITCOUNT", "key", "6", "10"}, int64(0)},
+		{[]string{"BITCOUNT", "key", "1", "1", "BIT"}, int64(1)},
+		{[]string{"BITCOUNT", "key", "5", "30", "bit"}, int64(17)},
+		{[]string{"BITCOUNT", "key", "-8", "-1", "BIT"}, int64(4)},
+		{[]string{"BITCOUNT", "key", "-1", "-8", "BIT"}, int64(0)},
+		{[]string{"BITCOUNT", "missing"}, int64(0)},
+		{[]string{"BITCOUNT", "missing", "0", "-1", "BIT"}, int64(0)},
+	})
+}
+
+func TestBitPos(t *testing.T) {
+	_, do := newTestHandler(t)
+	do("SET", "high", "\xff\xf0\x00")
+	do("SET", "low", "\x00\xff\xf0")
+	do("SET", "ones", "\xff\xff\xff")
+	do("SET", "zeros", "\x00\x00\x00")
+	runBitmapCases(t, do, []bitmapCase{
+		{[]string{"BITPOS", "high", "0"}, int64(12)},
+		{[]string{"BITPOS", "low", "1", "0"}, int64(8)},
+		{[]string{"BITPOS", "low", "1", "2"}, int64(16)},
+		{[]string{"BITPOS", "low", "1", "2", "-1", "BYTE"}, int64(16)},
+		{[]string{"BITPOS", "low", "1", "7", "15", "BIT"}, int64(8)},
+		{[]string{"BITPOS", "low", "1", "7", "-3", "BIT"}, int64(8)},
+		{[]string{"BITPOS", "low", "1", "-1"}, int64(16)},
+
+		// Without an end, a string of ones is padded with zeros.
+		{[]string{"BITPOS", "ones", "0"}, int64(24)},
+		{[]string{"BITPOS", "ones", "0", "1"}, int64(24)},
+		{[]string{"BITPOS", "ones", "0", "0", "-1"}, int64(-1)},
+		{[]string{"BITPOS", "ones", "0", "0", "-1", "BIT"}, int64(-1)},
+		{[]string{"BITPOS", "ones", "1", "-1"}, int64(16)},
+		{[]string{"BITPOS", "zeros", "1"}, int64(-1)},
+		{[]string{"BITPOS", "zeros", "0", "1", "1"}, int64(8)},
+
+		{[]string{"BITPOS", "low", "1", "5", "10"}, int64(-1)},
+		{[]string{"BITPOS", "missing", "0"}, int64(0)},
+		{[]string{"BITPOS", "missing", "1"}, int64(-1)},
+	})
+}
+
+func TestBitOp(t *testing.T) {
+	_, do := newTestHandler(t)
+	do("SET", "a", "\xf0\x0f")
+	do("SET", "b", "\xff")
+	do("SET", "dest", "old")
+	do("EXPIRE", "dest", "100")
+	runBitmapCases(t, do, []bitmapCase{
+		{[]string{"BITOP", "AND", "dest", "a", "b"}, int64(2)},
+		{[]string{"GET", "dest"}, "\xf0\x00"},
+		{[]string{"TTL", "dest"}, nil},
+		{[]string{"BITOP", "OR", "dest", "a", "b"}, int64(2)},
+		{[]string{"GET", "dest"}, "\xff\x0f"},
+		{[]string{"BITOP", "XOR", "dest", "a", "b"}, int64(2)},
+		{[]string{"GET", "dest"}, "\x0f\x0f"},
+		{[]string{"BITOP", "NOT", "dest", "a"}, int64(2)},
+		{[]string{"GET", "dest"}, "\x0f\xf0"},
+		{[]string{"BITOP", "and", "dest", "a"}, int64(2)},
+		{[]string{"GET", "dest"}, "\xf0\x0f"},
+
+		// A missing source reads as zeros.
+		{[]string{"BITOP", "AND", "dest", "a", "missing"}, int64(2)},
+		{[]string{"GET", "dest"}, "\x00\x00"},
+		{[]string{"BITOP", "OR", "dest", "missing", "b"}, int64(1)},
+		{[]string{"GET", "dest"}, "\xff"},
+
+		// Without any source value the destination is deleted.
+		{[]string{"BITOP", "OR", "dest", "missing", "other"}, int64(0)},
+		{[]string{"EXISTS", "dest"}, int64(0)},
+		{[]string{"SET", "dest", "old"}, "OK"},
+		{[]string{"BITOP", "NOT", "dest", "missing"}, int64(0)},
+		{[]string{"EXISTS", "dest"}, int64(0)},
+	})
+
+	h, _ := newTestHandler(t)
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"BITOP", "NOT", "dest", "a", "b"},
+		{"BITOP", "NAND", "dest", "a"},
+		{"BITOP", "AND", "dest"},
+	} {
+		if _, err := h.HandleCommand(ctx, args); err == nil {
+			t.Errorf("%s succeeded", strings.Join(args, " "))
+		}
+	}
+}
+
+func TestBitField(t *testing.T) {
+	_, do := newTestHandler(t)
+	runBitmapCases(t, do, []bitmapCase{
+		{[]string{"BITFIELD", "key", "SET", "i8", "0", "100", "GET", "i8", "0"}, []interface{}{int64(0), int64(100)}},
+		{[]string{"BITFIELD", "key", "GET", "u8", "100"}, []interface{}{int64(0)}},
+		{[]string{"BITFIELD", "missing", "GET", "i8", "0"}, []interface{}{int64(0)}},
+		{[]string{"EXISTS", "missing"}, int64(0)},
+		{[]string{"BITFIELD", "key"}, []interface{}{}},
+
+		// # offsets are multiplied by the width of the type.
+		{[]string{"BITFIELD", "hashed", "SET", "u8", "#1", "200"}, []interface{}{int64(0)}},
+		{[]string{"GET", "hashed"}, "\x00\xc8"},
+		{[]string{"BITFIELD", "hashed", "GET", "u8", "8", "GET", "u4", "#3", "GET", "i8", "#1"}, []interface{}{int64(200), int64(8), int64(-56)}},
+
+		// u2 counters: WRAP is the default, SAT applies to the
+		// operations after it and FAIL leaves the value alone.
+		{[]string{"BITFIELD", "counters", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, []interface{}{int64(1), int64(1)}},
+		{[]string{"BITFIELD", "counters", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, []interface{}{int64(2), int64(2)}},
+		{[]string{"BITFIELD", "counters", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, []interface{}{int64(3), int64(3)}},
+		{[]string{"BITFIELD", "counters", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, []interface{}{int64(0), int64(3)}},
+		{[]string{"BITFIELD", "counters", "OVERFLOW", "FAIL", "INCRBY", "u2", "102", "1", "GET", "u2", "102"}, []interface{}{nil, int64(3)}},
+	})
+
+	for _, c := range []struct {
+		typ, start, incr string
+		wrap, sat        interface{}
+	}{
+		{"i8", "127", "1", int64(-128), int64(127)},
+		{"i8", "-128", "-1", int64(127), int64(-128)},
+		{"i8", "0", "300", int64(44), int64(127)},
+		{"i5", "15", "1", int64(-16), int64(15)},
+		{"u8", "255", "1", int64(0), int64(255)},
+		{"u8", "0", "-1", int64(255), int64(0)},
+		{"u1", "1", "1", int64(0), int64(1)},
+		{"u63", "9223372036854775807", "1", int64(0), int64(9223372036854775807)},
+		{"i64", "9223372036854775807", "1", int64(-9223372036854775808), int64(9223372036854775807)},
+		{"i64", "-9223372036854775808", "-1", int64(9223372036854775807), int64(-9223372036854775808)},
+	} {
+		key := "limit:" + c.typ + ":" + c.start
+		for _, overflow := range []string{"WRAP", "SAT", "FAIL"} {
+			want := []interface{}{c.wrap, c.wrap}
+			switch overflow {
+			case "SAT":
+				want = []interface{}{c.sat, c.sat}
+			case "FAIL":
+				want = []interface{}{nil, "start"}
+			}
+			do("BITFIELD", key, "SET", c.typ, "#2", c.start)
+			got := do("BITFIELD", key, "OVERFLOW", overflow, "INCRBY", c.typ, "#2", c.incr, "GET", c.typ, "#2").([]interface{})
+			if want[1] == "start" {
+				want[1] = do("BITFIELD", key, "GET", c.typ, "#2").([]interface{})[0]
+				if fmt.Sprint(want[1]) != c.start {
+					t.Errorf("BITFIELD SET %s %s stored %v", c.typ, c.start, want[1])
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("INCRBY %s %s by %s under %s = %v, want %v", c.typ, c.start, c.incr, overflow, got, want)
+			}
+		}
+	}
+
+	// SET overflows like INCRBY from zero, and returns the old value.
+	runBitmapCases(t, do, []bitmapCase{
+		{[]string{"BITFIELD", "set", "SET", "u8", "0", "256", "GET", "u8", "0"}, []interface{}{int64(0), int64(0)}},
+		{[]string{"BITFIELD", "set", "SET", "u8", "0", "-1", "GET", "u8", "0"}, []interface{}{int64(0), int64(255)}},
+		{[]string{"BITFIELD", "set", "OVERFLOW", "SAT", "SET", "u8", "0", "300", "SET", "i8", "8", "-300"}, []interface{}{int64(255), int64(0)}},
+		{[]string{"BITFIELD", "set", "GET", "u8", "0", "GET", "i8", "8"}, []interface{}{int64(255), int64(-128)}},
+		{[]string{"BITFIELD", "set", "OVERFLOW", "FAIL", "SET", "i8", "8", "128", "GET", "i8", "8"}, []interface{}{nil, int64(-128)}},
+	})
+
+	h, _ := newTestHandler(t)
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"BITFIELD", "key", "GET", "u64", "0"},
+		{"BITFIELD", "key", "GET", "i65", "0"},
+		{"BITFIELD", "key", "GET", "x8", "0"},
+		{"BITFIELD", "key", "GET", "u8", "-1"},
+		{"BITFIELD", "key", "GET", "u8", "4294967290"},
+		{"BITFIELD", "key", "SET", "u8", "0"},
+		{"BITFIELD", "key", "OVERFLOW", "NEVER", "GET", "u8", "0"},
+		{"BITFIELD", "key", "FETCH", "u8", "0"},
+	} {
+		if _, err := h.HandleCommand(ctx, args); err == nil {
+			t.Errorf("%s succeeded", strings.Join(args, " "))
+		}
+	}
+}
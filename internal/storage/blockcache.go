@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// blockCacheKey identifies a data block by the id of its open table, which
+// unlike the file number is never reused by another tree sharing the
+// cache, and its index in the table.
+type blockCacheKey struct {
+	table uint64
+	block int
+}
+
+// blockCache is an LRU cache of SSTable data blocks shared by the tables
+// of an LSM tree and bounded by the total size of the blocks it holds.
+type blockCache struct {
+	capacity int64
+	mu       sync.Mutex
+	used     int64
+	// lru holds the cached blocks, most recently used first.
+	lru    *list.List
+	blocks map[blockCacheKey]*list.Element
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type blockCacheEntry struct {
+	key   blockCacheKey
+	block []byte
+}
+
+// tableIDs numbers the tables opened by the process for the block cache.
+var tableIDs atomic.Uint64
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[blockCacheKey]*list.Element),
+	}
+}
+
+// get returns a cached block and marks it as recently used.
+func (c *blockCache) get(key blockCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.lru.MoveToFront(e)
+	return e.Value.(*blockCacheEntry).block, true
+}
+
+// add caches a block, evicting the least recently used blocks to stay
+// within capacity. Blocks larger than the whole cache are not kept.
+func (c *blockCache) add(key blockCacheKey, block []byte) {
+	size := int64(len(block))
+	if size > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[key]; ok {
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&blockCacheEntry{key: key, block: block})
+	c.used += size
+	for c.used > c.capacity {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// evictTable drops the blocks of a table that is being closed.
+func (c *blockCache) evictTable(id uint64, blocks int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < blocks; i++ {
+		if e, ok := c.blocks[blockCacheKey{table: id, block: i}]; ok {
+			c.remove(e)
+		}
+	}
+}
+
+// remove drops a cached block. The caller must hold c.mu.
+func (c *blockCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*blockCacheEntry)
+	delete(c.blocks, entry.key)
+	c.used -= int64(len(entry.block))
+}
+
+// usage returns the bytes of blocks cached.
+func (c *blockCache) usage() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlockCacheEviction(t *testing.T) {
+	c := newBlockCache(100)
+	block := func(i int) blockCacheKey { return blockCacheKey{table: 1, block: i} }
+	for i := 0; i < 3; i++ {
+		c.add(block(i), make([]byte, 30))
+	}
+	if _, ok := c.get(block(0)); !ok {
+		t.Fatal("block 0 is not cached")
+	}
+	c.add(block(3), make([]byte, 30))
+	if _, ok := c.get(block(1)); ok {
+		t.Error("the least recently used block was kept")
+	}
+	for _, i := range []int{0, 2, 3} {
+		if _, ok := c.get(block(i)); !ok {
+			t.Errorf("block %d was evicted", i)
+		}
+	}
+	if c.usage() != 90 || c.evictions.Load() != 1 {
+		t.Errorf("cache holds %d bytes after %d evictions", c.usage(), c.evictions.Load())
+	}
+
+	c.add(block(4), make([]byte, 101))
+	if _, ok := c.get(block(4)); ok {
+		t.Error("a block larger than the cache was kept")
+	}
+	c.add(blockCacheKey{table: 2, block: 0}, make([]byte, 10))
+	c.evictTable(1, 5)
+	if c.usage() != 10 {
+		t.Errorf("cache holds %d bytes after its table was evicted", c.usage())
+	}
+}
+
+func TestBlockCacheServesReads(t *testing.T) {
+	opts := LSMOptions{L0CompactionTrigger: 100, BlockCacheSize: 3 * sstableBlockSize}
+	l := openTestLSM(t, t.TempDir(), opts)
+	writeLSM(t, l, 0, 2000, 1)
+	for round := 0; round < 2; round++ {
+		if _, _, ok, err := l.Get("key:00042"); err != nil || !ok {
+			t.Fatalf("key:00042 = %v, %v", ok, err)
+		}
+	}
+	stats := l.Stats()
+	if stats.BlockCacheHits != 1 || stats.BlockCacheMisses != 1 {
+		t.Errorf("block cache: %d hits, %d misses", stats.BlockCacheHits, stats.BlockCacheMisses)
+	}
+
+	for i := 0; i < 2000; i += 10 {
+		l.Get(fmt.Sprintf("key:%05d", i))
+	}
+	stats = l.Stats()
+	if stats.BlockCacheEvictions == 0 || stats.BlockCacheUsed > opts.BlockCacheSize {
+		t.Errorf("block cache holds %d of %d bytes after %d evictions",
+			stats.BlockCacheUsed, opts.BlockCacheSize, stats.BlockCacheEvictions)
+	}
+}
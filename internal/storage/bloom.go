@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"hash/fnv"
+)
+
+const (
+	// bloomBitsPerKey sizes the Bloom filter of an SSTable, which at 10
+	// bits and 7 probes per key gives about 1% false positives.
+	bloomBitsPerKey = 10
+	bloomProbes     = 7
+)
+
+// bloomFilter is the Bloom filter of an SSTable: a bit array followed by a
+// byte holding the number of probes, as stored in the table's index block.
+// Probes are derived from one 64-bit hash by double hashing.
+type bloomFilter []byte
+
+// bloomHash hashes a key for a Bloom filter.
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// newBloomFilter builds a filter holding the keys whose hashes are given.
+func newBloomFilter(hashes []uint64) bloomFilter {
+	bits := len(hashes) * bloomBitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	filter := make(bloomFilter, bytes+1)
+	filter[bytes] = bloomProbes
+	for _, h := range hashes {
+		delta := h>>33 | h<<31
+		for i := 0; i < bloomProbes; i++ {
+			bit := h % uint64(bits)
+			filter[bit/8] |= 1 << (bit % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// mayContain reports whether key may have been added to the filter. A
+// filter that cannot be interpreted matches every key.
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint64(len(f)-1) * 8
+	probes := int(f[len(f)-1])
+	h := bloomHash(key)
+	delta := h>>33 | h<<31
+	for i := 0; i < probes; i++ {
+		bit := h % bits
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 20000} {
+		hashes := make([]uint64, n)
+		for i := range hashes {
+			hashes[i] = bloomHash(fmt.Sprintf("key:%d", i))
+		}
+		filter := newBloomFilter(hashes)
+		for i := 0; i < n; i++ {
+			if !filter.mayContain(fmt.Sprintf("key:%d", i)) {
+				t.Fatalf("filter of %d keys lost key:%d", n, i)
+			}
+		}
+		if n < 1000 {
+			continue
+		}
+		positives := 0
+		for i := 0; i < 10000; i++ {
+			if filter.mayContain(fmt.Sprintf("other:%d", i)) {
+				positives++
+			}
+		}
+		if rate := float64(positives) / 10000; rate > 0.03 {
+			t.Errorf("filter of %d keys has a false positive rate of %.3f", n, rate)
+		}
+	}
+	if !bloomFilter(nil).mayContain("key") {
+		t.Error("a missing filter ruled a key out")
+	}
+}
+
+func TestBloomFilterSkipsTables(t *testing.T) {
+	l := openTestLSM(t, t.TempDir(), LSMOptions{L0CompactionTrigger: 100})
+	for i := 0; i < 5; i++ {
+		var b Batch
+		for j := 0; j < 200; j++ {
+			// Interleave the tables' key ranges so only filters can
+			// tell them apart.
+			b.Set(fmt.Sprintf("key:%05d", j*5+i), "value", time.Time{})
+		}
+		if err := l.Apply(&b); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if _, _, ok, err := l.Get(fmt.Sprintf("key:%05d", i)); err != nil || !ok {
+			t.Fatalf("key:%05d = %v, %v", i, ok, err)
+		}
+	}
+	stats := l.Stats()
+	if stats.BloomNegatives == 0 || stats.BloomFalsePositives > stats.BloomChecks/20 {
+		t.Errorf("bloom filters: %d checks, %d negatives, %d false positives",
+			stats.BloomChecks, stats.BloomNegatives, stats.BloomFalsePositives)
+	}
+}
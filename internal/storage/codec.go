@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// Value type tags used when values are written to disk.
+const (
+	valueString byte = iota
+	valueInt
+	valueList
+	valueSet
+	valueZSet
+	valueHash
+)
+
+// byteReader is what values are decoded from: a buffered file or an
+// in-memory record.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// maxValuePrealloc bounds what is allocated up front for a string whose
+// length is read from a reader that cannot tell how much it holds.
+const maxValuePrealloc = 1 << 20
+
+// readLength reads a string length or element count. One larger than what
+// is left of an in-memory record, such as a RESTORE payload, is rejected
+// before anything is allocated for it, since every byte and element takes
+// at least a byte.
+func readLength(r byteReader) (uint64, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if sized, ok := r.(interface{ Len() int }); ok && n > uint64(sized.Len()) {
+		return 0, fmt.Errorf("length %d is past the end of the value", n)
+	}
+	return n, nil
+}
+
+func readString(r byteReader) (string, error) {
+	n, err := readLength(r)
+	if err != nil {
+		return "", err
+	}
+	// Read in bounded chunks, so that a damaged length in a file fails on
+	// the missing data rather than on the allocation.
+	b := make([]byte, 0, min(n, maxValuePrealloc))
+	for uint64(len(b)) < n {
+		chunk := int(min(n-uint64(len(b)), maxValuePrealloc))
+		b = append(b, make([]byte, chunk)...)
+		if _, err := io.ReadFull(r, b[len(b)-chunk:]); err != nil {
+			return "", err
+		}
+	}
+	return string(b), nil
+}
+
+// valueTag returns the type tag of a stored value.
+func valueTag(value interface{}) (byte, error) {
+	switch value.(type) {
+	case string:
+		return valueString, nil
+	case int64:
+		return valueInt, nil
+	case *datastructures.List:
+		return valueList, nil
+	case *datastructures.Set:
+		return valueSet, nil
+	case *datastructures.SortedSet:
+		return valueZSet, nil
+	case *datastructures.Hash:
+		return valueHash, nil
+	}
+	return 0, fmt.Errorf("cannot encode value of type %T", value)
+}
+
+// appendValue encodes a stored value with its type tag.
+func appendValue(buf []byte, value interface{}) ([]byte, error) {
+	tag, err := valueTag(value)
+	if err != nil {
+		return nil, err
+	}
+	return appendValueBody(append(buf, tag), value)
+}
+
+// appendValueBody encodes a stored value without its type tag.
+// Collections are written as their length followed by their elements.
+// List, set and hash elements carry their own tags so that integers and
+// strings are told apart; sorted set scores are little endian float64s.
+func appendValueBody(buf []byte, value interface{}) ([]byte, error) {
+	var err error
+	switch v := value.(type) {
+	case string:
+		return appendString(buf, v), nil
+	case int64:
+		return binary.AppendVarint(buf, v), nil
+	case *datastructures.List:
+		elements := v.Range(0, v.Len())
+		buf = binary.AppendUvarint(buf, uint64(len(elements)))
+		for _, element := range elements {
+			if buf, err = appendValue(buf, element); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case *datastructures.Set:
+		members := v.Members()
+		buf = binary.AppendUvarint(buf, uint64(len(members)))
+		for _, member := range members {
+			if buf, err = appendValue(buf, member); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case *datastructures.SortedSet:
+		members, scores, _ := v.Scan(0, math.MaxInt32)
+		buf = binary.AppendUvarint(buf, uint64(len(members)))
+		for i, member := range members {
+			buf = appendString(buf, member)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(scores[i]))
+		}
+		return buf, nil
+	case *datastructures.Hash:
+		fields := v.HGetAll()
+		buf = binary.AppendUvarint(buf, uint64(len(fields)))
+		for field, fieldValue := range fields {
+			buf = appendString(buf, field)
+			if buf, err = appendValue(buf, fieldValue); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("cannot encode value of type %T", value)
+}
+
+// readValue decodes a value written by appendValue.
+func readValue(r byteReader) (interface{}, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return readValueBody(r, tag)
+}
+
+// readValueBody decodes a value written by appendValueBody with the given
+// type tag.
+func readValueBody(r byteReader, tag byte) (interface{}, error) {
+	switch tag {
+	case valueString:
+		return readString(r)
+	case valueInt:
+		return binary.ReadVarint(r)
+	case valueList, valueSet, valueHash, valueZSet:
+	default:
+		return nil, fmt.Errorf("unknown value type %d", tag)
+	}
+
+	n, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case valueList:
+		list := datastructures.NewList()
+		for i := uint64(0); i < n; i++ {
+			element, err := readValue(r)
+			if err != nil {
+				return nil, err
+			}
+			list.PushBack(element)
+		}
+		return list, nil
+	case valueSet:
+		set := datastructures.NewSet()
+		for i := uint64(0); i < n; i++ {
+			member, err := readValue(r)
+			if err != nil {
+				return nil, err
+			}
+			set.Add(member)
+		}
+		return set, nil
+	case valueZSet:
+		zset := datastructures.NewSortedSet()
+		var score [8]byte
+		for i := uint64(0); i < n; i++ {
+			member, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.ReadFull(r, score[:]); err != nil {
+				return nil, err
+			}
+			zset.Add(member, math.Float64frombits(binary.LittleEndian.Uint64(score[:])))
+		}
+		return zset, nil
+	default:
+		hash := datastructures.NewHash()
+		for i := uint64(0); i < n; i++ {
+			field, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			value, err := readValue(r)
+			if err != nil {
+				return nil, err
+			}
+			hash.HSet(field, value)
+		}
+		return hash, nil
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+// commandFlags describe how a command interacts with the keyspace.
+type commandFlags uint8
+
+const (
+	// cmdWrite marks commands that may modify the keyspace. They are
+	// written to the append-only log.
+	cmdWrite commandFlags = 1 << iota
+	// cmdDenyOOM marks commands that may grow memory usage. They are
+	// refused while used memory is above maxmemory and nothing can be
+	// evicted.
+	cmdDenyOOM
+	// cmdAllKeys marks commands that act on whole databases rather than
+	// on the keys in their arguments.
+	cmdAllKeys
+)
+
+type commandInfo struct {
+	flags commandFlags
+	// firstKey, lastKey and step locate the key arguments, as in the Redis
+	// command table. A negative lastKey counts from the end of the
+	// arguments; a zero firstKey means the command takes no keys.
+	firstKey, lastKey, step int
+}
+
+// commands describes every command HandleCommand accepts.
+var commands = map[string]commandInfo{
+	"SET":          {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"GET":          {0, 1, 1, 1},
+	"DEL":          {cmdWrite, 1, -1, 1},
+	"UNLINK":       {cmdWrite, 1, -1, 1},
+	"INCR":         {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"INCRBY":       {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"EXPIRE":       {cmdWrite, 1, 1, 1},
+	"PEXPIREAT":    {cmdWrite, 1, 1, 1},
+	"TTL":          {0, 1, 1, 1},
+	"EXISTS":       {0, 1, -1, 1},
+	"TOUCH":        {0, 1, -1, 1},
+	"RENAME":       {cmdWrite, 1, 2, 1},
+	"RENAMENX":     {cmdWrite, 1, 2, 1},
+	"COPY":         {cmdWrite | cmdDenyOOM, 1, 2, 1},
+	"MOVE":         {cmdWrite, 1, 1, 1},
+	"RANDOMKEY":    {},
+	"DBSIZE":       {},
+	"KEYS":         {},
+	"TYPE":         {0, 1, 1, 1},
+	"FLUSHALL":     {cmdWrite | cmdAllKeys, 0, 0, 0},
+	"FLUSHDB":      {cmdWrite | cmdAllKeys, 0, 0, 0},
+	"SELECT":       {},
+	"SWAPDB":       {cmdWrite | cmdAllKeys, 0, 0, 0},
+	"INFO":         {},
+	"OBJECT":       {0, 2, 2, 1},
+	"MEMORY":       {},
+	"BGREWRITEAOF": {},
+	"SAVE":         {},
+	"BGSAVE":       {},
+	"LASTSAVE":     {},
+	"BACKUP":       {},
+	"MSET":         {cmdWrite | cmdDenyOOM, 1, -1, 2},
+	"MGET":         {0, 1, -1, 1},
+	"SCAN":         {},
+	"HSCAN":        {0, 1, 1, 1},
+	"HGETALL":      {0, 1, 1, 1},
+	"SSCAN":        {0, 1, 1, 1},
+	"ZSCAN":        {0, 1, 1, 1},
+	"KEYRANGE":     {},
+	"KEYPREFIX":    {},
+	"SNAPSHOT":     {},
+	"DUMP":         {0, 1, 1, 1},
+	"RESTORE":      {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"SETBIT":       {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"GETBIT":       {0, 1, 1, 1},
+	"BITCOUNT":     {0, 1, 1, 1},
+	"BITPOS":       {0, 1, 1, 1},
+	"BITOP":        {cmdWrite | cmdDenyOOM, 2, -1, 1},
+	"BITFIELD":     {cmdWrite | cmdDenyOOM, 1, 1, 1},
+}
+
+// keys returns the key arguments of a command.
+func (c commandInfo) keys(args []string) []string {
+	if c.firstKey == 0 || c.firstKey >= len(args) {
+		return nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	keys := make([]string, 0, last-c.firstKey+1)
+	for i := c.firstKey; i <= last; i += c.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
@@ -0,0 +1,785 @@
+package storage
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CompactionStyle selects how an LSM tree merges its SSTables.
+type CompactionStyle int
+
+const (
+	// LeveledCompaction merges level 0 into level 1 once it holds enough
+	// tables, and each further level into the next once it outgrows its
+	// target size, so that every level but 0 is a single sorted run.
+	LeveledCompaction CompactionStyle = iota
+	// SizeTieredCompaction keeps every table in level 0 and merges runs
+	// of tables of similar size. It rewrites data less often than leveled
+	// compaction, at the cost of more tables to probe on reads.
+	SizeTieredCompaction
+)
+
+var compactionStyleNames = map[CompactionStyle]string{
+	LeveledCompaction:    "leveled",
+	SizeTieredCompaction: "size-tiered",
+}
+
+func (s CompactionStyle) String() string {
+	return compactionStyleNames[s]
+}
+
+// ParseCompactionStyle parses "leveled" or "size-tiered". An empty name
+// selects leveled compaction.
+func ParseCompactionStyle(name string) (CompactionStyle, error) {
+	if name == "" {
+		return LeveledCompaction, nil
+	}
+	for style, styleName := range compactionStyleNames {
+		if strings.EqualFold(name, styleName) {
+			return style, nil
+		}
+	}
+	return LeveledCompaction, fmt.Errorf("unknown compaction style %q", name)
+}
+
+const (
+	// A size-tiered run holds tables between tieredBucketLow and
+	// tieredBucketHigh times the average size of the run, and at most
+	// tieredMaxMerge of them are merged at once.
+	tieredBucketLow  = 0.5
+	tieredBucketHigh = 1.5
+	tieredMaxMerge   = 32
+)
+
+// LSMOptions configure how an LSM tree compacts its SSTables. Options
+// left at zero take their value from DefaultLSMOptions.
+type LSMOptions struct {
+	CompactionStyle CompactionStyle
+	// L0CompactionTrigger is the number of level 0 tables at which they
+	// are merged into level 1.
+	L0CompactionTrigger int
+	// BaseLevelSize is the target size of level 1. Each further level
+	// targets LevelSizeMultiplier times the size of the one above it.
+	BaseLevelSize       int64
+	LevelSizeMultiplier int
+	// TargetFileSize is the size at which a leveled compaction moves on
+	// to a new output table.
+	TargetFileSize int64
+	// TieredMinMerge is the number of tables of similar size a size-tiered
+	// compaction waits for before merging them.
+	TieredMinMerge int
+	// CompactionRate caps the bytes per second compactions read and
+	// write. Zero leaves them unthrottled.
+	CompactionRate int64
+	// BlockCacheSize is the byte budget of the cache of data blocks
+	// shared by the tables of the tree. A negative size disables it.
+	BlockCacheSize int64
+	// Compression is the codec data blocks of new tables are compressed
+	// with. Tables keep theirs until a compaction rewrites them.
+	Compression Compression
+}
+
+// DefaultLSMOptions returns leveled compaction with the level sizes of
+// LevelDB, scaled to the 4MB memtable.
+func DefaultLSMOptions() LSMOptions {
+	return LSMOptions{
+		CompactionStyle:     LeveledCompaction,
+		L0CompactionTrigger: 4,
+		BaseLevelSize:       64 << 20,
+		LevelSizeMultiplier: 10,
+		TargetFileSize:      8 << 20,
+		TieredMinMerge:      4,
+		BlockCacheSize:      8 << 20,
+	}
+}
+
+func (o LSMOptions) withDefaults() LSMOptions {
+	defaults := DefaultLSMOptions()
+	if o.L0CompactionTrigger <= 0 {
+		o.L0CompactionTrigger = defaults.L0CompactionTrigger
+	}
+	if o.BaseLevelSize <= 0 {
+		o.BaseLevelSize = defaults.BaseLevelSize
+	}
+	if o.LevelSizeMultiplier <= 1 {
+		o.LevelSizeMultiplier = defaults.LevelSizeMultiplier
+	}
+	if o.TargetFileSize <= 0 {
+		o.TargetFileSize = defaults.TargetFileSize
+	}
+	if o.TieredMinMerge <= 1 {
+		o.TieredMinMerge = defaults.TieredMinMerge
+	}
+	if o.BlockCacheSize == 0 {
+		o.BlockCacheSize = defaults.BlockCacheSize
+	}
+	return o
+}
+
+// levelTarget returns the target size of a level above level 0.
+func (o LSMOptions) levelTarget(level int) int64 {
+	target := o.BaseLevelSize
+	for i := 1; i < level; i++ {
+		target *= int64(o.LevelSizeMultiplier)
+	}
+	return target
+}
+
+// compaction is a merge of SSTables chosen by pickCompaction.
+type compaction struct {
+	// level is the level compacted and output the level the merged
+	// tables are written to. They are the same for size-tiered merges.
+	level, output int
+	// upper are the tables taken from level, newest first, and lower the
+	// tables of output whose key range they overlap.
+	upper, lower []*sstable
+	// bottom reports that no older table overlaps the inputs, so that
+	// tombstones and expired values can be dropped rather than copied.
+	bottom bool
+	// split is the size at which a new output table is started, zero to
+	// write a single table.
+	split int64
+	// move reports that the single upper table can be moved down a level
+	// as it is, since it overlaps nothing there.
+	move bool
+}
+
+// inputs returns every table merged, newest first.
+func (c *compaction) inputs() []*sstable {
+	return append(append([]*sstable(nil), c.upper...), c.lower...)
+}
+
+// keyRange returns the smallest and largest key of a set of tables.
+func keyRange(tables []*sstable) (string, string) {
+	smallest, largest := tables[0].smallest, tables[0].largest
+	for _, t := range tables[1:] {
+		smallest, largest = min(smallest, t.smallest), max(largest, t.largest)
+	}
+	return smallest, largest
+}
+
+// overlapping returns the tables whose key range meets [smallest, largest].
+func overlapping(tables []*sstable, smallest, largest string) []*sstable {
+	var out []*sstable
+	for _, t := range tables {
+		if t.largest >= smallest && t.smallest <= largest {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func tablesSize(tables []*sstable) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+// levelScore returns how far a level is past the point where it is
+// compacted: at 1 or more it is due.
+func (d *DiskStorage) levelScore(opts LSMOptions, level int) float64 {
+	tables := d.levels[level].tables
+	if level == 0 {
+		return float64(len(tables)) / float64(opts.L0CompactionTrigger)
+	}
+	return float64(tablesSize(tables)) / float64(opts.levelTarget(level))
+}
+
+// pickCompaction returns the compaction to run next, or nil if no level
+// needs one.
+func (d *DiskStorage) pickCompaction(opts LSMOptions) *compaction {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if opts.CompactionStyle == SizeTieredCompaction {
+		return d.pickTiered(opts)
+	}
+
+	best, bestScore := -1, 0.0
+	for level := 0; level < len(d.levels)-1; level++ {
+		if score := d.levelScore(opts, level); score >= 1 && score > bestScore {
+			best, bestScore = level, score
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	c := &compaction{level: best, output: best + 1, split: opts.TargetFileSize}
+	if best == 0 {
+		c.upper = append([]*sstable(nil), d.levels[0].tables...)
+	} else {
+		// Take the tables of a level in turn, so that every key range
+		// gets merged down.
+		tables := d.levels[best].tables
+		i := sort.Search(len(tables), func(i int) bool {
+			return tables[i].smallest > d.compactPointers[best]
+		})
+		if i == len(tables) {
+			i = 0
+		}
+		c.upper = []*sstable{tables[i]}
+		d.compactPointers[best] = tables[i].largest
+	}
+	smallest, largest := keyRange(c.upper)
+	c.lower = overlapping(d.levels[c.output].tables, smallest, largest)
+	c.bottom = !d.overlapsBelow(c.output, c.inputs())
+	c.move = best > 0 && len(c.lower) == 0 && !c.bottom
+	return c
+}
+
+// pickTiered returns a size-tiered merge of the oldest run of at least
+// TieredMinMerge level 0 tables of similar size, or nil if there is none.
+// Runs are made of tables adjacent in age, so that the merged table can
+// take their place without reordering any version of a key.
+func (d *DiskStorage) pickTiered(opts LSMOptions) *compaction {
+	tables := d.levels[0].tables
+	for end := len(tables); end > 0; {
+		start := end - 1
+		total := tables[start].size
+		for start > 0 && end-start < tieredMaxMerge {
+			avg := float64(total) / float64(end-start)
+			size := float64(tables[start-1].size)
+			if size < avg*tieredBucketLow || size > avg*tieredBucketHigh {
+				break
+			}
+			start--
+			total += tables[start].size
+		}
+		if end-start >= opts.TieredMinMerge {
+			c := &compaction{upper: append([]*sstable(nil), tables[start:end]...)}
+			c.bottom = end == len(tables) && !d.overlapsBelow(0, c.upper)
+			return c
+		}
+		end = start
+	}
+	return nil
+}
+
+// overlapsBelow reports whether a table in a level after level overlaps
+// the key range of tables. The caller must hold d.mu.
+func (d *DiskStorage) overlapsBelow(level int, tables []*sstable) bool {
+	smallest, largest := keyRange(tables)
+	for _, l := range d.levels[level+1:] {
+		if len(overlapping(l.tables, smallest, largest)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// install replaces the inputs of a compaction with its outputs and
+// records the change in the manifest. Inputs that are no longer listed
+// are closed and deleted once no read is using them.
+func (d *DiskStorage) install(c *compaction, outputs []*sstable) error {
+	d.mu.Lock()
+	previous := make([][]*sstable, len(d.levels))
+	for i, level := range d.levels {
+		previous[i] = level.tables
+	}
+
+	removed := make(map[*sstable]bool)
+	for _, t := range c.inputs() {
+		removed[t] = true
+	}
+	without := func(tables []*sstable) []*sstable {
+		var kept []*sstable
+		for _, t := range tables {
+			if !removed[t] {
+				kept = append(kept, t)
+			}
+		}
+		return kept
+	}
+
+	if c.level == c.output {
+		// A size-tiered run is still contiguous, as flushes only add
+		// tables in front of it.
+		tables := d.levels[0].tables
+		i := 0
+		for tables[i] != c.upper[0] {
+			i++
+		}
+		merged := append(append([]*sstable(nil), tables[:i]...), outputs...)
+		d.levels[0].tables = append(merged, tables[i+len(c.upper):]...)
+	} else {
+		d.levels[c.level].tables = without(d.levels[c.level].tables)
+		lower := append(without(d.levels[c.output].tables), outputs...)
+		sort.Slice(lower, func(i, j int) bool {
+			return lower[i].smallest < lower[j].smallest
+		})
+		d.levels[c.output].tables = lower
+	}
+
+	if err := d.writeManifest(); err != nil {
+		for i, tables := range previous {
+			d.levels[i].tables = tables
+		}
+		d.mu.Unlock()
+		return err
+	}
+	d.mu.Unlock()
+
+	if !c.move {
+		d.release(c.inputs())
+	}
+	return nil
+}
+
+// release closes and deletes tables that are no longer listed, or leaves
+// that to unpin for those a view still pins.
+func (d *DiskStorage) release(tables []*sstable) {
+	d.mu.Lock()
+	var unused []*sstable
+	for _, t := range tables {
+		t.obsolete = true
+		if t.refs == 0 {
+			unused = append(unused, t)
+		}
+	}
+	d.mu.Unlock()
+	d.closeTables(unused)
+}
+
+// closeTables closes and deletes tables once no lookup is using them.
+func (d *DiskStorage) closeTables(tables []*sstable) {
+	if len(tables) == 0 {
+		return
+	}
+	d.inUse.Lock()
+	for _, t := range tables {
+		t.file.Close()
+	}
+	d.inUse.Unlock()
+	if d.cache != nil {
+		for _, t := range tables {
+			d.cache.evictTable(t.id, len(t.blocks))
+		}
+	}
+	for _, t := range tables {
+		os.Remove(t.path)
+	}
+}
+
+// mergeSource is an input of a compaction. Sources are ranked by age, so
+// that of two versions of a key the one of the lowest rank is kept.
+type mergeSource struct {
+	it   *sstableIterator
+	rank int
+}
+
+// mergeHeap orders sources by their current key, then by rank.
+type mergeHeap []mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].it.key != h[j].it.key {
+		return h[i].it.key < h[j].it.key
+	}
+	return h[i].rank < h[j].rank
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// compactionResult counts what a compaction read, wrote and dropped.
+type compactionResult struct {
+	bytesRead, bytesWritten int64
+	droppedVersions         int64
+	droppedTombstones       int64
+	droppedExpired          int64
+}
+
+// compact merges the inputs of c into new tables. Only the newest version
+// of each key is kept, and at the bottom tombstones and expired values are
+// dropped as there is nothing left for them to hide.
+func (d *DiskStorage) compact(c *compaction, limiter *rateLimiter) ([]*sstable, compactionResult, error) {
+	var (
+		outputs []*sstable
+		result  compactionResult
+		w       *sstableWriter
+		num     int
+	)
+	fail := func(err error) ([]*sstable, compactionResult, error) {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			t.file.Close()
+			os.Remove(t.path)
+		}
+		return nil, result, err
+	}
+	finish := func() error {
+		path := w.file.Name()
+		err := w.finish()
+		w = nil
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+		t, err := d.openTable(path, num)
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+		outputs = append(outputs, t)
+		result.bytesWritten += t.size
+		return nil
+	}
+
+	h := &mergeHeap{}
+	for rank, t := range c.inputs() {
+		result.bytesRead += t.size
+		it := t.iterator(limiter)
+		if it.advance() {
+			*h = append(*h, mergeSource{it: it, rank: rank})
+		} else if it.err != nil {
+			return fail(it.err)
+		}
+	}
+	heap.Init(h)
+
+	nowMs := time.Now().UnixMilli()
+	for h.Len() > 0 {
+		newest := (*h)[0].it
+		key, kind, body := newest.key, newest.kind, newest.body
+
+		// Move every source past key, dropping the older versions.
+		for h.Len() > 0 && (*h)[0].it.key == key {
+			it := (*h)[0].it
+			if it != newest {
+				result.droppedVersions++
+			}
+			if it.advance() {
+				heap.Fix(h, 0)
+			} else {
+				if it.err != nil {
+					return fail(it.err)
+				}
+				heap.Pop(h)
+			}
+		}
+
+		if c.bottom && kind == sstableTombstone {
+			result.droppedTombstones++
+			continue
+		}
+		if c.bottom && kind == sstableValue {
+			if expireMs := sstableExpireAt(body); expireMs != 0 && expireMs <= nowMs {
+				result.droppedExpired++
+				continue
+			}
+		}
+
+		if w == nil {
+			var path string
+			var err error
+			path, num = d.newTablePath()
+			if w, err = newSSTableWriter(path, d.compression); err != nil {
+				return fail(err)
+			}
+			w.limiter = limiter
+		}
+		if err := w.addRecord(key, kind, body); err != nil {
+			return fail(err)
+		}
+		if c.split > 0 && w.size() >= c.split {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	return outputs, result, nil
+}
+
+// compactLoop runs compactions whenever a flush or the opening of the tree
+// may have made one due, until the tree is closed.
+func (l *LSMTree) compactLoop() {
+	defer close(l.compactDone)
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.compactc:
+		}
+		for {
+			c := l.disk.pickCompaction(l.opts)
+			if c == nil || l.runCompaction(c) != nil {
+				break
+			}
+		}
+	}
+}
+
+// runCompaction runs and installs a compaction and records its outcome.
+func (l *LSMTree) runCompaction(c *compaction) error {
+	l.statsMu.Lock()
+	l.stats.running = true
+	l.statsMu.Unlock()
+
+	start := time.Now()
+	var (
+		outputs []*sstable
+		result  compactionResult
+		err     error
+	)
+	if c.move {
+		outputs = c.upper
+	} else {
+		outputs, result, err = l.disk.compact(c, l.limiter)
+	}
+	if err == nil {
+		if err = l.disk.install(c, outputs); err != nil && !c.move {
+			for _, t := range outputs {
+				t.file.Close()
+				os.Remove(t.path)
+			}
+		}
+	}
+
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+	l.stats.running = false
+	if err == ErrLSMClosed {
+		return err
+	}
+	l.stats.lastErr = err
+	l.stats.lastDuration = time.Since(start)
+	if err != nil {
+		return err
+	}
+	l.stats.compactions++
+	if c.move {
+		l.stats.moves++
+	}
+	l.stats.bytesRead += result.bytesRead
+	l.stats.bytesWritten += result.bytesWritten
+	l.stats.droppedVersions += result.droppedVersions
+	l.stats.droppedTombstones += result.droppedTombstones
+	l.stats.droppedExpired += result.droppedExpired
+	return nil
+}
+
+// rateLimiter paces compaction I/O to rate bytes per second, or not at all
+// if rate is zero. Waits fail with ErrLSMClosed once stop is closed, which
+// makes a compaction in progress give up.
+type rateLimiter struct {
+	rate int64
+	stop <-chan struct{}
+	mu   sync.Mutex
+	// next is when the bytes granted so far will have been paid for.
+	next time.Time
+}
+
+// wait blocks until n more bytes may be read or written.
+func (r *rateLimiter) wait(n int) error {
+	var delay time.Duration
+	if r.rate > 0 {
+		r.mu.Lock()
+		now := time.Now()
+		if r.next.Before(now) {
+			r.next = now
+		}
+		delay = r.next.Sub(now)
+		r.next = r.next.Add(time.Duration(int64(n) * int64(time.Second) / r.rate))
+		r.mu.Unlock()
+	}
+	if delay <= 0 {
+		select {
+		case <-r.stop:
+			return ErrLSMClosed
+		default:
+			return nil
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-r.stop:
+		return ErrLSMClosed
+	case <-timer.C:
+		return nil
+	}
+}
+
+// compactionStats are the totals reported by LSMTree.Stats.
+type compactionStats struct {
+	running           bool
+	compactions       int64
+	moves             int64
+	bytesRead         int64
+	bytesWritten      int64
+	droppedVersions   int64
+	droppedTombstones int64
+	droppedExpired    int64
+	lastErr           error
+	lastDuration      time.Duration
+}
+
+// LevelStats describe the SSTables of one level.
+type LevelStats struct {
+	Tables int
+	Bytes  int64
+	// Score is how far the level is past the point where it is compacted:
+	// at 1 or more it is due.
+	Score float64
+}
+
+// LSMStats describe the state of an LSM tree and the compactions it has
+// run since it was opened.
+type LSMStats struct {
+	CompactionStyle    CompactionStyle
+	MemTableBytes      int64
+	ImmutableMemTables int
+	Levels             []LevelStats
+
+	Compacting bool
+	// Compactions counts the compactions that finished, including
+	// Moves, which moved a table down a level without rewriting it.
+	Compactions            int64
+	Moves                  int64
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	// DroppedVersions counts the versions of keys left out because a
+	// newer one was kept, and DroppedTombstones and DroppedExpired the
+	// tombstones and expired values dropped at the bottom of the tree.
+	DroppedVersions    int64
+	DroppedTombstones  int64
+	DroppedExpired     int64
+	LastCompactionErr  error
+	LastCompactionTime time.Duration
+
+	// BlockCacheSize is the budget of the block cache, zero if disabled,
+	// and BlockCacheUsed the bytes it holds.
+	BlockCacheSize      int64
+	BlockCacheUsed      int64
+	BlockCacheHits      int64
+	BlockCacheMisses    int64
+	BlockCacheEvictions int64
+	// BloomChecks counts the tables whose Bloom filter lookups consulted,
+	// BloomNegatives those skipped without reading a block and
+	// BloomFalsePositives those read in vain.
+	BloomChecks         int64
+	BloomNegatives      int64
+	BloomFalsePositives int64
+}
+
+// Stats returns the current state of the tree.
+func (l *LSMTree) Stats() LSMStats {
+	l.mutex.RLock()
+	stats := LSMStats{
+		CompactionStyle:    l.opts.CompactionStyle,
+		MemTableBytes:      l.memSize,
+		ImmutableMemTables: len(l.immutables),
+	}
+	l.mutex.RUnlock()
+
+	l.disk.mu.RLock()
+	for i, level := range l.disk.levels {
+		stats.Levels = append(stats.Levels, LevelStats{
+			Tables: len(level.tables),
+			Bytes:  tablesSize(level.tables),
+			Score:  l.disk.levelScore(l.opts, i),
+		})
+	}
+	l.disk.mu.RUnlock()
+
+	l.statsMu.Lock()
+	s := l.stats
+	l.statsMu.Unlock()
+	stats.Compacting = s.running
+	stats.Compactions, stats.Moves = s.compactions, s.moves
+	stats.CompactionBytesRead, stats.CompactionBytesWritten = s.bytesRead, s.bytesWritten
+	stats.DroppedVersions = s.droppedVersions
+	stats.DroppedTombstones, stats.DroppedExpired = s.droppedTombstones, s.droppedExpired
+	stats.LastCompactionErr, stats.LastCompactionTime = s.lastErr, s.lastDuration
+
+	if c := l.disk.cache; c != nil {
+		stats.BlockCacheSize, stats.BlockCacheUsed = c.capacity, c.usage()
+		stats.BlockCacheHits, stats.BlockCacheMisses = c.hits.Load(), c.misses.Load()
+		stats.BlockCacheEvictions = c.evictions.Load()
+	}
+	stats.BloomChecks = l.disk.bloomChecks.Load()
+	stats.BloomNegatives = l.disk.bloomNegatives.Load()
+	stats.BloomFalsePositives = l.disk.bloomFalsePositives.Load()
+	return stats
+}
+
+// EnableLSM reports the state of an LSM tree in the lsm section of INFO.
+func (h *CommandHandler) EnableLSM(l *LSMTree) {
+	h.lsm = l
+}
+
+// infoLSM renders the lsm section of INFO.
+func (h *CommandHandler) infoLSM() string {
+	var b strings.Builder
+	b.WriteString("# LSM\r\n")
+	if h.lsm == nil {
+		b.WriteString("lsm_enabled:0\r\n")
+		return b.String()
+	}
+	stats := h.lsm.Stats()
+	compacting, status := 0, "ok"
+	if stats.Compacting {
+		compacting = 1
+	}
+	if stats.LastCompactionErr != nil {
+		status = "err"
+	}
+	b.WriteString("lsm_enabled:1\r\n")
+	fmt.Fprintf(&b, "lsm_compaction_style:%s\r\n", stats.CompactionStyle)
+	fmt.Fprintf(&b, "lsm_memtable_bytes:%d\r\n", stats.MemTableBytes)
+	fmt.Fprintf(&b, "lsm_immutable_memtables:%d\r\n", stats.ImmutableMemTables)
+	fmt.Fprintf(&b, "lsm_compaction_in_progress:%d\r\n", compacting)
+	fmt.Fprintf(&b, "lsm_compactions:%d\r\n", stats.Compactions)
+	fmt.Fprintf(&b, "lsm_compaction_moves:%d\r\n", stats.Moves)
+	fmt.Fprintf(&b, "lsm_compaction_bytes_read:%d\r\n", stats.CompactionBytesRead)
+	fmt.Fprintf(&b, "lsm_compaction_bytes_written:%d\r\n", stats.CompactionBytesWritten)
+	fmt.Fprintf(&b, "lsm_compaction_dropped_versions:%d\r\n", stats.DroppedVersions)
+	fmt.Fprintf(&b, "lsm_compaction_dropped_tombstones:%d\r\n", stats.DroppedTombstones)
+	fmt.Fprintf(&b, "lsm_compaction_dropped_expired:%d\r\n", stats.DroppedExpired)
+	fmt.Fprintf(&b, "lsm_last_compaction_status:%s\r\n", status)
+	fmt.Fprintf(&b, "lsm_last_compaction_time_ms:%d\r\n", stats.LastCompactionTime.Milliseconds())
+	fmt.Fprintf(&b, "lsm_block_cache_size:%d\r\n", stats.BlockCacheSize)
+	fmt.Fprintf(&b, "lsm_block_cache_used:%d\r\n", stats.BlockCacheUsed)
+	fmt.Fprintf(&b, "lsm_block_cache_hits:%d\r\n", stats.BlockCacheHits)
+	fmt.Fprintf(&b, "lsm_block_cache_misses:%d\r\n", stats.BlockCacheMisses)
+	fmt.Fprintf(&b, "lsm_block_cache_hit_rate:%.4f\r\n", ratio(stats.BlockCacheHits, stats.BlockCacheHits+stats.BlockCacheMisses))
+	fmt.Fprintf(&b, "lsm_block_cache_evictions:%d\r\n", stats.BlockCacheEvictions)
+	fmt.Fprintf(&b, "lsm_bloom_filter_checks:%d\r\n", stats.BloomChecks)
+	fmt.Fprintf(&b, "lsm_bloom_filter_negatives:%d\r\n", stats.BloomNegatives)
+	fmt.Fprintf(&b, "lsm_bloom_filter_false_positives:%d\r\n", stats.BloomFalsePositives)
+	for i, level := range stats.Levels {
+		if level.Tables == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "lsm_level%d:tables=%d,bytes=%d,score=%.2f\r\n", i, level.Tables, level.Bytes, level.Score)
+	}
+	return b.String()
+}
+
+// ratio returns n/total, or 0 if total is 0.
+func ratio(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLSMOptions makes a tree compact after a few small flushes.
+func testLSMOptions(style CompactionStyle) LSMOptions {
+	return LSMOptions{
+		CompactionStyle:     style,
+		L0CompactionTrigger: 2,
+		BaseLevelSize:       32 << 10,
+		LevelSizeMultiplier: 4,
+		TargetFileSize:      8 << 10,
+		TieredMinMerge:      2,
+	}
+}
+
+func openTestLSM(t *testing.T, dir string, opts LSMOptions) *LSMTree {
+	t.Helper()
+	l, err := NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// writeLSM writes keys [from, to) with values tagged by round, one flushed
+// table per 100 keys.
+func writeLSM(t *testing.T, l *LSMTree, from, to, round int) {
+	t.Helper()
+	for start := from; start < to; start += 100 {
+		var b Batch
+		for i := start; i < min(start+100, to); i++ {
+			b.Set(fmt.Sprintf("key:%05d", i), fmt.Sprintf("round %d %s", round, strings.Repeat("x", 64)), time.Time{})
+		}
+		if err := l.Apply(&b); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitCompactions waits until the tree has stopped compacting and, for
+// leveled compaction, no level is due for one.
+func waitCompactions(t *testing.T, l *LSMTree) LSMStats {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	last := l.Stats()
+	for {
+		time.Sleep(20 * time.Millisecond)
+		stats := l.Stats()
+		due := false
+		for _, level := range stats.Levels[:len(stats.Levels)-1] {
+			due = due || (stats.CompactionStyle == LeveledCompaction && level.Score >= 1)
+		}
+		if !due && !stats.Compacting && stats.Compactions == last.Compactions {
+			if stats.LastCompactionErr != nil {
+				t.Fatal(stats.LastCompactionErr)
+			}
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("compactions did not finish")
+		}
+		last = stats
+	}
+}
+
+// versions returns the levels holding a version of key, and whether each
+// is a tombstone.
+func versions(t *testing.T, l *LSMTree, key string) map[int]bool {
+	t.Helper()
+	l.disk.mu.RLock()
+	defer l.disk.mu.RUnlock()
+	found := make(map[int]bool)
+	for i, level := range l.disk.levels {
+		for _, table := range level.tables {
+			if e, ok, err := table.get(key); err != nil {
+				t.Fatal(err)
+			} else if ok {
+				found[i] = found[i] || e.deleted
+			}
+		}
+	}
+	return found
+}
+
+func TestLSMTombstonesAcrossLevels(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir, testLSMOptions(LeveledCompaction))
+	writeLSM(t, l, 0, 3000, 1)
+	waitCompactions(t, l)
+
+	// Delete every third key, then add enough new keys for the tombstones
+	// to be compacted into level 1 while their values sit further down.
+	var b Batch
+	for i := 0; i < 3000; i += 3 {
+		b.Delete(fmt.Sprintf("key:%05d", i))
+	}
+	if err := l.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writeLSM(t, l, 3000, 3200, 2)
+	waitCompactions(t, l)
+
+	shadowed := 0
+	for i := 0; i < 3000; i += 3 {
+		found := versions(t, l, fmt.Sprintf("key:%05d", i))
+		for level, tombstone := range found {
+			for deeper, deeperTombstone := range found {
+				if tombstone && !deeperTombstone && deeper > level {
+					shadowed++
+				}
+			}
+		}
+	}
+	if shadowed == 0 {
+		t.Fatal("no tombstone hides a value in a lower level; the test needs more data")
+	}
+
+	check := func(l *LSMTree) {
+		t.Helper()
+		for i := 0; i < 3200; i++ {
+			key := fmt.Sprintf("key:%05d", i)
+			_, _, ok, err := l.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := i >= 3000 || i%3 != 0; ok != want {
+				t.Fatalf("%s found = %v, want %v", key, ok, want)
+			}
+		}
+	}
+	check(l)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(openTestLSM(t, dir, testLSMOptions(LeveledCompaction)))
+}
+
+// TestLSMBottomDropsTombstones merges a table and the tombstones of all its
+// keys into an empty level 1, where the tombstones have nothing to hide.
+func TestLSMBottomDropsTombstones(t *testing.T) {
+	l := openTestLSM(t, t.TempDir(), testLSMOptions(LeveledCompaction))
+	writeLSM(t, l, 0, 100, 1)
+	var b Batch
+	for i := 0; i < 100; i++ {
+		b.Delete(fmt.Sprintf("key:%05d", i))
+	}
+	if err := l.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stats := waitCompactions(t, l)
+	if stats.DroppedTombstones != 100 || stats.DroppedVersions != 100 {
+		t.Errorf("dropped %d tombstones and %d versions, want 100 of each", stats.DroppedTombstones, stats.DroppedVersions)
+	}
+	if n := stats.Levels[0].Tables + stats.Levels[1].Tables; n != 0 {
+		t.Errorf("%d tables are left", n)
+	}
+	if _, _, ok, _ := l.Get("key:00042"); ok {
+		t.Error("deleted key is visible")
+	}
+}
+
+func TestCompactionStyles(t *testing.T) {
+	for _, style := range []CompactionStyle{LeveledCompaction, SizeTieredCompaction} {
+		t.Run(style.String(), func(t *testing.T) {
+			l := openTestLSM(t, t.TempDir(), testLSMOptions(style))
+			for round := 1; round <= 3; round++ {
+				writeLSM(t, l, 0, 1500, round)
+			}
+			stats := waitCompactions(t, l)
+			if stats.Compactions == 0 {
+				t.Fatal("no compactions ran")
+			}
+
+			l.disk.mu.RLock()
+			levels := make([][]*sstable, len(l.disk.levels))
+			for i, level := range l.disk.levels {
+				levels[i] = level.tables
+			}
+			l.disk.mu.RUnlock()
+			switch style {
+			case LeveledCompaction:
+				if len(levels[0]) >= 2 {
+					t.Errorf("level 0 kept %d tables", len(levels[0]))
+				}
+				deepest := 0
+				for i, tables := range levels[1:] {
+					for j := 1; j < len(tables); j++ {
+						if tables[j-1].largest >= tables[j].smallest {
+							t.Errorf("level %d tables %d and %d overlap", i+1, j-1, j)
+						}
+					}
+					for _, table := range tables {
+						if table.size > 4*testLSMOptions(style).TargetFileSize {
+							t.Errorf("level %d table of %d bytes was not split", i+1, table.size)
+						}
+					}
+					if len(tables) > 0 {
+						deepest = i + 1
+					}
+				}
+				if deepest < 2 {
+					t.Errorf("data only reached level %d", deepest)
+				}
+			case SizeTieredCompaction:
+				for i, tables := range levels[1:] {
+					if len(tables) > 0 {
+						t.Errorf("level %d holds %d tables", i+1, len(tables))
+					}
+				}
+				if n := len(levels[0]); n == 0 || n >= 45 {
+					t.Errorf("level 0 holds %d tables after 45 flushes", n)
+				}
+				if stats.Moves != 0 {
+					t.Errorf("size-tiered compaction moved %d tables", stats.Moves)
+				}
+			}
+
+			for i := 0; i < 1500; i += 37 {
+				value, _, ok, err := l.Get(fmt.Sprintf("key:%05d", i))
+				if err != nil || !ok || !strings.HasPrefix(value.(string), "round 3 ") {
+					t.Fatalf("key:%05d = %v, %v, %v", i, value, ok, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects the codec that SSTable blocks and snapshot files are
+// compressed with.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	// CompressionSnappy is the Snappy block format: byte-aligned LZ77
+	// that is cheap to compress and very cheap to decompress.
+	CompressionSnappy
+	// CompressionDeflate is DEFLATE at its best compression. It is kept
+	// so that blocks written with it can still be read.
+	CompressionDeflate
+	// CompressionZstd is Zstandard at its default level, for data that is
+	// written once and read rarely: it compresses close to DEFLATE's best
+	// and decompresses several times faster.
+	CompressionZstd
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone:    "none",
+	CompressionSnappy:  "snappy",
+	CompressionDeflate: "deflate",
+	CompressionZstd:    "zstd",
+}
+
+func (c Compression) String() string {
+	return compressionNames[c]
+}
+
+// ParseCompression parses "none", "snappy", "zstd" or "deflate". An empty name
+// selects none.
+func ParseCompression(name string) (Compression, error) {
+	if name == "" {
+		return CompressionNone, nil
+	}
+	for c, cName := range compressionNames {
+		if strings.EqualFold(name, cName) {
+			return c, nil
+		}
+	}
+	return CompressionNone, fmt.Errorf("unknown compression %q", name)
+}
+
+// ErrChecksum is wrapped by the errors returned for blocks whose contents
+// do not match their checksum.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// A compressed block is framed as the codec byte, the payload and the
+// CRC32C of the codec byte and payload as a little endian uint32. Blocks
+// that do not shrink by at least an eighth are stored with CompressionNone.
+const blockTrailerLen = 4
+
+// appendBlock appends block compressed with codec and framed.
+func appendBlock(buf []byte, codec Compression, block []byte) []byte {
+	start := len(buf)
+	buf = append(buf, byte(codec))
+	switch codec {
+	case CompressionSnappy:
+		buf = snappyEncode(buf, block)
+	case CompressionDeflate:
+		buf = deflateEncode(buf, block)
+	case CompressionZstd:
+		buf = zstdEncode(buf, block)
+	default:
+		buf = append(buf, block...)
+	}
+	if codec != CompressionNone && len(buf)-start-1 > len(block)-len(block)/8 {
+		buf = append(buf[:start], byte(CompressionNone))
+		buf = append(buf, block...)
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf[start:], crc32c))
+}
+
+// readFramedBlock checks the checksum of a framed block and returns its
+// decompressed contents.
+func readFramedBlock(frame []byte) ([]byte, error) {
+	if len(frame) < 1+blockTrailerLen {
+		return nil, fmt.Errorf("block of %d bytes is too short", len(frame))
+	}
+	body := frame[:len(frame)-blockTrailerLen]
+	if crc32.Checksum(body, crc32c) != binary.LittleEndian.Uint32(frame[len(body):]) {
+		return nil, ErrChecksum
+	}
+	payload := body[1:]
+	switch Compression(body[0]) {
+	case CompressionNone:
+		return payload, nil
+	case CompressionSnappy:
+		return snappyDecode(payload)
+	case CompressionDeflate:
+		return deflateDecode(payload)
+	case CompressionZstd:
+		return zstdDecode(payload)
+	}
+	return nil, fmt.Errorf("unknown compression %d", body[0])
+}
+
+var deflateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestCompression)
+		return w
+	},
+}
+
+func deflateEncode(dst, src []byte) []byte {
+	b := bytes.NewBuffer(dst)
+	w := deflateWriters.Get().(*flate.Writer)
+	w.Reset(b)
+	w.Write(src)
+	w.Close()
+	deflateWriters.Put(w)
+	return b.Bytes()
+}
+
+func deflateDecode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll calls, so one of each serves every block.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// zstdEncode appends src as a single zstd frame.
+func zstdEncode(dst, src []byte) []byte {
+	enc, _ := zstdCodec()
+	return enc.EncodeAll(src, dst)
+}
+
+func zstdDecode(src []byte) ([]byte, error) {
+	_, dec := zstdCodec()
+	return dec.DecodeAll(src, nil)
+}
+
+// snappyEncode appends the Snappy encoding of src: its length as a uvarint
+// followed by literal and copy elements.
+func snappyEncode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	if len(src) < 16 {
+		return snappyLiteral(dst, src)
+	}
+
+	const tableBits = 14
+	var table [1 << tableBits]int32
+	hash := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(src[i:]) * 0x1e35a7bd >> (32 - tableBits)
+	}
+
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		h := hash(i)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > 0xffff ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyLiteral(dst, src[literal:i])
+		dst = snappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return snappyLiteral(dst, src[literal:])
+}
+
+// snappyLiteral appends a literal element holding lit.
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	switch n := len(lit) - 1; {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy appends copy elements repeating length bytes from offset
+// bytes back, which must be less than 65536.
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
+
+var errSnappyCorrupt = errors.New("corrupt snappy block")
+
+// snappyDecode decodes a Snappy block.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, read := binary.Uvarint(src)
+	if read <= 0 || n > uint64(len(src))*256 {
+		return nil, errSnappyCorrupt
+	}
+	dst := make([]byte, 0, n)
+	for s := read; s < len(src); {
+		tag := src[s]
+		s++
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			if length >= 60 {
+				extra := length - 59
+				if s+extra > len(src) {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for j := extra - 1; j >= 0; j-- {
+					length = length<<8 | int(src[s+j])
+				}
+				s += extra
+			}
+			length++
+			if length > len(src)-s {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case 1:
+			if s >= len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[s])
+			s++
+		case 2:
+			if s+2 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s:]))
+			s += 2
+		case 3:
+			if s+4 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s:]))
+			s += 4
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errSnappyCorrupt
+		}
+		for from := len(dst) - offset; length > 0; length-- {
+			dst = append(dst, dst[from])
+			from++
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
+
+// streamBlockSize is the amount of data a blockWriter compresses at once.
+const streamBlockSize = 64 << 10
+
+// blockWriter cuts a stream into framed blocks, each preceded by its
+// framed length as a little endian uint32. Close writes the last block and
+// a zero length that ends the stream.
+type blockWriter struct {
+	w     io.Writer
+	codec Compression
+	buf   []byte
+	frame []byte
+}
+
+func newBlockWriter(w io.Writer, codec Compression) *blockWriter {
+	return &blockWriter{w: w, codec: codec, buf: make([]byte, 0, streamBlockSize)}
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), streamBlockSize-len(b.buf))
+		b.buf = append(b.buf, p[:take]...)
+		p = p[take:]
+		if len(b.buf) == streamBlockSize {
+			if err := b.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (b *blockWriter) flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	b.frame = appendBlock(append(b.frame[:0], 0, 0, 0, 0), b.codec, b.buf)
+	binary.LittleEndian.PutUint32(b.frame, uint32(len(b.frame)-4))
+	b.buf = b.buf[:0]
+	_, err := b.w.Write(b.frame)
+	return err
+}
+
+func (b *blockWriter) Close() error {
+	if err := b.flush(); err != nil {
+		return err
+	}
+	_, err := b.w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// blockReader reads back the stream written by a blockWriter, checking
+// every block. offset is the position in the file of the next frame, by
+// which errors locate the damaged block.
+type blockReader struct {
+	r      io.Reader
+	offset int64
+	block  []byte
+	done   bool
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	for len(b.block) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		if err := b.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.block)
+	b.block = b.block[n:]
+	return n, nil
+}
+
+func (b *blockReader) next() error {
+	var header [4]byte
+	if _, err := io.ReadFull(b.r, header[:]); err != nil {
+		return &blockError{offset: b.offset, err: io.ErrUnexpectedEOF}
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size == 0 {
+		b.done = true
+		return nil
+	}
+	if size > 2*streamBlockSize {
+		return &blockError{offset: b.offset, err: fmt.Errorf("invalid length %d", size)}
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(b.r, frame); err != nil {
+		return &blockError{offset: b.offset, err: io.ErrUnexpectedEOF}
+	}
+	block, err := readFramedBlock(frame)
+	if err != nil {
+		return &blockError{offset: b.offset, err: err}
+	}
+	b.offset += 4 + int64(size)
+	b.block = block
+	return nil
+}
+
+// blockError reports a damaged block of a stream and where it starts.
+type blockError struct {
+	offset int64
+	err    error
+}
+
+func (e *blockError) Error() string {
+	return fmt.Sprintf("block at offset %d: %v", e.offset, e.err)
+}
+
+func (e *blockError) Unwrap() error {
+	return e.err
+}
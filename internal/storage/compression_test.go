@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var codecs = []Compression{CompressionNone, CompressionSnappy, CompressionDeflate, CompressionZstd}
+
+func TestParseCompression(t *testing.T) {
+	for _, codec := range codecs {
+		got, err := ParseCompression(strings.ToUpper(codec.String()))
+		if err != nil || got != codec {
+			t.Errorf("ParseCompression(%q) = %v, %v, want %v", codec, got, err, codec)
+		}
+	}
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Error("ParseCompression(lz4) succeeded")
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	random := make([]byte, 8<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	blocks := map[string][]byte{
+		"empty":        nil,
+		"short":        []byte("abc"),
+		"compressible": bytes.Repeat([]byte("key:0001 value value value "), 400),
+		"random":       random,
+	}
+	for _, codec := range codecs {
+		for name, block := range blocks {
+			t.Run(codec.String()+"/"+name, func(t *testing.T) {
+				frame := appendBlock(nil, codec, block)
+				got, err := readFramedBlock(frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, block) {
+					t.Fatalf("read %d bytes back, want %d", len(got), len(block))
+				}
+				if name == "compressible" && codec != CompressionNone && Compression(frame[0]) != codec {
+					t.Errorf("compressible block stored with %v", Compression(frame[0]))
+				}
+				if name == "random" && Compression(frame[0]) != CompressionNone {
+					t.Errorf("incompressible block stored with %v", Compression(frame[0]))
+				}
+			})
+		}
+	}
+}
+
+func TestZstdBlocksAreZstdFrames(t *testing.T) {
+	frame := appendBlock(nil, CompressionZstd, bytes.Repeat([]byte("redix "), 1000))
+	if Compression(frame[0]) != CompressionZstd {
+		t.Fatalf("block stored with %v", Compression(frame[0]))
+	}
+	if magic := []byte{0x28, 0xb5, 0x2f, 0xfd}; !bytes.HasPrefix(frame[1:], magic) {
+		t.Fatalf("payload starts with % x, want the zstd magic number", frame[1:5])
+	}
+}
+
+func TestBlockChecksum(t *testing.T) {
+	for _, codec := range codecs {
+		frame := appendBlock(nil, codec, bytes.Repeat([]byte("checksummed "), 100))
+		for _, i := range []int{0, 1, len(frame) / 2, len(frame) - 1} {
+			damaged := append([]byte(nil), frame...)
+			damaged[i] ^= 0x40
+			if _, err := readFramedBlock(damaged); !errors.Is(err, ErrChecksum) {
+				t.Errorf("%v: flipping byte %d returned %v, want %v", codec, i, err, ErrChecksum)
+			}
+		}
+		if _, err := readFramedBlock(frame[:3]); err == nil {
+			t.Errorf("%v: short block read without error", codec)
+		}
+	}
+}
+
+func TestSSTableCodecs(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(codec.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "table.sst")
+			w, err := newSSTableWriter(path, codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2000; i++ {
+				if err := w.add(fmt.Sprintf("key:%05d", i), lsmEntry{value: strings.Repeat("v", i%50)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.finish(); err != nil {
+				t.Fatal(err)
+			}
+
+			table, err := openSSTable(path, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer table.file.Close()
+			if len(table.blocks) < 2 {
+				t.Fatalf("table has %d blocks, want several", len(table.blocks))
+			}
+			for _, i := range []int{0, 999, 1999} {
+				e, ok, err := table.get(fmt.Sprintf("key:%05d", i))
+				if err != nil || !ok {
+					t.Fatalf("get key:%05d = %v, %v", i, ok, err)
+				}
+				if want := strings.Repeat("v", i%50); e.value != want {
+					t.Errorf("key:%05d = %q, want %q", i, e.value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotCodecs(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(codec.String(), func(t *testing.T) {
+			dbs := NewDatabases(2, 4)
+			db, _ := dbs.DB(1)
+			for i := 0; i < 500; i++ {
+				db.Set(fmt.Sprintf("key:%d", i), strings.Repeat("value", 20))
+			}
+			db.ExpireAt("key:7", time.Now().Add(time.Hour))
+
+			path := filepath.Join(t.TempDir(), snapshotFileName)
+			if err := writeSnapshotFile(path, codec, 42, dbs.Len(), dbs.forEach); err != nil {
+				t.Fatal(err)
+			}
+			loaded := NewDatabases(2, 4)
+			keys, err := loaded.LoadSnapshotFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys != 500 {
+				t.Fatalf("loaded %d keys, want 500", keys)
+			}
+			got, _ := loaded.DB(1)
+			if value, _ := got.Get("key:499"); value != strings.Repeat("value", 20) {
+				t.Errorf("key:499 = %v", value)
+			}
+			if _, ok := got.ExpireTime("key:7"); !ok {
+				t.Error("key:7 lost its TTL")
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSnapshotReleased is returned when reading a snapshot that has been
+// released.
+var ErrSnapshotReleased = fmt.Errorf("snapshot has been released")
+
+// cowEntry is a key as it was when a snapshot began. exists is false for
+// keys created since.
+type cowEntry struct {
+	value    interface{}
+	expireAt time.Time
+	exists   bool
+}
+
+// shardCOW is the copy-on-write state of a shard for one snapshot. Stored
+// values are never modified in place, only replaced, so keeping the old
+// value and expiry of a key the first time it changes is enough for the
+// snapshot to see the shard as it was.
+type shardCOW struct {
+	saved map[string]cowEntry
+	// size is the estimated memory held by the saved values.
+	size int64
+}
+
+// preserve saves key as it is now for every snapshot of the shard that
+// has not already saved it. It must be called before key, or its expiry,
+// is changed. The caller must hold sh.mu for writing.
+func (sh *shard) preserve(key string) {
+	var old cowEntry
+	var size int64
+	read := false
+	for _, cow := range sh.cows {
+		if _, saved := cow.saved[key]; saved {
+			continue
+		}
+		if !read {
+			old, size = sh.current(key)
+			read = true
+		}
+		cow.saved[key] = old
+		cow.size += size
+	}
+}
+
+// current returns key as it is now, and the memory its value is accounted
+// for. Cold values are read from the tier. The caller must hold sh.mu.
+func (sh *shard) current(key string) (cowEntry, int64) {
+	if e, exists := sh.data[key]; exists {
+		return cowEntry{value: e.value, expireAt: sh.ttls[key], exists: true}, e.size
+	}
+	c, cold := sh.cold[key]
+	if !cold {
+		return cowEntry{}, 0
+	}
+	value, err := sh.coldValue(key)
+	if err != nil {
+		log.Printf("tiering: saving %q for a snapshot: %v", key, err)
+		return cowEntry{}, 0
+	}
+	return cowEntry{value: value, expireAt: sh.ttls[key], exists: true}, c.size
+}
+
+// detach stops keeping old values for cow. The caller must hold sh.mu for
+// writing.
+func (sh *shard) detach(cow *shardCOW) {
+	for i, c := range sh.cows {
+		if c == cow {
+			sh.cows = append(sh.cows[:i], sh.cows[i+1:]...)
+			return
+		}
+	}
+}
+
+// viewGet returns key as cow sees it. The caller must hold sh.mu.
+func (sh *shard) viewGet(cow *shardCOW, key string) cowEntry {
+	if old, saved := cow.saved[key]; saved {
+		return old
+	}
+	value, exists := sh.get(key)
+	if !exists {
+		return cowEntry{}
+	}
+	return cowEntry{value: value, expireAt: sh.ttls[key], exists: true}
+}
+
+// viewKeys calls fn for every key cow sees, without reading values. The
+// caller must hold sh.mu.
+func (sh *shard) viewKeys(cow *shardCOW, fn func(key string)) {
+	for key := range sh.data {
+		if _, saved := cow.saved[key]; !saved {
+			fn(key)
+		}
+	}
+	for key := range sh.cold {
+		if _, saved := cow.saved[key]; !saved {
+			fn(key)
+		}
+	}
+	for key, old := range cow.saved {
+		if old.exists {
+			fn(key)
+		}
+	}
+}
+
+// viewEntries returns every key cow sees with its value. The caller must
+// hold sh.mu.
+func (sh *shard) viewEntries(cow *shardCOW, entries []rewriteEntry) ([]rewriteEntry, error) {
+	for key, e := range sh.data {
+		if _, saved := cow.saved[key]; !saved {
+			entries = append(entries, rewriteEntry{key: key, value: e.value, expireAt: sh.ttls[key]})
+		}
+	}
+	for key := range sh.cold {
+		if _, saved := cow.saved[key]; saved {
+			continue
+		}
+		value, err := sh.coldValue(key)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, rewriteEntry{key: key, value: value, expireAt: sh.ttls[key]})
+	}
+	for key, old := range cow.saved {
+		if old.exists {
+			entries = append(entries, rewriteEntry{key: key, value: old.value, expireAt: old.expireAt})
+		}
+	}
+	return entries, nil
+}
+
+// snapshotIDs numbers the snapshots of the process.
+var snapshotIDs atomic.Uint64
+
+// Snapshot is a point-in-time view of every database, kept by copy-on-write
+// while writes continue: the first time a key changes, each open snapshot
+// saves the value and expiry it had. A snapshot costs nothing until keys
+// change, and then the memory of their old values, so it must be released
+// once read. Snapshots serve BGSAVE, RDB exports and the SNAPSHOT command.
+type Snapshot struct {
+	id      uint64
+	created time.Time
+	// stores are held on to so that SWAPDB does not change what the
+	// snapshot sees. cows[i][j] keeps shard j of stores[i].
+	stores []*InMemoryStore
+	cows   [][]*shardCOW
+	keys   int64
+
+	mu       sync.RWMutex
+	released bool
+}
+
+// OpenSnapshot takes a snapshot of every database. All shards are locked
+// while it is set up, in database and shard order like the cross-database
+// commands, so that it falls between any two writes.
+func (d *Databases) OpenSnapshot() *Snapshot {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return openSnapshot(append([]*InMemoryStore(nil), d.dbs...))
+}
+
+// openSnapshot takes a snapshot of stores, which become its databases.
+func openSnapshot(stores []*InMemoryStore) *Snapshot {
+	s := &Snapshot{
+		id:      snapshotIDs.Add(1),
+		created: time.Now(),
+		stores:  stores,
+		cows:    make([][]*shardCOW, len(stores)),
+	}
+	unlocks := make([]func(), 0, len(stores))
+	for i, db := range s.stores {
+		unlocks = append(unlocks, db.lockAll())
+		s.cows[i] = make([]*shardCOW, len(db.shards))
+		for j, sh := range db.shards {
+			cow := &shardCOW{saved: make(map[string]cowEntry)}
+			sh.cows = append(sh.cows, cow)
+			s.cows[i][j] = cow
+			s.keys += int64(len(sh.data) + len(sh.cold))
+		}
+	}
+	for i := len(unlocks) - 1; i >= 0; i-- {
+		unlocks[i]()
+	}
+	return s
+}
+
+// Keys returns the number of keys in the snapshot.
+func (s *Snapshot) Keys() int64 {
+	return s.keys
+}
+
+// Created returns when the snapshot was taken.
+func (s *Snapshot) Created() time.Time {
+	return s.created
+}
+
+// Len returns the number of databases in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.stores)
+}
+
+// Release stops keeping old values for the snapshot, which can then no
+// longer be read. Releasing it again does nothing.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	for i, db := range s.stores {
+		for j, sh := range db.shards {
+			sh.mu.Lock()
+			sh.detach(s.cows[i][j])
+			sh.mu.Unlock()
+		}
+	}
+}
+
+// read runs fn while the snapshot cannot be released.
+func (s *Snapshot) read(fn func() error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return ErrSnapshotReleased
+	}
+	return fn()
+}
+
+// db returns the store and shard states of database i.
+func (s *Snapshot) db(i int) (*InMemoryStore, []*shardCOW, error) {
+	if i < 0 || i >= len(s.stores) {
+		return nil, nil, ErrDBOutOfRange
+	}
+	return s.stores[i], s.cows[i], nil
+}
+
+// Get returns the value and expiry time key had in database i. A key whose
+// TTL has passed since is missing, as it is to live reads.
+func (s *Snapshot) Get(i int, key string) (value interface{}, expireAt time.Time, exists bool, err error) {
+	err = s.read(func() error {
+		db, cows, err := s.db(i)
+		if err != nil {
+			return err
+		}
+		n := db.shardIndex(key)
+		sh := db.shards[n]
+		sh.mu.RLock()
+		old := sh.viewGet(cows[n], key)
+		sh.mu.RUnlock()
+		if !old.exists || (!old.expireAt.IsZero() && !time.Now().Before(old.expireAt)) {
+			return nil
+		}
+		value, expireAt, exists = old.value, old.expireAt, true
+		return nil
+	})
+	return value, expireAt, exists, err
+}
+
+// ForEach calls fn for every key of database i as it was when the
+// snapshot was taken, like InMemoryStore.forEach. Each shard is locked
+// only while its keys are copied out.
+func (s *Snapshot) ForEach(i int, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	return s.read(func() error {
+		db, cows, err := s.db(i)
+		if err != nil {
+			return err
+		}
+		var entries []rewriteEntry
+		for j, sh := range db.shards {
+			sh.mu.RLock()
+			entries, err = sh.viewEntries(cows[j], entries[:0])
+			sh.mu.RUnlock()
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if err := fn(e.key, e.value, e.expireAt); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// drain is ForEach for a snapshot that is read once: each shard stops
+// keeping old values as soon as its keys are copied out. It returns the
+// memory the old values held. The snapshot must still be released.
+func (s *Snapshot) drain(i int, fn func(key string, value interface{}, expireAt time.Time) error) (int64, error) {
+	var size int64
+	err := s.read(func() error {
+		db, cows, err := s.db(i)
+		if err != nil {
+			return err
+		}
+		var entries []rewriteEntry
+		for j, sh := range db.shards {
+			sh.mu.Lock()
+			entries, err = sh.viewEntries(cows[j], entries[:0])
+			size += cows[j].size
+			sh.detach(cows[j])
+			sh.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if err := fn(e.key, e.value, e.expireAt); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return size, err
+}
+
+// size returns the memory held by the old values of the snapshot.
+func (s *Snapshot) size() int64 {
+	var size int64
+	s.read(func() error {
+		for i, db := range s.stores {
+			for j, sh := range db.shards {
+				sh.mu.RLock()
+				size += s.cows[i][j].size
+				sh.mu.RUnlock()
+			}
+		}
+		return nil
+	})
+	return size
+}
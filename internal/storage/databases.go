@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDatabases is the number of logical databases used when the
+// configuration does not specify one.
+const DefaultDatabases = 16
+
+// Databases holds the numbered logical databases of a server. Each one is
+// an independent InMemoryStore; SWAPDB exchanges them by index.
+type Databases struct {
+	dbs []*InMemoryStore
+	mem *memoryTracker
+	mu  sync.RWMutex
+
+	// writeLocks order logged writes; onEvict, when set, is told about
+	// every key evicted for maxmemory.
+	writeLocks keyLocks
+	onEvict    func(db int, key string)
+	// tier, when set, is where eviction demotes values to.
+	tier *tier
+}
+
+// NewDatabases creates count databases, each partitioned into the given
+// number of shards. Zero values select the defaults.
+func NewDatabases(count, shards int) *Databases {
+	if count <= 0 {
+		count = DefaultDatabases
+	}
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+	d := &Databases{dbs: make([]*InMemoryStore, count), mem: newMemoryTracker()}
+	for i := range d.dbs {
+		d.dbs[i] = newStore(shards, d.mem)
+	}
+	return d
+}
+
+// Len returns the number of databases.
+func (d *Databases) Len() int {
+	return len(d.dbs)
+}
+
+// DB returns the database with the given index.
+func (d *Databases) DB(index int) (*InMemoryStore, error) {
+	if index < 0 || index >= len(d.dbs) {
+		return nil, ErrDBOutOfRange
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.dbs[index], nil
+}
+
+// Swap exchanges the contents of two databases. Clients connected to
+// either database immediately see the other one's data.
+func (d *Databases) Swap(a, b int) error {
+	if a < 0 || a >= len(d.dbs) || b < 0 || b >= len(d.dbs) {
+		return ErrDBOutOfRange
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dbs[a], d.dbs[b] = d.dbs[b], d.dbs[a]
+	return nil
+}
+
+// FlushAll empties every database.
+func (d *Databases) FlushAll() {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, db := range d.dbs {
+		db.Flush()
+	}
+}
+
+// lockPair write-locks the shard of srcKey in one database and the shard
+// of dstKey in another. Locks are taken in database index order so
+// concurrent cross-database commands cannot deadlock. It returns the two
+// shards and the unlock function.
+func (d *Databases) lockPair(srcIndex, dstIndex int, srcKey, dstKey string) (*shard, *shard, func()) {
+	d.mu.RLock()
+	src := d.dbs[srcIndex].shardFor(srcKey)
+	dst := d.dbs[dstIndex].shardFor(dstKey)
+	first, second := src, dst
+	if dstIndex < srcIndex {
+		first, second = dst, src
+	}
+	first.mu.Lock()
+	second.mu.Lock()
+	return src, dst, func() {
+		second.mu.Unlock()
+		first.mu.Unlock()
+		d.mu.RUnlock()
+	}
+}
+
+// Move transfers key and its TTL from one database to another. It returns
+// false if the key does not exist in the source or already exists in the
+// destination.
+func (d *Databases) Move(key string, srcIndex, dstIndex int) (bool, error) {
+	if dstIndex < 0 || dstIndex >= len(d.dbs) {
+		return false, ErrDBOutOfRange
+	}
+	if srcIndex == dstIndex {
+		return false, ErrSameObject
+	}
+
+	src, dst, unlock := d.lockPair(srcIndex, dstIndex, key, key)
+	defer unlock()
+
+	value, exists := src.get(key)
+	if !exists {
+		return false, nil
+	}
+	if _, exists := dst.get(key); exists {
+		return false, nil
+	}
+
+	expireAt, hasTTL := src.ttls[key]
+	src.delete(key)
+	dst.set(key, value)
+	if hasTTL {
+		dst.ttls[key] = expireAt
+	}
+	return true, nil
+}
+
+// CopyTo copies srcKey from one database to dstKey in another.
+func (d *Databases) CopyTo(srcKey, dstKey string, srcIndex, dstIndex int, replace bool) (bool, error) {
+	if dstIndex < 0 || dstIndex >= len(d.dbs) {
+		return false, ErrDBOutOfRange
+	}
+	if srcIndex == dstIndex {
+		db, err := d.DB(srcIndex)
+		if err != nil {
+			return false, err
+		}
+		return db.Copy(srcKey, dstKey, replace)
+	}
+
+	src, dst, unlock := d.lockPair(srcIndex, dstIndex, srcKey, dstKey)
+	defer unlock()
+	return copyKey(src, dst, srcKey, dstKey, replace), nil
+}
+
+// KeyspaceStats describes one database for INFO keyspace.
+type KeyspaceStats struct {
+	Keys    int64
+	Expires int64
+	AvgTTL  int64 // milliseconds
+}
+
+// Stats returns the key count, the number of keys with a TTL and their
+// average remaining TTL.
+func (s *InMemoryStore) Stats() KeyspaceStats {
+	var stats KeyspaceStats
+	var total time.Duration
+	now := time.Now()
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		stats.Keys += int64(len(sh.data) + len(sh.cold))
+		for _, expireAt := range sh.ttls {
+			if remaining := expireAt.Sub(now); remaining > 0 {
+				stats.Expires++
+				total += remaining
+			} else {
+				stats.Keys--
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	if stats.Expires > 0 {
+		stats.AvgTTL = total.Milliseconds() / stats.Expires
+	}
+	return stats
+}
+
+// session is the per-connection state of a client.
+type session struct {
+	db int
+}
+
+type sessionKey struct{}
+
+// NewSession attaches fresh per-connection state to ctx. The network layer
+// calls it once for every accepted connection.
+func (h *CommandHandler) NewSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &session{})
+}
+
+// CloseSession releases what the session in ctx holds, such as the
+// snapshots it opened. The network layer calls it once a connection
+// closes.
+func (h *CommandHandler) CloseSession(ctx context.Context) {
+	if sess := sessionFrom(ctx); sess != nil {
+		h.reads.closeSession(sess)
+	}
+}
+
+// sessionFrom returns the client session stored in ctx, or nil for callers
+// that do not use connections, such as replication.
+func sessionFrom(ctx context.Context) *session {
+	sess, _ := ctx.Value(sessionKey{}).(*session)
+	return sess
+}
+
+func parseDBIndex(arg string) (int, error) {
+	db, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("value is not an integer or out of range")
+	}
+	return db, nil
+}
+
+// parseFlushMode checks the optional ASYNC|SYNC argument of FLUSHDB and
+// FLUSHALL. Both modes flush the same way: the old contents are left to
+// the garbage collector either way.
+func parseFlushMode(args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for %s", strings.ToUpper(args[0]))
+	}
+	if len(args) == 1 {
+		return nil
+	}
+	switch strings.ToUpper(args[1]) {
+	case "ASYNC", "SYNC":
+		return nil
+	}
+	return fmt.Errorf("syntax error")
+}
+
+func (h *CommandHandler) handleSelect(ctx context.Context, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("wrong number of arguments for SELECT")
+	}
+	db, err := parseDBIndex(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if db < 0 || db >= h.dbs.Len() {
+		return nil, ErrDBOutOfRange
+	}
+	sess := sessionFrom(ctx)
+	if sess == nil {
+		return nil, fmt.Errorf("SELECT is only supported on client connections")
+	}
+	sess.db = db
+	return "OK", nil
+}
+
+func (h *CommandHandler) handleSwapDB(args []string) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments for SWAPDB")
+	}
+	a, err := parseDBIndex(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid first DB index")
+	}
+	b, err := parseDBIndex(args[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid second DB index")
+	}
+	if err := h.dbs.Swap(a, b); err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
+
+func (h *CommandHandler) infoKeyspace() string {
+	var b strings.Builder
+	b.WriteString("# Keyspace\r\n")
+	for i := 0; i < h.dbs.Len(); i++ {
+		db, _ := h.dbs.DB(i)
+		stats := db.Stats()
+		if stats.Keys == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "db%d:keys=%d,expires=%d,avg_ttl=%d\r\n", i, stats.Keys, stats.Expires, stats.AvgTTL)
+	}
+	return b.String()
+}
+
+// handleInfo serves INFO [section ...]. Without arguments every section
+// is reported.
+func (h *CommandHandler) handleInfo(args []string) (interface{}, error) {
+	sections := []struct {
+		name string
+		fn   func() string
+	}{
+		{"memory", h.infoMemory},
+		{"persistence", h.infoPersistence},
+		{"snapshots", h.infoSnapshots},
+		{"tiering", h.infoTiering},
+		{"lsm", h.infoLSM},
+		{"stats", h.infoStats},
+		{"keyspace", h.infoKeyspace},
+	}
+
+	wanted := make(map[string]bool)
+	for _, arg := range args[1:] {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["everything"] || wanted["default"]
+
+	var parts []string
+	for _, section := range sections {
+		if all || wanted[section.name] {
+			parts = append(parts, section.fn())
+		}
+	}
+	return strings.Join(parts, "\r\n"), nil
+}
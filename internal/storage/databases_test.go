@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// newTestClients returns a handler over four databases and a function
+// running commands as each of n clients, every one with its own session.
+func newTestClients(t *testing.T, n int) (*CommandHandler, []func(args ...string) interface{}) {
+	t.Helper()
+	h := NewCommandHandler(NewDatabases(4, 4))
+	clients := make([]func(args ...string) interface{}, n)
+	for i := range clients {
+		ctx := h.NewSession(context.Background())
+		clients[i] = func(args ...string) interface{} {
+			t.Helper()
+			reply, err := h.HandleCommand(ctx, args)
+			if err != nil {
+				t.Fatalf("%s: %v", strings.Join(args, " "), err)
+			}
+			return reply
+		}
+	}
+	return h, clients
+}
+
+// wantReplies runs each command as do and compares the replies with
+// fmt.Sprint.
+func wantReplies(t *testing.T, do func(args ...string) interface{}, cases [][2]interface{}) {
+	t.Helper()
+	for _, c := range cases {
+		args := c[0].([]string)
+		if got := do(args...); fmt.Sprint(got) != fmt.Sprint(c[1]) {
+			t.Errorf("%s = %v, want %v", strings.Join(args, " "), got, c[1])
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	h, _ := newTestClients(t, 0)
+	ctx := h.NewSession(context.Background())
+	for _, c := range []struct {
+		index string
+		want  error
+	}{
+		{"4", ErrDBOutOfRange},
+		{"-1", ErrDBOutOfRange},
+		{"100000000000000000000", nil},
+		{"one", nil},
+	} {
+		if _, err := h.HandleCommand(ctx, []string{"SELECT", c.index}); err == nil || (c.want != nil && !errors.Is(err, c.want)) {
+			t.Errorf("SELECT %s returned %v, want %v", c.index, err, c.want)
+		}
+	}
+	if _, err := h.HandleCommand(ctx, []string{"SELECT", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.HandleCommand(context.Background(), []string{"SELECT", "1"}); err == nil {
+		t.Errorf("SELECT without a session succeeded")
+	}
+
+	// A refused SELECT leaves the database selected.
+	h.HandleCommand(ctx, []string{"SELECT", "9"})
+	h.HandleCommand(ctx, []string{"SET", "key", "value"})
+	db, _ := h.dbs.DB(3)
+	if _, exists := db.Get("key"); !exists {
+		t.Errorf("SET after a refused SELECT did not write to database 3")
+	}
+}
+
+func TestDatabasesAreIsolated(t *testing.T) {
+	h, clients := newTestClients(t, 2)
+	a, b := clients[0], clients[1]
+	a("SELECT", "1")
+	a("SET", "key", "a")
+	a("SET", "only:1", "a")
+	b("SET", "key", "b")
+
+	wantReplies(t, a, [][2]interface{}{
+		{[]string{"GET", "key"}, "a"},
+		{[]string{"EXISTS", "only:1"}, int64(1)},
+		{[]string{"DBSIZE"}, int64(2)},
+	})
+	wantReplies(t, b, [][2]interface{}{
+		{[]string{"GET", "key"}, "b"},
+		{[]string{"EXISTS", "only:1"}, int64(0)},
+		{[]string{"KEYS", "*"}, "[key]"},
+		{[]string{"DBSIZE"}, int64(1)},
+	})
+
+	// Each session keeps its own selection.
+	b("SELECT", "2")
+	wantReplies(t, a, [][2]interface{}{{[]string{"GET", "key"}, "a"}})
+	wantReplies(t, b, [][2]interface{}{{[]string{"GET", "key"}, nil}})
+	if db, _ := h.dbs.DB(0); db.DBSize() != 1 {
+		t.Errorf("database 0 holds %d keys, want 1", db.DBSize())
+	}
+}
+
+func TestSwapDB(t *testing.T) {
+	h, clients := newTestClients(t, 2)
+	a, b := clients[0], clients[1]
+	a("SELECT", "1")
+	a("SET", "key", "a")
+	a("EXPIRE", "key", "100")
+	b("SET", "key", "b")
+
+	wantReplies(t, b, [][2]interface{}{
+		{[]string{"SWAPDB", "0", "1"}, "OK"},
+		{[]string{"GET", "key"}, "a"},
+		{[]string{"TTL", "key"}, int64(99)},
+	})
+	wantReplies(t, a, [][2]interface{}{
+		{[]string{"GET", "key"}, "b"},
+		{[]string{"TTL", "key"}, nil},
+		{[]string{"SWAPDB", "1", "1"}, "OK"},
+		{[]string{"GET", "key"}, "b"},
+	})
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		args []string
+		want error
+	}{
+		{[]string{"SWAPDB", "0", "4"}, ErrDBOutOfRange},
+		{[]string{"SWAPDB", "-1", "0"}, ErrDBOutOfRange},
+		{[]string{"SWAPDB", "x", "0"}, nil},
+		{[]string{"SWAPDB", "0"}, nil},
+	} {
+		if _, err := h.HandleCommand(ctx, c.args); err == nil || (c.want != nil && !errors.Is(err, c.want)) {
+			t.Errorf("%s returned %v, want %v", strings.Join(c.args, " "), err, c.want)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	h, clients := newTestClients(t, 2)
+	a, b := clients[0], clients[1]
+	b("SELECT", "2")
+	a("SET", "moved", "value")
+	a("EXPIRE", "moved", "100")
+	a("SET", "persistent", "value")
+	a("SET", "taken", "a")
+	b("SET", "taken", "b")
+
+	wantReplies(t, a, [][2]interface{}{
+		{[]string{"MOVE", "moved", "2"}, int64(1)},
+		{[]string{"EXISTS", "moved"}, int64(0)},
+		{[]string{"MOVE", "persistent", "2"}, int64(1)},
+		{[]string{"MOVE", "taken", "2"}, int64(0)},
+		{[]string{"GET", "taken"}, "a"},
+		{[]string{"MOVE", "missing", "2"}, int64(0)},
+	})
+	wantReplies(t, b, [][2]interface{}{
+		{[]string{"GET", "moved"}, "value"},
+		{[]string{"TTL", "moved"}, int64(99)},
+		{[]string{"TTL", "persistent"}, nil},
+		{[]string{"GET", "taken"}, "b"},
+		{[]string{"EXISTS", "missing"}, int64(0)},
+	})
+
+	ctx := h.NewSession(context.Background())
+	h.HandleCommand(ctx, []string{"SET", "key", "value"})
+	for _, c := range []struct {
+		args []string
+		want error
+	}{
+		{[]string{"MOVE", "key", "0"}, ErrSameObject},
+		{[]string{"MOVE", "key", "4"}, ErrDBOutOfRange},
+		{[]string{"MOVE", "key", "-1"}, ErrDBOutOfRange},
+		{[]string{"MOVE", "key", "x"}, nil},
+	} {
+		if _, err := h.HandleCommand(ctx, c.args); err == nil || (c.want != nil && !errors.Is(err, c.want)) {
+			t.Errorf("%s returned %v, want %v", strings.Join(c.args, " "), err, c.want)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	fill := func(do func(args ...string) interface{}) {
+		for db := 0; db < 3; db++ {
+			do("SELECT", fmt.Sprint(db))
+			do("SET", "a", "1")
+			do("SET", "b", "1")
+		}
+		do("SELECT", "1")
+	}
+	sizes := func(h *CommandHandler) string {
+		var s []int64
+		for i := 0; i < h.dbs.Len(); i++ {
+			db, _ := h.dbs.DB(i)
+			s = append(s, db.DBSize())
+		}
+		return fmt.Sprint(s)
+	}
+
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"FLUSHDB"}, "[2 0 2 0]"},
+		{[]string{"FLUSHDB", "ASYNC"}, "[2 0 2 0]"},
+		{[]string{"FLUSHDB", "sync"}, "[2 0 2 0]"},
+		{[]string{"FLUSHALL"}, "[0 0 0 0]"},
+		{[]string{"FLUSHALL", "async"}, "[0 0 0 0]"},
+		{[]string{"FLUSHALL", "SYNC"}, "[0 0 0 0]"},
+	} {
+		h, clients := newTestClients(t, 1)
+		fill(clients[0])
+		if got := clients[0](c.args...); got != "OK" {
+			t.Errorf("%s = %v", strings.Join(c.args, " "), got)
+		}
+		if got := sizes(h); got != c.want {
+			t.Errorf("after %s databases hold %s keys, want %s", strings.Join(c.args, " "), got, c.want)
+		}
+	}
+
+	h, clients := newTestClients(t, 1)
+	fill(clients[0])
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"FLUSHDB", "LAZY"},
+		{"FLUSHALL", "ASYNC", "SYNC"},
+	} {
+		if _, err := h.HandleCommand(ctx, args); err == nil {
+			t.Errorf("%s succeeded", strings.Join(args, " "))
+		}
+	}
+	if got := sizes(h); got != "[2 2 2 0]" {
+		t.Errorf("refused flushes left %s keys", got)
+	}
+}
+
+func TestInfoKeyspace(t *testing.T) {
+	_, clients := newTestClients(t, 1)
+	do := clients[0]
+	do("SET", "a", "1")
+	do("SET", "b", "1")
+	do("EXPIRE", "b", "100")
+	do("SELECT", "2")
+	do("SET", "c", "1")
+
+	info := do("INFO", "keyspace").(string)
+	lines := strings.Split(strings.TrimSpace(info), "\r\n")
+	if len(lines) != 3 || lines[0] != "# Keyspace" {
+		t.Fatalf("INFO keyspace returned %q", info)
+	}
+	if !strings.HasPrefix(lines[1], "db0:keys=2,expires=1,avg_ttl=") {
+		t.Errorf("database 0 reported as %q", lines[1])
+	}
+	var ttl int64
+	if _, err := fmt.Sscanf(lines[1], "db0:keys=2,expires=1,avg_ttl=%d", &ttl); err != nil || ttl < 99000 || ttl > 100000 {
+		t.Errorf("database 0 reported an average TTL of %dms", ttl)
+	}
+	if lines[2] != "db2:keys=1,expires=0,avg_ttl=0" {
+		t.Errorf("database 2 reported as %q", lines[2])
+	}
+
+	do("FLUSHALL")
+	if info := do("INFO", "keyspace"); info != "# Keyspace\r\n" {
+		t.Errorf("INFO keyspace of empty databases returned %q", info)
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A DUMP payload is laid out like Redis' own:
+//
+//	value    type tag and value, as in appendValue
+//	version  uint16, little endian, dumpVersion
+//	crc      uint64, little endian, CRC64 of the value and version
+//
+// The value uses the per-type encodings of the snapshot file, so a payload
+// written by one Redix node can be restored by any other with a codec at
+// least as recent. dumpVersion is raised whenever those encodings change.
+const (
+	dumpVersion    = 1
+	dumpTrailerLen = 10
+	maxFreq        = 255
+)
+
+var (
+	ErrBusyKey = fmt.Errorf("target key name already exists")
+	ErrBadDump = fmt.Errorf("DUMP payload version or checksum are wrong")
+)
+
+// dumpValue serializes value into a DUMP payload.
+func dumpValue(value interface{}) ([]byte, error) {
+	buf, err := appendValue(nil, value)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, dumpVersion)
+	return binary.LittleEndian.AppendUint64(buf, crc64Update(0, buf)), nil
+}
+
+// undumpValue decodes a DUMP payload, checking its version and checksum.
+func undumpValue(payload []byte) (interface{}, error) {
+	if len(payload) < dumpTrailerLen {
+		return nil, ErrBadDump
+	}
+	body := payload[:len(payload)-8]
+	if binary.LittleEndian.Uint64(payload[len(body):]) != crc64Update(0, body) {
+		return nil, ErrBadDump
+	}
+	value := body[:len(body)-2]
+	if version := binary.LittleEndian.Uint16(body[len(value):]); version > dumpVersion {
+		return nil, ErrBadDump
+	}
+	r := bytes.NewReader(value)
+	decoded, err := readValue(r)
+	if err != nil || r.Len() != 0 {
+		return nil, fmt.Errorf("bad data format")
+	}
+	return decoded, nil
+}
+
+// Dump returns the DUMP payload of the value stored at key, without
+// counting as an access.
+func (s *InMemoryStore) Dump(key string) ([]byte, bool, error) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists := sh.get(key)
+	if !exists {
+		return nil, false, nil
+	}
+	payload, err := dumpValue(value)
+	return payload, true, err
+}
+
+// restoreOptions holds the arguments of RESTORE after the payload.
+type restoreOptions struct {
+	expireAt time.Time
+	replace  bool
+	// idle and freq, when not negative, replace the access history the
+	// key starts with.
+	idle time.Duration
+	freq int
+}
+
+// Restore stores value at key as RESTORE does. An expiry time already in
+// the past leaves the key deleted, if replacing, and otherwise untouched.
+func (s *InMemoryStore) Restore(key string, value interface{}, opts restoreOptions) error {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, exists := sh.get(key); exists {
+		if !opts.replace {
+			return ErrBusyKey
+		}
+		sh.delete(key)
+	}
+	if !opts.expireAt.IsZero() && !opts.expireAt.After(time.Now()) {
+		return nil
+	}
+	sh.set(key, value)
+	if !opts.expireAt.IsZero() {
+		sh.ttls[key] = opts.expireAt
+	}
+	if e, ok := sh.data[key]; ok {
+		if opts.idle >= 0 {
+			e.accessed.Store(time.Now().Add(-opts.idle).UnixMilli())
+		}
+		if opts.freq >= 0 {
+			e.lfu.Store(lfuMinutes()<<8 | uint32(opts.freq))
+		}
+	}
+	return nil
+}
+
+func (h *CommandHandler) handleDump(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("wrong number of arguments for DUMP")
+	}
+	payload, exists, err := store.Dump(args[1])
+	if err != nil || !exists {
+		return nil, err
+	}
+	return string(payload), nil
+}
+
+// parseRestoreArgs parses "key ttl payload [REPLACE] [ABSTTL] [IDLETIME
+// seconds] [FREQ frequency]". ttl is in milliseconds, relative unless
+// ABSTTL is given, and 0 for no expiry.
+func parseRestoreArgs(args []string) (restoreOptions, error) {
+	opts := restoreOptions{idle: -1, freq: -1}
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return opts, fmt.Errorf("value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return opts, fmt.Errorf("invalid TTL value, must be >= 0")
+	}
+	absolute := false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			opts.replace = true
+		case "ABSTTL":
+			absolute = true
+		case "IDLETIME":
+			if i+1 == len(args) || opts.freq >= 0 {
+				return opts, fmt.Errorf("syntax error")
+			}
+			i++
+			seconds, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return opts, fmt.Errorf("value is not an integer or out of range")
+			}
+			if seconds < 0 {
+				return opts, fmt.Errorf("invalid IDLETIME value, must be >= 0")
+			}
+			opts.idle = time.Duration(seconds) * time.Second
+		case "FREQ":
+			if i+1 == len(args) || opts.idle >= 0 {
+				return opts, fmt.Errorf("syntax error")
+			}
+			i++
+			freq, err := strconv.Atoi(args[i])
+			if err != nil {
+				return opts, fmt.Errorf("value is not an integer or out of range")
+			}
+			if freq < 0 || freq > maxFreq {
+				return opts, fmt.Errorf("invalid FREQ value, must be >= 0 and <= %d", maxFreq)
+			}
+			opts.freq = freq
+		default:
+			return opts, fmt.Errorf("syntax error")
+		}
+	}
+	switch {
+	case ttl == 0:
+	case absolute:
+		opts.expireAt = time.UnixMilli(ttl)
+	default:
+		opts.expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	return opts, nil
+}
+
+func (h *CommandHandler) handleRestore(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) < 4 {
+		return nil, fmt.Errorf("wrong number of arguments for RESTORE")
+	}
+	opts, err := parseRestoreArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	value, err := undumpValue([]byte(args[3]))
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Restore(args[1], value, opts); err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// valueText describes a value in a form that does not depend on map order
+// or encoding, so that two values can be compared.
+func valueText(value interface{}) string {
+	switch v := value.(type) {
+	case *datastructures.List:
+		return fmt.Sprint("list", v.Range(0, v.Len()))
+	case *datastructures.Set:
+		return fmt.Sprint("set", sortedElements(v.Members()))
+	case *datastructures.Hash:
+		return fmt.Sprint("hash", v.HGetAll())
+	case *datastructures.SortedSet:
+		members := v.Range(math.Inf(-1), math.Inf(1), 0, v.ZCard())
+		scored := make([]string, len(members))
+		for i, member := range members {
+			score, _ := v.GetScore(member)
+			scored[i] = fmt.Sprintf("%s=%v", member, score)
+		}
+		return fmt.Sprint("zset", scored)
+	}
+	return fmt.Sprintf("%T %v", value, value)
+}
+
+// dumpValues returns a value of every type, with collections both small
+// enough for a compact encoding and too large for one.
+func dumpValues() map[string]interface{} {
+	values := map[string]interface{}{
+		"string":  "value",
+		"empty":   "",
+		"binary":  "\x00\xff\r\n",
+		"integer": int64(-42),
+		"minimum": int64(math.MinInt64),
+	}
+	for _, n := range []int{3, 300} {
+		list := datastructures.NewList()
+		ints, strs := datastructures.NewSet(), datastructures.NewSet()
+		hash := datastructures.NewHash()
+		zset := datastructures.NewSortedSet()
+		for i := 0; i < n; i++ {
+			list.PushBack("element:" + strconv.Itoa(i))
+			list.PushBack(int64(i))
+			ints.Add(int64(i))
+			strs.Add("member:" + strconv.Itoa(i))
+			hash.HSet("field:"+strconv.Itoa(i), strings.Repeat("v", i%70))
+			zset.Add("member:"+strconv.Itoa(i), float64(i)/3)
+		}
+		zset.Add("infinite", math.Inf(-1))
+		suffix := ":" + strconv.Itoa(n)
+		values["list"+suffix] = list
+		values["ints"+suffix] = ints
+		values["strs"+suffix] = strs
+		values["hash"+suffix] = hash
+		values["zset"+suffix] = zset
+	}
+	return values
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	h, do := newTestHandler(t)
+	db, _ := h.dbs.DB(0)
+	values := dumpValues()
+	for key, value := range values {
+		db.Set(key, value)
+	}
+
+	for key, value := range values {
+		payload := do("DUMP", key).(string)
+		do("RESTORE", key+":copy", "0", payload)
+		copied, _ := db.Get(key + ":copy")
+		if got, want := valueText(copied), valueText(value); got != want {
+			t.Errorf("%s restored as %.80s, want %.80s", key, got, want)
+		}
+		if got, want := do("OBJECT", "ENCODING", key+":copy"), do("OBJECT", "ENCODING", key); got != want {
+			t.Errorf("%s restored encoded as %v, want %v", key, got, want)
+		}
+		if ttl := do("TTL", key+":copy"); ttl != nil {
+			t.Errorf("%s restored with TTL %v, want none", key, ttl)
+		}
+		if again := do("DUMP", key+":copy").(string); valueText(mustUndump(t, again)) != valueText(value) {
+			t.Errorf("%s dumped again does not round trip", key)
+		}
+	}
+	if got := do("DUMP", "missing"); got != nil {
+		t.Errorf("DUMP of a missing key = %v, want nil", got)
+	}
+}
+
+func mustUndump(t *testing.T, payload string) interface{} {
+	t.Helper()
+	value, err := undumpValue([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestRestoreReplace(t *testing.T) {
+	h, do := newTestHandler(t)
+	do("SET", "source", "new")
+	do("SET", "target", "old")
+	do("EXPIRE", "target", "100")
+	payload := do("DUMP", "source").(string)
+
+	if _, err := h.HandleCommand(context.Background(), []string{"RESTORE", "target", "0", payload}); !errors.Is(err, ErrBusyKey) {
+		t.Fatalf("RESTORE over an existing key returned %v, want %v", err, ErrBusyKey)
+	}
+	if got := do("GET", "target"); got != "old" {
+		t.Fatalf("a refused RESTORE left %v", got)
+	}
+
+	do("RESTORE", "target", "0", payload, "REPLACE")
+	if got := do("GET", "target"); got != "new" {
+		t.Errorf("RESTORE REPLACE stored %v, want new", got)
+	}
+	if ttl := do("TTL", "target"); ttl != nil {
+		t.Errorf("RESTORE REPLACE kept the TTL %v of the key it replaced", ttl)
+	}
+
+	// A TTL already in the past deletes the replaced key and stores nothing.
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10)
+	do("RESTORE", "target", past, payload, "REPLACE", "ABSTTL")
+	if got := do("EXISTS", "target"); got != int64(0) {
+		t.Errorf("RESTORE REPLACE with an expired TTL left the key: EXISTS = %v", got)
+	}
+}
+
+func TestRestoreTTL(t *testing.T) {
+	_, do := newTestHandler(t)
+	do("SET", "source", "value")
+	payload := do("DUMP", "source").(string)
+
+	do("RESTORE", "relative", "100000", payload)
+	if ttl, _ := do("TTL", "relative").(int64); ttl < 99 || ttl > 100 {
+		t.Errorf("RESTORE with a TTL of 100000ms gave TTL %v", ttl)
+	}
+
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	do("RESTORE", "absolute", strconv.FormatInt(at.UnixMilli(), 10), payload, "ABSTTL")
+	if ttl, _ := do("TTL", "absolute").(int64); ttl < 3590 || ttl > 3600 {
+		t.Errorf("RESTORE ABSTTL an hour from now gave TTL %v", ttl)
+	}
+
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10)
+	do("RESTORE", "expired", past, payload, "ABSTTL")
+	if got := do("EXISTS", "expired"); got != int64(0) {
+		t.Errorf("RESTORE ABSTTL in the past stored the key: EXISTS = %v", got)
+	}
+}
+
+func TestRestoreAccessHistory(t *testing.T) {
+	h, do := newTestHandler(t)
+	do("SET", "source", "value")
+	payload := do("DUMP", "source").(string)
+
+	do("RESTORE", "idle", "0", payload, "IDLETIME", "3600")
+	if idle := do("OBJECT", "IDLETIME", "idle").(int64); idle < 3600 || idle > 3601 {
+		t.Errorf("RESTORE IDLETIME 3600 gave OBJECT IDLETIME %d", idle)
+	}
+	do("RESTORE", "frequent", "0", payload, "FREQ", "200")
+	if freq := do("OBJECT", "FREQ", "frequent"); freq != int64(200) {
+		t.Errorf("RESTORE FREQ 200 gave OBJECT FREQ %v", freq)
+	}
+
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"RESTORE", "bad", "0", payload, "IDLETIME", "-1"},
+		{"RESTORE", "bad", "0", payload, "IDLETIME"},
+		{"RESTORE", "bad", "0", payload, "FREQ", "256"},
+		{"RESTORE", "bad", "0", payload, "FREQ", "-1"},
+		{"RESTORE", "bad", "0", payload, "IDLETIME", "1", "FREQ", "1"},
+		{"RESTORE", "bad", "-1", payload},
+		{"RESTORE", "bad", "0", payload, "BOGUS"},
+	} {
+		if _, err := h.HandleCommand(ctx, args); err == nil {
+			t.Errorf("%s succeeded", strings.Join(args, " "))
+		}
+	}
+	if got := do("EXISTS", "bad"); got != int64(0) {
+		t.Errorf("a refused RESTORE stored the key")
+	}
+}
+
+func TestRestoreRejectsBadPayloads(t *testing.T) {
+	h, do := newTestHandler(t)
+	do("SET", "source", "value")
+	payload := []byte(do("DUMP", "source").(string))
+
+	// resign recomputes the checksum of a payload whose body was changed.
+	resign := func(p []byte) []byte {
+		body := p[:len(p)-8]
+		return binary.LittleEndian.AppendUint64(append([]byte(nil), body...), crc64Update(0, body))
+	}
+	newer := append([]byte(nil), payload...)
+	binary.LittleEndian.PutUint16(newer[len(newer)-dumpTrailerLen:], dumpVersion+1)
+	older := append([]byte(nil), payload...)
+	binary.LittleEndian.PutUint16(older[len(older)-dumpTrailerLen:], dumpVersion-1)
+	checksum := append([]byte(nil), payload...)
+	checksum[len(checksum)-1] ^= 0xff
+	body := append([]byte(nil), payload...)
+	body[1] ^= 0xff
+	truncated := resign(append(append([]byte(nil), payload[:2]...), payload[len(payload)-dumpTrailerLen:]...))
+	// forged builds a correctly signed payload holding a value of the tag
+	// given that claims to hold n bytes or elements.
+	forged := func(tag byte, n uint64) []byte {
+		p := binary.AppendUvarint([]byte{tag}, n)
+		return resign(append(p, payload[len(payload)-dumpTrailerLen:]...))
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		name    string
+		payload []byte
+		want    error
+	}{
+		{"a newer version", resign(newer), ErrBadDump},
+		{"a bad checksum", checksum, ErrBadDump},
+		{"a damaged body", body, ErrBadDump},
+		{"a short payload", payload[:dumpTrailerLen-1], ErrBadDump},
+		{"a truncated value", truncated, nil},
+		{"an oversized string", forged(valueString, 1<<62), nil},
+		{"a string longer than the payload", forged(valueString, 2), nil},
+		{"an oversized list", forged(valueList, 1<<62), nil},
+		{"an oversized hash", forged(valueHash, math.MaxUint64), nil},
+		{"an oversized sorted set", forged(valueZSet, 1<<40), nil},
+	} {
+		_, err := h.HandleCommand(ctx, []string{"RESTORE", "bad", "0", string(c.payload)})
+		if err == nil || (c.want != nil && !errors.Is(err, c.want)) {
+			t.Errorf("RESTORE of %s returned %v, want %v", c.name, err, c.want)
+		}
+	}
+	if got := do("EXISTS", "bad"); got != int64(0) {
+		t.Errorf("a refused RESTORE stored the key")
+	}
+
+	// A reader that cannot tell how much it holds, such as a snapshot file,
+	// fails on the missing data instead.
+	if _, err := readString(bufio.NewReader(bytes.NewReader(binary.AppendUvarint(nil, 1<<62)))); err == nil {
+		t.Errorf("reading an oversized string from a file succeeded")
+	}
+
+	// Payloads of an older version are still accepted.
+	do("RESTORE", "old", "0", string(resign(older)))
+	if got := do("GET", "old"); got != "value" {
+		t.Errorf("RESTORE of an older version stored %v", got)
+	}
+}
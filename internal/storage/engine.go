@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EngineReader reads typed values and their expiry times from an engine.
+// Expired values are not returned.
+type EngineReader interface {
+	// Get returns the value stored at key and its expiry time, which is
+	// zero for values without one.
+	Get(key string) (value interface{}, expireAt time.Time, found bool, err error)
+	// Ascend calls fn for every key from start onwards in key order,
+	// stopping at the first error fn returns, which Ascend returns.
+	Ascend(start string, fn func(key string, value interface{}, expireAt time.Time) error) error
+}
+
+// Engine is an ordered store of typed values with expiry times, which
+// MemoryEngine and LSMTree implement. Each database's keyspace is an
+// Engine too, which GET, SET, MGET, MSET and HGETALL run against whatever
+// the storage.engine setting; under the tiered and lsm settings it keeps
+// its values in another Engine. Commands that read a key and then write it
+// depending on what they read, such as INCR, EXPIRE, RENAME or the bitmap
+// commands, cannot be expressed as a Batch and call the keyspace's own
+// methods instead, as do those that need its metadata without the value,
+// such as EXISTS, TYPE or SCAN. Values must not be modified once written,
+// only replaced.
+type Engine interface {
+	EngineReader
+	// Apply writes every operation of b, which readers see either all
+	// together or not at all.
+	Apply(b *Batch) error
+	// Snapshot returns a view of the engine as it is now, which later
+	// writes do not change. It must be released, and before Close.
+	Snapshot() (EngineSnapshot, error)
+	Close() error
+}
+
+// EngineSnapshot is a point-in-time view of an engine.
+type EngineSnapshot interface {
+	EngineReader
+	Release()
+}
+
+// Batch is a list of writes applied to an engine at once. Of several
+// writes to a key, the last one wins.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key   string
+	entry lsmEntry
+	// keepTTL gives the write the expiry time the key has when the batch
+	// is applied, in place of entry's.
+	keepTTL bool
+}
+
+// Set adds a write of value at key, expiring at expireAt unless it is
+// zero.
+func (b *Batch) Set(key string, value interface{}, expireAt time.Time) {
+	b.ops = append(b.ops, batchOp{key: key, entry: lsmEntry{value: value, expireAt: expireAt}})
+}
+
+// SetKeepTTL adds a write of value at key that keeps the expiry time key
+// has, if any, as the SET command does.
+func (b *Batch) SetKeepTTL(key string, value interface{}) {
+	b.ops = append(b.ops, batchOp{key: key, entry: lsmEntry{value: value}, keepTTL: true})
+}
+
+// Delete adds a deletion of key.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, entry: lsmEntry{deleted: true}})
+}
+
+// Len returns the number of writes in b.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// EngineKind selects where the keyspace keeps its values. It is a setting
+// of the keyspace, not an Engine implementation.
+type EngineKind int
+
+const (
+	// EngineMemory keeps every value in the keyspace itself, without another
+	// Engine.
+	EngineMemory EngineKind = iota
+	// EngineTiered keeps the working set in memory and demotes the
+	// values that maxmemory evicts to an engine.
+	EngineTiered
+	// EngineLSM keeps every value in an engine, and only the keys, their
+	// types and TTLs in memory.
+	EngineLSM
+)
+
+var engineKindNames = map[EngineKind]string{
+	EngineMemory: "memory",
+	EngineTiered: "tiered",
+	EngineLSM:    "lsm",
+}
+
+func (k EngineKind) String() string {
+	return engineKindNames[k]
+}
+
+// ParseEngineKind parses "memory", "tiered" or "lsm". An empty name
+// selects memory.
+func ParseEngineKind(name string) (EngineKind, error) {
+	if name == "" {
+		return EngineMemory, nil
+	}
+	for kind, kindName := range engineKindNames {
+		if strings.EqualFold(name, kindName) {
+			return kind, nil
+		}
+	}
+	return EngineMemory, fmt.Errorf("unknown storage engine %q", name)
+}
@@ -0,0 +1,782 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// engineImpl opens an Engine implementation in dir. A durable one reopens
+// what an earlier instance left there.
+type engineImpl struct {
+	name    string
+	durable bool
+	open    func(dir string) (Engine, error)
+}
+
+func lsmImpl(name string, style CompactionStyle, codec Compression) engineImpl {
+	return engineImpl{name, true, func(dir string) (Engine, error) {
+		opts := DefaultLSMOptions()
+		opts.CompactionStyle = style
+		opts.Compression = codec
+		return NewLSMTree(dir, opts)
+	}}
+}
+
+var engineImpls = []engineImpl{
+	{"memory", false, func(string) (Engine, error) { return NewMemoryEngine(), nil }},
+	lsmImpl("lsm-leveled", LeveledCompaction, CompressionNone),
+	lsmImpl("lsm-size-tiered-snappy", SizeTieredCompaction, CompressionSnappy),
+}
+
+// TestEngineConformance runs the same checks against every Engine
+// implementation.
+func TestEngineConformance(t *testing.T) {
+	checks := []struct {
+		name    string
+		durable bool
+		run     func(t *testing.T, e Engine, reopen func() Engine)
+	}{
+		{"typed values", false, checkTypedValues},
+		{"overwrite and delete", false, checkOverwriteDelete},
+		{"expiry", false, checkExpiry},
+		{"ordered iteration", false, checkAscend},
+		{"snapshot isolation", false, checkEngineSnapshot},
+		{"atomic batches", false, checkAtomicBatches},
+		{"keep ttl", false, checkKeepTTL},
+		{"reopen", true, checkReopen},
+	}
+	impls := append([]engineImpl(nil), engineImpls...)
+	for _, setup := range keyspaceSetups {
+		impls = append(impls, keyspaceImpl(setup))
+	}
+	for _, impl := range impls {
+		for _, check := range checks {
+			t.Run(impl.name+"/"+check.name, func(t *testing.T) {
+				if check.durable && !impl.durable {
+					t.Skip("the engine keeps nothing across instances")
+				}
+				dir := t.TempDir()
+				e, err := impl.open(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { e.Close() }()
+				reopen := func() Engine {
+					t.Helper()
+					if err := e.Close(); err != nil {
+						t.Fatal(err)
+					}
+					if e, err = impl.open(dir); err != nil {
+						t.Fatal(err)
+					}
+					return e
+				}
+				check.run(t, e, reopen)
+			})
+		}
+	}
+}
+
+// keyspaceImpl opens a database under a storage.engine setting, as the
+// Engine commands run against.
+func keyspaceImpl(setup keyspaceSetup) engineImpl {
+	return engineImpl{"keyspace-" + setup.name, false, func(dir string) (Engine, error) {
+		dbs := NewDatabases(1, 4)
+		var tier Engine
+		if setup.open != nil {
+			var err error
+			if tier, err = setup.open(dir); err != nil {
+				return nil, err
+			}
+			dbs.UseEngine(setup.kind, tier)
+		}
+		store, err := dbs.DB(0)
+		if err != nil {
+			return nil, err
+		}
+		return keyspaceEngine{store.Engine(), tier}, nil
+	}}
+}
+
+// keyspaceEngine closes the engine a keyspace keeps its values in along
+// with the keyspace.
+type keyspaceEngine struct {
+	Engine
+	tier Engine
+}
+
+func (e keyspaceEngine) Close() error {
+	if e.tier == nil {
+		return nil
+	}
+	return e.tier.Close()
+}
+
+// flushed flushes engines that buffer writes in memory, so that a check
+// reads back from both places.
+func flushed(t *testing.T, e Engine) {
+	t.Helper()
+	if f, ok := e.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func apply(t *testing.T, e Engine, fn func(b *Batch)) {
+	t.Helper()
+	var b Batch
+	fn(&b)
+	if err := e.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect checks that key holds want, or is absent if want is nil.
+func expect(t *testing.T, r EngineReader, key string, want interface{}) {
+	t.Helper()
+	value, _, found, err := r.Get(key)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case want == nil && found:
+		t.Fatalf("%q holds %v, want no value", key, value)
+	case want != nil && !found:
+		t.Fatalf("%q is missing, want %v", key, want)
+	case want != nil && !sameValue(value, want):
+		t.Fatalf("%q holds %v (%T), want %v (%T)", key, value, value, want, want)
+	}
+}
+
+func sameValue(a, b interface{}) bool {
+	ha, aHash := a.(*datastructures.Hash)
+	hb, bHash := b.(*datastructures.Hash)
+	if aHash || bHash {
+		return aHash && bHash && fmt.Sprint(ha.HGetAll()) == fmt.Sprint(hb.HGetAll())
+	}
+	return a == b
+}
+
+// collect returns the keys r iterates over from start.
+func collect(t *testing.T, r EngineReader, start string) string {
+	t.Helper()
+	var keys []string
+	if err := r.Ascend(start, func(key string, _ interface{}, _ time.Time) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keys, ",")
+}
+
+func checkTypedValues(t *testing.T, e Engine, _ func() Engine) {
+	hash := datastructures.NewHash()
+	hash.HSet("field", "value")
+	values := map[string]interface{}{"string": "value", "int": int64(42), "hash": hash}
+	apply(t, e, func(b *Batch) {
+		for key, value := range values {
+			b.Set(key, value, time.Time{})
+		}
+	})
+	for round := 0; round < 2; round++ {
+		for key, value := range values {
+			expect(t, e, key, value)
+		}
+		expect(t, e, "missing", nil)
+		flushed(t, e)
+	}
+}
+
+func checkOverwriteDelete(t *testing.T, e Engine, _ func() Engine) {
+	apply(t, e, func(b *Batch) {
+		b.Set("a", "1", time.Time{})
+		b.Set("b", "1", time.Time{})
+		b.Set("a", "2", time.Time{})
+	})
+	flushed(t, e)
+	apply(t, e, func(b *Batch) {
+		b.Delete("b")
+		b.Set("c", "1", time.Time{})
+		b.Delete("c")
+	})
+	for round := 0; round < 2; round++ {
+		for key, want := range map[string]interface{}{"a": "2", "b": nil, "c": nil} {
+			expect(t, e, key, want)
+		}
+		flushed(t, e)
+	}
+}
+
+func checkExpiry(t *testing.T, e Engine, _ func() Engine) {
+	future := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	apply(t, e, func(b *Batch) {
+		b.Set("expired", "v", time.Now().Add(-time.Second))
+		b.Set("expiring", "v", future)
+	})
+	expect(t, e, "expired", nil)
+	_, expireAt, found, err := e.Get("expiring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !expireAt.Equal(future) {
+		t.Fatalf("expiring: found %v expiring at %v, want %v", found, expireAt, future)
+	}
+	if keys := collect(t, e, ""); keys != "expiring" {
+		t.Fatalf("iteration returned %q, want expiring", keys)
+	}
+}
+
+func checkAscend(t *testing.T, e Engine, _ func() Engine) {
+	// Spread the keys over a table and the memtable, with a tombstone
+	// hiding a key in the table.
+	apply(t, e, func(b *Batch) {
+		for _, key := range []string{"d", "b", "f", "a"} {
+			b.Set(key, key, time.Time{})
+		}
+	})
+	flushed(t, e)
+	apply(t, e, func(b *Batch) {
+		b.Set("c", "c", time.Time{})
+		b.Set("e", "e", time.Time{})
+		b.Delete("d")
+	})
+
+	for start, want := range map[string]string{"": "a,b,c,e,f", "c": "c,e,f", "cc": "e,f", "g": ""} {
+		if got := collect(t, e, start); got != want {
+			t.Errorf("iteration from %q returned %q, want %q", start, got, want)
+		}
+	}
+
+	stop := errors.New("stop")
+	visited := 0
+	err := e.Ascend("", func(string, interface{}, time.Time) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("iteration stopped by its callback returned %v after %d keys", err, visited)
+	}
+}
+
+func checkEngineSnapshot(t *testing.T, e Engine, _ func() Engine) {
+	apply(t, e, func(b *Batch) {
+		b.Set("kept", "old", time.Time{})
+		b.Set("deleted", "old", time.Time{})
+	})
+	snap, err := e.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	apply(t, e, func(b *Batch) {
+		b.Set("kept", "new", time.Time{})
+		b.Delete("deleted")
+		b.Set("added", "new", time.Time{})
+	})
+	flushed(t, e)
+	for key, want := range map[string]interface{}{"kept": "old", "deleted": "old", "added": nil} {
+		expect(t, snap, key, want)
+	}
+	for key, want := range map[string]interface{}{"kept": "new", "deleted": nil, "added": "new"} {
+		expect(t, e, key, want)
+	}
+	if keys := collect(t, snap, ""); keys != "deleted,kept" {
+		t.Errorf("snapshot iteration returned %q, want deleted,kept", keys)
+	}
+}
+
+func checkAtomicBatches(t *testing.T, e Engine, _ func() Engine) {
+	const rounds = 2000
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < rounds; i++ {
+			var b Batch
+			b.Set("x", int64(i), time.Time{})
+			b.Set("y", int64(i), time.Time{})
+			if err := e.Apply(&b); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		values := map[string]interface{}{}
+		if err := e.Ascend("", func(key string, value interface{}, _ time.Time) error {
+			values[key] = value
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if values["x"] != values["y"] {
+			t.Fatalf("saw x=%v and y=%v, written by one batch", values["x"], values["y"])
+		}
+	}
+}
+
+func checkKeepTTL(t *testing.T, e Engine, _ func() Engine) {
+	future := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	apply(t, e, func(b *Batch) {
+		b.Set("expiring", "old", future)
+		b.Set("expired", "old", time.Now().Add(-time.Second))
+		b.Set("persistent", "old", time.Time{})
+	})
+	flushed(t, e)
+	apply(t, e, func(b *Batch) {
+		for _, key := range []string{"expiring", "expired", "persistent", "new"} {
+			b.SetKeepTTL(key, "new")
+		}
+		b.Set("batched", "old", future)
+		b.SetKeepTTL("batched", "new")
+	})
+	for key, want := range map[string]time.Time{
+		"expiring": future, "expired": {}, "persistent": {}, "new": {}, "batched": future,
+	} {
+		expect(t, e, key, "new")
+		if _, expireAt, _, _ := e.Get(key); !expireAt.Equal(want) {
+			t.Errorf("%s expires at %v after a write keeping its TTL, want %v", key, expireAt, want)
+		}
+	}
+}
+
+func checkReopen(t *testing.T, e Engine, reopen func() Engine) {
+	apply(t, e, func(b *Batch) {
+		for i := 0; i < 100; i++ {
+			b.Set("key:"+strconv.Itoa(i), int64(i), time.Time{})
+		}
+		b.Delete("key:7")
+	})
+	e = reopen()
+	expect(t, e, "key:7", nil)
+	expect(t, e, "key:42", int64(42))
+	if keys := strings.Split(collect(t, e, ""), ","); len(keys) != 99 {
+		t.Errorf("iteration after reopening returned %d keys, want 99", len(keys))
+	}
+}
+
+// keyspaceSetup is a storage.engine setting, with the Engine it keeps
+// values in.
+type keyspaceSetup struct {
+	name string
+	kind EngineKind
+	open func(dir string) (Engine, error)
+}
+
+func tierImpl(kind EngineKind) func(dir string) (Engine, error) {
+	return func(dir string) (Engine, error) {
+		return OpenTier(dir, kind, DefaultLSMOptions())
+	}
+}
+
+var keyspaceSetups = []keyspaceSetup{
+	{"memory", EngineMemory, nil},
+	{"tiered", EngineTiered, tierImpl(EngineTiered)},
+	{"lsm", EngineLSM, tierImpl(EngineLSM)},
+	{"tiered-memory-engine", EngineTiered, engineImpls[0].open},
+	{"lsm-memory-engine", EngineLSM, engineImpls[0].open},
+}
+
+// TestKeyspaceConformance runs the same commands against the keyspace
+// under each storage.engine setting.
+func TestKeyspaceConformance(t *testing.T) {
+	checks := []struct {
+		name string
+		run  func(t *testing.T, k *testKeyspace)
+	}{
+		{"strings", checkStrings},
+		{"delete and exists", checkDelete},
+		{"ttl", checkTTL},
+		{"types and scan", checkScan},
+		{"key ranges", checkKeyRange},
+		{"rename, copy and move", checkRenameCopyMove},
+		{"snapshot round trip", checkRoundTrip},
+		{"read snapshots", checkReadSnapshot},
+		{"dump and restore", checkDumpRestore},
+		{"backup and point-in-time restore", checkBackup},
+		{"flushall", checkFlushAll},
+	}
+	for _, setup := range keyspaceSetups {
+		for _, check := range checks {
+			t.Run(setup.name+"/"+check.name, func(t *testing.T) {
+				check.run(t, newTestKeyspace(t, setup, t.TempDir()))
+			})
+		}
+	}
+}
+
+// testKeyspace is a server's databases and command handler under one
+// storage.engine setting. The tiered engine runs under a memory limit
+// small enough for the checks to demote most keys.
+type testKeyspace struct {
+	setup   keyspaceSetup
+	dir     string
+	dbs     *Databases
+	handler *CommandHandler
+	ctx     context.Context
+}
+
+func newTestKeyspace(t *testing.T, setup keyspaceSetup, dir string) *testKeyspace {
+	t.Helper()
+	k := &testKeyspace{setup: setup, dir: dir, dbs: NewDatabases(2, 4)}
+	if setup.kind == EngineTiered {
+		k.dbs.ConfigureEviction(64<<10, NoEviction, 0)
+	}
+	if setup.open != nil {
+		e, err := setup.open(filepath.Join(dir, "lsm"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { e.Close() })
+		k.dbs.UseEngine(setup.kind, e)
+	}
+	k.handler = NewCommandHandler(k.dbs)
+	k.ctx = k.handler.NewSession(context.Background())
+	return k
+}
+
+// do runs a command and returns its reply.
+func (k *testKeyspace) do(t *testing.T, args ...string) interface{} {
+	t.Helper()
+	reply, err := k.handler.HandleCommand(k.ctx, args)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return reply
+}
+
+// want runs a command and checks its reply.
+func (k *testKeyspace) want(t *testing.T, reply interface{}, args ...string) {
+	t.Helper()
+	if got := k.do(t, args...); fmt.Sprint(got) != fmt.Sprint(reply) {
+		t.Fatalf("%s returned %v, want %v", strings.Join(args, " "), got, reply)
+	}
+}
+
+// fill stores n keys with values of about 1KB, enough for the tiered
+// engine to demote most of them.
+func (k *testKeyspace) fill(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		k.want(t, "OK", "SET", "key:"+strconv.Itoa(i), fillValue(i))
+	}
+}
+
+func fillValue(i int) string {
+	return strconv.Itoa(i) + strings.Repeat("v", 1000)
+}
+
+func checkStrings(t *testing.T, k *testKeyspace) {
+	k.fill(t, 500)
+	for i := 0; i < 500; i += 7 {
+		k.want(t, fillValue(i), "GET", "key:"+strconv.Itoa(i))
+	}
+	k.want(t, "OK", "SET", "key:3", "changed")
+	k.want(t, "changed", "GET", "key:3")
+	k.want(t, int64(11), "INCRBY", "counter", "11")
+	k.want(t, int64(501), "DBSIZE")
+}
+
+func checkDelete(t *testing.T, k *testKeyspace) {
+	k.fill(t, 200)
+	k.want(t, int64(3), "DEL", "key:1", "key:150", "key:199", "missing")
+	k.want(t, int64(1), "EXISTS", "key:1", "key:2")
+	k.want(t, nil, "GET", "key:150")
+	k.want(t, int64(197), "DBSIZE")
+}
+
+func checkTTL(t *testing.T, k *testKeyspace) {
+	k.fill(t, 200)
+	k.want(t, int64(1), "EXPIRE", "key:0", "100")
+	// Demote key:0 again, if the engine demotes, before reading its TTL.
+	k.fill(t, 200)
+	if ttl, _ := k.do(t, "TTL", "key:0").(int64); ttl <= 0 || ttl > 100 {
+		t.Fatalf("TTL key:0 returned %v, want 1 to 100", ttl)
+	}
+	k.want(t, nil, "TTL", "key:1")
+
+	// SET keeps the TTL, and GET and MGET do not return expired values.
+	k.want(t, "OK", "SET", "key:0", "new")
+	if ttl, _ := k.do(t, "TTL", "key:0").(int64); ttl <= 0 {
+		t.Fatalf("TTL key:0 returned %v after SET, want 1 to 100", ttl)
+	}
+	k.want(t, int64(1), "EXPIRE", "key:2", "-1")
+	k.want(t, nil, "GET", "key:2")
+	k.want(t, []interface{}{"new", nil}, "MGET", "key:0", "key:2")
+}
+
+func checkScan(t *testing.T, k *testKeyspace) {
+	k.fill(t, 300)
+	k.want(t, int64(0), "SETBIT", "bits", "7", "1")
+	k.want(t, int64(42), "INCRBY", "number", "42")
+	k.want(t, "string", "TYPE", "key:12")
+	k.want(t, "string", "TYPE", "number")
+
+	seen := map[string]bool{}
+	cursor := "0"
+	for {
+		page, ok := k.do(t, "SCAN", cursor, "COUNT", "50", "TYPE", "string").([]interface{})
+		if !ok || len(page) != 2 {
+			t.Fatalf("SCAN returned %v", page)
+		}
+		keys, _ := page[1].([]string)
+		for _, key := range keys {
+			seen[key] = true
+		}
+		if cursor = fmt.Sprint(page[0]); cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 302 || !seen["number"] || !seen["bits"] {
+		t.Fatalf("SCAN TYPE string returned %d keys, want 302", len(seen))
+	}
+}
+
+func checkKeyRange(t *testing.T, k *testKeyspace) {
+	k.fill(t, 200)
+	k.want(t, int64(1), "DEL", "key:105")
+	for _, ordered := range []bool{false, true} {
+		if ordered {
+			k.dbs.EnableOrderedIndex()
+		}
+		keyRangeSteps(t, k)
+		keyPrefixPages(t, k)
+	}
+}
+
+// keyRangeSteps checks the bounds, limits and tokens of KEYRANGE and
+// KEYPREFIX over the keys fill stores, less key:105.
+func keyRangeSteps(t *testing.T, k *testKeyspace) {
+	t.Helper()
+	keys := func(keys ...string) []string { return keys }
+	for _, step := range []struct {
+		reply interface{}
+		args  []string
+	}{
+		{[]interface{}{"(key:108", keys("key:10", "key:100", "key:101", "key:102", "key:103",
+			"key:104", "key:106", "key:107", "key:108")}, []string{"KEYRANGE", "[key:10", "(key:11", "LIMIT", "9"}},
+		{[]interface{}{"", keys("key:109")}, []string{"KEYRANGE", "(key:108", "(key:11"}},
+		{[]interface{}{"", keys("key:100")}, []string{"KEYRANGE", "(key:10", "[key:100"}},
+		{[]interface{}{"", keys()}, []string{"KEYRANGE", "(key:109", "(key:11"}},
+		{[]interface{}{"(key:0", keys("key:0")}, []string{"KEYRANGE", "-", "+", "LIMIT", "1"}},
+		{[]interface{}{"", keys("key:99")}, []string{"KEYRANGE", "(key:98", "+"}},
+		{[]interface{}{"(key:102", keys("key:10", "key:100", "key:101", "key:102")},
+			[]string{"KEYPREFIX", "key:10", "LIMIT", "4"}},
+		{[]interface{}{"", keys("key:106", "key:107", "key:108", "key:109")},
+			[]string{"KEYPREFIX", "key:10", "FROM", "(key:104"}},
+		{[]interface{}{"(key:100", keys("key:10", "key:100")},
+			[]string{"KEYPREFIX", "key:10", "FROM", "[a", "LIMIT", "2"}},
+		{[]interface{}{"", keys()}, []string{"KEYPREFIX", "none:"}},
+	} {
+		k.want(t, step.reply, step.args...)
+	}
+	for _, args := range [][]string{
+		{"KEYRANGE", "key:1", "+"},
+		{"KEYRANGE", "-", "+", "LIMIT", "0"},
+		{"KEYRANGE", "-", "+", "FROM", "(key:1"},
+		{"KEYPREFIX", "key:", "LIMIT"},
+	} {
+		if _, err := k.handler.HandleCommand(k.ctx, args); err == nil {
+			t.Errorf("%s succeeded", strings.Join(args, " "))
+		}
+	}
+}
+
+// keyPrefixPages reads every key starting with key:1 a page at a time and
+// checks that the pages join up in order.
+func keyPrefixPages(t *testing.T, k *testKeyspace) {
+	t.Helper()
+	var got []string
+	token := ""
+	for pages := 0; ; pages++ {
+		args := []string{"KEYPREFIX", "key:1", "LIMIT", "7"}
+		if token != "" {
+			args = append(args, "FROM", token)
+		}
+		page := k.do(t, args...).([]interface{})
+		got = append(got, page[1].([]string)...)
+		if token = page[0].(string); token == "" {
+			break
+		}
+		if pages > 100 {
+			t.Fatalf("KEYPREFIX did not finish, last token %q", token)
+		}
+	}
+	if !sort.StringsAreSorted(got) {
+		t.Fatalf("KEYPREFIX pages are out of order: %v", got)
+	}
+	// key:1, key:10 to key:19 and key:100 to key:199, less key:105.
+	if len(got) != 110 || got[0] != "key:1" || got[len(got)-1] != "key:199" {
+		t.Fatalf("KEYPREFIX returned %d keys from %v", len(got), got)
+	}
+}
+
+func checkRenameCopyMove(t *testing.T, k *testKeyspace) {
+	k.fill(t, 200)
+	for _, step := range []struct {
+		reply interface{}
+		args  []string
+	}{
+		{"OK", []string{"RENAME", "key:0", "renamed"}},
+		{nil, []string{"GET", "key:0"}},
+		{fillValue(0), []string{"GET", "renamed"}},
+		{int64(1), []string{"COPY", "key:1", "copied"}},
+		{fillValue(1), []string{"GET", "copied"}},
+		{int64(1), []string{"MOVE", "key:2", "1"}},
+		{nil, []string{"GET", "key:2"}},
+		{"OK", []string{"SELECT", "1"}},
+		{fillValue(2), []string{"GET", "key:2"}},
+	} {
+		k.want(t, step.reply, step.args...)
+	}
+}
+
+func checkRoundTrip(t *testing.T, k *testKeyspace) {
+	k.fill(t, 300)
+	k.want(t, int64(1), "EXPIRE", "key:5", "1000")
+	p, err := NewPersistenceLayer(filepath.Join(k.dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.handler.SaveSnapshot(p)
+	p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestKeyspace(t, k.setup, filepath.Join(k.dir, "restored"))
+	p, err = NewPersistenceLayer(filepath.Join(k.dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := restored.handler.Recover(p); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		restored.want(t, fillValue(i), "GET", "key:"+strconv.Itoa(i))
+	}
+	restored.want(t, int64(1), "EXISTS", "key:5")
+	if restored.do(t, "TTL", "key:5") == nil {
+		t.Fatal("restored key:5 lost its TTL")
+	}
+}
+
+// checkReadSnapshot changes keys while a SNAPSHOT is open and reads them
+// back from it.
+func checkReadSnapshot(t *testing.T, k *testKeyspace) {
+	k.fill(t, 300)
+	token := k.do(t, "SNAPSHOT", "OPEN").(string)
+	for _, args := range [][]string{
+		{"SET", "key:1", "changed"},
+		{"DEL", "key:2"},
+		{"SET", "added", "new"},
+		{"FLUSHDB"},
+		{"SET", "key:3", "after flush"},
+	} {
+		k.do(t, args...)
+	}
+	for _, c := range []struct {
+		reply interface{}
+		args  []string
+	}{
+		{fillValue(1), []string{"GET", "key:1"}},
+		{fillValue(2), []string{"GET", "key:2"}},
+		{fillValue(3), []string{"GET", "key:3"}},
+		{nil, []string{"GET", "added"}},
+		{int64(300), []string{"DBSIZE"}},
+		{"[ [key:0 key:1 key:10]]", []string{"KEYRANGE", "-", "[key:10"}},
+	} {
+		k.want(t, c.reply, append([]string{"SNAPSHOT", "READ", token}, c.args...)...)
+	}
+	k.want(t, "after flush", "GET", "key:3")
+	k.want(t, int64(1), "SNAPSHOT", "RELEASE", token)
+	if _, err := k.handler.HandleCommand(k.ctx, []string{"SNAPSHOT", "READ", token, "DBSIZE"}); err == nil {
+		t.Fatal("a released snapshot can still be read")
+	}
+}
+
+// checkDumpRestore copies keys with DUMP and RESTORE.
+func checkDumpRestore(t *testing.T, k *testKeyspace) {
+	k.fill(t, 200)
+	k.want(t, int64(7), "INCRBY", "counter", "7")
+	for _, key := range []string{"key:0", "key:199", "counter"} {
+		payload := k.do(t, "DUMP", key).(string)
+		if _, err := k.handler.HandleCommand(k.ctx, []string{"RESTORE", key, "0", payload}); err != ErrBusyKey {
+			t.Fatalf("RESTORE over %s returned %v, want %v", key, err, ErrBusyKey)
+		}
+		k.want(t, "OK", "RESTORE", key+":copy", "100000", payload)
+		k.want(t, k.do(t, "GET", key), "GET", key+":copy")
+		if k.do(t, "TTL", key+":copy") == nil {
+			t.Fatalf("%s:copy has no TTL", key)
+		}
+	}
+	damaged := []byte(k.do(t, "DUMP", "key:5").(string))
+	damaged[1] ^= 0xff
+	if _, err := k.handler.HandleCommand(k.ctx, []string{"RESTORE", "damaged", "0", string(damaged)}); err != ErrBadDump {
+		t.Fatalf("RESTORE of a damaged payload returned %v, want %v", err, ErrBadDump)
+	}
+	k.want(t, nil, "DUMP", "missing")
+}
+
+// checkBackup takes a backup, brings it up to date after more writes and
+// restores it both in full and as of a command in between.
+func checkBackup(t *testing.T, k *testKeyspace) {
+	p, err := NewPersistenceLayer(filepath.Join(k.dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	k.handler.EnablePersistence(p)
+	backup := filepath.Join(k.dir, "backup")
+
+	k.fill(t, 100)
+	k.do(t, "BACKUP", backup)
+	k.want(t, "OK", "SET", "key:0", "changed")
+	seq := p.Seq()
+	k.want(t, int64(1), "DEL", "key:1")
+	k.do(t, "BACKUP", backup)
+
+	for _, c := range []struct {
+		opts RestoreOptions
+		key1 interface{}
+	}{
+		{RestoreOptions{}, nil},
+		{RestoreOptions{UntilSeq: seq}, fillValue(1)},
+	} {
+		restored := newTestKeyspace(t, k.setup, filepath.Join(k.dir, "restored"+strconv.FormatUint(c.opts.UntilSeq, 10)))
+		if _, err := restored.handler.RestoreBackup(backup, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		restored.want(t, "changed", "GET", "key:0")
+		restored.want(t, c.key1, "GET", "key:1")
+		restored.want(t, fillValue(99), "GET", "key:99")
+	}
+}
+
+func checkFlushAll(t *testing.T, k *testKeyspace) {
+	k.fill(t, 300)
+	k.want(t, "OK", "FLUSHALL")
+	k.want(t, int64(0), "DBSIZE")
+	k.want(t, nil, "GET", "key:10")
+	k.fill(t, 50)
+}
@@ -0,0 +1,547 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+const (
+	// DefaultEvictionSamples is the number of keys sampled per database
+	// when looking for an eviction candidate.
+	DefaultEvictionSamples = 5
+
+	evictionPoolSize = 16
+	// evictionAttempts is how many times an eviction samples keys before
+	// giving up when none of those sampled can be evicted.
+	evictionAttempts = 5
+
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	// lfuDecayTime is the number of idle minutes after which a key's LFU
+	// counter is decremented by one.
+	lfuDecayTime = 1
+
+	// entryOverhead approximates the bytes spent per key outside of the key
+	// and value themselves: the map slot, the entry and its scan index slot.
+	entryOverhead = 96
+	// compactHeader approximates a packed collection's struct and lock.
+	compactHeader = 64
+)
+
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+
+// EvictionPolicy selects which keys are removed when maxmemory is reached.
+type EvictionPolicy int
+
+const (
+	NoEviction EvictionPolicy = iota
+	AllKeysLRU
+	AllKeysLFU
+	AllKeysRandom
+	VolatileLRU
+	VolatileLFU
+	VolatileRandom
+	VolatileTTL
+)
+
+var evictionPolicyNames = map[EvictionPolicy]string{
+	NoEviction:     "noeviction",
+	AllKeysLRU:     "allkeys-lru",
+	AllKeysLFU:     "allkeys-lfu",
+	AllKeysRandom:  "allkeys-random",
+	VolatileLRU:    "volatile-lru",
+	VolatileLFU:    "volatile-lfu",
+	VolatileRandom: "volatile-random",
+	VolatileTTL:    "volatile-ttl",
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+// volatile reports whether the policy only evicts keys with a TTL.
+func (p EvictionPolicy) volatile() bool {
+	return p == VolatileLRU || p == VolatileLFU || p == VolatileRandom || p == VolatileTTL
+}
+
+func (p EvictionPolicy) random() bool {
+	return p == AllKeysRandom || p == VolatileRandom
+}
+
+// ParseEvictionPolicy parses a maxmemory-policy name such as "allkeys-lru".
+// An empty name selects noeviction.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	if name == "" {
+		return NoEviction, nil
+	}
+	for policy, policyName := range evictionPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return policy, nil
+		}
+	}
+	return NoEviction, fmt.Errorf("unknown maxmemory policy %q", name)
+}
+
+// ParseMemory parses a memory size such as "100mb" using the Redis units:
+// k, m and g are powers of 1000, kb, mb and gb powers of 1024.
+func ParseMemory(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", value)
+	}
+	return n * scale, nil
+}
+
+func formatMemory(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.2fG", float64(bytes)/(1<<30))
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.2fM", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.2fK", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", bytes)
+}
+
+// estimateSize approximates the memory used by a key and its value.
+func estimateSize(key string, value interface{}) int64 {
+	return entryOverhead + int64(len(key)) + valueSize(value)
+}
+
+func valueSize(value interface{}) int64 {
+	return sampledValueSize(value, 0)
+}
+
+// sampledValueSize estimates the size of value from at most samples of its
+// elements, extrapolated to the whole collection. Zero samples every
+// element.
+func sampledValueSize(value interface{}, samples int) int64 {
+	var header int64
+	var sizes []int64
+	sampled := func() bool {
+		return samples > 0 && len(sizes) == samples
+	}
+
+	if compact, ok := value.(interface{ CompactSize() (int, bool) }); ok {
+		if size, packed := compact.CompactSize(); packed {
+			return compactHeader + int64(size)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return int64(len(v)) + 16
+	case int64:
+		return 8
+	case *datastructures.Hash:
+		header = 48
+		for field, fieldValue := range v.HGetAll() {
+			if sampled() {
+				break
+			}
+			sizes = append(sizes, int64(len(field))+valueSize(fieldValue)+32)
+		}
+	case *datastructures.Set:
+		header = 48
+		for _, member := range v.Members() {
+			if sampled() {
+				break
+			}
+			sizes = append(sizes, valueSize(member)+32)
+		}
+	case *datastructures.List:
+		header = 24
+		stop := v.Len()
+		if samples > 0 && samples < stop {
+			stop = samples
+		}
+		for _, element := range v.Range(0, stop) {
+			sizes = append(sizes, valueSize(element)+16)
+		}
+	case *datastructures.SortedSet:
+		header = 48
+		count := math.MaxInt32
+		if samples > 0 {
+			count = samples
+		}
+		members, _, _ := v.Scan(0, count)
+		for _, member := range members {
+			if sampled() {
+				break
+			}
+			sizes = append(sizes, int64(len(member))+8+32)
+		}
+	default:
+		return 16
+	}
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	if n := int64(valueLen(value)); len(sizes) > 0 && int64(len(sizes)) < n {
+		total = total * n / int64(len(sizes))
+	}
+	return header + total
+}
+
+// lfuMinutes returns the current time in minutes, truncated to 16 bits.
+func lfuMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 0xffff
+}
+
+// lfuDecay returns the LFU counter stored in packed after decrementing it
+// by one for every lfuDecayTime minutes since its last decrement.
+func lfuDecay(packed uint32) uint8 {
+	last, counter := packed>>8, uint8(packed&0xff)
+	now := lfuMinutes()
+	elapsed := now - last
+	if now < last {
+		elapsed = 0xffff - last + now
+	}
+	periods := elapsed / lfuDecayTime
+	if periods >= uint32(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+// lfuLogIncr increments an LFU counter with a probability that falls as
+// the counter grows, so 8 bits can represent millions of accesses.
+func lfuLogIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// evictionCandidate is a sampled key and its score; the higher the score,
+// the better the key is to evict.
+type evictionCandidate struct {
+	score uint64
+	db    int
+	key   string
+}
+
+// memoryTracker accounts memory across every database sharing a maxmemory
+// limit and runs evictions when it is exceeded.
+type memoryTracker struct {
+	used    atomic.Int64
+	peak    atomic.Int64
+	evicted atomic.Int64
+
+	maxMemory int64
+	policy    EvictionPolicy
+	samples   int
+
+	// mu serializes evictions and guards the candidate pool.
+	mu   sync.Mutex
+	pool []evictionCandidate
+}
+
+func newMemoryTracker() *memoryTracker {
+	return &memoryTracker{samples: DefaultEvictionSamples}
+}
+
+// add adjusts the used memory by delta and records the peak.
+func (m *memoryTracker) add(delta int64) {
+	used := m.used.Add(delta)
+	for {
+		peak := m.peak.Load()
+		if used <= peak || m.peak.CompareAndSwap(peak, used) {
+			return
+		}
+	}
+}
+
+// overLimit reports whether maxmemory is set and exceeded.
+func (m *memoryTracker) overLimit() bool {
+	return m.maxMemory > 0 && m.used.Load() > m.maxMemory
+}
+
+// addToPool merges candidates into the pool, keeping the best
+// evictionPoolSize of them ordered from worst to best.
+func (m *memoryTracker) addToPool(candidates []evictionCandidate) {
+	for _, c := range candidates {
+		replaced := false
+		for i := range m.pool {
+			if m.pool[i].db == c.db && m.pool[i].key == c.key {
+				m.pool[i].score = c.score
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			m.pool = append(m.pool, c)
+		}
+	}
+	sort.Slice(m.pool, func(i, j int) bool {
+		return m.pool[i].score < m.pool[j].score
+	})
+	if len(m.pool) > evictionPoolSize {
+		m.pool = m.pool[len(m.pool)-evictionPoolSize:]
+	}
+}
+
+// evictionScore scores an entry under policy. The caller must hold the
+// shard lock.
+func (sh *shard) evictionScore(key string, e *entry, policy EvictionPolicy, now int64) uint64 {
+	switch policy {
+	case AllKeysLFU, VolatileLFU:
+		return 255 - uint64(lfuDecay(e.lfu.Load()))
+	case VolatileTTL:
+		return math.MaxUint64 - uint64(sh.ttls[key].UnixMilli())
+	default:
+		idle := now - e.accessed.Load()
+		if idle < 0 {
+			idle = 0
+		}
+		return uint64(idle)
+	}
+}
+
+// sampleCandidates returns up to n randomly chosen keys scored for policy.
+// Volatile policies only sample keys with a TTL. Cold keys are never
+// sampled; the TTLs of cold keys are skipped, looking at no more than 3n
+// of them per shard.
+func (s *InMemoryStore) sampleCandidates(db, n int, policy EvictionPolicy) []evictionCandidate {
+	now := time.Now().UnixMilli()
+	candidates := make([]evictionCandidate, 0, n)
+	start := rand.Intn(len(s.shards))
+	for i := 0; i < len(s.shards) && len(candidates) < n; i++ {
+		sh := s.shards[(start+i)%len(s.shards)]
+		sh.mu.RLock()
+		if policy.volatile() {
+			// Map iteration starts at a random position.
+			skipped := 0
+			for key := range sh.ttls {
+				if len(candidates) == n || skipped == 3*n {
+					break
+				}
+				e, exists := sh.data[key]
+				if !exists {
+					skipped++
+					continue
+				}
+				candidates = append(candidates, evictionCandidate{sh.evictionScore(key, e, policy, now), db, key})
+			}
+		} else if len(sh.cold) > 0 {
+			// The index mostly holds cold keys, so sample the keys in
+			// memory directly.
+			for key, e := range sh.data {
+				if len(candidates) == n {
+					break
+				}
+				candidates = append(candidates, evictionCandidate{sh.evictionScore(key, e, policy, now), db, key})
+			}
+		} else if len(sh.data) > 0 {
+			for attempts := 0; attempts < 3*n && len(candidates) < n; attempts++ {
+				bucket := sh.index.buckets[rand.Intn(len(sh.index.buckets))]
+				if len(bucket) == 0 {
+					continue
+				}
+				key := bucket[rand.Intn(len(bucket))].key
+				if e, exists := sh.data[key]; exists {
+					candidates = append(candidates, evictionCandidate{sh.evictionScore(key, e, policy, now), db, key})
+				}
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return candidates
+}
+
+// evictKey removes key if it is still in memory and, for volatile
+// policies, still has a TTL.
+func (s *InMemoryStore) evictKey(key string, volatile bool) bool {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, hasTTL := sh.ttls[key]; volatile && !hasTTL {
+		return false
+	}
+	if _, exists := sh.data[key]; !exists {
+		return false
+	}
+	return sh.delete(key)
+}
+
+// ConfigureEviction sets the memory limit shared by all databases, the
+// eviction policy applied when it is exceeded and the number of keys
+// sampled per database. A limit of 0 disables eviction.
+func (d *Databases) ConfigureEviction(maxMemory int64, policy EvictionPolicy, samples int) {
+	d.mem.mu.Lock()
+	defer d.mem.mu.Unlock()
+
+	if samples <= 0 {
+		samples = DefaultEvictionSamples
+	}
+	d.mem.maxMemory = maxMemory
+	d.mem.policy = policy
+	d.mem.samples = samples
+	d.mem.pool = nil
+}
+
+// UsedMemory returns the estimated memory used by all databases.
+func (d *Databases) UsedMemory() int64 {
+	return d.mem.used.Load()
+}
+
+// freeMemoryIfNeeded evicts keys until used memory is back under
+// maxmemory. It returns ErrOOM if that is not possible, either because the
+// policy is noeviction or because no key is eligible.
+func (d *Databases) freeMemoryIfNeeded() error {
+	if !d.mem.overLimit() {
+		return nil
+	}
+
+	d.mem.mu.Lock()
+	defer d.mem.mu.Unlock()
+
+	policy := d.mem.policy
+	if d.tier != nil && policy == NoEviction {
+		policy = AllKeysLRU
+	}
+	if policy == NoEviction {
+		if d.mem.overLimit() {
+			return ErrOOM
+		}
+		return nil
+	}
+	for d.mem.overLimit() {
+		if !d.evictOne(policy) {
+			return ErrOOM
+		}
+	}
+	return nil
+}
+
+// evictOne removes or demotes a single key chosen by policy. The caller
+// must hold d.mem.mu.
+func (d *Databases) evictOne(policy EvictionPolicy) bool {
+	volatile := policy.volatile()
+
+	if policy.random() {
+		start := rand.Intn(d.Len())
+		for i := 0; i < d.Len(); i++ {
+			index := (start + i) % d.Len()
+			db, _ := d.DB(index)
+			for _, c := range db.sampleCandidates(index, 1, policy) {
+				if d.evict(index, c.key, volatile) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// Approximated LRU/LFU/TTL: refill the pool with samples from every
+	// database, then evict the best candidate that still exists. Candidates
+	// can all have gone by the time they are evicted, so the pool is only
+	// refilled a few times.
+	for attempt := 0; attempt < evictionAttempts; attempt++ {
+		sampled := 0
+		for i := 0; i < d.Len(); i++ {
+			db, _ := d.DB(i)
+			candidates := db.sampleCandidates(i, d.mem.samples, policy)
+			sampled += len(candidates)
+			d.mem.addToPool(candidates)
+		}
+		if sampled == 0 {
+			return false
+		}
+
+		for len(d.mem.pool) > 0 {
+			best := d.mem.pool[len(d.mem.pool)-1]
+			d.mem.pool = d.mem.pool[:len(d.mem.pool)-1]
+			if d.evict(best.db, best.key, volatile) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evict removes key from database index for the eviction policy, or with
+// tiering enabled demotes it, falling back to removing it if the tier
+// cannot take its value. The key's write stripe is held so that a deletion
+// is logged in order with writes to the same key.
+func (d *Databases) evict(index int, key string, volatile bool) bool {
+	unlock := d.writeLocks.lock([]string{key})
+	defer unlock()
+
+	db, err := d.DB(index)
+	if err != nil {
+		return false
+	}
+	if d.tier != nil && db.demoteKey(key, volatile) {
+		return true
+	}
+	if !db.evictKey(key, volatile) {
+		return false
+	}
+	d.mem.evicted.Add(1)
+	if d.onEvict != nil {
+		d.onEvict(index, key)
+	}
+	return true
+}
+
+func (h *CommandHandler) infoMemory() string {
+	mem := h.dbs.mem
+	var b strings.Builder
+	b.WriteString("# Memory\r\n")
+	fmt.Fprintf(&b, "used_memory:%d\r\n", mem.used.Load())
+	fmt.Fprintf(&b, "used_memory_human:%s\r\n", formatMemory(mem.used.Load()))
+	fmt.Fprintf(&b, "maxmemory:%d\r\n", mem.maxMemory)
+	fmt.Fprintf(&b, "maxmemory_human:%s\r\n", formatMemory(mem.maxMemory))
+	fmt.Fprintf(&b, "maxmemory_policy:%s\r\n", mem.policy)
+	return b.String()
+}
+
+func (h *CommandHandler) infoStats() string {
+	var b strings.Builder
+	b.WriteString("# Stats\r\n")
+	fmt.Fprintf(&b, "evicted_keys:%d\r\n", h.dbs.mem.evicted.Load())
+	return b.String()
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTieredVolatileEviction fills a tiered keyspace with keys that have a
+// TTL under each volatile policy. Demoted keys keep their TTL, so eviction
+// must neither score nor wait for them.
+func TestTieredVolatileEviction(t *testing.T) {
+	for _, policy := range []EvictionPolicy{VolatileLRU, VolatileLFU, VolatileRandom, VolatileTTL} {
+		t.Run(policy.String(), func(t *testing.T) {
+			lsm, err := NewLSMTree(t.TempDir(), LSMOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lsm.Close()
+			dbs := NewDatabases(1, 4)
+			dbs.UseEngine(EngineTiered, lsm)
+			dbs.ConfigureEviction(64<<10, policy, 5)
+			h := NewCommandHandler(dbs)
+			ctx := h.NewSession(context.Background())
+
+			done := make(chan error, 1)
+			go func() {
+				value := strings.Repeat("v", 200)
+				for i := 0; i < 2000; i++ {
+					key := fmt.Sprintf("key:%d", i)
+					for _, args := range [][]string{{"SET", key, value}, {"EXPIRE", key, "1000"}} {
+						if _, err := h.HandleCommand(ctx, args); err != nil && !errors.Is(err, ErrOOM) {
+							done <- err
+							return
+						}
+					}
+				}
+				done <- nil
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatal("writes under maxmemory did not finish")
+			}
+
+			if dbs.tier.demotions.Load() == 0 {
+				t.Error("no keys were demoted")
+			}
+			if used := dbs.UsedMemory(); used > 64<<10+1<<10 {
+				t.Errorf("used memory %d is over the limit", used)
+			}
+		})
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"100", 100},
+		{"10b", 10},
+		{"1k", 1000},
+		{"1kb", 1 << 10},
+		{"2m", 2000000},
+		{"2MB", 2 << 20},
+		{"1g", 1000000000},
+		{" 3gb ", 3 << 30},
+	} {
+		if got, err := ParseMemory(c.value); err != nil || got != c.want {
+			t.Errorf("ParseMemory(%q) = %d, %v, want %d", c.value, got, err, c.want)
+		}
+	}
+	for _, value := range []string{"-1", "-1mb", "abc", "1.5mb", "mb", "1tb", "1 mb"} {
+		if got, err := ParseMemory(value); err == nil {
+			t.Errorf("ParseMemory(%q) = %d, want an error", value, got)
+		}
+	}
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for policy, name := range evictionPolicyNames {
+		for _, s := range []string{name, strings.ToUpper(name)} {
+			if got, err := ParseEvictionPolicy(s); err != nil || got != policy {
+				t.Errorf("ParseEvictionPolicy(%q) = %v, %v, want %v", s, got, err, policy)
+			}
+		}
+	}
+	if got, err := ParseEvictionPolicy(""); err != nil || got != NoEviction {
+		t.Errorf("ParseEvictionPolicy(\"\") = %v, %v, want noeviction", got, err)
+	}
+	for _, name := range []string{"lru", "allkeys", "allkeys_lru", "volatile-lru "} {
+		if _, err := ParseEvictionPolicy(name); err == nil {
+			t.Errorf("ParseEvictionPolicy(%q) succeeded", name)
+		}
+	}
+}
+
+// TestEvictionPolicies fills a keyspace with recently and often used keys
+// that have a distant TTL ("hot"), keys idle for an hour, rarely used and
+// close to expiring ("cold"), and cold keys without a TTL ("persistent"),
+// then lowers maxmemory so that about ten keys must go, and checks which
+// ones each policy evicted.
+func TestEvictionPolicies(t *testing.T) {
+	const perGroup = 30
+	for _, c := range []struct {
+		policy EvictionPolicy
+		// keeps lists the groups none of whose keys may be evicted.
+		keeps []string
+	}{
+		{AllKeysLRU, []string{"hot"}},
+		{AllKeysLFU, []string{"hot"}},
+		{AllKeysRandom, nil},
+		{VolatileLRU, []string{"hot", "persistent"}},
+		{VolatileLFU, []string{"hot", "persistent"}},
+		{VolatileRandom, []string{"persistent"}},
+		{VolatileTTL, []string{"hot", "persistent"}},
+	} {
+		t.Run(c.policy.String(), func(t *testing.T) {
+			dbs := NewDatabases(1, 4)
+			h := NewCommandHandler(dbs)
+			ctx := h.NewSession(context.Background())
+			do := func(args ...string) (interface{}, error) {
+				return h.HandleCommand(ctx, args)
+			}
+			db, _ := dbs.DB(0)
+			idle := time.Now().Add(-time.Hour).UnixMilli()
+			for i := 0; i < perGroup; i++ {
+				for _, group := range []string{"hot", "cold", "persistent"} {
+					key := fmt.Sprintf("%s:%d", group, i)
+					do("SET", key, strings.Repeat("v", 100))
+					e := db.shardFor(key).data[key]
+					switch group {
+					case "hot":
+						do("EXPIRE", key, "100000")
+						e.lfu.Store(lfuMinutes()<<8 | 200)
+					case "cold":
+						do("EXPIRE", key, "100")
+						fallthrough
+					default:
+						e.accessed.Store(idle)
+						e.lfu.Store(lfuMinutes() << 8)
+					}
+				}
+			}
+
+			keySize := estimateSize("cold:0", strings.Repeat("v", 100))
+			limit := dbs.UsedMemory() - 10*keySize
+			// Sample enough keys that every sample holds cold ones, so
+			// that the approximated policies behave exactly.
+			dbs.ConfigureEviction(limit, c.policy, 64)
+			if _, err := do("SET", "new", "value"); err != nil {
+				t.Fatalf("SET over maxmemory: %v", err)
+			}
+			if used := dbs.UsedMemory(); used > limit+keySize {
+				t.Errorf("used memory %d is over the limit of %d", used, limit)
+			}
+
+			evicted := map[string]int{}
+			total := 0
+			for i := 0; i < perGroup; i++ {
+				for _, group := range []string{"hot", "cold", "persistent"} {
+					if reply, _ := do("EXISTS", fmt.Sprintf("%s:%d", group, i)); reply == int64(0) {
+						evicted[group]++
+						total++
+					}
+				}
+			}
+			if total < 10 {
+				t.Errorf("%d keys were evicted, want at least 10", total)
+			}
+			for _, group := range c.keeps {
+				if evicted[group] > 0 {
+					t.Errorf("%d %s keys were evicted: %v", evicted[group], group, evicted)
+				}
+			}
+			size, _ := do("DBSIZE")
+			if got, missing := dbs.mem.evicted.Load(), 3*perGroup+1-size.(int64); got != missing {
+				t.Errorf("%d evictions counted, %d keys missing", got, missing)
+			}
+		})
+	}
+}
+
+func TestNoEvictionOOM(t *testing.T) {
+	dbs := NewDatabases(1, 4)
+	h := NewCommandHandler(dbs)
+	ctx := h.NewSession(context.Background())
+	for i := 0; i < 10; i++ {
+		h.HandleCommand(ctx, []string{"SET", fmt.Sprintf("key:%d", i), "value"})
+	}
+	dbs.ConfigureEviction(dbs.UsedMemory()-1, NoEviction, 0)
+
+	// Only commands flagged cmdDenyOOM are refused.
+	for _, args := range [][]string{
+		{"SET", "key:0", "other"},
+		{"SET", "new", "value"},
+		{"INCR", "counter"},
+		{"SETBIT", "bits", "1", "1"},
+		{"MSET", "a", "1", "b", "2"},
+		{"COPY", "key:0", "copy"},
+	} {
+		if commands[args[0]].flags&cmdDenyOOM == 0 {
+			t.Errorf("%s is not flagged cmdDenyOOM", args[0])
+		}
+		if _, err := h.HandleCommand(ctx, args); !errors.Is(err, ErrOOM) {
+			t.Errorf("%s over maxmemory returned %v, want %v", strings.Join(args, " "), err, ErrOOM)
+		}
+	}
+	if reply, err := h.HandleCommand(ctx, []string{"GET", "key:0"}); err != nil || reply != "value" {
+		t.Errorf("GET over maxmemory returned %v, %v", reply, err)
+	}
+	if reply, err := h.HandleCommand(ctx, []string{"DEL", "key:1", "key:2"}); err != nil || reply != int64(2) {
+		t.Errorf("DEL over maxmemory returned %v, %v", reply, err)
+	}
+	if reply, err := h.HandleCommand(ctx, []string{"DBSIZE"}); err != nil || reply != int64(8) {
+		t.Errorf("noeviction evicted keys: DBSIZE = %v, %v", reply, err)
+	}
+
+	// Once DEL has freed memory, writes are accepted again.
+	if _, err := h.HandleCommand(ctx, []string{"SET", "new", "value"}); err != nil {
+		t.Errorf("SET after freeing memory: %v", err)
+	}
+	if info, _ := h.HandleCommand(ctx, []string{"INFO", "memory"}); !strings.Contains(fmt.Sprint(info), "maxmemory_policy:noeviction") {
+		t.Errorf("INFO memory does not report the policy:\n%v", info)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+// matchPattern reports whether str matches a Redis glob pattern. Unlike
+// filepath.Match, '/' has no special meaning and a malformed character
+// class is matched literally instead of returning an error.
+//
+// Supported syntax: '*', '?', '[abc]', '[^abc]', '[a-z]' and '\x' to
+// escape a special character.
+func matchPattern(pattern, str string) bool {
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for ; s < len(str); s++ {
+				if matchPattern(pattern[p+1:], str[s:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			s++
+
+		case '[':
+			p++
+			negate := p < len(pattern) && pattern[p] == '^'
+			if negate {
+				p++
+			}
+			matched := false
+			for {
+				if p >= len(pattern) {
+					// Unterminated class: treat the remainder as consumed.
+					p--
+					break
+				}
+				if pattern[p] == '\\' && p+1 < len(pattern) {
+					p++
+					if pattern[p] == str[s] {
+						matched = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end := pattern[p], pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[s] >= start && str[s] <= end {
+						matched = true
+					}
+					p += 2
+				} else if pattern[p] == str[s] {
+					matched = true
+				}
+				p++
+			}
+			if negate {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			s++
+
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+
+		default:
+			if pattern[p] != str[s] {
+				return false
+			}
+			s++
+		}
+
+		p++
+	}
+
+	// Trailing stars match the empty remainder.
+	if s == len(str) {
+		for p < len(pattern) && pattern[p] == '*' {
+			p++
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
@@ -0,0 +1,64 @@
+package storage
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern, str string
+		want         bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"**", "", true},
+		{"a*", "a", true},
+		{"a*", "abc", true},
+		{"a*", "", false},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"*b*", "abc", true},
+		{"**b", "ab", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+
+		{"?", "", false},
+		{"?", "a", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"???", "ab", false},
+		{"*?", "a", true},
+
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[c-a]llo", "hbllo", true},
+		{"[0-9][0-9]", "42", true},
+		{"[0-9][0-9]", "4a", false},
+		{"[^0-9]*", "key", true},
+		{"[^0-9]*", "1key", false},
+		{"[]", "a", false},
+		{"[abc", "a", true},
+		{"[abc", "d", false},
+
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`a\?`, "a?", true},
+		{`a\?`, "ab", false},
+		{`\[a]`, "[a]", true},
+		{`[\]]`, "]", true},
+		{`[a\-z]`, "-", true},
+		{`[a\-z]`, "b", false},
+		{`a\`, `a\`, true},
+		{`user:\*:name`, "user:*:name", true},
+		{`user:\*:name`, "user:1:name", false},
+	} {
+		if got := matchPattern(c.pattern, c.str); got != c.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", c.pattern, c.str, got, c.want)
+		}
+	}
+}
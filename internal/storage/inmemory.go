@@ -3,96 +3,127 @@ package storage
 import (
 	"context"
 	"fmt"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
 )
 
+// InMemoryStore is a single keyspace, partitioned into independently
+// locked shards so that commands on unrelated keys do not contend.
 type InMemoryStore struct {
-	data map[string]interface{}
-	ttls map[string]time.Time
-	mu   sync.RWMutex
+	shards    []*shard
+	shardBits uint
 }
 
 func NewInMemoryStore() *InMemoryStore {
-	return &InMemoryStore{
-		data: make(map[string]interface{}),
-		ttls: make(map[string]time.Time),
+	return NewShardedStore(DefaultShards)
+}
+
+// NewShardedStore creates a store with at least the given number of
+// shards, rounded up to a power of two. A single shard behaves like a
+// store guarded by one global lock.
+func NewShardedStore(shards int) *InMemoryStore {
+	return newStore(shards, newMemoryTracker())
+}
+
+// newStore creates a store whose memory usage is accounted in mem, which
+// may be shared with other stores.
+func newStore(shards int, mem *memoryTracker) *InMemoryStore {
+	bits := shardBitsFor(shards)
+	prefix := tierPrefix(storeIDs.Add(1))
+	s := &InMemoryStore{
+		shards:    make([]*shard, 1<<bits),
+		shardBits: bits,
+	}
+	for i := range s.shards {
+		s.shards[i] = newShard(bits, mem, prefix)
 	}
+	return s
 }
 
 func (s *InMemoryStore) Set(key string, value interface{}) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.data[key] = value
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.set(key, value)
 }
 
 func (s *InMemoryStore) Get(key string) (interface{}, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	value, exists := s.data[key]
-	return value, exists
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.lookup(key)
 }
 
 func (s *InMemoryStore) Delete(key string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.data, key)
-	delete(s.ttls, key)
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.delete(key)
 }
 
 func (s *InMemoryStore) Incr(key string) (int64, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if value, exists := s.data[key]; exists {
-		if num, ok := value.(int64); ok {
-			num++
-			s.data[key] = num
-			return num, nil
-		}
-		return 0, fmt.Errorf("ERR value is not an integer or out of range")
-	}
-
-	s.data[key] = int64(1)
-	return int64(1), nil
+	return s.IncrBy(key, 1)
 }
 
 func (s *InMemoryStore) IncrBy(key string, increment int64) (int64, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if value, exists := s.data[key]; exists {
+	if value, exists := sh.get(key); exists {
 		if num, ok := value.(int64); ok {
 			num += increment
-			s.data[key] = num
+			sh.set(key, num)
 			return num, nil
 		}
 		return 0, fmt.Errorf("ERR value is not an integer or out of range")
 	}
 
-	s.data[key] = increment
+	sh.set(key, increment)
 	return increment, nil
 }
 
 func (s *InMemoryStore) Expire(key string, seconds int) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.ExpireAt(key, time.Now().Add(time.Duration(seconds)*time.Second))
+}
 
-	if _, exists := s.data[key]; exists {
-		s.ttls[key] = time.Now().Add(time.Duration(seconds) * time.Second)
-		return true
+// ExpireAt sets the absolute expiry time of key. A time that is not in
+// the future deletes the key.
+func (s *InMemoryStore) ExpireAt(key string, at time.Time) bool {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, exists := sh.get(key); !exists {
+		return false
+	}
+	if !at.After(time.Now()) {
+		return sh.delete(key)
 	}
-	return false
+	sh.preserve(key)
+	sh.ttls[key] = at
+	return true
+}
+
+// ExpireTime returns the absolute expiry time of key, if it has one.
+func (s *InMemoryStore) ExpireTime(key string) (time.Time, bool) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	at, exists := sh.ttls[key]
+	return at, exists
 }
 
 func (s *InMemoryStore) TTL(key string) (int64, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	if expireTime, exists := s.ttls[key]; exists {
+	if expireTime, exists := sh.ttls[key]; exists && !sh.expired(key) {
 		remaining := expireTime.Sub(time.Now())
 		return int64(remaining.Seconds()), true
 	}
@@ -100,67 +131,93 @@ func (s *InMemoryStore) TTL(key string) (int64, bool) {
 }
 
 func (s *InMemoryStore) Exists(key string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	_, exists := s.data[key]
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	_, exists := sh.get(key)
 	return exists
 }
 
 func (s *InMemoryStore) Keys(pattern string) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	var matches []string
-	for key := range s.data {
-		if match, _ := filepath.Match(pattern, key); match {
-			matches = append(matches, key)
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key := range sh.data {
+			if matchPattern(pattern, key) && !sh.expired(key) {
+				matches = append(matches, key)
+			}
+		}
+		for key := range sh.cold {
+			if matchPattern(pattern, key) && !sh.expired(key) {
+				matches = append(matches, key)
+			}
 		}
+		sh.mu.RUnlock()
 	}
 	return matches
 }
 
 func (s *InMemoryStore) Type(key string) string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	if value, exists := s.data[key]; exists {
-		switch value.(type) {
-		case string:
-			return "string"
-		case int64:
-			return "integer"
-		default:
-			return "unknown"
-		}
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	if value, exists := sh.get(key); exists {
+		return typeName(value)
 	}
 	return ""
 }
 
-func (s *InMemoryStore) FlushAll() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.data = make(map[string]interface{})
-	s.ttls = make(map[string]time.Time)
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case string, int64:
+		return "string"
+	case *datastructures.List:
+		return "list"
+	case *datastructures.Set:
+		return "set"
+	case *datastructures.SortedSet:
+		return "zset"
+	case *datastructures.Hash:
+		return "hash"
+	default:
+		return "unknown"
+	}
+}
+
+// Flush removes every key. As with Unlink, the old contents are left to
+// the garbage collector.
+func (s *InMemoryStore) Flush() {
+	unlock := s.lockAll()
+	defer unlock()
+	for _, sh := range s.shards {
+		sh.reset()
+	}
 }
 
 func (s *InMemoryStore) MSet(keysValues ...string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	keys := make([]string, 0, len(keysValues)/2)
+	for i := 0; i+1 < len(keysValues); i += 2 {
+		keys = append(keys, keysValues[i])
+	}
+
+	unlock := s.lockKeys(keys...)
+	defer unlock()
 
 	for i := 0; i < len(keysValues); i += 2 {
 		if i+1 < len(keysValues) {
-			s.data[keysValues[i]] = keysValues[i+1]
+			s.shardFor(keysValues[i]).set(keysValues[i], keysValues[i+1])
 		}
 	}
 }
 
 func (s *InMemoryStore) MGet(keys ...string) []interface{} {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	unlock := s.rlockKeys(keys...)
+	defer unlock()
 
 	var values []interface{}
 	for _, key := range keys {
-		if value, exists := s.data[key]; exists {
+		if value, exists := s.shardFor(key).lookup(key); exists {
 			values = append(values, value)
 		} else {
 			values = append(values, nil)
@@ -169,12 +226,39 @@ func (s *InMemoryStore) MGet(keys ...string) []interface{} {
 	return values
 }
 
+// mget reads keys from a snapshot of e, so that the values returned were
+// all stored at the same time.
+func mget(e Engine, keys []string) ([]interface{}, error) {
+	snap, err := e.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	values := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		value, _, _, err := snap.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
 type CommandHandler struct {
-	store *InMemoryStore
+	dbs       *Databases
+	aof       *PersistenceLayer
+	snapshots *snapshotter
+	lsm       *LSMTree
+	// reads are the snapshots clients have opened with SNAPSHOT.
+	reads readSnapshots
+	// backupMu lets one BACKUP at a time run.
+	backupMu sync.Mutex
 }
 
-func NewCommandHandler(store *InMemoryStore) *CommandHandler {
-	return &CommandHandler{store: store}
+func NewCommandHandler(dbs *Databases) *CommandHandler {
+	return &CommandHandler{dbs: dbs}
 }
 
 func (h *CommandHandler) HandleCommand(ctx context.Context, args []string) (interface{}, error) {
@@ -183,41 +267,77 @@ func (h *CommandHandler) HandleCommand(ctx context.Context, args []string) (inte
 	}
 
 	command := strings.ToUpper(args[0])
+	info := commands[command]
+
+	if err := h.dbs.freeMemoryIfNeeded(); err != nil && info.flags&cmdDenyOOM != 0 {
+		return nil, err
+	}
+	if t := h.dbs.tier; t != nil && t.kind == EngineTiered {
+		if keys := info.keys(args); len(keys) > 0 {
+			if store, err := h.dbs.DB(h.selectedDB(ctx)); err == nil {
+				store.promote(keys)
+			}
+		}
+	}
+
+	if info.flags&cmdWrite != 0 && (h.aof != nil || h.snapshots != nil) {
+		return h.executeWrite(ctx, command, info, args)
+	}
+	return h.execute(ctx, command, args)
+}
+
+// selectedDB returns the database index selected by the client of ctx.
+func (h *CommandHandler) selectedDB(ctx context.Context) int {
+	if sess := sessionFrom(ctx); sess != nil {
+		return sess.db
+	}
+	return 0
+}
+
+// execute runs a command against the client's selected database.
+func (h *CommandHandler) execute(ctx context.Context, command string, args []string) (interface{}, error) {
+	dbIndex := h.selectedDB(ctx)
+	store, err := h.dbs.DB(dbIndex)
+	if err != nil {
+		return nil, err
+	}
 
 	switch command {
 	case "SET":
 		if len(args) < 3 {
 			return nil, fmt.Errorf("wrong number of arguments for SET")
 		}
-		h.store.Set(args[1], strings.Join(args[2:], " "))
+		var b Batch
+		b.SetKeepTTL(args[1], strings.Join(args[2:], " "))
+		if err := store.Engine().Apply(&b); err != nil {
+			return nil, err
+		}
 		return "OK", nil
 
 	case "GET":
 		if len(args) != 2 {
 			return nil, fmt.Errorf("wrong number of arguments for GET")
 		}
-		value, exists := h.store.Get(args[1])
-		if !exists {
-			return nil, nil // Return nil to indicate key doesn't exist (no error)
-		}
-		return value, nil
+		value, _, _, err := store.Engine().Get(args[1])
+		return value, err
 
 	case "DEL":
 		if len(args) < 2 {
 			return nil, fmt.Errorf("wrong number of arguments for DEL")
 		}
-		key := args[1]
-		if _, exists := h.store.Get(key); exists {
-			h.store.Delete(key)
-			return int64(1), nil
+		return store.DeleteKeys(args[1:]...), nil
+
+	case "UNLINK":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("wrong number of arguments for UNLINK")
 		}
-		return int64(0), nil
+		return store.Unlink(args[1:]...), nil
 
 	case "INCR":
 		if len(args) != 2 {
 			return nil, fmt.Errorf("wrong number of arguments for INCR")
 		}
-		result, err := h.store.Incr(args[1])
+		result, err := store.Incr(args[1])
 		if err != nil {
 			return nil, err
 		}
@@ -231,7 +351,7 @@ func (h *CommandHandler) HandleCommand(ctx context.Context, args []string) (inte
 		if err != nil {
 			return nil, fmt.Errorf("value is not an integer or out of range")
 		}
-		result, err := h.store.IncrBy(args[1], incr)
+		result, err := store.IncrBy(args[1], incr)
 		if err != nil {
 			return nil, err
 		}
@@ -245,63 +365,198 @@ func (h *CommandHandler) HandleCommand(ctx context.Context, args []string) (inte
 		if err != nil {
 			return nil, fmt.Errorf("invalid expire time")
 		}
-		result := h.store.Expire(args[1], seconds)
+		result := store.Expire(args[1], seconds)
 		if result {
 			return int64(1), nil
 		}
 		return int64(0), nil
 
+	case "PEXPIREAT":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("wrong number of arguments for PEXPIREAT")
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("value is not an integer or out of range")
+		}
+		if store.ExpireAt(args[1], time.UnixMilli(ms)) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+
 	case "TTL":
 		if len(args) != 2 {
 			return nil, fmt.Errorf("wrong number of arguments for TTL")
 		}
-		ttl, exists := h.store.TTL(args[1])
+		ttl, exists := store.TTL(args[1])
 		if !exists {
 			return nil, nil
 		}
 		return ttl, nil
 
 	case "EXISTS":
-		if len(args) != 2 {
+		if len(args) < 2 {
 			return nil, fmt.Errorf("wrong number of arguments for EXISTS")
 		}
-		exists := h.store.Exists(args[1])
-		if exists {
-			return int64(1), nil
+		return store.CountExisting(args[1:]...), nil
+
+	case "TOUCH":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("wrong number of arguments for TOUCH")
 		}
-		return int64(0), nil
+		return store.Touch(args[1:]...), nil
+
+	case "RENAME":
+		return h.handleRename(store, args, false)
+
+	case "RENAMENX":
+		return h.handleRename(store, args, true)
+
+	case "COPY":
+		return h.handleCopy(dbIndex, args)
+
+	case "MOVE":
+		return h.handleMove(dbIndex, args)
+
+	case "RANDOMKEY":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("wrong number of arguments for RANDOMKEY")
+		}
+		key, exists := store.RandomKey()
+		if !exists {
+			return nil, nil
+		}
+		return key, nil
+
+	case "DBSIZE":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("wrong number of arguments for DBSIZE")
+		}
+		return store.DBSize(), nil
 
 	case "KEYS":
 		if len(args) != 2 {
 			return nil, fmt.Errorf("wrong number of arguments for KEYS")
 		}
-		return h.store.Keys(args[1]), nil
+		return store.Keys(args[1]), nil
 
 	case "TYPE":
 		if len(args) != 2 {
 			return nil, fmt.Errorf("wrong number of arguments for TYPE")
 		}
-		return h.store.Type(args[1]), nil
+		return store.Type(args[1]), nil
 
 	case "FLUSHALL":
-		if len(args) != 1 {
-			return nil, fmt.Errorf("wrong number of arguments for FLUSHALL")
+		if err := parseFlushMode(args); err != nil {
+			return nil, err
+		}
+		h.dbs.FlushAll()
+		return "OK", nil
+
+	case "FLUSHDB":
+		if err := parseFlushMode(args); err != nil {
+			return nil, err
 		}
-		h.store.FlushAll()
+		store.Flush()
 		return "OK", nil
 
+	case "SELECT":
+		return h.handleSelect(ctx, args)
+
+	case "SWAPDB":
+		return h.handleSwapDB(args)
+
+	case "INFO":
+		return h.handleInfo(args)
+
+	case "OBJECT":
+		return h.handleObject(store, args)
+
+	case "MEMORY":
+		return h.handleMemory(store, args)
+
+	case "BGREWRITEAOF":
+		return h.handleBgRewriteAOF(args)
+
+	case "SAVE":
+		return h.handleSave(args)
+
+	case "BGSAVE":
+		return h.handleBgSave(args)
+
+	case "LASTSAVE":
+		return h.handleLastSave(args)
+
+	case "BACKUP":
+		return h.handleBackup(args)
+
 	case "MSET":
 		if len(args) < 3 || (len(args)-1)%2 != 0 {
 			return nil, fmt.Errorf("wrong number of arguments for MSET")
 		}
-		h.store.MSet(args[1:]...)
+		var b Batch
+		for i := 1; i < len(args); i += 2 {
+			b.SetKeepTTL(args[i], args[i+1])
+		}
+		if err := store.Engine().Apply(&b); err != nil {
+			return nil, err
+		}
 		return "OK", nil
 
 	case "MGET":
 		if len(args) < 2 {
 			return nil, fmt.Errorf("wrong number of arguments for MGET")
 		}
-		return h.store.MGet(args[1:]...), nil
+		return mget(store.Engine(), args[1:])
+
+	case "SCAN":
+		return h.handleScan(store, args)
+
+	case "HSCAN", "SSCAN", "ZSCAN":
+		return h.handleCollectionScan(store, command, args)
+
+	case "HGETALL":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for HGETALL")
+		}
+		value, _, exists, err := store.Engine().Get(args[1])
+		if err != nil || !exists {
+			return []string{}, err
+		}
+		return hashFields(value)
+
+	case "KEYRANGE":
+		return h.handleKeyRange(store, args)
+
+	case "KEYPREFIX":
+		return h.handleKeyPrefix(store, args)
+
+	case "SNAPSHOT":
+		return h.handleSnapshot(ctx, args)
+
+	case "DUMP":
+		return h.handleDump(store, args)
+
+	case "RESTORE":
+		return h.handleRestore(store, args)
+
+	case "SETBIT":
+		return h.handleSetBit(store, args)
+
+	case "GETBIT":
+		return h.handleGetBit(store, args)
+
+	case "BITCOUNT":
+		return h.handleBitCount(store, args)
+
+	case "BITPOS":
+		return h.handleBitPos(store, args)
+
+	case "BITOP":
+		return h.handleBitOp(store, args)
+
+	case "BITFIELD":
+		return h.handleBitField(store, args)
 
 	default:
 		return nil, fmt.Errorf("unknown command: %s", command)
@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMemorySamples is the number of collection elements MEMORY
+	// USAGE looks at unless SAMPLES is given.
+	defaultMemorySamples = 5
+	doctorLargestKeys    = 5
+)
+
+// KeyInfo is the per-key metadata reported by OBJECT.
+type KeyInfo struct {
+	Encoding string
+	Idle     time.Duration
+	Freq     uint8
+	Size     int64
+}
+
+// encodingOf returns the name OBJECT ENCODING reports for value.
+func encodingOf(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return "int"
+	case string:
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil && len(v) <= 20 {
+			return "int"
+		}
+		if len(v) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case interface{ Encoding() string }:
+		return v.Encoding()
+	default:
+		return "unknown"
+	}
+}
+
+// KeyInfo returns the metadata of key. Unlike reads, inspecting a key does
+// not count as an access.
+func (s *InMemoryStore) KeyInfo(key string) (KeyInfo, bool) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, exists := sh.data[key]
+	if !exists || sh.expired(key) {
+		return KeyInfo{}, false
+	}
+	idle := time.Since(time.UnixMilli(e.accessed.Load()))
+	if idle < 0 {
+		idle = 0
+	}
+	return KeyInfo{
+		Encoding: encodingOf(e.value),
+		Idle:     idle,
+		Freq:     lfuDecay(e.lfu.Load()),
+		Size:     e.size,
+	}, true
+}
+
+// MemoryUsage estimates the bytes used by key and its value, looking at no
+// more than samples elements of a collection. Zero samples every element.
+func (s *InMemoryStore) MemoryUsage(key string, samples int) (int64, bool) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists := sh.get(key)
+	if !exists {
+		return 0, false
+	}
+	return entryOverhead + int64(len(key)) + sampledValueSize(value, samples), true
+}
+
+// UsedMemory returns the estimated memory used by the keys of the store.
+func (s *InMemoryStore) UsedMemory() int64 {
+	var used int64
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		used += sh.used
+		sh.mu.RUnlock()
+	}
+	return used
+}
+
+type keySize struct {
+	db   int
+	key  string
+	typ  string
+	size int64
+}
+
+// largestKeys returns up to n keys with the largest accounted sizes,
+// largest first.
+func (s *InMemoryStore) largestKeys(n int) []keySize {
+	var largest []keySize
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, e := range sh.data {
+			if len(largest) == n && e.size <= largest[n-1].size {
+				continue
+			}
+			largest = append(largest, keySize{key: key, typ: typeName(e.value), size: e.size})
+			sort.Slice(largest, func(i, j int) bool {
+				return largest[i].size > largest[j].size
+			})
+			if len(largest) > n {
+				largest = largest[:n]
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return largest
+}
+
+func (h *CommandHandler) handleObject(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("wrong number of arguments for OBJECT")
+	}
+	subcommand := strings.ToUpper(args[1])
+	if subcommand == "HELP" {
+		return []string{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is",
+			"    proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with the specified",
+			"    <key>.",
+		}, nil
+	}
+	if len(args) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments for OBJECT %s", subcommand)
+	}
+
+	info, exists := store.KeyInfo(args[2])
+	switch subcommand {
+	case "ENCODING", "FREQ", "IDLETIME", "REFCOUNT":
+		if !exists {
+			return nil, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try OBJECT HELP.", args[1])
+	}
+
+	switch subcommand {
+	case "ENCODING":
+		return info.Encoding, nil
+	case "FREQ":
+		return int64(info.Freq), nil
+	case "IDLETIME":
+		return int64(info.Idle / time.Second), nil
+	default:
+		// Values are never shared between keys.
+		return int64(1), nil
+	}
+}
+
+func (h *CommandHandler) handleMemory(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("wrong number of arguments for MEMORY")
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "USAGE":
+		return h.handleMemoryUsage(store, args)
+	case "STATS":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for MEMORY STATS")
+		}
+		return h.memoryStats(), nil
+	case "DOCTOR":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for MEMORY DOCTOR")
+		}
+		return h.memoryDoctor(), nil
+	case "HELP":
+		return []string{
+			"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value. Nested values are",
+			"    sampled up to <count> times (default: 5, 0 means sample all).",
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown subcommand '%s'. Try MEMORY HELP.", args[1])
+}
+
+func (h *CommandHandler) handleMemoryUsage(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) != 3 && len(args) != 5 {
+		return nil, fmt.Errorf("wrong number of arguments for MEMORY USAGE")
+	}
+
+	samples := defaultMemorySamples
+	if len(args) == 5 {
+		if !strings.EqualFold(args[3], "SAMPLES") {
+			return nil, fmt.Errorf("syntax error")
+		}
+		n, err := strconv.Atoi(args[4])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("value is out of range, must be positive")
+		}
+		samples = n
+	}
+
+	usage, exists := store.MemoryUsage(args[2], samples)
+	if !exists {
+		return nil, nil
+	}
+	return usage, nil
+}
+
+// memoryStats builds the MEMORY STATS reply: a flat list of metric names
+// and values, with a nested list for each non-empty database.
+func (h *CommandHandler) memoryStats() []interface{} {
+	var heap runtime.MemStats
+	runtime.ReadMemStats(&heap)
+
+	used := h.dbs.UsedMemory()
+	var keys int64
+	var perDB []interface{}
+	for i := 0; i < h.dbs.Len(); i++ {
+		db, _ := h.dbs.DB(i)
+		stats := db.Stats()
+		if stats.Keys == 0 {
+			continue
+		}
+		keys += stats.Keys
+		perDB = append(perDB, fmt.Sprintf("db.%d", i), []interface{}{
+			"keys", stats.Keys,
+			"expires", stats.Expires,
+			"dataset.bytes", db.UsedMemory(),
+		})
+	}
+
+	var bytesPerKey int64
+	if keys > 0 {
+		bytesPerKey = used / keys
+	}
+	reply := []interface{}{
+		"peak.allocated", h.dbs.mem.peak.Load(),
+		"total.allocated", int64(heap.HeapAlloc),
+		"dataset.bytes", used,
+		"keys.count", keys,
+		"keys.bytes-per-key", bytesPerKey,
+	}
+	return append(reply, perDB...)
+}
+
+// memoryDoctor reports likely memory problems and the keys using the most
+// memory.
+func (h *CommandHandler) memoryDoctor() string {
+	mem := h.dbs.mem
+	used := mem.used.Load()
+	if used == 0 {
+		return "The dataset is empty; there is nothing to report."
+	}
+
+	var issues []string
+	if mem.maxMemory > 0 && used*10 > mem.maxMemory*9 {
+		issues = append(issues, fmt.Sprintf("Used memory (%s) is above 90%% of maxmemory (%s); policy %s will %s.",
+			formatMemory(used), formatMemory(mem.maxMemory), mem.policy, evictionOutcome(mem.policy)))
+	}
+	if peak := mem.peak.Load(); peak*2 > used*3 {
+		issues = append(issues, fmt.Sprintf("Peak memory (%s) is more than 150%% of the current usage (%s); sizing for the peak may waste memory.",
+			formatMemory(peak), formatMemory(used)))
+	}
+	if evicted := mem.evicted.Load(); evicted > 0 {
+		issues = append(issues, fmt.Sprintf("%d keys have been evicted to stay under maxmemory.", evicted))
+	}
+
+	var largest []keySize
+	for i := 0; i < h.dbs.Len(); i++ {
+		db, _ := h.dbs.DB(i)
+		for _, k := range db.largestKeys(doctorLargestKeys) {
+			k.db = i
+			largest = append(largest, k)
+		}
+	}
+	sort.SliceStable(largest, func(i, j int) bool {
+		return largest[i].size > largest[j].size
+	})
+	if len(largest) > doctorLargestKeys {
+		largest = largest[:doctorLargestKeys]
+	}
+
+	var b strings.Builder
+	if len(issues) == 0 {
+		b.WriteString("No memory issues detected.\n")
+	} else {
+		b.WriteString("Memory issues:\n")
+		for _, issue := range issues {
+			fmt.Fprintf(&b, " * %s\n", issue)
+		}
+	}
+	fmt.Fprintf(&b, "\nLargest keys (%s used in total):\n", formatMemory(used))
+	for _, k := range largest {
+		fmt.Fprintf(&b, " * db%d %q (%s): %s, %.1f%%\n", k.db, k.key, k.typ, formatMemory(k.size), float64(k.size)*100/float64(used))
+	}
+	return b.String()
+}
+
+func evictionOutcome(policy EvictionPolicy) string {
+	switch {
+	case policy == NoEviction:
+		return "reject writes once it is reached"
+	case policy.volatile():
+		return "evict keys with a TTL, then reject writes"
+	default:
+		return "evict keys"
+	}
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+func newTestHandler(t *testing.T) (*CommandHandler, func(args ...string) interface{}) {
+	t.Helper()
+	h := NewCommandHandler(NewDatabases(2, 4))
+	ctx := h.NewSession(context.Background())
+	return h, func(args ...string) interface{} {
+		t.Helper()
+		reply, err := h.HandleCommand(ctx, args)
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+		return reply
+	}
+}
+
+func TestObjectEncoding(t *testing.T) {
+	h, do := newTestHandler(t)
+	db, _ := h.dbs.DB(0)
+
+	do("SET", "number", "12345")
+	do("SET", "short", "hello")
+	do("SET", "long", strings.Repeat("x", 45))
+	do("INCR", "counter")
+
+	small, large := datastructures.NewHash(), datastructures.NewHash()
+	small.HSet("field", "value")
+	for i := 0; i < 200; i++ {
+		large.HSet("field:"+strconv.Itoa(i), int64(i))
+	}
+	ints, strs := datastructures.NewSet(), datastructures.NewSet()
+	ints.Add(int64(1))
+	strs.Add("member")
+	zset, list := datastructures.NewSortedSet(), datastructures.NewList()
+	zset.Add("member", 1)
+	list.PushBack("element")
+	for key, value := range map[string]interface{}{
+		"small": small, "large": large, "ints": ints, "strs": strs, "zset": zset, "list": list,
+	} {
+		db.Set(key, value)
+	}
+
+	for key, want := range map[string]string{
+		"number":  "int",
+		"short":   "embstr",
+		"long":    "raw",
+		"counter": "int",
+		"small":   "listpack",
+		"large":   "hashtable",
+		"ints":    "intset",
+		"strs":    "listpack",
+		"zset":    "listpack",
+		"list":    "listpack",
+	} {
+		if got := do("OBJECT", "ENCODING", key); got != want {
+			t.Errorf("OBJECT ENCODING %s = %v, want %s", key, got, want)
+		}
+	}
+
+	if got := do("OBJECT", "REFCOUNT", "short"); got != int64(1) {
+		t.Errorf("OBJECT REFCOUNT = %v, want 1", got)
+	}
+	if got := do("OBJECT", "IDLETIME", "short"); got != int64(0) {
+		t.Errorf("OBJECT IDLETIME of a new key = %v, want 0", got)
+	}
+	if got := do("OBJECT", "FREQ", "short").(int64); got < lfuInitVal {
+		t.Errorf("OBJECT FREQ of a new key = %d, want at least %d", got, lfuInitVal)
+	}
+	if got := do("OBJECT", "ENCODING", "missing"); got != nil {
+		t.Errorf("OBJECT ENCODING of a missing key = %v, want nil", got)
+	}
+	if _, err := h.HandleCommand(context.Background(), []string{"OBJECT", "BOGUS", "short"}); err == nil {
+		t.Error("OBJECT BOGUS succeeded")
+	}
+}
+
+func TestRestorePacksAShrunkCollection(t *testing.T) {
+	h, do := newTestHandler(t)
+	db, _ := h.dbs.DB(0)
+
+	hash := datastructures.NewHash()
+	for i := 0; i < 200; i++ {
+		hash.HSet("field:"+strconv.Itoa(i), int64(i))
+	}
+	for i := 1; i < 200; i++ {
+		hash.HDel("field:" + strconv.Itoa(i))
+	}
+	db.Set("hash", hash)
+	if got := do("OBJECT", "ENCODING", "hash"); got != "hashtable" {
+		t.Fatalf("OBJECT ENCODING of a shrunk hash = %v, want hashtable", got)
+	}
+
+	payload := do("DUMP", "hash").(string)
+	do("RESTORE", "copy", "0", payload)
+	if got := do("OBJECT", "ENCODING", "copy"); got != "listpack" {
+		t.Errorf("OBJECT ENCODING of the restored hash = %v, want listpack", got)
+	}
+}
+
+func TestInfoSections(t *testing.T) {
+	_, do := newTestHandler(t)
+	do("SET", "a", "1")
+	do("SET", "b", "2")
+	do("EXPIRE", "b", "100")
+	do("SELECT", "1")
+	do("SET", "c", "3")
+
+	info := do("INFO").(string)
+	for _, want := range []string{
+		"# Memory\r\n",
+		"maxmemory_policy:noeviction\r\n",
+		"# Keyspace\r\n",
+		"db0:keys=2,expires=1,",
+		"db1:keys=1,expires=0,",
+		"storage_engine:memory\r\n",
+	} {
+		if !strings.Contains(info, want) {
+			t.Errorf("INFO does not contain %q:\n%s", want, info)
+		}
+	}
+
+	info = do("INFO", "keyspace").(string)
+	if strings.Contains(info, "# Memory") || !strings.Contains(info, "db1:keys=1") {
+		t.Errorf("INFO keyspace = %q", info)
+	}
+
+	used := do("MEMORY", "USAGE", "c").(int64)
+	if used <= int64(len("c")+len("3")) {
+		t.Errorf("MEMORY USAGE = %d, want more than the key and value", used)
+	}
+	if got := do("MEMORY", "USAGE", "missing"); got != nil {
+		t.Errorf("MEMORY USAGE of a missing key = %v, want nil", got)
+	}
+}
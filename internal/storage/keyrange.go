@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	orderedChunkSize  = 1024
+	defaultRangeLimit = 10
+)
+
+// orderedIndex keeps a shard's keys in lexicographic order. The keys are
+// held in sorted chunks of at most orderedChunkSize keys, so that adding
+// or removing a key moves at most one chunk's worth of strings, and a
+// chunk is found by a binary search over the last key of each.
+type orderedIndex struct {
+	chunks [][]string
+}
+
+// chunkFor returns the chunk key belongs in: the first whose last key is
+// not less than key, or the last chunk.
+func (x *orderedIndex) chunkFor(key string) int {
+	i := sort.Search(len(x.chunks), func(i int) bool {
+		c := x.chunks[i]
+		return c[len(c)-1] >= key
+	})
+	if i == len(x.chunks) {
+		i--
+	}
+	return i
+}
+
+func (x *orderedIndex) add(key string) {
+	if len(x.chunks) == 0 {
+		x.chunks = [][]string{{key}}
+		return
+	}
+	i := x.chunkFor(key)
+	c := x.chunks[i]
+	j := sort.SearchStrings(c, key)
+	if j < len(c) && c[j] == key {
+		return
+	}
+	c = append(c, "")
+	copy(c[j+1:], c[j:])
+	c[j] = key
+	x.chunks[i] = c
+	if len(c) > orderedChunkSize {
+		half := len(c) / 2
+		upper := append([]string(nil), c[half:]...)
+		x.chunks[i] = c[:half]
+		x.chunks = append(x.chunks, nil)
+		copy(x.chunks[i+2:], x.chunks[i+1:])
+		x.chunks[i+1] = upper
+	}
+}
+
+func (x *orderedIndex) remove(key string) {
+	if len(x.chunks) == 0 {
+		return
+	}
+	i := x.chunkFor(key)
+	c := x.chunks[i]
+	j := sort.SearchStrings(c, key)
+	if j == len(c) || c[j] != key {
+		return
+	}
+	c = append(c[:j], c[j+1:]...)
+	if len(c) == 0 {
+		x.chunks = append(x.chunks[:i], x.chunks[i+1:]...)
+		return
+	}
+	x.chunks[i] = c
+}
+
+// ascend calls fn for the keys from start onwards in order, until fn
+// returns false.
+func (x *orderedIndex) ascend(start string, fn func(key string) bool) {
+	if len(x.chunks) == 0 {
+		return
+	}
+	i := x.chunkFor(start)
+	j := sort.SearchStrings(x.chunks[i], start)
+	for ; i < len(x.chunks); i++ {
+		for _, key := range x.chunks[i][j:] {
+			if !fn(key) {
+				return
+			}
+		}
+		j = 0
+	}
+}
+
+// EnableOrderedIndex makes every database keep its keys sorted, so that
+// KEYRANGE and KEYPREFIX read only the keys they return instead of
+// sorting the whole keyspace. Keys already stored are indexed.
+func (d *Databases) EnableOrderedIndex() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, db := range d.dbs {
+		unlock := db.lockAll()
+		for _, sh := range db.shards {
+			if sh.ordered != nil {
+				continue
+			}
+			sh.ordered = &orderedIndex{}
+			for key := range sh.data {
+				sh.ordered.add(key)
+			}
+			for key := range sh.cold {
+				sh.ordered.add(key)
+			}
+		}
+		unlock()
+	}
+}
+
+// lexBound is an end of a key range, in the syntax of ZRANGEBYLEX: "-" and
+// "+" leave the range open, "[key" includes key and "(key" excludes it.
+type lexBound struct {
+	key       string
+	exclusive bool
+	open      bool
+}
+
+func parseLexBound(arg string, isMin bool) (lexBound, error) {
+	switch {
+	case arg == "-" && isMin, arg == "+" && !isMin:
+		return lexBound{open: true}, nil
+	case strings.HasPrefix(arg, "["):
+		return lexBound{key: arg[1:]}, nil
+	case strings.HasPrefix(arg, "("):
+		return lexBound{key: arg[1:], exclusive: true}, nil
+	}
+	return lexBound{}, fmt.Errorf("min or max not valid string range item")
+}
+
+// above reports whether key is past min, as the lower end of a range.
+func (b lexBound) above(key string) bool {
+	if b.open {
+		return true
+	}
+	if b.exclusive {
+		return key > b.key
+	}
+	return key >= b.key
+}
+
+// below reports whether key is before max, as the upper end of a range.
+func (b lexBound) below(key string) bool {
+	if b.open {
+		return true
+	}
+	if b.exclusive {
+		return key < b.key
+	}
+	return key <= b.key
+}
+
+// prefixEnd returns the exclusive upper bound of the keys starting with
+// prefix, which is open if no key sorts after all of them.
+func prefixEnd(prefix string) lexBound {
+	end := []byte(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return lexBound{open: true}
+	}
+	end[len(end)-1]++
+	return lexBound{key: string(end), exclusive: true}
+}
+
+// RangeKeys returns up to limit keys between min and max in lexicographic
+// order, and whether there are more. Each shard contributes its first
+// limit+1 keys of the range, which are merged; without the ordered index
+// a shard's keys are collected and sorted first. Shards are read one at a
+// time, so the result is not a point-in-time view of the keyspace.
+func (s *InMemoryStore) RangeKeys(min, max lexBound, limit int) ([]string, bool) {
+	var keys []string
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		keys = append(keys, sh.rangeKeys(min, max, limit+1)...)
+		sh.mu.RUnlock()
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		return keys[:limit], true
+	}
+	return keys, false
+}
+
+// rangeKeys returns the first count keys of the shard between min and max.
+// The caller must hold sh.mu.
+func (sh *shard) rangeKeys(min, max lexBound, count int) []string {
+	var keys []string
+	if sh.ordered != nil {
+		sh.ordered.ascend(min.key, func(key string) bool {
+			if !min.above(key) {
+				return true
+			}
+			if !max.below(key) {
+				return false
+			}
+			keys = append(keys, key)
+			return len(keys) < count
+		})
+		return keys
+	}
+
+	collect := func(key string) {
+		if min.above(key) && max.below(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range sh.data {
+		collect(key)
+	}
+	for key := range sh.cold {
+		collect(key)
+	}
+	sort.Strings(keys)
+	if len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// parseRangeLimit parses the optional "LIMIT count" and, for KEYPREFIX,
+// "FROM token" arguments of the key range commands.
+func parseRangeLimit(args []string, allowFrom bool) (limit int, from string, err error) {
+	limit = defaultRangeLimit
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return 0, "", fmt.Errorf("syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "LIMIT":
+			limit, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return 0, "", fmt.Errorf("value is not an integer or out of range")
+			}
+			if limit < 1 {
+				return 0, "", fmt.Errorf("syntax error")
+			}
+		case "FROM":
+			if !allowFrom {
+				return 0, "", fmt.Errorf("syntax error")
+			}
+			from = args[i+1]
+		default:
+			return 0, "", fmt.Errorf("syntax error")
+		}
+	}
+	return limit, from, nil
+}
+
+// rangeReply pairs a page of keys with the token that continues after it:
+// the exclusive bound of the last key, or "" once the range is exhausted.
+func rangeReply(keys []string, more bool) []interface{} {
+	next := ""
+	if more {
+		next = "(" + keys[len(keys)-1]
+	}
+	return []interface{}{next, keys}
+}
+
+// parseKeyRange parses "KEYRANGE min max [LIMIT count]".
+func parseKeyRange(args []string) (min, max lexBound, limit int, err error) {
+	if len(args) < 3 {
+		return min, max, 0, fmt.Errorf("wrong number of arguments for KEYRANGE")
+	}
+	if min, err = parseLexBound(args[1], true); err != nil {
+		return min, max, 0, err
+	}
+	if max, err = parseLexBound(args[2], false); err != nil {
+		return min, max, 0, err
+	}
+	limit, _, err = parseRangeLimit(args[3:], false)
+	return min, max, limit, err
+}
+
+// parseKeyPrefix parses "KEYPREFIX prefix [FROM token] [LIMIT count]" into
+// the range it reads.
+func parseKeyPrefix(args []string) (min, max lexBound, limit int, err error) {
+	if len(args) < 2 {
+		return min, max, 0, fmt.Errorf("wrong number of arguments for KEYPREFIX")
+	}
+	prefix := args[1]
+	limit, from, err := parseRangeLimit(args[2:], true)
+	if err != nil {
+		return min, max, 0, err
+	}
+	min = lexBound{key: prefix}
+	if from != "" {
+		if min, err = parseLexBound(from, true); err != nil {
+			return min, max, 0, err
+		}
+		if min.open || min.key < prefix {
+			min = lexBound{key: prefix}
+		}
+	}
+	return min, prefixEnd(prefix), limit, nil
+}
+
+// handleKeyRange serves KEYRANGE min max [LIMIT count]. The token it
+// returns is passed as min to read the next page.
+func (h *CommandHandler) handleKeyRange(store *InMemoryStore, args []string) (interface{}, error) {
+	min, max, limit, err := parseKeyRange(args)
+	if err != nil {
+		return nil, err
+	}
+	keys, more := store.RangeKeys(min, max, limit)
+	return rangeReply(keys, more), nil
+}
+
+// handleKeyPrefix serves KEYPREFIX prefix [FROM token] [LIMIT count]. The
+// token it returns is passed as FROM to read the next page.
+func (h *CommandHandler) handleKeyPrefix(store *InMemoryStore, args []string) (interface{}, error) {
+	min, max, limit, err := parseKeyPrefix(args)
+	if err != nil {
+		return nil, err
+	}
+	keys, more := store.RangeKeys(min, max, limit)
+	return rangeReply(keys, more), nil
+}
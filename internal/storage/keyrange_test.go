@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// TestOrderedIndexChunks adds and removes enough keys for the ordered
+// index to split and drop chunks, checking its order throughout.
+func TestOrderedIndexChunks(t *testing.T) {
+	const n = 3 * orderedChunkSize
+	x := &orderedIndex{}
+	var want []string
+	for i := 0; i < n; i++ {
+		// Add keys out of order, so that chunks split in the middle.
+		key := fmt.Sprintf("key:%05d", (i*7919)%n)
+		x.add(key)
+		want = append(want, key)
+	}
+	x.add("key:00000")
+	sort.Strings(want)
+
+	ascend := func(start string) []string {
+		var keys []string
+		x.ascend(start, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+	check := func(what string) {
+		t.Helper()
+		got := ascend("")
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: index holds %d keys, want %d in order", what, len(got), len(want))
+		}
+		for _, c := range x.chunks {
+			if len(c) == 0 || len(c) > orderedChunkSize {
+				t.Fatalf("%s: chunk of %d keys", what, len(c))
+			}
+		}
+	}
+	check("after adding")
+	if len(x.chunks) < 3 {
+		t.Fatalf("%d keys are held in %d chunks", n, len(x.chunks))
+	}
+
+	if got := ascend("key:01000.5"); len(got) != n-1001 || got[0] != "key:01001" {
+		t.Fatalf("ascending from between keys returned %d keys from %v", len(got), got[:1])
+	}
+	var stopped []string
+	x.ascend("key:02000", func(key string) bool {
+		stopped = append(stopped, key)
+		return len(stopped) < 2
+	})
+	if fmt.Sprint(stopped) != "[key:02000 key:02001]" {
+		t.Fatalf("ascent stopped after 2 keys returned %v", stopped)
+	}
+
+	for i := 0; i < n; i += 2 {
+		x.remove(fmt.Sprintf("key:%05d", i))
+	}
+	x.remove("missing")
+	want = want[:0]
+	for i := 1; i < n; i += 2 {
+		want = append(want, fmt.Sprintf("key:%05d", i))
+	}
+	check("after removing half")
+
+	for _, key := range want {
+		x.remove(key)
+	}
+	if len(x.chunks) != 0 {
+		t.Fatalf("an emptied index holds %d chunks", len(x.chunks))
+	}
+}
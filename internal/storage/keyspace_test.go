@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+func TestUnlinkKeepsSnapshotValues(t *testing.T) {
+	for _, command := range [][]string{
+		{"UNLINK", "hash", "list"},
+		{"FLUSHALL", "ASYNC"},
+		{"FLUSHDB", "ASYNC"},
+	} {
+		t.Run(command[0], func(t *testing.T) {
+			s, _ := openTestServer(t, t.TempDir())
+			db, _ := s.h.dbs.DB(0)
+			hash, list := datastructures.NewHash(), datastructures.NewList()
+			for i := 0; i < 200; i++ {
+				n := strconv.Itoa(i)
+				hash.HSet("field:"+n, n)
+				list.PushBack(n)
+			}
+			db.Set("hash", hash)
+			db.Set("list", list)
+			snap := s.h.dbs.OpenSnapshot()
+			defer snap.Release()
+
+			s.do(t, command...)
+			if reply := s.do(t, "EXISTS", "hash", "list"); reply != int64(0) {
+				t.Fatalf("EXISTS after %v = %v, want 0", command, reply)
+			}
+
+			value, _, ok, err := snap.Get(0, "hash")
+			if err != nil || !ok {
+				t.Fatalf("snapshot lost hash: %v, %v", ok, err)
+			}
+			if n := value.(*datastructures.Hash).HLen(); n != 200 {
+				t.Errorf("snapshot hash has %d fields, want 200", n)
+			}
+			value, _, ok, err = snap.Get(0, "list")
+			if err != nil || !ok {
+				t.Fatalf("snapshot lost list: %v, %v", ok, err)
+			}
+			if n := value.(*datastructures.List).Len(); n != 200 {
+				t.Errorf("snapshot list has %d elements, want 200", n)
+			}
+		})
+	}
+}
+
+// TestExpiredKeys checks that a key whose TTL has passed is gone for every
+// command, before anything has deleted it.
+func TestExpiredKeys(t *testing.T) {
+	h, do := newTestHandler(t)
+	db, _ := h.dbs.DB(0)
+	do("SET", "live", "value")
+	do("SET", "source", "value")
+	payload := do("DUMP", "source").(string)
+	do("DEL", "source")
+	for _, key := range []string{"string", "counter", "bits", "renamed", "copied", "dumped", "restored"} {
+		do("SET", key, "1")
+		sh := db.shardFor(key)
+		sh.ttls[key] = time.Now().Add(-time.Second)
+	}
+
+	for _, c := range []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"GET", "string"}, nil},
+		{[]string{"EXISTS", "string", "counter", "live"}, int64(1)},
+		{[]string{"TTL", "string"}, nil},
+		{[]string{"TYPE", "string"}, ""},
+		{[]string{"DBSIZE"}, int64(1)},
+		{[]string{"KEYS", "*"}, []interface{}{"live"}},
+		{[]string{"SCAN", "0", "COUNT", "100"}, []interface{}{"0", []interface{}{"live"}}},
+		{[]string{"RANDOMKEY"}, "live"},
+		{[]string{"INCR", "counter"}, int64(1)},
+		{[]string{"TTL", "counter"}, nil},
+		{[]string{"GETBIT", "bits", "7"}, int64(0)},
+		{[]string{"BITCOUNT", "bits"}, int64(0)},
+		{[]string{"COPY", "copied", "copy"}, int64(0)},
+		{[]string{"DUMP", "dumped"}, nil},
+		{[]string{"RESTORE", "restored", "0", payload}, "OK"},
+		{[]string{"GET", "restored"}, "value"},
+		{[]string{"TTL", "restored"}, nil},
+		{[]string{"OBJECT", "IDLETIME", "string"}, nil},
+	} {
+		if got := do(c.args...); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s = %v, want %v", strings.Join(c.args, " "), got, c.want)
+		}
+	}
+	if _, err := h.HandleCommand(context.Background(), []string{"RENAME", "renamed", "other"}); err == nil {
+		t.Errorf("RENAME of an expired key succeeded")
+	}
+	if got := h.infoKeyspace(); !strings.Contains(got, "db0:keys=3,expires=0,") {
+		t.Errorf("INFO keyspace counts expired keys:\n%s", got)
+	}
+}
+
+func TestExpireInThePast(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestServer(t, dir)
+	s.do(t, "SET", "key", "value")
+	if got := s.do(t, "EXPIRE", "key", "-1"); got != int64(1) {
+		t.Fatalf("EXPIRE key -1 = %v, want 1", got)
+	}
+	for _, args := range [][]string{{"EXISTS", "key"}, {"DBSIZE"}} {
+		if got := s.do(t, args...); got != int64(0) {
+			t.Errorf("%s after EXPIRE key -1 = %v, want 0", strings.Join(args, " "), got)
+		}
+	}
+
+	s.p.Close()
+	s, _ = openTestServer(t, dir)
+	if got := s.do(t, "EXISTS", "key"); got != int64(0) {
+		t.Errorf("the key expired by EXPIRE -1 is back after a restart")
+	}
+}
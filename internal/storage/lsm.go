@@ -1,110 +1,602 @@
 package storage
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	lsmLevels = 7
+	// lsmMemTableSize is the estimated size at which the memtable is
+	// frozen and flushed to an SSTable.
+	lsmMemTableSize = 4 << 20
+	// lsmMaxImmutables is the number of frozen memtables that may wait
+	// for a flush before writes wait for one to finish.
+	lsmMaxImmutables    = 4
+	lsmManifestFileName = "lsm.manifest"
+)
+
+var ErrLSMClosed = errors.New("LSM tree is closed")
+
+// LSMTree is a log-structured merge tree of typed values. Writes go to the
+// memtable, which once full is frozen and written to a level 0 SSTable in
+// the background. Reads look at the memtable, the frozen memtables from
+// newest to oldest and then the SSTables level by level, and stop at the
+// first version of the key they find, which may be a tombstone.
+//
+// The memtables are not logged, so writes that have not been flushed are
+// lost if the process stops without calling Close.
 type LSMTree struct {
-	memTable   *MemTable
+	memTable *MemTable
+	// memSize is the estimated size of memTable.
+	memSize int64
+	// immutables are the frozen memtables waiting to be flushed, newest
+	// first.
 	immutables []*MemTable
 	disk       *DiskStorage
+	opts       LSMOptions
 	mutex      sync.RWMutex
+
+	// flushc wakes the flusher, which signals flushed after each flush
+	// and closes done once it has stopped.
+	flushc  chan struct{}
+	flushed *sync.Cond
+	done    chan struct{}
+	// flushErr is the error of a failed flush. Writes fail once it is
+	// set, as the memtables can no longer be written out.
+	flushErr error
+	closed   bool
+
+	// compactc wakes the compactor, which stops once stop is closed and
+	// then closes compactDone. limiter paces its I/O.
+	compactc    chan struct{}
+	stop        chan struct{}
+	compactDone chan struct{}
+	limiter     *rateLimiter
+	statsMu     sync.Mutex
+	stats       compactionStats
 }
 
+// DiskStorage holds the SSTables of an LSM tree. Level 0 holds flushed
+// memtables, newest first, whose key ranges may overlap; the tables of
+// every other level are sorted by key and do not overlap.
 type DiskStorage struct {
-	dir     string
-	levels  []*Level
-	current *MemTable
+	dir    string
+	levels []*Level
+	// next numbers the next table file.
+	next int
+	// compactPointers hold, per level, the largest key of the table that
+	// was last compacted into the next level.
+	compactPointers []string
+	mu              sync.RWMutex
+	// inUse is held for reading while tables are read, so that tables
+	// replaced by a compaction are only closed once no read uses them.
+	inUse sync.RWMutex
+	// cache holds recently read data blocks, nil if disabled.
+	cache *blockCache
+	// compression is the codec new tables are written with.
+	compression Compression
+
+	// bloomChecks counts the tables whose Bloom filter a lookup consulted,
+	// bloomNegatives those it thereby skipped and bloomFalsePositives
+	// those it read without finding the key.
+	bloomChecks         atomic.Int64
+	bloomNegatives      atomic.Int64
+	bloomFalsePositives atomic.Int64
 }
 
+// Level is one level of SSTables. Its tables slice is replaced, never
+// modified in place, so that readers can use a copy of it without a lock.
 type Level struct {
-	files []string
+	tables []*sstable
 }
 
-func NewLSMTree(dir string) (*LSMTree, error) {
+// NewLSMTree opens the LSM tree in dir, creating it if needed, and
+// compacts it as opts describe.
+func NewLSMTree(dir string, opts LSMOptions) (*LSMTree, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
-	disk := &DiskStorage{
-		dir:    dir,
-		levels: make([]*Level, 7),
+	opts = opts.withDefaults()
+	disk, err := openDiskStorage(dir, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < 7; i++ {
-		disk.levels[i] = &Level{}
+	l := &LSMTree{
+		memTable:    NewMemTable(),
+		disk:        disk,
+		opts:        opts,
+		flushc:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		compactc:    make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		compactDone: make(chan struct{}),
 	}
+	l.limiter = &rateLimiter{rate: opts.CompactionRate, stop: l.stop}
+	l.flushed = sync.NewCond(&l.mutex)
+	go l.flushLoop()
+	go l.compactLoop()
+	l.compactc <- struct{}{}
+	return l, nil
+}
 
-	return &LSMTree{
-		memTable: NewMemTable(),
-		disk:     disk,
-	}, nil
+// Get returns the value stored at key and its expiry time.
+func (l *LSMTree) Get(key string) (interface{}, time.Time, bool, error) {
+	e, found, err := l.lookup(key)
+	if err != nil || !found || e.deleted || e.expired(time.Now()) {
+		return nil, time.Time{}, false, err
+	}
+	return e.value, e.expireAt, true, nil
 }
 
-func (l *LSMTree) Set(key string, value interface{}) {
+// Apply adds the writes of b to the memtable at once. Values must be of a
+// type that can be written to disk. Deletions write tombstones, which
+// hide the versions of a key in older tables until compaction drops them.
+func (l *LSMTree) Apply(b *Batch) error {
+	for _, op := range b.ops {
+		if !op.entry.deleted {
+			if _, err := valueTag(op.entry.value); err != nil {
+				return fmt.Errorf("key %q: %v", op.key, err)
+			}
+		}
+	}
+
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	l.memTable.Set(key, value)
+	for !l.closed && l.flushErr == nil && len(l.immutables) >= lsmMaxImmutables {
+		l.flushed.Wait()
+	}
+	if l.closed {
+		return ErrLSMClosed
+	}
+	if l.flushErr != nil {
+		return l.flushErr
+	}
 
-	if l.memTable.Size() > 1000 {
+	ops, err := l.keepTTLs(b.ops)
+	if err != nil {
+		return err
+	}
+	l.memTable.apply(ops)
+	for _, op := range ops {
+		if op.entry.deleted {
+			l.memSize += entryOverhead + int64(len(op.key))
+		} else {
+			l.memSize += estimateSize(op.key, op.entry.value)
+		}
+	}
+	if l.memSize >= lsmMemTableSize {
 		l.flushMemTable()
 	}
+	return nil
 }
 
-func (l *LSMTree) Get(key string) (interface{}, bool) {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
+// keepTTLs returns ops with the expiry time of each SetKeepTTL write taken
+// from the newest version of its key, which may be an earlier write of
+// ops. Versions on disk are read under l.mutex, so only such writes wait
+// for the disk. The caller must hold l.mutex.
+func (l *LSMTree) keepTTLs(ops []batchOp) ([]batchOp, error) {
+	var resolved []batchOp
+	now := time.Now()
+	for i, op := range ops {
+		if !op.keepTTL {
+			continue
+		}
+		if resolved == nil {
+			resolved = append([]batchOp(nil), ops...)
+		}
+		e, found, err := l.newest(op.key, resolved[:i])
+		if err != nil {
+			return nil, err
+		}
+		if found && !e.deleted && !e.expired(now) {
+			resolved[i].entry.expireAt = e.expireAt
+		}
+	}
+	if resolved == nil {
+		return ops, nil
+	}
+	return resolved, nil
+}
 
-	if value, exists := l.memTable.Get(key); exists {
-		return value, exists
+// newest returns the newest version of key, looking at the writes of
+// pending before the tree. The caller must hold l.mutex.
+func (l *LSMTree) newest(key string, pending []batchOp) (lsmEntry, bool, error) {
+	for i := len(pending) - 1; i >= 0; i-- {
+		if pending[i].key == key {
+			return pending[i].entry, true, nil
+		}
 	}
+	for _, m := range append([]*MemTable{l.memTable}, l.immutables...) {
+		if value, exists := m.Get(key); exists {
+			return value.(lsmEntry), true, nil
+		}
+	}
+	return l.disk.find(key)
+}
+
+// lookup returns the newest version of key.
+func (l *LSMTree) lookup(key string) (lsmEntry, bool, error) {
+	l.mutex.RLock()
+	memTables := append([]*MemTable{l.memTable}, l.immutables...)
+	l.mutex.RUnlock()
 
-	for _, immutable := range l.immutables {
-		if value, exists := immutable.Get(key); exists {
-			return value, exists
+	for _, m := range memTables {
+		if value, exists := m.Get(key); exists {
+			return value.(lsmEntry), true, nil
 		}
 	}
+	return l.disk.find(key)
+}
+
+// flushMemTable freezes the memtable and wakes the flusher. The caller
+// must hold l.mutex.
+func (l *LSMTree) flushMemTable() {
+	immutable := l.memTable
+	l.memTable = NewMemTable()
+	l.memSize = 0
+	l.immutables = append([]*MemTable{immutable}, l.immutables...)
+
+	select {
+	case l.flushc <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop writes frozen memtables to level 0, oldest first, until the
+// tree is closed, and then wakes the compactor. A frozen memtable stays
+// readable until its table has been added, so reads never miss its keys.
+func (l *LSMTree) flushLoop() {
+	defer close(l.done)
+	for range l.flushc {
+		for {
+			l.mutex.Lock()
+			if len(l.immutables) == 0 || l.flushErr != nil {
+				l.mutex.Unlock()
+				break
+			}
+			oldest := l.immutables[len(l.immutables)-1]
+			l.mutex.Unlock()
 
-	// Check disk storage
-	return l.disk.Get(key)
+			err := l.disk.flush(oldest)
+
+			l.mutex.Lock()
+			if err != nil {
+				l.flushErr = fmt.Errorf("LSM flush failed: %v", err)
+			} else {
+				l.immutables = l.immutables[:len(l.immutables)-1]
+			}
+			l.flushed.Broadcast()
+			l.mutex.Unlock()
+		}
+		select {
+		case l.compactc <- struct{}{}:
+		default:
+		}
+	}
 }
 
-func (l *LSMTree) Delete(key string) {
+// Flush freezes the memtable and waits until every frozen memtable has
+// been written to disk.
+func (l *LSMTree) Flush() error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	l.memTable.Delete(key)
+	if l.closed {
+		return ErrLSMClosed
+	}
+	if l.memTable.Size() > 0 {
+		l.flushMemTable()
+	}
+	for len(l.immutables) > 0 && l.flushErr == nil {
+		l.flushed.Wait()
+	}
+	return l.flushErr
 }
 
-func (l *LSMTree) flushMemTable() {
-	immutable := l.memTable
-	l.memTable = NewMemTable()
-	l.immutables = append(l.immutables, immutable)
+// Close flushes the memtable, waits for the flusher to finish, stops any
+// compaction in progress and closes the SSTables.
+func (l *LSMTree) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	if l.memTable.Size() > 0 {
+		l.flushMemTable()
+	}
+	l.closed = true
+	close(l.flushc)
+	l.flushed.Broadcast()
+	l.mutex.Unlock()
 
-	go l.mergeLevels()
+	<-l.done
+	close(l.stop)
+	<-l.compactDone
+	l.disk.close()
+	return l.flushErr
 }
 
-func (l *LSMTree) mergeLevels() {
-	// Implement level merging logic
-	// This is a simplified version
-	for i := 0; i < len(l.disk.levels)-1; i++ {
-		if len(l.disk.levels[i].files) > 10 {
-			// Merge to next level
-			l.mergeLevel(i, i+1)
+// openDiskStorage opens the SSTables listed in the manifest in dir, and
+// deletes any other table left behind by a flush that did not finish.
+func openDiskStorage(dir string, opts LSMOptions) (*DiskStorage, error) {
+	d := &DiskStorage{
+		dir:             dir,
+		levels:          make([]*Level, lsmLevels),
+		next:            1,
+		compactPointers: make([]string, lsmLevels),
+		compression:     opts.Compression,
+	}
+	if opts.BlockCacheSize > 0 {
+		d.cache = newBlockCache(opts.BlockCacheSize)
+	}
+	for i := range d.levels {
+		d.levels[i] = &Level{}
+	}
+	if err := d.readManifest(); err != nil {
+		d.close()
+		return nil, err
+	}
+
+	listed := make(map[string]bool)
+	for _, level := range d.levels {
+		for _, t := range level.tables {
+			listed[filepath.Base(t.path)] = true
 		}
 	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	for _, path := range matches {
+		if !listed[filepath.Base(path)] {
+			os.Remove(path)
+		}
+	}
+	return d, nil
+}
+
+// readManifest opens the tables listed in the manifest, which has one
+// "<level> <file>" line per table, in the order of their level.
+func (d *DiskStorage) readManifest() error {
+	file, err := os.Open(filepath.Join(d.dir, lsmManifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var level, num int
+		if len(fields) == 2 {
+			level, err = strconv.Atoi(fields[0])
+			if err == nil {
+				num, err = strconv.Atoi(strings.TrimSuffix(fields[1], ".sst"))
+			}
+		}
+		if len(fields) != 2 || err != nil || level < 0 || level >= lsmLevels {
+			return fmt.Errorf("%s line %d: invalid entry %q", lsmManifestFileName, line, scanner.Text())
+		}
+		t, err := d.openTable(filepath.Join(d.dir, fields[1]), num)
+		if err != nil {
+			return err
+		}
+		d.levels[level].tables = append(d.levels[level].tables, t)
+		if num >= d.next {
+			d.next = num + 1
+		}
+	}
+	return scanner.Err()
 }
 
-func (l *LSMTree) mergeLevel(srcLevel, destLevel int) {
-	// Implementation would merge files from srcLevel to destLevel
-	// and then remove them from srcLevel
+// writeManifest records the tables of every level. The caller must hold
+// d.mu.
+func (d *DiskStorage) writeManifest() error {
+	var b strings.Builder
+	for i, level := range d.levels {
+		for _, t := range level.tables {
+			fmt.Fprintf(&b, "%d %s\n", i, filepath.Base(t.path))
+		}
+	}
+	return replaceFile(filepath.Join(d.dir, lsmManifestFileName), []byte(b.String()))
+}
+
+// newTablePath returns the path of the next table file.
+func (d *DiskStorage) newTablePath() (string, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	num := d.next
+	d.next++
+	return filepath.Join(d.dir, fmt.Sprintf("%06d.sst", num)), num
+}
+
+// openTable opens a table of the tree.
+func (d *DiskStorage) openTable(path string, num int) (*sstable, error) {
+	t, err := openSSTable(path, num)
+	if err != nil {
+		return nil, err
+	}
+	t.cache = d.cache
+	return t, nil
+}
+
+// flush writes a frozen memtable to a new table in level 0.
+func (d *DiskStorage) flush(m *MemTable) error {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.data))
+	for key := range m.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	path, num := d.newTablePath()
+	w, err := newSSTableWriter(path, d.compression)
+	if err != nil {
+		m.mu.RUnlock()
+		return err
+	}
+	for _, key := range keys {
+		if err := w.add(key, m.data[key].(lsmEntry)); err != nil {
+			m.mu.RUnlock()
+			w.abort()
+			return err
+		}
+	}
+	m.mu.RUnlock()
+	if err := w.finish(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	t, err := d.openTable(path, num)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	previous := d.levels[0].tables
+	d.levels[0].tables = append([]*sstable{t}, previous...)
+	if err := d.writeManifest(); err != nil {
+		d.levels[0].tables = previous
+		t.file.Close()
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// Get returns the value stored at key on disk.
+func (d *DiskStorage) Get(key string) (interface{}, bool, error) {
+	e, found, err := d.find(key)
+	if err != nil || !found || e.deleted || e.expired(time.Now()) {
+		return nil, false, err
+	}
+	return e.value, true, nil
+}
+
+// find returns the newest version of key on disk.
+func (d *DiskStorage) find(key string) (lsmEntry, bool, error) {
+	d.inUse.RLock()
+	defer d.inUse.RUnlock()
+	d.mu.RLock()
+	levels := make([][]*sstable, len(d.levels))
+	for i, level := range d.levels {
+		levels[i] = level.tables
+	}
+	d.mu.RUnlock()
+	return d.findIn(levels, key)
+}
+
+// findIn returns the newest version of key in levels: the first found in
+// the level 0 tables from newest to oldest, or else in the one table of
+// each further level whose key range covers it. Tables whose Bloom filter
+// rules the key out are skipped without reading any of their blocks.
+func (d *DiskStorage) findIn(levels [][]*sstable, key string) (lsmEntry, bool, error) {
+	for i, tables := range levels {
+		if i > 0 {
+			j := sort.Search(len(tables), func(j int) bool {
+				return tables[j].largest >= key
+			})
+			tables = tables[j:min(j+1, len(tables))]
+		}
+		for _, t := range tables {
+			if key < t.smallest || key > t.largest {
+				continue
+			}
+			if t.filter != nil {
+				d.bloomChecks.Add(1)
+				if !t.filter.mayContain(key) {
+					d.bloomNegatives.Add(1)
+					continue
+				}
+			}
+			e, found, err := t.get(key)
+			if err != nil || found {
+				return e, found, err
+			}
+			if t.filter != nil {
+				d.bloomFalsePositives.Add(1)
+			}
+		}
+	}
+	return lsmEntry{}, false, nil
+}
+
+func (d *DiskStorage) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, level := range d.levels {
+		for _, t := range level.tables {
+			t.file.Close()
+		}
+	}
+}
+
+// MemTable holds the most recent writes to an LSMTree.
+type MemTable struct {
+	data map[string]interface{}
+	mu   sync.RWMutex
+}
+
+// NewMemTable creates a new instance of MemTable
+func NewMemTable() *MemTable {
+	return &MemTable{
+		data: make(map[string]interface{}),
+	}
+}
+
+// Set adds or updates a key-value pair in the MemTable
+func (m *MemTable) Set(key string, value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = value
+}
+
+// Get retrieves a value by key from the MemTable
+func (m *MemTable) Get(key string) (interface{}, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, exists := m.data[key]
+	return value, exists
+}
+
+// Delete removes a key-value pair from the MemTable
+func (m *MemTable) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+}
+
+// apply writes the versions of an LSM batch under a single lock, so that
+// readers see all of them or none.
+func (m *MemTable) apply(ops []batchOp) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range ops {
+		m.data[op.key] = op.entry
+	}
 }
 
-// Add Get method to DiskStorage
-func (d *DiskStorage) Get(key string) (interface{}, bool) {
-	// Implement logic to retrieve value from disk storage
-	// This is a placeholder implementation
-	return nil, false
+// Size returns the number of key-value pairs in the MemTable
+func (m *MemTable) Size() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data)
 }
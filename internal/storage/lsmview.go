@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// memEntry is a version of a key held in a memtable.
+type memEntry struct {
+	key   string
+	entry lsmEntry
+}
+
+// sortedEntries returns the versions held in m in key order.
+func (m *MemTable) sortedEntries() []memEntry {
+	m.mu.RLock()
+	entries := make([]memEntry, 0, len(m.data))
+	for key, e := range m.data {
+		entries = append(entries, memEntry{key: key, entry: e.(lsmEntry)})
+	}
+	m.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
+
+// lsmView is a consistent view of an LSM tree: the contents of its
+// memtables, newest first, and the tables of every level, which are pinned
+// so that compactions do not close them while the view is in use.
+type lsmView struct {
+	disk      *DiskStorage
+	memTables [][]memEntry
+	levels    [][]*sstable
+}
+
+// view returns a view of the tree as it is now, which must be released.
+func (l *LSMTree) view() (*lsmView, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.closed {
+		return nil, ErrLSMClosed
+	}
+
+	// Holding l.mutex keeps batches out and frozen memtables listed
+	// until their tables are, so no version is missed.
+	v := &lsmView{disk: l.disk, levels: l.disk.pin()}
+	for _, m := range append([]*MemTable{l.memTable}, l.immutables...) {
+		v.memTables = append(v.memTables, m.sortedEntries())
+	}
+	return v, nil
+}
+
+func (v *lsmView) release() {
+	v.disk.unpin(v.levels)
+}
+
+// lookup returns the newest version of key in the view.
+func (v *lsmView) lookup(key string) (lsmEntry, bool, error) {
+	for _, entries := range v.memTables {
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].key >= key
+		})
+		if i < len(entries) && entries[i].key == key {
+			return entries[i].entry, true, nil
+		}
+	}
+	return v.disk.findIn(v.levels, key)
+}
+
+func (v *lsmView) Get(key string) (interface{}, time.Time, bool, error) {
+	e, found, err := v.lookup(key)
+	if err != nil || !found || e.deleted || e.expired(time.Now()) {
+		return nil, time.Time{}, false, err
+	}
+	return e.value, e.expireAt, true, nil
+}
+
+// Ascend merges the memtables and tables of the view, keeping the newest
+// version of each key and skipping tombstones and expired values.
+func (v *lsmView) Ascend(start string, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	h := &viewHeap{}
+	add := func(s *viewSource) error {
+		if s.advance(start) {
+			*h = append(*h, s)
+		}
+		return s.err
+	}
+	rank := 0
+	for _, entries := range v.memTables {
+		if err := add(&viewSource{rank: rank, mem: entries}); err != nil {
+			return err
+		}
+		rank++
+	}
+	for i, tables := range v.levels {
+		// The tables of level 0 may overlap, those of any other level are
+		// read one after the other.
+		if i == 0 {
+			for _, t := range tables {
+				if err := add(&viewSource{rank: rank, onDisk: true, tables: []*sstable{t}}); err != nil {
+					return err
+				}
+				rank++
+			}
+			continue
+		}
+		if err := add(&viewSource{rank: rank, onDisk: true, tables: tables}); err != nil {
+			return err
+		}
+		rank++
+	}
+	heap.Init(h)
+
+	now := time.Now()
+	for h.Len() > 0 {
+		newest := (*h)[0]
+		key := newest.key
+		e, err := newest.entry()
+		if err != nil {
+			return err
+		}
+		for h.Len() > 0 && (*h)[0].key == key {
+			s := (*h)[0]
+			if s.advance(start) {
+				heap.Fix(h, 0)
+			} else {
+				if s.err != nil {
+					return s.err
+				}
+				heap.Pop(h)
+			}
+		}
+		if e.deleted || e.expired(now) {
+			continue
+		}
+		if err := fn(key, e.value, e.expireAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// viewSource walks a memtable, or tables whose key ranges do not overlap,
+// in key order. Sources are ranked by age, newest first.
+type viewSource struct {
+	rank int
+	key  string
+	err  error
+
+	mem []memEntry
+	// started is set once the source has moved to its first entry.
+	started bool
+
+	onDisk bool
+	tables []*sstable
+	it     *sstableIterator
+}
+
+// advance moves to the next entry at or after start, returning false at
+// the end or on an error.
+func (s *viewSource) advance(start string) bool {
+	if !s.onDisk {
+		if !s.started {
+			s.started = true
+			s.mem = s.mem[sort.Search(len(s.mem), func(i int) bool {
+				return s.mem[i].key >= start
+			}):]
+		} else {
+			s.mem = s.mem[1:]
+		}
+		if len(s.mem) == 0 {
+			return false
+		}
+		s.key = s.mem[0].key
+		return true
+	}
+
+	for {
+		if s.it == nil {
+			for len(s.tables) > 0 && s.tables[0].largest < start {
+				s.tables = s.tables[1:]
+			}
+			if len(s.tables) == 0 {
+				return false
+			}
+			s.it = s.tables[0].iteratorFrom(start)
+			s.tables = s.tables[1:]
+		}
+		for s.it.advance() {
+			if s.it.key >= start {
+				s.key = s.it.key
+				return true
+			}
+		}
+		if s.err = s.it.err; s.err != nil {
+			return false
+		}
+		s.it = nil
+	}
+}
+
+// entry decodes the current entry of the source.
+func (s *viewSource) entry() (lsmEntry, error) {
+	if !s.onDisk {
+		return s.mem[0].entry, nil
+	}
+	if s.it.kind == sstableTombstone {
+		return lsmEntry{deleted: true}, nil
+	}
+	return decodeSSTableValue(s.it.body)
+}
+
+// viewHeap orders sources by their current key, then by rank.
+type viewHeap []*viewSource
+
+func (h viewHeap) Len() int { return len(h) }
+func (h viewHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].rank < h[j].rank
+}
+func (h viewHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *viewHeap) Push(x interface{}) { *h = append(*h, x.(*viewSource)) }
+func (h *viewHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// Ascend calls fn for the live keys of the tree from start onwards, in key
+// order, as they were when it was called.
+func (l *LSMTree) Ascend(start string, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	v, err := l.view()
+	if err != nil {
+		return err
+	}
+	defer v.release()
+	return v.Ascend(start, fn)
+}
+
+// lsmSnapshot is a view of an LSM tree that lasts until it is released.
+type lsmSnapshot struct {
+	*lsmView
+}
+
+func (s lsmSnapshot) Release() {
+	s.release()
+}
+
+// Snapshot returns a view of the tree as it is now. The tables it reads
+// stay on disk until it is released, even if compactions replace them.
+func (l *LSMTree) Snapshot() (EngineSnapshot, error) {
+	v, err := l.view()
+	if err != nil {
+		return nil, err
+	}
+	return lsmSnapshot{v}, nil
+}
+
+// pin returns the tables of every level, which stay open until they are
+// unpinned.
+func (d *DiskStorage) pin() [][]*sstable {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	levels := make([][]*sstable, len(d.levels))
+	for i, level := range d.levels {
+		levels[i] = level.tables
+		for _, t := range level.tables {
+			t.refs++
+		}
+	}
+	return levels
+}
+
+// unpin releases tables pinned by pin, closing those that compactions have
+// replaced meanwhile.
+func (d *DiskStorage) unpin(levels [][]*sstable) {
+	d.mu.Lock()
+	var unused []*sstable
+	for _, tables := range levels {
+		for _, t := range tables {
+			t.refs--
+			if t.refs == 0 && t.obsolete {
+				unused = append(unused, t)
+			}
+		}
+	}
+	d.mu.Unlock()
+	d.closeTables(unused)
+}
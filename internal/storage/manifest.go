@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	manifestFileName = "wal.manifest"
+	// legacyWALFileName is the single WAL file used before the log was
+	// segmented. It is adopted as the first segment.
+	legacyWALFileName = "wal.log"
+	// walSegmentSize is the size at which the WAL moves on to a new
+	// segment file.
+	walSegmentSize = 64 << 20
+)
+
+// walManifest lists the files that make up the WAL, oldest first: an
+// optional base written by an AOF rewrite, which holds the whole dataset
+// as of sequence number baseSeq, and the segments appended since. The last
+// segment is the one being written.
+//
+// On disk it is a text file with one "base <file> <seq>" line, one
+// "segment <file>" line per segment and a "hold <file> <seq>" line while
+// segments are held for BACKUP.
+type walManifest struct {
+	base     string
+	baseSeq  uint64
+	segments []string
+	// hold is the first segment BACKUP has yet to archive, which holds
+	// the commands after sequence number holdSeq. Checkpoints and
+	// rewrites keep it and the segments after it.
+	hold    string
+	holdSeq uint64
+	// next numbers the next file created.
+	next int
+}
+
+// readManifest reads the manifest in dir, returning nil if there is none.
+func readManifest(dir string) (*walManifest, error) {
+	file, err := os.Open(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	m := &walManifest{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "base" && len(fields) == 3:
+			seq, err := strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid sequence number", manifestFileName, line)
+			}
+			m.base, m.baseSeq = fields[1], seq
+			m.numbered(fields[1])
+		case fields[0] == "segment" && len(fields) == 2:
+			m.segments = append(m.segments, fields[1])
+			m.numbered(fields[1])
+		case fields[0] == "hold" && len(fields) == 3:
+			seq, err := strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid sequence number", manifestFileName, line)
+			}
+			m.hold, m.holdSeq = fields[1], seq
+		default:
+			return nil, fmt.Errorf("%s line %d: invalid entry %q", manifestFileName, line, scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// numbered makes sure files created later are numbered after name.
+func (m *walManifest) numbered(name string) {
+	i := strings.LastIndexByte(name, '-')
+	n, err := strconv.Atoi(strings.TrimSuffix(name[i+1:], ".log"))
+	if err == nil && n >= m.next {
+		m.next = n + 1
+	}
+}
+
+// newFile returns the name of the next base or segment file.
+func (m *walManifest) newFile(prefix string) string {
+	if m.next == 0 {
+		m.next = 1
+	}
+	name := fmt.Sprintf("%s-%06d.log", prefix, m.next)
+	m.next++
+	return name
+}
+
+// trim drops the segments before from, or before the held segment if that
+// comes first, and reports whether either was found.
+func (m *walManifest) trim(from string) bool {
+	for i, segment := range m.segments {
+		if segment == from || segment == m.hold {
+			m.segments = m.segments[i:]
+			return true
+		}
+	}
+	return false
+}
+
+// files returns every file the manifest refers to.
+func (m *walManifest) files() []string {
+	files := append([]string(nil), m.segments...)
+	if m.base != "" {
+		files = append(files, m.base)
+	}
+	return files
+}
+
+// write atomically replaces the manifest in dir.
+func (m *walManifest) write(dir string) error {
+	var b strings.Builder
+	if m.base != "" {
+		fmt.Fprintf(&b, "base %s %d\n", m.base, m.baseSeq)
+	}
+	for _, segment := range m.segments {
+		fmt.Fprintf(&b, "segment %s\n", segment)
+	}
+	if m.hold != "" {
+		fmt.Fprintf(&b, "hold %s %d\n", m.hold, m.holdSeq)
+	}
+
+	return replaceFile(filepath.Join(dir, manifestFileName), []byte(b.String()))
+}
+
+// replaceFile atomically replaces the file at path with data, making the
+// change durable.
+func replaceFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// removeUnlisted deletes WAL files in dir that the manifest does not refer
+// to: segments and bases replaced by a checkpoint or rewrite, or created
+// by one that did not finish.
+func (m *walManifest) removeUnlisted(dir string) {
+	listed := make(map[string]bool)
+	for _, name := range m.files() {
+		listed[name] = true
+	}
+	for _, pattern := range []string{"wal-*.log", "base-*.log", legacyWALFileName} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, path := range matches {
+			if !listed[filepath.Base(path)] {
+				os.Remove(path)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrEngineClosed is returned by a MemoryEngine that has been closed.
+var ErrEngineClosed = errors.New("engine is closed")
+
+// MemoryEngine is an Engine that holds its values in memory, in a map and
+// a sorted list of its keys. A snapshot shares both until the next write,
+// which copies them.
+type MemoryEngine struct {
+	mu     sync.RWMutex
+	state  *memoryState
+	shared bool
+	closed bool
+}
+
+// memoryState is the content of a MemoryEngine. Once shared with a
+// snapshot it is never modified.
+type memoryState struct {
+	entries map[string]lsmEntry
+	keys    []string
+}
+
+// NewMemoryEngine returns an empty MemoryEngine.
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{state: &memoryState{entries: make(map[string]lsmEntry)}}
+}
+
+// Get returns the value stored at key and its expiry time.
+func (m *MemoryEngine) Get(key string) (interface{}, time.Time, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, time.Time{}, false, ErrEngineClosed
+	}
+	return m.state.Get(key)
+}
+
+// Ascend calls fn for every key from start onwards in key order. It reads
+// the engine as it was when Ascend was called, so fn may write to it.
+func (m *MemoryEngine) Ascend(start string, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	s, err := m.share()
+	if err != nil {
+		return err
+	}
+	return s.Ascend(start, fn)
+}
+
+// Apply writes every operation of b under a single lock. Values must be of
+// a type that can be written to disk, as for an LSMTree, so the two are
+// interchangeable.
+func (m *MemoryEngine) Apply(b *Batch) error {
+	for _, op := range b.ops {
+		if !op.entry.deleted {
+			if _, err := valueTag(op.entry.value); err != nil {
+				return fmt.Errorf("key %q: %v", op.key, err)
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrEngineClosed
+	}
+	if m.shared {
+		m.state = m.state.clone()
+		m.shared = false
+	}
+	s := m.state
+	now := time.Now()
+	for _, op := range b.ops {
+		old, exists := s.entries[op.key]
+		if op.keepTTL && exists && !old.expired(now) {
+			op.entry.expireAt = old.expireAt
+		}
+		i := sort.SearchStrings(s.keys, op.key)
+		switch {
+		case op.entry.deleted && exists:
+			delete(s.entries, op.key)
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+		case !op.entry.deleted:
+			if !exists {
+				s.keys = append(s.keys, "")
+				copy(s.keys[i+1:], s.keys[i:])
+				s.keys[i] = op.key
+			}
+			s.entries[op.key] = op.entry
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a view of the engine as it is now.
+func (m *MemoryEngine) Snapshot() (EngineSnapshot, error) {
+	s, err := m.share()
+	if err != nil {
+		return nil, err
+	}
+	return memorySnapshot{s}, nil
+}
+
+// Close drops the values of the engine.
+func (m *MemoryEngine) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.state = &memoryState{}
+	return nil
+}
+
+// share returns the current state, which the next write leaves as it is.
+func (m *MemoryEngine) share() (*memoryState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrEngineClosed
+	}
+	m.shared = true
+	return m.state, nil
+}
+
+func (s *memoryState) clone() *memoryState {
+	c := &memoryState{
+		entries: make(map[string]lsmEntry, len(s.entries)),
+		keys:    append([]string(nil), s.keys...),
+	}
+	for key, e := range s.entries {
+		c.entries[key] = e
+	}
+	return c
+}
+
+func (s *memoryState) Get(key string) (interface{}, time.Time, bool, error) {
+	e, found := s.entries[key]
+	if !found || e.expired(time.Now()) {
+		return nil, time.Time{}, false, nil
+	}
+	return e.value, e.expireAt, true, nil
+}
+
+func (s *memoryState) Ascend(start string, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	now := time.Now()
+	for _, key := range s.keys[sort.SearchStrings(s.keys, start):] {
+		e := s.entries[key]
+		if e.expired(now) {
+			continue
+		}
+		if err := fn(key, e.value, e.expireAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memorySnapshot is a MemoryEngine as it was when the snapshot was taken.
+type memorySnapshot struct {
+	*memoryState
+}
+
+func (memorySnapshot) Release() {}
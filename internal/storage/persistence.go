@@ -1,25 +1,79 @@
 package storage
 
 import (
-	"encoding/binary"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
+// AppendFsync controls when WAL writes are flushed to stable storage.
+type AppendFsync int
+
+const (
+	// FsyncAlways syncs every record before the write is acknowledged.
+	FsyncAlways AppendFsync = iota
+	// FsyncEverySec syncs once a second, losing at most a second of
+	// writes on a crash.
+	FsyncEverySec
+	// FsyncNo leaves flushing to the operating system.
+	FsyncNo
+)
+
+// ParseAppendFsync parses an appendfsync mode: always, everysec or no.
+func ParseAppendFsync(name string) (AppendFsync, error) {
+	switch strings.ToLower(name) {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec", "":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return FsyncAlways, fmt.Errorf("unknown appendfsync mode %q", name)
+}
+
 type PersistenceLayer struct {
 	walFile     *os.File
 	snapshotDir string
-	memTable    *MemTable
 	mutex       sync.Mutex
-}
 
-type MemTable struct {
-	data map[string]interface{}
-	mu   sync.RWMutex
+	// manifest lists the WAL files; walFile is its last segment, of
+	// walSize bytes.
+	manifest *walManifest
+	walSize  int64
+	// segmentSize is the size at which the WAL moves on to a new segment,
+	// walSegmentSize but in tests.
+	segmentSize int64
+
+	fsync AppendFsync
+	// compression is the codec snapshots are written with.
+	compression Compression
+	// written counts the records written to the WAL and synced the ones
+	// known to be on stable storage. One writer at a time syncs, outside
+	// the mutex, on behalf of every record written before it started;
+	// the others wait on syncDone.
+	written  uint64
+	synced   uint64
+	syncing  bool
+	syncDone *sync.Cond
+	// syncFile syncs a WAL file for syncTo, which is where group commit
+	// happens.
+	syncFile func(*os.File) error
+	// syncErr is the error of the last background sync under
+	// FsyncEverySec. Writes fail while it is set, as their durability
+	// can no longer be promised.
+	syncErr error
+	// seq numbers logged commands so that recovery can skip the ones a
+	// snapshot already contains.
+	seq  uint64
+	stop chan struct{}
+
+	rewrite rewriteState
+	// snapshotMu lets one snapshot at a time be written and checkpointed.
+	snapshotMu sync.Mutex
 }
 
 func NewPersistenceLayer(baseDir string) (*PersistenceLayer, error) {
@@ -27,298 +81,304 @@ func NewPersistenceLayer(baseDir string) (*PersistenceLayer, error) {
 		return nil, err
 	}
 
-	walPath := filepath.Join(baseDir, "wal.log")
-	walFile, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	manifest, err := readManifest(baseDir)
 	if err != nil {
 		return nil, err
 	}
+	if manifest == nil {
+		manifest = &walManifest{}
+		if info, err := os.Stat(filepath.Join(baseDir, legacyWALFileName)); err == nil && info.Size() > int64(walHeaderLen) {
+			manifest.segments = []string{legacyWALFileName}
+		}
+	}
+	if len(manifest.segments) == 0 {
+		manifest.segments = []string{manifest.newFile("wal")}
+	}
 
-	memTable := &MemTable{
-		data: make(map[string]interface{}),
+	walPath := filepath.Join(baseDir, manifest.segments[len(manifest.segments)-1])
+	walFile, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := walFile.Stat()
+	if err != nil {
+		walFile.Close()
+		return nil, err
+	}
+	walSize := info.Size()
+	if walSize < int64(walHeaderLen) {
+		// A new segment, or one whose header was cut short: it holds no
+		// records either way.
+		if err := resetWAL(walFile); err != nil {
+			walFile.Close()
+			return nil, err
+		}
+		walSize = int64(walHeaderLen)
+	}
+	if err := manifest.write(baseDir); err != nil {
+		walFile.Close()
+		return nil, err
+	}
+	manifest.removeUnlisted(baseDir)
+	// Left behind by a rewrite that did not finish.
+	if matches, err := filepath.Glob(filepath.Join(baseDir, "base-*.log.tmp")); err == nil {
+		for _, path := range matches {
+			os.Remove(path)
+		}
 	}
 
-	return &PersistenceLayer{
+	p := &PersistenceLayer{
 		walFile:     walFile,
 		snapshotDir: baseDir,
-		memTable:    memTable,
-	}, nil
+		manifest:    manifest,
+		walSize:     walSize,
+		segmentSize: walSegmentSize,
+		syncFile:    (*os.File).Sync,
+	}
+	p.syncDone = sync.NewCond(&p.mutex)
+	p.rewrite.baseSize = p.fileSize(manifest.base)
+	for _, segment := range manifest.segments {
+		p.rewrite.logSize += p.fileSize(segment)
+	}
+	return p, nil
 }
 
-func (p *PersistenceLayer) Set(key string, value interface{}) error {
+// SetAppendFsync changes when WAL writes are synced. A PersistenceLayer
+// syncs every record, as FsyncAlways does, until it is called; the server
+// calls it with the appendfsync setting, which defaults to everysec.
+func (p *PersistenceLayer) SetAppendFsync(policy AppendFsync) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	// Write to WAL
-	err := p.writeToWAL(key, value)
-	if err != nil {
-		return err
+	p.fsync = policy
+	if policy == FsyncEverySec && p.stop == nil {
+		p.stop = make(chan struct{})
+		go p.syncLoop(p.stop)
+	}
+}
+
+// syncLoop syncs the WAL once a second while there are unsynced writes.
+func (p *PersistenceLayer) syncLoop(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.mutex.Lock()
+			// A sync already in progress will do; there is no point in
+			// queueing behind it.
+			if !p.syncing && p.synced < p.written {
+				p.syncErr = p.syncTo(p.written)
+			}
+			p.mutex.Unlock()
+		}
 	}
+}
 
-	// Update memtable
-	p.memTable.data[key] = value
+// syncTo returns once the first n records written are on stable storage.
+// If no sync is running, the caller runs one for every record written so
+// far, releasing p.mutex meanwhile so that other writers can append and
+// queue up for the next one; otherwise it waits for the running sync. The
+// caller must hold p.mutex.
+func (p *PersistenceLayer) syncTo(n uint64) error {
+	for p.synced < n {
+		if p.syncing {
+			p.syncDone.Wait()
+			continue
+		}
 
-	// Check if we need to flush to disk
-	if len(p.memTable.data) > 1000 {
-		go p.flushToDisk()
+		p.syncing = true
+		target := p.written
+		file := p.walFile
+		p.mutex.Unlock()
+		err := p.syncFile(file)
+		p.mutex.Lock()
+		p.syncing = false
+		p.syncDone.Broadcast()
+		if err != nil {
+			return err
+		}
+		if target > p.synced {
+			p.synced = target
+		}
 	}
+	return nil
+}
 
+// appendRecord frames a record payload and writes it to the WAL. Under
+// FsyncAlways it returns once the record has been synced, possibly
+// together with records of concurrent writers. The caller must hold
+// p.mutex.
+func (p *PersistenceLayer) appendRecord(payload []byte) error {
+	frame := frameWALRecord(payload)
+	if _, err := p.walFile.Write(frame); err != nil {
+		return err
+	}
+	p.written++
+	p.walSize += int64(len(frame))
+	p.rewrite.logSize += int64(len(frame))
+	switch p.fsync {
+	case FsyncAlways:
+		if err := p.syncTo(p.written); err != nil {
+			return err
+		}
+	case FsyncEverySec:
+		if p.syncErr != nil {
+			return fmt.Errorf("background WAL fsync failed: %v", p.syncErr)
+		}
+	}
+	if p.walSize >= p.segmentSize {
+		return p.rotate()
+	}
 	return nil
 }
 
-func (p *PersistenceLayer) Get(key string) (interface{}, bool) {
+// LogCommand appends a write command executed against database db.
+func (p *PersistenceLayer) LogCommand(db int, args []string) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	value, exists := p.memTable.data[key]
-	return value, exists
+	p.seq++
+	return p.appendRecord(appendCommandRecord(nil, p.seq, db, args))
 }
 
-func (p *PersistenceLayer) Delete(key string) error {
+// Seq returns the sequence number of the last logged command.
+func (p *PersistenceLayer) Seq() uint64 {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	return p.seq
+}
 
-	// Write delete marker to WAL
-	err := p.writeDeleteToWAL(key)
-	if err != nil {
+// resetWAL empties a WAL file, leaving only its header.
+func resetWAL(walFile *os.File) error {
+	if err := walFile.Truncate(0); err != nil {
 		return err
 	}
-
-	// Remove from memtable
-	delete(p.memTable.data, key)
-
-	return nil
+	if _, err := walFile.Write(appendWALHeader(nil)); err != nil {
+		return err
+	}
+	return walFile.Sync()
 }
 
-func (p *PersistenceLayer) writeToWAL(key string, value interface{}) error {
-	// Create a record with timestamp and operation type
-	var buf []byte
-	// Add timestamp
-	ts := uint64(time.Now().UnixNano())
-	tsBytes := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(tsBytes, ts)
-	buf = append(buf, tsBytes[:n]...)
-
-	// Add operation type (SET)
-	buf = append(buf, 'S')
-
-	// Add key
-	keyBytes := []byte(key)
-	keyLenBytes := make([]byte, binary.MaxVarintLen64)
-	n = binary.PutUvarint(keyLenBytes, uint64(len(keyBytes)))
-	buf = append(buf, keyLenBytes[:n]...)
-	buf = append(buf, keyBytes...)
-
-	// Add value
-	valueBytes, ok := value.([]byte)
-	if !ok {
-		valueBytes = []byte(fmt.Sprintf("%v", value))
+// repairWAL cuts the damaged tail described by repair off the WAL, so that
+// new records are appended after the last intact one. The caller must hold
+// p.mutex.
+func (p *PersistenceLayer) repairWAL(repair *WALRepair) error {
+	if repair == nil {
+		return nil
 	}
-	valueLenBytes := make([]byte, binary.MaxVarintLen64)
-	n = binary.PutUvarint(valueLenBytes, uint64(len(valueBytes)))
-	buf = append(buf, valueLenBytes[:n]...)
-	buf = append(buf, valueBytes...)
-
-	// Write to WAL file
-	_, err := p.walFile.Write(buf)
-	if err != nil {
+	if err := p.walFile.Truncate(repair.Offset); err != nil {
 		return err
 	}
-
 	return p.walFile.Sync()
 }
 
-func (p *PersistenceLayer) writeDeleteToWAL(key string) error {
-	// Create a record with timestamp and operation type
-	var buf []byte
-	// Add timestamp
-	ts := uint64(time.Now().UnixNano())
-	tsBytes := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(tsBytes, ts)
-	buf = append(buf, tsBytes[:n]...)
-
-	// Add operation type (DELETE)
-	buf = append(buf, 'D')
-
-	// Add key
-	keyBytes := []byte(key)
-	keyLenBytes := make([]byte, binary.MaxVarintLen64)
-	n = binary.PutUvarint(keyLenBytes, uint64(len(keyBytes)))
-	buf = append(buf, keyLenBytes[:n]...)
-	buf = append(buf, keyBytes...)
+// Close syncs and closes the WAL.
+func (p *PersistenceLayer) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	// Write to WAL file
-	_, err := p.walFile.Write(buf)
-	if err != nil {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.rewrite.closed = true
+	for p.syncing {
+		p.syncDone.Wait()
+	}
+	if err := p.walFile.Sync(); err != nil {
+		p.walFile.Close()
 		return err
 	}
-
-	return p.walFile.Sync()
+	return p.walFile.Close()
 }
 
-func (p *PersistenceLayer) flushToDisk() error {
+// Replay passes every command of the WAL logged after sequence number
+// after to apply, and every value restored by an AOF rewrite base to
+// restore. Later commands are numbered after the last one replayed. A torn
+// or corrupt tail is cut off and described by the returned repair.
+func (p *PersistenceLayer) Replay(after uint64, apply func(db int, args []string) error,
+	restore func(db int, key string, value interface{}, expireAt time.Time) error) (*WALRepair, error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	// Create a new snapshot file
-	snapshotPath := filepath.Join(p.snapshotDir, fmt.Sprintf("snapshot-%d.sst", time.Now().UnixNano()))
-	snapshotFile, err := os.Create(snapshotPath)
-	if err != nil {
-		return err
+	if after > p.seq {
+		p.seq = after
 	}
-	defer snapshotFile.Close()
-
-	// Write all key-value pairs to the snapshot
-	for key, value := range p.memTable.data {
-		// Format: key length (varint) + key + value length (varint) + value
-		keyBytes := []byte(key)
-		keyLenBytes := make([]byte, binary.MaxVarintLen64)
-		n := binary.PutUvarint(keyLenBytes, uint64(len(keyBytes)))
-		snapshotFile.Write(keyLenBytes[:n])
-		snapshotFile.Write(keyBytes)
-
-		valueBytes, ok := value.([]byte)
-		if !ok {
-			valueBytes = []byte(fmt.Sprintf("%v", value))
+	return p.replayFiles(after, func(record walRecord) error {
+		switch record.op {
+		case 'C':
+			return apply(record.db, record.args)
+		case 'V':
+			var expireAt time.Time
+			if record.expireMs != 0 {
+				expireAt = time.UnixMilli(record.expireMs)
+			}
+			return restore(record.db, record.key, record.data, expireAt)
 		}
-		valueLenBytes := make([]byte, binary.MaxVarintLen64)
-		n = binary.PutUvarint(valueLenBytes, uint64(len(valueBytes)))
-		snapshotFile.Write(valueLenBytes[:n])
-		snapshotFile.Write(valueBytes)
-	}
-
-	// After successful snapshot, clear the memtable
-	p.memTable.data = make(map[string]interface{})
-
-	return nil
-}
-
-func (p *PersistenceLayer) Recover() error {
-	// Recover from previous WAL if needed
-	return recoverFromWAL(p.walFile.Name(), p.memTable)
+		return nil
+	})
 }
 
-func recoverFromWAL(walPath string, memTable *MemTable) error {
-	file, err := os.Open(walPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // No WAL file yet
+// replayFiles streams the WAL files in the manifest to fn. A rewrite base
+// newer than sequence number after is replayed in full, and commands in
+// the segments only if they come after both. A damaged tail of the last
+// segment is cut off; damage anywhere else is an error, as later records
+// would be lost with it. The caller must hold p.mutex.
+func (p *PersistenceLayer) replayFiles(after uint64, fn func(walRecord) error) (*WALRepair, error) {
+	m := p.manifest
+	if m.base != "" && m.baseSeq > after {
+		_, repair, err := replayWAL(filepath.Join(p.snapshotDir, m.base), fn)
+		if err != nil {
+			return nil, err
+		}
+		if repair != nil {
+			return nil, fmt.Errorf("%s is damaged at offset %d: %s", m.base, repair.Offset, repair.Reason)
+		}
+		after = m.baseSeq
+		if after > p.seq {
+			p.seq = after
 		}
-		return err
 	}
-	defer file.Close()
 
-	var buf [65536]byte
-	for {
-		n, err := file.Read(buf[:])
-		if err != nil {
-			if err == io.EOF {
-				break
+	for i, segment := range m.segments {
+		last, repair, err := replayWAL(filepath.Join(p.snapshotDir, segment), func(record walRecord) error {
+			if record.op == 'C' && record.seq <= after {
+				return nil
 			}
-			return err
+			return fn(record)
+		})
+		if last > p.seq {
+			p.seq = last
 		}
-
-		pos := 0
-		for pos < n {
-			// Read timestamp
-			var ts uint64
-			ts, pos = binary.Uvarint(buf[pos:])
-			if pos == 0 {
-				return fmt.Errorf("invalid WAL record", ts)
-			}
-
-			// Read operation type
-			if pos >= n {
-				break
-			}
-			op := buf[pos]
-			pos++
-
-			// Process SET operation
-			if op == 'S' {
-				// Find key length
-				var keyLen uint64
-				keyLen, pos = binary.Uvarint(buf[pos:])
-				if pos == 0 {
-					return fmt.Errorf("invalid WAL record")
-				}
-
-				// Read key
-				if pos+int(keyLen) > n {
-					break
-				}
-				key := string(buf[pos : pos+int(keyLen)])
-				pos += int(keyLen)
-
-				// Find value length
-				var valueLen uint64
-				valueLen, pos = binary.Uvarint(buf[pos:])
-				if pos == 0 {
-					return fmt.Errorf("invalid WAL record")
-				}
-
-				// Read value
-				if pos+int(valueLen) > n {
-					break
-				}
-				value := buf[pos : pos+int(valueLen)]
-				pos += int(valueLen)
-
-				memTable.data[key] = value
-			} else if op == 'D' { // DELETE operation
-				// Find key length
-				var keyLen uint64
-				keyLen, pos = binary.Uvarint(buf[pos:])
-				if pos == 0 {
-					return fmt.Errorf("invalid WAL record")
-				}
-
-				// Read key
-				if pos+int(keyLen) > n {
-					break
-				}
-				key := string(buf[pos : pos+int(keyLen)])
-				pos += int(keyLen)
-
-				delete(memTable.data, key)
-			}
+		if err != nil {
+			return nil, err
+		}
+		if repair == nil {
+			continue
 		}
+		if i < len(m.segments)-1 {
+			return nil, fmt.Errorf("%s is damaged at offset %d: %s", segment, repair.Offset, repair.Reason)
+		}
+		if err := p.repairWAL(repair); err != nil {
+			return nil, err
+		}
+		p.walSize = repair.Offset
+		return repair, nil
 	}
-
-	return nil
+	return nil, nil
 }
 
-// NewMemTable creates a new instance of MemTable
-func NewMemTable() *MemTable {
-	return &MemTable{
-		data: make(map[string]interface{}),
+// fileSize returns the size of a file in the data directory, or 0.
+func (p *PersistenceLayer) fileSize(name string) int64 {
+	if name == "" {
+		return 0
 	}
-}
-
-// Set adds or updates a key-value pair in the MemTable
-func (m *MemTable) Set(key string, value interface{}) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.data[key] = value
-}
-
-// Get retrieves a value by key from the MemTable
-func (m *MemTable) Get(key string) (interface{}, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	value, exists := m.data[key]
-	return value, exists
-}
-
-// Delete removes a key-value pair from the MemTable
-func (m *MemTable) Delete(key string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.data, key)
-}
-
-// Size returns the number of key-value pairs in the MemTable
-func (m *MemTable) Size() int {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return len(m.data)
+	info, err := os.Stat(filepath.Join(p.snapshotDir, name))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncCounter stands in for fsync in a PersistenceLayer. It counts syncs,
+// and the first one blocks until release is closed.
+type syncCounter struct {
+	mu      sync.Mutex
+	syncs   int
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newSyncCounter(t *testing.T, p *PersistenceLayer) *syncCounter {
+	c := &syncCounter{entered: make(chan struct{}), release: make(chan struct{})}
+	p.syncFile = func(*os.File) error {
+		c.mu.Lock()
+		c.syncs++
+		first := c.syncs == 1
+		c.mu.Unlock()
+		if first {
+			close(c.entered)
+			<-c.release
+		}
+		return nil
+	}
+	t.Cleanup(func() {
+		select {
+		case <-c.release:
+		default:
+			close(c.release)
+		}
+	})
+	return c
+}
+
+func (c *syncCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.syncs
+}
+
+func openTestPersistence(t *testing.T) *PersistenceLayer {
+	t.Helper()
+	p, err := NewPersistenceLayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// waitWritten waits until n records have been written to the WAL of p.
+func waitWritten(t *testing.T, p *PersistenceLayer, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mutex.Lock()
+		written := p.written
+		p.mutex.Unlock()
+		if written >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d records written, want %d", written, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestGroupCommit holds the first writer's fsync while others write. Their
+// records all go into the next fsync, and none of them returns before it.
+func TestGroupCommit(t *testing.T) {
+	p := openTestPersistence(t)
+	p.SetAppendFsync(FsyncAlways)
+	syncs := newSyncCounter(t, p)
+
+	const writers = 8
+	done := make(chan error, writers)
+	write := func() {
+		done <- p.LogCommand(0, []string{"SET", "key", "value"})
+	}
+	go write()
+	<-syncs.entered
+	for i := 1; i < writers; i++ {
+		go write()
+	}
+	waitWritten(t, p, writers)
+
+	select {
+	case err := <-done:
+		t.Fatalf("a write returned before its record was synced: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(syncs.release)
+	for i := 0; i < writers; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := syncs.count(); n != 2 {
+		t.Errorf("%d writers caused %d fsyncs, want 2", writers, n)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.synced != writers {
+		t.Errorf("%d records synced, want %d", p.synced, writers)
+	}
+}
+
+// TestFsyncAlwaysRepliesAfterSync checks that a command's reply waits for
+// the fsync of its record under appendfsync always.
+func TestFsyncAlwaysRepliesAfterSync(t *testing.T) {
+	s, _ := openTestServer(t, t.TempDir())
+	s.p.SetAppendFsync(FsyncAlways)
+	syncs := newSyncCounter(t, s.p)
+
+	replied := make(chan error, 1)
+	go func() {
+		_, err := s.h.HandleCommand(s.ctx, []string{"SET", "key", "value"})
+		replied <- err
+	}()
+	<-syncs.entered
+	select {
+	case err := <-replied:
+		t.Fatalf("SET replied during the fsync of its record: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(syncs.release)
+	if err := <-replied; err != nil {
+		t.Fatal(err)
+	}
+	if n := syncs.count(); n != 1 {
+		t.Errorf("SET caused %d fsyncs, want 1", n)
+	}
+}
+
+func TestFsyncEverySecDoesNotSyncWrites(t *testing.T) {
+	p := openTestPersistence(t)
+	syncs := newSyncCounter(t, p)
+	close(syncs.release)
+	p.SetAppendFsync(FsyncEverySec)
+
+	for i := 0; i < 10; i++ {
+		if err := p.LogCommand(0, []string{"SET", "key", "value"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := syncs.count(); n > 1 {
+		t.Errorf("10 writes under everysec caused %d fsyncs", n)
+	}
+}
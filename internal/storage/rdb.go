@@ -0,0 +1,1021 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// Redis RDB files start with "REDIS" and the version as four decimal
+// digits, followed by opcodes much like those of a snapshot file. After
+// the EOF opcode, files of version 5 and later hold a CRC64 of everything
+// before it, or zero if the checksum was disabled.
+//
+// Files up to rdbMaxVersion (Redis 7.2) are read, with every encoding of
+// strings, lists, sets, sorted sets and hashes; streams and module types
+// are not supported. Files are written as rdbVersion, which Redis 5.0 and
+// later load, using only the plain encodings.
+const (
+	rdbMagic      = "REDIS"
+	rdbVersion    = 9
+	rdbMaxVersion = 11
+)
+
+// RDB opcodes.
+const (
+	rdbOpFunction  byte = 0xF6
+	rdbOpFreq      byte = 0xF7
+	rdbOpIdle      byte = 0xF8
+	rdbOpModuleAux byte = 0xF9
+	rdbOpAux       byte = 0xFA
+	rdbOpResizeDB  byte = 0xFB
+	rdbOpExpireMs  byte = 0xFC
+	rdbOpExpireSec byte = 0xFD
+	rdbOpSelectDB  byte = 0xFE
+	rdbOpEOF       byte = 0xFF
+)
+
+// RDB value types. The plain types hold their elements as strings; the
+// others hold a whole ziplist, listpack or intset in one string, or a
+// quicklist of them.
+const (
+	rdbTypeString  byte = 0
+	rdbTypeList    byte = 1
+	rdbTypeSet     byte = 2
+	rdbTypeZSet    byte = 3
+	rdbTypeHash    byte = 4
+	rdbTypeZSet2   byte = 5
+	rdbTypeListZip byte = 10
+	rdbTypeIntset  byte = 11
+	rdbTypeZSetZip byte = 12
+	rdbTypeHashZip byte = 13
+	rdbTypeQuick   byte = 14
+	rdbTypeHashLP  byte = 16
+	rdbTypeZSetLP  byte = 17
+	rdbTypeQuick2  byte = 18
+	rdbTypeSetLP   byte = 20
+)
+
+// Special string encodings, and the containers of quicklist nodes.
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// rdbCRC64 is the table of the CRC-64/Jones checksum Redis uses, in its
+// reflected form.
+var rdbCRC64 = func() *[256]uint64 {
+	const poly = 0x95ac9329ac4bc9b5
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return &table
+}()
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = rdbCRC64[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+// LoadRDB loads the Redis RDB file at path into d, and returns the number
+// of keys loaded. Keys that have already expired are skipped.
+func (d *Databases) LoadRDB(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	keys, err := d.ReadRDB(file)
+	if err != nil {
+		return keys, fmt.Errorf("%s: %v", path, err)
+	}
+	return keys, nil
+}
+
+// ReadRDB loads a Redis RDB file from r into d, and returns the number of
+// keys loaded. A file that is damaged or uses an unsupported feature is an
+// error, and may have been partly loaded.
+func (d *Databases) ReadRDB(r io.Reader) (int, error) {
+	rr := &rdbReader{r: bufio.NewReader(r)}
+	header, err := rr.read(len(rdbMagic) + 4)
+	if err != nil || string(header[:len(rdbMagic)]) != rdbMagic {
+		return 0, fmt.Errorf("not an RDB file")
+	}
+	version, err := strconv.Atoi(string(header[len(rdbMagic):]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid RDB version %q", header[len(rdbMagic):])
+	}
+	if version > rdbMaxVersion {
+		return 0, fmt.Errorf("RDB version %d is newer than the supported version %d", version, rdbMaxVersion)
+	}
+
+	now := time.Now().UnixMilli()
+	keys := 0
+	db, _ := d.DB(0)
+	var expireMs int64
+	for {
+		op, err := rr.ReadByte()
+		if err != nil {
+			return keys, fmt.Errorf("truncated RDB file: %v", err)
+		}
+		switch op {
+		case rdbOpEOF:
+			if version < 5 {
+				return keys, nil
+			}
+			want := rr.crc
+			var got uint64
+			if err := binary.Read(rr.r, binary.LittleEndian, &got); err != nil {
+				return keys, fmt.Errorf("truncated RDB file: missing checksum")
+			}
+			if got != 0 && got != want {
+				return keys, fmt.Errorf("checksum mismatch")
+			}
+			return keys, nil
+
+		case rdbOpSelectDB:
+			index, _, err := rr.readLength()
+			if err != nil {
+				return keys, err
+			}
+			if db, err = d.DB(int(index)); err != nil {
+				return keys, fmt.Errorf("RDB file uses database %d: %v", index, err)
+			}
+
+		case rdbOpResizeDB:
+			if _, _, err := rr.readLength(); err != nil {
+				return keys, err
+			}
+			if _, _, err := rr.readLength(); err != nil {
+				return keys, err
+			}
+
+		case rdbOpExpireMs:
+			b, err := rr.read(8)
+			if err != nil {
+				return keys, err
+			}
+			expireMs = int64(binary.LittleEndian.Uint64(b))
+
+		case rdbOpExpireSec:
+			b, err := rr.read(4)
+			if err != nil {
+				return keys, err
+			}
+			expireMs = int64(binary.LittleEndian.Uint32(b)) * 1000
+
+		case rdbOpAux:
+			if _, err := rr.readString(); err != nil {
+				return keys, err
+			}
+			if _, err := rr.readString(); err != nil {
+				return keys, err
+			}
+
+		case rdbOpIdle:
+			if _, _, err := rr.readLength(); err != nil {
+				return keys, err
+			}
+
+		case rdbOpFreq:
+			if _, err := rr.read(1); err != nil {
+				return keys, err
+			}
+
+		case rdbOpFunction:
+			// Function libraries are skipped; Redix has no scripting.
+			if _, err := rr.readString(); err != nil {
+				return keys, err
+			}
+
+		case rdbOpModuleAux:
+			return keys, fmt.Errorf("module data is not supported")
+
+		default:
+			key, err := rr.readString()
+			if err != nil {
+				return keys, err
+			}
+			value, err := rr.readObject(op)
+			if err != nil {
+				return keys, fmt.Errorf("key %q: %v", key, err)
+			}
+			if expireMs == 0 || expireMs > now {
+				db.Set(string(key), value)
+				if expireMs != 0 {
+					db.ExpireAt(string(key), time.UnixMilli(expireMs))
+				}
+				keys++
+			}
+			expireMs = 0
+		}
+	}
+}
+
+// rdbReader reads an RDB file, keeping the checksum of what it has read.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+	one [1]byte
+}
+
+func (r *rdbReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.one[0] = b
+		r.crc = crc64Update(r.crc, r.one[:])
+	}
+	return b, err
+}
+
+// rdbMaxPrealloc bounds what is allocated up front for a length read from
+// the file, so a damaged length fails on the missing data rather than on
+// a huge allocation.
+const rdbMaxPrealloc = 1 << 20
+
+// read reads the next n bytes.
+func (r *rdbReader) read(n int) ([]byte, error) {
+	b := make([]byte, 0, min(n, rdbMaxPrealloc))
+	for len(b) < n {
+		chunk := min(n-len(b), rdbMaxPrealloc)
+		b = append(b, make([]byte, chunk)...)
+		if _, err := io.ReadFull(r.r, b[len(b)-chunk:]); err != nil {
+			return nil, fmt.Errorf("truncated RDB file: %v", err)
+		}
+	}
+	r.crc = crc64Update(r.crc, b)
+	return b, nil
+}
+
+// readLength reads a length. If encoded is set, the length is instead the
+// special encoding of the string that follows.
+func (r *rdbReader) readLength() (length uint64, encoded bool, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, false, fmt.Errorf("truncated RDB file: %v", err)
+	}
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		next, err := r.ReadByte()
+		if err != nil {
+			return 0, false, fmt.Errorf("truncated RDB file: %v", err)
+		}
+		return uint64(first&0x3F)<<8 | uint64(next), false, nil
+	case 3:
+		return uint64(first & 0x3F), true, nil
+	}
+	switch first {
+	case 0x80:
+		b, err := r.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), false, nil
+	case 0x81:
+		b, err := r.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(b), false, nil
+	}
+	return 0, false, fmt.Errorf("invalid length encoding 0x%02x", first)
+}
+
+// readCount reads the number of elements of a collection.
+func (r *rdbReader) readCount() (int, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || n > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid element count")
+	}
+	return int(n), nil
+}
+
+// readString reads a string, which may be stored as an integer or
+// LZF compressed.
+func (r *rdbReader) readString() ([]byte, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		if n > math.MaxInt32 {
+			return nil, fmt.Errorf("string of %d bytes is too long", n)
+		}
+		return r.read(int(n))
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(b[0])), 10), nil
+	case rdbEncInt16:
+		b, err := r.read(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(b))), 10), nil
+	case rdbEncInt32:
+		b, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(b))), 10), nil
+	case rdbEncLZF:
+		compressed, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.read(compressed)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(b, length)
+	}
+	return nil, fmt.Errorf("unknown string encoding %d", n)
+}
+
+// readScore reads a sorted set score stored as text, as in RDB_TYPE_ZSET.
+func (r *rdbReader) readScore() (float64, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("truncated RDB file: %v", err)
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := r.read(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// readObject reads a value of the given RDB type.
+func (r *rdbReader) readObject(typ byte) (interface{}, error) {
+	switch typ {
+	case rdbTypeString:
+		b, err := r.readString()
+		return string(b), err
+
+	case rdbTypeList, rdbTypeSet:
+		n, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		elements := make([][]byte, 0, min(n, rdbMaxPrealloc))
+		for i := 0; i < n; i++ {
+			b, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, b)
+		}
+		if typ == rdbTypeList {
+			return rdbList(elements), nil
+		}
+		return rdbSet(elements), nil
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		zset := datastructures.NewSortedSet()
+		for i := 0; i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == rdbTypeZSet {
+				score, err = r.readScore()
+			} else {
+				var b []byte
+				if b, err = r.read(8); err == nil {
+					score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			zset.Add(string(member), score)
+		}
+		return zset, nil
+
+	case rdbTypeHash:
+		n, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		elements := make([][]byte, 0, min(2*n, rdbMaxPrealloc))
+		for i := 0; i < 2*n; i++ {
+			b, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, b)
+		}
+		return rdbHash(elements), nil
+
+	case rdbTypeQuick, rdbTypeQuick2:
+		nodes, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		var elements [][]byte
+		for i := 0; i < nodes; i++ {
+			container := uint64(quicklistNodePacked)
+			if typ == rdbTypeQuick2 {
+				if container, _, err = r.readLength(); err != nil {
+					return nil, err
+				}
+			}
+			node, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case container == quicklistNodePlain:
+				elements = append(elements, node)
+				continue
+			case typ == rdbTypeQuick:
+				node, err := parseZiplist(node)
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, node...)
+			default:
+				node, err := parseListpack(node)
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, node...)
+			}
+		}
+		return rdbList(elements), nil
+
+	case rdbTypeIntset:
+		b, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		return parseIntset(b)
+
+	case rdbTypeListZip, rdbTypeZSetZip, rdbTypeHashZip, rdbTypeHashLP, rdbTypeZSetLP, rdbTypeSetLP:
+		b, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		var elements [][]byte
+		if typ == rdbTypeListZip || typ == rdbTypeZSetZip || typ == rdbTypeHashZip {
+			elements, err = parseZiplist(b)
+		} else {
+			elements, err = parseListpack(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case rdbTypeListZip:
+			return rdbList(elements), nil
+		case rdbTypeSetLP:
+			return rdbSet(elements), nil
+		case rdbTypeHashZip, rdbTypeHashLP:
+			if len(elements)%2 != 0 {
+				return nil, fmt.Errorf("hash has a field without a value")
+			}
+			return rdbHash(elements), nil
+		}
+		if len(elements)%2 != 0 {
+			return nil, fmt.Errorf("sorted set has a member without a score")
+		}
+		zset := datastructures.NewSortedSet()
+		for i := 0; i < len(elements); i += 2 {
+			score, err := strconv.ParseFloat(string(elements[i+1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid score %q", elements[i+1])
+			}
+			zset.Add(string(elements[i]), score)
+		}
+		return zset, nil
+	}
+	return nil, fmt.Errorf("unsupported RDB value type %d", typ)
+}
+
+// rdbElement converts an element of an RDB collection to the value stored
+// for it. Redis keeps integers in compact encodings as such, and so do
+// lists, sets and hashes here.
+func rdbElement(b []byte) interface{} {
+	if n, err := strconv.ParseInt(string(b), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(b) {
+		return n
+	}
+	return string(b)
+}
+
+func rdbList(elements [][]byte) *datastructures.List {
+	list := datastructures.NewList()
+	for _, element := range elements {
+		list.PushBack(rdbElement(element))
+	}
+	return list
+}
+
+func rdbSet(members [][]byte) *datastructures.Set {
+	set := datastructures.NewSet()
+	for _, member := range members {
+		set.Add(rdbElement(member))
+	}
+	return set
+}
+
+// rdbHash builds a hash from alternating fields and values.
+func rdbHash(elements [][]byte) *datastructures.Hash {
+	hash := datastructures.NewHash()
+	for i := 0; i+1 < len(elements); i += 2 {
+		hash.HSet(string(elements[i]), rdbElement(elements[i+1]))
+	}
+	return hash
+}
+
+var errCorruptEncoding = errors.New("corrupt compact encoding")
+
+// parseIntset decodes an intset: the integer width and count as little
+// endian uint32s, followed by the integers.
+func parseIntset(b []byte) (*datastructures.Set, error) {
+	if len(b) < 8 {
+		return nil, errCorruptEncoding
+	}
+	width := int(binary.LittleEndian.Uint32(b[0:4]))
+	n := int(binary.LittleEndian.Uint32(b[4:8]))
+	if (width != 2 && width != 4 && width != 8) || len(b) != 8+n*width {
+		return nil, errCorruptEncoding
+	}
+	set := datastructures.NewSet()
+	for i := 0; i < n; i++ {
+		p := b[8+i*width:]
+		switch width {
+		case 2:
+			set.Add(int64(int16(binary.LittleEndian.Uint16(p))))
+		case 4:
+			set.Add(int64(int32(binary.LittleEndian.Uint32(p))))
+		default:
+			set.Add(int64(binary.LittleEndian.Uint64(p)))
+		}
+	}
+	return set, nil
+}
+
+// parseZiplist decodes the entries of a ziplist, with integers converted
+// to text. A ziplist is a 10 byte header holding its size, the offset of
+// its last entry and its entry count, then entries made of the length of
+// the previous entry, an encoding and the data, and a 0xFF terminator.
+func parseZiplist(b []byte) ([][]byte, error) {
+	if len(b) < 11 || int(binary.LittleEndian.Uint32(b[0:4])) != len(b) {
+		return nil, errCorruptEncoding
+	}
+	var entries [][]byte
+	for pos := 10; ; {
+		if pos >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		if b[pos] == 0xFF {
+			return compactEntries(entries, b[8:10], pos == len(b)-1)
+		}
+		if b[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(b) {
+			return nil, errCorruptEncoding
+		}
+
+		enc := b[pos]
+		var length, header int
+		var value int64
+		isInt := true
+		switch {
+		case enc>>6 == 0:
+			length, header, isInt = int(enc&0x3F), 1, false
+		case enc>>6 == 1:
+			if pos+2 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			length, header, isInt = int(enc&0x3F)<<8|int(b[pos+1]), 2, false
+		case enc == 0x80:
+			if pos+5 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			length, header, isInt = int(binary.BigEndian.Uint32(b[pos+1:])), 5, false
+		case enc == 0xC0:
+			length, header = 2, 1
+		case enc == 0xD0:
+			length, header = 4, 1
+		case enc == 0xE0:
+			length, header = 8, 1
+		case enc == 0xF0:
+			length, header = 3, 1
+		case enc == 0xFE:
+			length, header = 1, 1
+		case enc >= 0xF1 && enc <= 0xFD:
+			length, header, value = 0, 1, int64(enc&0x0F)-1
+		default:
+			return nil, errCorruptEncoding
+		}
+		data := pos + header
+		if length < 0 || data+length > len(b) {
+			return nil, errCorruptEncoding
+		}
+		p := b[data : data+length]
+		if !isInt {
+			entries = append(entries, p)
+		} else {
+			switch enc {
+			case 0xC0:
+				value = int64(int16(binary.LittleEndian.Uint16(p)))
+			case 0xD0:
+				value = int64(int32(binary.LittleEndian.Uint32(p)))
+			case 0xE0:
+				value = int64(binary.LittleEndian.Uint64(p))
+			case 0xF0:
+				value = int64(int32(uint32(p[0])<<8|uint32(p[1])<<16|uint32(p[2])<<24) >> 8)
+			case 0xFE:
+				value = int64(int8(p[0]))
+			}
+			entries = append(entries, strconv.AppendInt(nil, value, 10))
+		}
+		pos = data + length
+	}
+}
+
+// parseListpack decodes the entries of a listpack, with integers converted
+// to text. A listpack is a 6 byte header holding its size and entry count,
+// entries made of an encoding, the data and the entry's length written
+// backwards, and a 0xFF terminator.
+func parseListpack(b []byte) ([][]byte, error) {
+	if len(b) < 7 || int(binary.LittleEndian.Uint32(b[0:4])) != len(b) {
+		return nil, errCorruptEncoding
+	}
+	var entries [][]byte
+	for pos := 6; ; {
+		if pos >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		enc := b[pos]
+		if enc == 0xFF {
+			return compactEntries(entries, b[4:6], pos == len(b)-1)
+		}
+
+		var header, length int
+		var value int64
+		isInt := true
+		switch {
+		case enc&0x80 == 0:
+			header, value = 1, int64(enc&0x7F)
+		case enc&0xC0 == 0x80:
+			header, length, isInt = 1, int(enc&0x3F), false
+		case enc&0xE0 == 0xC0:
+			if pos+2 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			header = 2
+			value = int64(uint64(enc&0x1F)<<8 | uint64(b[pos+1]))
+			if value >= 1<<12 {
+				value -= 1 << 13
+			}
+		case enc&0xF0 == 0xE0:
+			if pos+2 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			header, length, isInt = 2, int(enc&0x0F)<<8|int(b[pos+1]), false
+		case enc == 0xF0:
+			if pos+5 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			header, length, isInt = 5, int(binary.LittleEndian.Uint32(b[pos+1:])), false
+		case enc == 0xF1:
+			header, length = 1, 2
+		case enc == 0xF2:
+			header, length = 1, 3
+		case enc == 0xF3:
+			header, length = 1, 4
+		case enc == 0xF4:
+			header, length = 1, 8
+		default:
+			return nil, errCorruptEncoding
+		}
+		data := pos + header
+		if length < 0 || data+length > len(b) {
+			return nil, errCorruptEncoding
+		}
+		p := b[data : data+length]
+		if !isInt {
+			entries = append(entries, p)
+		} else {
+			switch enc {
+			case 0xF1:
+				value = int64(int16(binary.LittleEndian.Uint16(p)))
+			case 0xF2:
+				value = int64(int32(uint32(p[0])<<8|uint32(p[1])<<16|uint32(p[2])<<24) >> 8)
+			case 0xF3:
+				value = int64(int32(binary.LittleEndian.Uint32(p)))
+			case 0xF4:
+				value = int64(binary.LittleEndian.Uint64(p))
+			}
+			entries = append(entries, strconv.AppendInt(nil, value, 10))
+		}
+		pos = data + length + listpackBacklenSize(header+length)
+	}
+}
+
+// compactEntries checks the entries decoded from a ziplist or listpack
+// against the count in its header, which is 65535 when there are too many
+// to count, and that the terminator ends it.
+func compactEntries(entries [][]byte, count []byte, terminated bool) ([][]byte, error) {
+	n := int(binary.LittleEndian.Uint16(count))
+	if !terminated || (n != math.MaxUint16 && n != len(entries)) {
+		return nil, errCorruptEncoding
+	}
+	return entries, nil
+}
+
+// listpackBacklenSize returns the size of the backwards length written
+// after a listpack entry of n bytes.
+func listpackBacklenSize(n int) int {
+	switch {
+	case n < 1<<7:
+		return 1
+	case n < 1<<14:
+		return 2
+	case n < 1<<21:
+		return 3
+	case n < 1<<28:
+		return 4
+	}
+	return 5
+}
+
+// lzfDecompress expands LZF compressed data to its original length.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, min(length, rdbMaxPrealloc))
+	for i := 0; i < len(in); {
+		if len(out) > length {
+			return nil, errCorruptEncoding
+		}
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// A run of ctrl+1 literal bytes.
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errCorruptEncoding
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// A back reference of n+2 bytes.
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errCorruptEncoding
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errCorruptEncoding
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorruptEncoding
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != length {
+		return nil, errCorruptEncoding
+	}
+	return out, nil
+}
+
+// SaveRDB writes every database to a Redis RDB file at path, atomically
+// replacing any file there.
+func (d *Databases) SaveRDB(path string) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	if err := d.WriteRDB(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// WriteRDB writes every database to w as a Redis RDB file. Integers are
+// written as strings, and every collection in its plain encoding, which
+// Redis converts to a compact one on load where it fits. The databases
+// are read from a Snapshot, so the file holds them as they were at one
+// point in time while writes continue.
+func (d *Databases) WriteRDB(w io.Writer) error {
+	snap := d.OpenSnapshot()
+	defer snap.Release()
+
+	rw := &rdbWriter{w: bufio.NewWriter(w)}
+	rw.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, rdbVersion)))
+	for _, aux := range [][2]string{
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+	} {
+		rw.write([]byte{rdbOpAux})
+		rw.writeString(aux[0])
+		rw.writeString(aux[1])
+	}
+
+	for i := 0; i < snap.Len(); i++ {
+		selected := false
+		err := snap.ForEach(i, func(key string, value interface{}, expireAt time.Time) error {
+			if !selected {
+				rw.write([]byte{rdbOpSelectDB})
+				rw.writeLength(uint64(i))
+				selected = true
+			}
+			if !expireAt.IsZero() {
+				rw.write(binary.LittleEndian.AppendUint64([]byte{rdbOpExpireMs}, uint64(expireAt.UnixMilli())))
+			}
+			if err := rw.writeObject(key, value); err != nil {
+				return fmt.Errorf("key %q: %v", key, err)
+			}
+			return rw.err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	rw.write([]byte{rdbOpEOF})
+	rw.write(binary.LittleEndian.AppendUint64(nil, rw.crc))
+	if rw.err != nil {
+		return rw.err
+	}
+	return rw.w.Flush()
+}
+
+// rdbWriter writes an RDB file, keeping the checksum of what it has
+// written. The first error is kept in err and stops further writes.
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (w *rdbWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = crc64Update(w.crc, p)
+	_, w.err = w.w.Write(p)
+}
+
+func (w *rdbWriter) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.write([]byte{byte(n)})
+	case n < 1<<14:
+		w.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		w.write(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n)))
+	default:
+		w.write(binary.BigEndian.AppendUint64([]byte{0x81}, n))
+	}
+}
+
+func (w *rdbWriter) writeString(s string) {
+	w.writeLength(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+// rdbString returns the text of a string value or collection element.
+func rdbString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	}
+	return "", fmt.Errorf("cannot encode element of type %T", value)
+}
+
+// writeObject writes the type, key and value of a key.
+func (w *rdbWriter) writeObject(key string, value interface{}) error {
+	switch v := value.(type) {
+	case string, int64:
+		s, _ := rdbString(v)
+		w.write([]byte{rdbTypeString})
+		w.writeString(key)
+		w.writeString(s)
+	case *datastructures.List:
+		w.write([]byte{rdbTypeList})
+		w.writeString(key)
+		return w.writeElements(v.Range(0, v.Len()))
+	case *datastructures.Set:
+		w.write([]byte{rdbTypeSet})
+		w.writeString(key)
+		return w.writeElements(v.Members())
+	case *datastructures.SortedSet:
+		members, scores, _ := v.Scan(0, math.MaxInt32)
+		w.write([]byte{rdbTypeZSet2})
+		w.writeString(key)
+		w.writeLength(uint64(len(members)))
+		for i, member := range members {
+			w.writeString(member)
+			w.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(scores[i])))
+		}
+	case *datastructures.Hash:
+		fields := v.HGetAll()
+		w.write([]byte{rdbTypeHash})
+		w.writeString(key)
+		w.writeLength(uint64(len(fields)))
+		for field, fieldValue := range fields {
+			s, err := rdbString(fieldValue)
+			if err != nil {
+				return err
+			}
+			w.writeString(field)
+			w.writeString(s)
+		}
+	default:
+		return fmt.Errorf("cannot encode value of type %T", value)
+	}
+	return nil
+}
+
+func (w *rdbWriter) writeElements(elements []interface{}) error {
+	w.writeLength(uint64(len(elements)))
+	for _, element := range elements {
+		s, err := rdbString(element)
+		if err != nil {
+			return err
+		}
+		w.writeString(s)
+	}
+	return nil
+}
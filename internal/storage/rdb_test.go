@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// testdata/redis-7.2.rdb was assembled by hand, following the layout that
+// rdb.c and listpack.c of Redis 7.2 write with SAVE: version 11, the usual
+// aux fields, SELECTDB and RESIZEDB for databases 0 and 1, integer and
+// LZF string encodings, EXPIRETIME_MS, a FREQ opcode, a quicklist of one
+// listpack, an intset, and listpack sets, hashes and sorted sets, ending
+// with a CRC64.
+const redisFixture = "testdata/redis-7.2.rdb"
+
+func readFixture(t *testing.T) []byte {
+	t.Helper()
+	b, err := os.ReadFile(redisFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCRC64(t *testing.T) {
+	// The check value given for the Jones polynomial in Redis's crc64.c.
+	if got := crc64Update(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("crc64(123456789) = %#x", got)
+	}
+}
+
+// sortedElements returns the text of a set's members or a list's elements
+// in a stable order.
+func sortedElements(elements []interface{}) []string {
+	s := make([]string, len(elements))
+	for i, element := range elements {
+		s[i] = fmt.Sprint(element)
+	}
+	sort.Strings(s)
+	return s
+}
+
+func TestReadRedisRDB(t *testing.T) {
+	dbs := NewDatabases(2, 4)
+	keys, err := dbs.ReadRDB(bytes.NewReader(readFixture(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 12 {
+		t.Errorf("loaded %d keys, want 12 of the 13 in the file", keys)
+	}
+	db, _ := dbs.DB(0)
+	get := func(key string) interface{} {
+		t.Helper()
+		value, ok := db.Get(key)
+		if !ok {
+			t.Fatalf("%s is missing", key)
+		}
+		return value
+	}
+
+	for key, want := range map[string]string{
+		"greeting":   "hello, world",
+		"small":      "-7",
+		"counter":    "12345",
+		"big":        "100000",
+		"compressed": strings.Repeat("redix ", 20),
+		"expiring":   "later",
+	} {
+		if got := get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if at, ok := db.ExpireTime("expiring"); !ok || !at.Equal(time.UnixMilli(4102444800000)) {
+		t.Errorf("expiring expires at %v, %v", at, ok)
+	}
+	if db.Exists("expired") {
+		t.Error("a key that had already expired was loaded")
+	}
+
+	list := get("list").(*datastructures.List)
+	if got, want := list.Range(0, list.Len()), []interface{}{"a", "b", int64(7), int64(-300), int64(70000)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("list = %v, want %v", got, want)
+	}
+	if got := sortedElements(get("intset").(*datastructures.Set).Members()); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Errorf("intset = %v", got)
+	}
+	if got := sortedElements(get("set").(*datastructures.Set).Members()); !reflect.DeepEqual(got, []string{"x", "y", "z"}) {
+		t.Errorf("set = %v", got)
+	}
+	hash := get("hash").(*datastructures.Hash)
+	if got, want := hash.HGetAll(), map[string]interface{}{"name": "redix", "version": int64(42)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hash = %v, want %v", got, want)
+	}
+	zset := get("zset").(*datastructures.SortedSet)
+	for member, want := range map[string]float64{"alice": 1, "bob": 2.5} {
+		if score, ok := zset.GetScore(member); !ok || score != want {
+			t.Errorf("zset score of %s = %v, %v, want %v", member, score, ok, want)
+		}
+	}
+
+	db1, _ := dbs.DB(1)
+	if value, _ := db1.Get("other"); value != "db1" {
+		t.Errorf("other in database 1 = %v", value)
+	}
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	dbs := NewDatabases(2, 4)
+	db, _ := dbs.DB(0)
+	list := datastructures.NewList()
+	set := datastructures.NewSet()
+	hash := datastructures.NewHash()
+	zset := datastructures.NewSortedSet()
+	for i := 0; i < 300; i++ {
+		list.PushBack(fmt.Sprintf("element:%d", i))
+		set.Add(int64(i))
+		hash.HSet(fmt.Sprintf("field:%d", i), strings.Repeat("v", i%40))
+		zset.Add(fmt.Sprintf("member:%d", i), float64(i)/4)
+	}
+	zset.Add("infinite", math.Inf(1))
+	db.Set("string", strings.Repeat("redix", 100))
+	db.Set("list", list)
+	db.Set("set", set)
+	db.Set("hash", hash)
+	db.Set("zset", zset)
+	db.ExpireAt("string", time.Now().Add(time.Hour).Truncate(time.Millisecond))
+	db1, _ := dbs.DB(1)
+	db1.Set("elsewhere", "1")
+
+	var buf bytes.Buffer
+	if err := dbs.WriteRDB(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewDatabases(2, 4)
+	keys, err := loaded.ReadRDB(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 6 {
+		t.Fatalf("loaded %d keys, want 6", keys)
+	}
+	got, _ := loaded.DB(0)
+	if value, _ := got.Get("string"); value != strings.Repeat("redix", 100) {
+		t.Errorf("string = %v", value)
+	}
+	want, _ := db.ExpireTime("string")
+	if at, ok := got.ExpireTime("string"); !ok || !at.Equal(want) {
+		t.Errorf("string expires at %v, want %v", at, want)
+	}
+	value, _ := got.Get("list")
+	if l := value.(*datastructures.List); !reflect.DeepEqual(l.Range(0, l.Len()), list.Range(0, list.Len())) {
+		t.Error("list changed")
+	}
+	value, _ = got.Get("set")
+	if s := value.(*datastructures.Set); !reflect.DeepEqual(sortedElements(s.Members()), sortedElements(set.Members())) {
+		t.Error("set changed")
+	}
+	value, _ = got.Get("hash")
+	if h := value.(*datastructures.Hash); !reflect.DeepEqual(h.HGetAll(), hash.HGetAll()) {
+		t.Error("hash changed")
+	}
+	value, _ = got.Get("zset")
+	z := value.(*datastructures.SortedSet)
+	if z.ZCard() != zset.ZCard() {
+		t.Errorf("zset has %d members, want %d", z.ZCard(), zset.ZCard())
+	}
+	if score, _ := z.GetScore("infinite"); !math.IsInf(score, 1) {
+		t.Errorf("infinite has score %v", score)
+	}
+	got1, _ := loaded.DB(1)
+	if value, _ := got1.Get("elsewhere"); value != "1" {
+		t.Errorf("elsewhere in database 1 = %v", value)
+	}
+}
+
+func TestReadRDBChecksum(t *testing.T) {
+	b := readFixture(t)
+	b[len(b)-1] ^= 1
+	if _, err := NewDatabases(2, 4).ReadRDB(bytes.NewReader(b)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("ReadRDB with a bad checksum returned %v", err)
+	}
+
+	// A zero checksum means it was disabled with rdbchecksum no.
+	b = readFixture(t)
+	copy(b[len(b)-8:], make([]byte, 8))
+	if _, err := NewDatabases(2, 4).ReadRDB(bytes.NewReader(b)); err != nil {
+		t.Fatalf("ReadRDB without a checksum: %v", err)
+	}
+}
+
+func TestReadRDBTruncated(t *testing.T) {
+	b := readFixture(t)
+	for n := 0; n < len(b); n++ {
+		if _, err := NewDatabases(2, 4).ReadRDB(bytes.NewReader(b[:n])); err == nil {
+			t.Errorf("reading the first %d of %d bytes succeeded", n, len(b))
+		}
+	}
+}
+
+// TestReadRDBCorrupt flips each byte of the fixture in turn. Damage must
+// be reported, usually by the checksum, except to the version, which may
+// become an older one without a checksum. With the checksum disabled, the
+// damage reaches the decoders, which may accept it but must not crash.
+func TestReadRDBCorrupt(t *testing.T) {
+	fixture := readFixture(t)
+	unchecked := append([]byte(nil), fixture...)
+	copy(unchecked[len(unchecked)-8:], make([]byte, 8))
+	for _, tc := range []struct {
+		b       []byte
+		checked bool
+	}{{fixture, true}, {unchecked, false}} {
+		b := tc.b
+		for i := 0; i < len(b)-8; i++ {
+			for _, flip := range []byte{0x01, 0x80, 0xFF} {
+				damaged := append([]byte(nil), b...)
+				damaged[i] ^= flip
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("flipping byte %d with %#x panicked: %v", i, flip, r)
+						}
+					}()
+					_, err := NewDatabases(2, 4).ReadRDB(bytes.NewReader(damaged))
+					if err == nil && tc.checked && i >= len(rdbMagic)+4 {
+						t.Errorf("flipping byte %d with %#x was not detected", i, flip)
+					}
+				}()
+			}
+		}
+	}
+}
+
+func TestCompactEncodingsRejectDamage(t *testing.T) {
+	for name, parse := range map[string]func([]byte) error{
+		"ziplist":  func(b []byte) error { _, err := parseZiplist(b); return err },
+		"listpack": func(b []byte) error { _, err := parseListpack(b); return err },
+		"intset":   func(b []byte) error { _, err := parseIntset(b); return err },
+		"lzf":      func(b []byte) error { _, err := lzfDecompress(b, 1<<30); return err },
+	} {
+		for _, b := range [][]byte{
+			nil,
+			{0xFF},
+			bytes.Repeat([]byte{0xFF}, 16),
+			{10, 0, 0, 0, 1, 0, 0xF0, 0xFF, 0xFF, 0xFF, 0x7F, 0xFF},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80, 0xFF, 0xFF, 0xFF, 0xFF},
+			{2, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 1, 0},
+			{0xE0, 0xFF, 0x00},
+		} {
+			if err := parse(b); err == nil {
+				t.Errorf("%s accepted % x", name, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// DefaultSnapshotTimeout is how long a snapshot opened by a client stays
+// open without being read, unless SNAPSHOT OPEN sets another timeout.
+const DefaultSnapshotTimeout = 60 * time.Second
+
+// MaxSessionSnapshots is how many snapshots one session can have open at
+// a time. Each keeps the old values of every key changed while it is
+// open, so a client opening them in a loop would otherwise hold on to
+// memory without bound.
+const MaxSessionSnapshots = 16
+
+var (
+	// ErrNoSuchSnapshot is returned for a token that names no open snapshot.
+	ErrNoSuchSnapshot = fmt.Errorf("no such snapshot")
+	// ErrTooManySnapshots is returned by SNAPSHOT OPEN for a session that
+	// already has MaxSessionSnapshots open.
+	ErrTooManySnapshots = fmt.Errorf("too many open snapshots, release one first")
+)
+
+// readSnapshots are the snapshots clients have opened with SNAPSHOT OPEN,
+// by token. A snapshot belongs to the session that opened it, and is
+// released by SNAPSHOT RELEASE, when that session closes, or once it has
+// not been read for its timeout, so that a client that goes away does not
+// keep old values forever.
+type readSnapshots struct {
+	mu   sync.Mutex
+	open map[string]*readSnapshot
+}
+
+type readSnapshot struct {
+	*Snapshot
+	token string
+	// owner is the session that opened the snapshot, nil for callers
+	// without one.
+	owner   *session
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// newSnapshotToken returns a token that cannot be guessed from the ones
+// handed out before it.
+func newSnapshotToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// add keeps snap open for owner, unless owner already has
+// MaxSessionSnapshots open, in which case snap is released.
+func (r *readSnapshots) add(owner *session, snap *Snapshot, timeout time.Duration) (string, error) {
+	token, err := newSnapshotToken()
+	if err != nil {
+		snap.Release()
+		return "", err
+	}
+	rs := &readSnapshot{Snapshot: snap, token: token, owner: owner, timeout: timeout}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	owned := 0
+	for _, other := range r.open {
+		if other.owner == owner {
+			owned++
+		}
+	}
+	if owned >= MaxSessionSnapshots {
+		snap.Release()
+		return "", ErrTooManySnapshots
+	}
+	rs.timer = time.AfterFunc(timeout, func() { r.remove(rs) })
+	if r.open == nil {
+		r.open = make(map[string]*readSnapshot)
+	}
+	r.open[token] = rs
+	return token, nil
+}
+
+// get returns the snapshot named by token if owner opened it, and restarts
+// its timeout. Other sessions' tokens name no snapshot.
+func (r *readSnapshots) get(owner *session, token string) (*readSnapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rs, ok := r.open[token]
+	if !ok || rs.owner != owner {
+		return nil, ErrNoSuchSnapshot
+	}
+	rs.timer.Reset(rs.timeout)
+	return rs, nil
+}
+
+// release releases the snapshot named by token if owner opened it.
+func (r *readSnapshots) release(owner *session, token string) bool {
+	r.mu.Lock()
+	rs, ok := r.open[token]
+	r.mu.Unlock()
+	if !ok || rs.owner != owner {
+		return false
+	}
+	return r.remove(rs)
+}
+
+// closeSession releases the snapshots owner opened.
+func (r *readSnapshots) closeSession(owner *session) {
+	for _, rs := range r.list() {
+		if rs.owner == owner {
+			r.remove(rs)
+		}
+	}
+}
+
+// remove releases rs unless it has been released already.
+func (r *readSnapshots) remove(rs *readSnapshot) bool {
+	r.mu.Lock()
+	ok := r.open[rs.token] == rs
+	if ok {
+		delete(r.open, rs.token)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	rs.timer.Stop()
+	rs.Release()
+	return true
+}
+
+// list returns the open snapshots, oldest first.
+func (r *readSnapshots) list() []*readSnapshot {
+	r.mu.Lock()
+	snaps := make([]*readSnapshot, 0, len(r.open))
+	for _, rs := range r.open {
+		snaps = append(snaps, rs)
+	}
+	r.mu.Unlock()
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].id < snaps[j].id
+	})
+	return snaps
+}
+
+// handleSnapshot serves SNAPSHOT OPEN [TIMEOUT seconds], SNAPSHOT READ
+// token command [arg ...], SNAPSHOT RELEASE token and SNAPSHOT LIST.
+func (h *CommandHandler) handleSnapshot(ctx context.Context, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("wrong number of arguments for SNAPSHOT")
+	}
+	switch sub := strings.ToUpper(args[1]); sub {
+	case "OPEN":
+		timeout := DefaultSnapshotTimeout
+		switch {
+		case len(args) == 4 && strings.EqualFold(args[2], "TIMEOUT"):
+			seconds, err := strconv.Atoi(args[3])
+			if err != nil || seconds <= 0 {
+				return nil, fmt.Errorf("invalid timeout")
+			}
+			timeout = time.Duration(seconds) * time.Second
+		case len(args) != 2:
+			return nil, fmt.Errorf("syntax error")
+		}
+		return h.reads.add(sessionFrom(ctx), h.dbs.OpenSnapshot(), timeout)
+
+	case "READ":
+		if len(args) < 4 {
+			return nil, fmt.Errorf("wrong number of arguments for SNAPSHOT READ")
+		}
+		rs, err := h.reads.get(sessionFrom(ctx), args[2])
+		if err != nil {
+			return nil, err
+		}
+		return h.snapshotRead(ctx, rs.Snapshot, args[3:])
+
+	case "RELEASE":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("wrong number of arguments for SNAPSHOT RELEASE")
+		}
+		if h.reads.release(sessionFrom(ctx), args[2]) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+
+	case "LIST":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for SNAPSHOT LIST")
+		}
+		var reply []interface{}
+		for _, rs := range h.reads.list() {
+			if rs.owner != sessionFrom(ctx) {
+				continue
+			}
+			reply = append(reply, []interface{}{
+				rs.token,
+				int64(time.Since(rs.created).Seconds()),
+				rs.Keys(),
+			})
+		}
+		return reply, nil
+
+	default:
+		return nil, fmt.Errorf("unknown SNAPSHOT subcommand '%s'", sub)
+	}
+}
+
+// snapshotRead runs a read command against the client's selected database
+// as it was in snap. Replies have the same shape as those of the command
+// run against the live keyspace.
+func (h *CommandHandler) snapshotRead(ctx context.Context, snap *Snapshot, args []string) (interface{}, error) {
+	db := h.selectedDB(ctx)
+	command := strings.ToUpper(args[0])
+	switch command {
+	case "GET":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for GET")
+		}
+		value, _, _, err := snap.Get(db, args[1])
+		return value, err
+
+	case "DUMP":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for DUMP")
+		}
+		value, _, exists, err := snap.Get(db, args[1])
+		if err != nil || !exists {
+			return nil, err
+		}
+		payload, err := dumpValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(payload), nil
+
+	case "MGET":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("wrong number of arguments for MGET")
+		}
+		values := make([]interface{}, 0, len(args)-1)
+		for _, key := range args[1:] {
+			value, _, _, err := snap.Get(db, key)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+
+	case "EXISTS":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("wrong number of arguments for EXISTS")
+		}
+		var count int64
+		for _, key := range args[1:] {
+			_, _, exists, err := snap.Get(db, key)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				count++
+			}
+		}
+		return count, nil
+
+	case "TYPE":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for TYPE")
+		}
+		value, _, exists, err := snap.Get(db, args[1])
+		if err != nil || !exists {
+			return "", err
+		}
+		return typeName(value), nil
+
+	case "TTL":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for TTL")
+		}
+		_, expireAt, _, err := snap.Get(db, args[1])
+		if err != nil || expireAt.IsZero() {
+			return nil, err
+		}
+		return int64(time.Until(expireAt).Seconds()), nil
+
+	case "DBSIZE":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("wrong number of arguments for DBSIZE")
+		}
+		var size int64
+		err := snap.forEachKey(db, func(key string) { size++ })
+		return size, err
+
+	case "KEYS":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for KEYS")
+		}
+		var matches []string
+		err := snap.forEachKey(db, func(key string) {
+			if matchPattern(args[1], key) {
+				matches = append(matches, key)
+			}
+		})
+		return matches, err
+
+	case "SCAN":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("wrong number of arguments for SCAN")
+		}
+		opts, err := parseScanArgs(args[1:], true)
+		if err != nil {
+			return nil, err
+		}
+		keys, next, err := snap.scan(db, opts.cursor, opts.count, opts.pattern, opts.typ)
+		if err != nil {
+			return nil, err
+		}
+		return scanReply(next, keys), nil
+
+	case "HGETALL":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong number of arguments for HGETALL")
+		}
+		value, _, exists, err := snap.Get(db, args[1])
+		if err != nil || !exists {
+			return []string{}, err
+		}
+		return hashFields(value)
+
+	case "HSCAN", "SSCAN", "ZSCAN":
+		if len(args) < 3 {
+			return nil, fmt.Errorf("wrong number of arguments for %s", command)
+		}
+		opts, err := parseScanArgs(args[2:], false)
+		if err != nil {
+			return nil, err
+		}
+		value, _, exists, err := snap.Get(db, args[1])
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return scanReply(0, []string{}), nil
+		}
+		scan := map[string]func(interface{}, uint64, int, string) ([]string, uint64, error){
+			"HSCAN": scanHash,
+			"SSCAN": scanSet,
+			"ZSCAN": scanSortedSet,
+		}[command]
+		items, next, err := scan(value, opts.cursor, opts.count, opts.pattern)
+		if err != nil {
+			return nil, err
+		}
+		return scanReply(next, items), nil
+
+	case "KEYRANGE", "KEYPREFIX":
+		parse := parseKeyRange
+		if command == "KEYPREFIX" {
+			parse = parseKeyPrefix
+		}
+		min, max, limit, err := parse(args)
+		if err != nil {
+			return nil, err
+		}
+		keys, more, err := snap.rangeKeys(db, min, max, limit)
+		if err != nil {
+			return nil, err
+		}
+		return rangeReply(keys, more), nil
+	}
+	return nil, fmt.Errorf("'%s' cannot be read from a snapshot", command)
+}
+
+// forEachKey calls fn for every key of database i in the snapshot, with
+// each shard read-locked while it is visited.
+func (s *Snapshot) forEachKey(i int, fn func(key string)) error {
+	return s.read(func() error {
+		db, cows, err := s.db(i)
+		if err != nil {
+			return err
+		}
+		for j, sh := range db.shards {
+			sh.mu.RLock()
+			sh.viewKeys(cows[j], fn)
+			sh.mu.RUnlock()
+		}
+		return nil
+	})
+}
+
+// scan is InMemoryStore.Scan over database i of the snapshot. The live
+// scan index holds the keys that still exist; keys deleted since the
+// snapshot was taken are added when the part of the shard their hash falls
+// in is visited, so cursors mean the same as for SCAN.
+func (s *Snapshot) scan(i int, cursor uint64, count int, pattern, typ string) ([]string, uint64, error) {
+	keys := make([]string, 0, count)
+	var next uint64
+	err := s.read(func() error {
+		db, cows, err := s.db(i)
+		if err != nil {
+			return err
+		}
+		add := func(key, keyType string) {
+			if pattern != "" && !matchPattern(pattern, key) {
+				return
+			}
+			if typ != "" && !strings.EqualFold(keyType, typ) {
+				return
+			}
+			keys = append(keys, key)
+		}
+
+		visited := 0
+		for n := db.shardIndexForCursor(cursor); n < len(db.shards); n++ {
+			sh, cow := db.shards[n], cows[n]
+			sh.mu.RLock()
+			from := cursor
+			v, resume, done := sh.index.scan(cursor, count-visited, func(key string) {
+				old, saved := cow.saved[key]
+				switch {
+				case !saved:
+					add(key, sh.typeOf(key))
+				case old.exists:
+					add(key, typeName(old.value))
+				}
+			})
+			for key, old := range cow.saved {
+				if !old.exists {
+					continue
+				}
+				if _, live := sh.data[key]; live {
+					continue
+				}
+				if _, cold := sh.cold[key]; cold {
+					continue
+				}
+				if hash := datastructures.ScanHash(key); hash >= from && (done || hash < resume) {
+					add(key, typeName(old.value))
+				}
+			}
+			sh.mu.RUnlock()
+
+			visited += v
+			if !done {
+				next = resume
+				return nil
+			}
+			if n+1 == len(db.shards) {
+				break
+			}
+			cursor = uint64(n+1) << (64 - db.shardBits)
+			if visited >= count {
+				next = cursor
+				return nil
+			}
+		}
+		return nil
+	})
+	return keys, next, err
+}
+
+// rangeKeys is InMemoryStore.RangeKeys over database i of the snapshot.
+// The ordered index holds live keys only, so every shard's keys in the
+// range are collected and sorted.
+func (s *Snapshot) rangeKeys(i int, min, max lexBound, limit int) ([]string, bool, error) {
+	var keys []string
+	err := s.read(func() error {
+		db, cows, err := s.db(i)
+		if err != nil {
+			return err
+		}
+		var shardKeys []string
+		for j, sh := range db.shards {
+			shardKeys = shardKeys[:0]
+			sh.mu.RLock()
+			sh.viewKeys(cows[j], func(key string) {
+				if min.above(key) && max.below(key) {
+					shardKeys = append(shardKeys, key)
+				}
+			})
+			sh.mu.RUnlock()
+			sort.Strings(shardKeys)
+			if len(shardKeys) > limit+1 {
+				shardKeys = shardKeys[:limit+1]
+			}
+			keys = append(keys, shardKeys...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+func (h *CommandHandler) infoSnapshots() string {
+	var b strings.Builder
+	b.WriteString("# Snapshots\r\n")
+	snaps := h.reads.list()
+	var size int64
+	oldest := int64(0)
+	for _, rs := range snaps {
+		size += rs.size()
+	}
+	if len(snaps) > 0 {
+		oldest = int64(time.Since(snaps[0].created).Seconds())
+	}
+	fmt.Fprintf(&b, "snapshots_open:%d\r\n", len(snaps))
+	fmt.Fprintf(&b, "snapshots_oldest_age:%d\r\n", oldest)
+	fmt.Fprintf(&b, "snapshots_saved_bytes:%d\r\n", size)
+	fmt.Fprintf(&b, "snapshots_saved_bytes_human:%s\r\n", formatMemory(size))
+	return b.String()
+}
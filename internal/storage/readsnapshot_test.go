@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+func TestSnapshotTokensBelongToTheirSession(t *testing.T) {
+	h := NewCommandHandler(NewDatabases(1, 4))
+	owner := h.NewSession(context.Background())
+	other := h.NewSession(context.Background())
+	do := func(ctx context.Context, args ...string) (interface{}, error) {
+		return h.HandleCommand(ctx, args)
+	}
+	if _, err := do(owner, "SET", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := do(owner, "SNAPSHOT", "OPEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := do(owner, "SNAPSHOT", "OPEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := first.(string)
+	if len(token) != 32 || token == second.(string) {
+		t.Fatalf("tokens %q and %q are not random", token, second)
+	}
+
+	if _, err := do(other, "SNAPSHOT", "READ", token, "GET", "key"); !errors.Is(err, ErrNoSuchSnapshot) {
+		t.Errorf("another session read the snapshot: %v", err)
+	}
+	if released, _ := do(other, "SNAPSHOT", "RELEASE", token); released != int64(0) {
+		t.Error("another session released the snapshot")
+	}
+	if list, _ := do(other, "SNAPSHOT", "LIST"); len(list.([]interface{})) != 0 {
+		t.Errorf("another session listed %v", list)
+	}
+	if list, _ := do(owner, "SNAPSHOT", "LIST"); len(list.([]interface{})) != 2 {
+		t.Errorf("the owner listed %v", list)
+	}
+	if value, err := do(owner, "SNAPSHOT", "READ", token, "GET", "key"); err != nil || value != "value" {
+		t.Errorf("the owner read %v, %v", value, err)
+	}
+
+	h.CloseSession(owner)
+	if n := len(h.reads.list()); n != 0 {
+		t.Errorf("%d snapshots are still open after their session closed", n)
+	}
+	if _, err := do(owner, "SNAPSHOT", "READ", token, "GET", "key"); !errors.Is(err, ErrNoSuchSnapshot) {
+		t.Errorf("a closed session's snapshot can still be read: %v", err)
+	}
+}
+
+func TestSnapshotReadHGetAll(t *testing.T) {
+	h := NewCommandHandler(NewDatabases(1, 4))
+	ctx := h.NewSession(context.Background())
+	do := func(args ...string) (interface{}, error) {
+		return h.HandleCommand(ctx, args)
+	}
+	db, _ := h.dbs.DB(0)
+	hash := datastructures.NewHash()
+	hash.HSet("b", "two")
+	hash.HSet("a", int64(1))
+	db.Set("hash", hash)
+	db.Set("string", "value")
+
+	open, err := do("SNAPSHOT", "OPEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := open.(string)
+	changed := hash.Clone()
+	changed.HSet("c", "three")
+	db.Set("hash", changed)
+	db.Delete("string")
+
+	for _, step := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SNAPSHOT", "READ", token, "HGETALL", "hash"}, "[a 1 b two]"},
+		{[]string{"HGETALL", "hash"}, "[a 1 b two c three]"},
+		{[]string{"SNAPSHOT", "READ", token, "HGETALL", "missing"}, "[]"},
+		{[]string{"HGETALL", "string"}, "[]"},
+	} {
+		got, err := do(step.args...)
+		if err != nil || fmt.Sprint(got) != step.want {
+			t.Errorf("%s returned %v, %v, want %s", strings.Join(step.args, " "), got, err, step.want)
+		}
+	}
+	if _, err := do("SNAPSHOT", "READ", token, "HGETALL", "string"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("HGETALL of a string in a snapshot returned %v, want %v", err, ErrWrongType)
+	}
+}
+
+func TestSnapshotReadSkipsExpiredKeys(t *testing.T) {
+	h, do := newTestHandler(t)
+	db, _ := h.dbs.DB(0)
+	soon := time.Now().Add(30 * time.Millisecond)
+	for _, key := range []string{"kept", "changed", "persistent"} {
+		db.Set(key, "old")
+	}
+	db.ExpireAt("kept", soon)
+	db.ExpireAt("changed", soon)
+	token := do("SNAPSHOT", "OPEN").(string)
+	// The snapshot saves changed with its TTL before it is deleted.
+	do("DEL", "changed")
+	time.Sleep(time.Until(soon) + 10*time.Millisecond)
+
+	for _, c := range []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"GET", "kept"}, nil},
+		{[]string{"GET", "changed"}, nil},
+		{[]string{"MGET", "kept", "changed", "persistent"}, "[<nil> <nil> old]"},
+		{[]string{"EXISTS", "kept", "changed", "persistent"}, int64(1)},
+		{[]string{"TYPE", "kept"}, ""},
+		{[]string{"TTL", "changed"}, nil},
+		{[]string{"DUMP", "kept"}, nil},
+	} {
+		got := do(append([]string{"SNAPSHOT", "READ", token}, c.args...)...)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("SNAPSHOT READ %s = %v, want %v", strings.Join(c.args, " "), got, c.want)
+		}
+	}
+}
+
+func TestSnapshotsPerSession(t *testing.T) {
+	h := NewCommandHandler(NewDatabases(1, 4))
+	owner := h.NewSession(context.Background())
+	other := h.NewSession(context.Background())
+	var tokens []string
+	for i := 0; i < MaxSessionSnapshots; i++ {
+		token, err := h.HandleCommand(owner, []string{"SNAPSHOT", "OPEN"})
+		if err != nil {
+			t.Fatalf("opening snapshot %d: %v", i+1, err)
+		}
+		tokens = append(tokens, token.(string))
+	}
+	if _, err := h.HandleCommand(owner, []string{"SNAPSHOT", "OPEN"}); !errors.Is(err, ErrTooManySnapshots) {
+		t.Fatalf("opening snapshot %d returned %v, want %v", MaxSessionSnapshots+1, err, ErrTooManySnapshots)
+	}
+	if n := len(h.reads.list()); n != MaxSessionSnapshots {
+		t.Errorf("%d snapshots open after a refused SNAPSHOT OPEN, want %d", n, MaxSessionSnapshots)
+	}
+	db, _ := h.dbs.DB(0)
+	if n := len(db.shards[0].cows); n != MaxSessionSnapshots {
+		t.Errorf("shards keep old values for %d snapshots, want %d", n, MaxSessionSnapshots)
+	}
+
+	// The limit is per session, and releasing a snapshot makes room.
+	if _, err := h.HandleCommand(other, []string{"SNAPSHOT", "OPEN"}); err != nil {
+		t.Errorf("another session could not open a snapshot: %v", err)
+	}
+	if _, err := h.HandleCommand(owner, []string{"SNAPSHOT", "RELEASE", tokens[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.HandleCommand(owner, []string{"SNAPSHOT", "OPEN"}); err != nil {
+		t.Errorf("opening a snapshot after releasing one: %v", err)
+	}
+}
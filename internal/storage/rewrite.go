@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// DefaultAutoRewritePercentage is the growth, relative to the last
+// rewrite, at which the AOF is rewritten automatically, as in Redis.
+const DefaultAutoRewritePercentage = 100
+
+var (
+	ErrRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+	ErrPersistenceClosed = errors.New("persistence layer is closed")
+)
+
+// rewriteState tracks AOF rewrites of a PersistenceLayer.
+type rewriteState struct {
+	running bool
+	// pending is set once an automatic rewrite has been asked for, so
+	// that it is only asked for once.
+	pending bool
+	closed  bool
+	// lastErr is the error of the last rewrite, nil if it succeeded.
+	lastErr error
+	// checkpointSeq is the sequence number of the last snapshot that
+	// replaced the WAL. A rewrite of an older dataset is discarded.
+	checkpointSeq uint64
+
+	// baseSize is the size of the rewrite base and logSize that of the
+	// segments logged since. A rewrite is due once logSize has grown by
+	// percentage percent of baseSize, and is at least minSize.
+	baseSize   int64
+	logSize    int64
+	percentage int
+	minSize    int64
+}
+
+// SetAutoRewrite makes the WAL ask for a rewrite once the segments logged
+// since the last one have grown by percentage percent of its size and are
+// at least minSize bytes. A percentage of zero disables automatic rewrites.
+func (p *PersistenceLayer) SetAutoRewrite(percentage int, minSize int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.rewrite.percentage = percentage
+	p.rewrite.minSize = minSize
+}
+
+// rewriteDue reports, once, that an automatic rewrite should be started.
+func (p *PersistenceLayer) rewriteDue() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	r := &p.rewrite
+	if r.percentage <= 0 || r.running || r.pending || r.closed || r.logSize < r.minSize {
+		return false
+	}
+	if r.logSize*100 < r.baseSize*int64(r.percentage) {
+		return false
+	}
+	r.pending = true
+	return true
+}
+
+// rewriteInfo returns a copy of the rewrite state, for INFO.
+func (p *PersistenceLayer) rewriteInfo() rewriteState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.rewrite
+}
+
+// baseReplaces reports whether the rewrite base holds a newer dataset than
+// a snapshot of sequence number seq, which then need not be loaded.
+func (p *PersistenceLayer) baseReplaces(seq uint64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.manifest.base != "" && p.manifest.baseSeq > seq
+}
+
+// rotate moves on to a new WAL segment. The caller must hold p.mutex.
+func (p *PersistenceLayer) rotate() error {
+	for p.syncing {
+		p.syncDone.Wait()
+	}
+	if err := p.walFile.Sync(); err != nil {
+		return err
+	}
+
+	name := p.manifest.newFile("wal")
+	file, err := os.OpenFile(filepath.Join(p.snapshotDir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := resetWAL(file); err != nil {
+		file.Close()
+		return err
+	}
+	p.manifest.segments = append(p.manifest.segments, name)
+	if err := p.manifest.write(p.snapshotDir); err != nil {
+		p.manifest.segments = p.manifest.segments[:len(p.manifest.segments)-1]
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	p.walFile.Close()
+	p.walFile = file
+	p.walSize = int64(walHeaderLen)
+	p.rewrite.logSize += int64(walHeaderLen)
+	p.synced = p.written
+	return nil
+}
+
+// checkpoint drops the WAL files superseded by a snapshot holding the
+// commands up to sequence number seq. keepFrom is the first segment logged
+// after the snapshot was taken; if it is empty, logged writes must have
+// been paused while the snapshot was written, and the WAL moves on to a
+// new segment that is the only one kept.
+func (p *PersistenceLayer) checkpoint(seq uint64, keepFrom string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if keepFrom == "" {
+		if err := p.rotate(); err != nil {
+			return err
+		}
+		keepFrom = p.manifest.segments[len(p.manifest.segments)-1]
+	}
+	previous := *p.manifest
+	// A rewrite that started after the snapshot replaced the segments
+	// before keepFrom already, and its base is newer than the snapshot.
+	p.manifest.trim(keepFrom)
+	if p.manifest.baseSeq <= seq {
+		p.manifest.base, p.manifest.baseSeq = "", 0
+	}
+	if err := p.manifest.write(p.snapshotDir); err != nil {
+		*p.manifest = previous
+		return err
+	}
+	p.manifest.removeUnlisted(p.snapshotDir)
+
+	if p.manifest.base == "" {
+		p.rewrite.baseSize = 0
+	}
+	if seq > p.rewrite.checkpointSeq {
+		p.rewrite.checkpointSeq = seq
+	}
+	// Segments held for BACKUP before keepFrom do not count towards the
+	// next rewrite.
+	p.rewrite.logSize = p.walSize
+	counted := false
+	for _, segment := range p.manifest.segments[:len(p.manifest.segments)-1] {
+		counted = counted || segment == keepFrom
+		if counted {
+			p.rewrite.logSize += p.fileSize(segment)
+		}
+	}
+	return nil
+}
+
+// aofRewrite is an AOF rewrite in progress: the dataset as of sequence
+// number seq is being written to a new base, while new commands go to the
+// segments from firstSegment on.
+type aofRewrite struct {
+	seq          uint64
+	firstSegment string
+	logSize      int64
+}
+
+// startRewrite begins an AOF rewrite of the dataset as it is now, moving
+// on to a new segment for the commands logged from here on. Logged writes
+// must be paused until the dataset has been captured.
+func (p *PersistenceLayer) startRewrite() (*aofRewrite, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.rewrite.pending = false
+	if p.rewrite.closed {
+		return nil, ErrPersistenceClosed
+	}
+	if p.rewrite.running {
+		return nil, ErrRewriteInProgress
+	}
+	logSize := p.rewrite.logSize
+	if err := p.rotate(); err != nil {
+		return nil, err
+	}
+	p.rewrite.running = true
+	return &aofRewrite{
+		seq:          p.seq,
+		firstSegment: p.manifest.segments[len(p.manifest.segments)-1],
+		logSize:      logSize,
+	}, nil
+}
+
+// rewriteEntry is a key copied out of a snapshot.
+type rewriteEntry struct {
+	key      string
+	value    interface{}
+	expireAt time.Time
+}
+
+// finishRewrite writes databases databases, read from source as they were
+// when rw started, to a new base and, unless a snapshot has replaced the
+// WAL meanwhile, installs it in place of the base and segments it
+// supersedes. Strings are written as SET commands, followed by PEXPIREAT
+// for keys with a TTL; other values, integers included, as value records,
+// which keep their type.
+func (p *PersistenceLayer) finishRewrite(rw *aofRewrite, databases int, source snapshotSource) (err error) {
+	p.mutex.Lock()
+	name := p.manifest.newFile("base")
+	p.mutex.Unlock()
+
+	err = p.writeRewriteBase(name, rw.seq, databases, source)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	defer func() { p.rewrite.lastErr = err }()
+	p.rewrite.running = false
+	path := filepath.Join(p.snapshotDir, name)
+	if err != nil {
+		return err
+	}
+	if p.rewrite.closed || p.rewrite.checkpointSeq >= rw.seq {
+		os.Remove(path)
+		return nil
+	}
+
+	previous := *p.manifest
+	if !p.manifest.trim(rw.firstSegment) {
+		p.manifest.segments = nil
+	}
+	p.manifest.base, p.manifest.baseSeq = name, rw.seq
+	if err := p.manifest.write(p.snapshotDir); err != nil {
+		*p.manifest = previous
+		os.Remove(path)
+		return err
+	}
+	p.manifest.removeUnlisted(p.snapshotDir)
+
+	p.rewrite.baseSize = p.fileSize(name)
+	p.rewrite.logSize -= rw.logSize
+	return nil
+}
+
+// writeRewriteBase writes a rewrite base file and makes it durable.
+func (p *PersistenceLayer) writeRewriteBase(name string, seq uint64, databases int, source snapshotSource) error {
+	path := filepath.Join(p.snapshotDir, name)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	w := bufio.NewWriter(file)
+	w.Write(appendWALHeader(nil))
+	var buf []byte
+	for db := 0; db < databases; db++ {
+		err := source(db, func(key string, value interface{}, expireAt time.Time) error {
+			var expireMs int64
+			if !expireAt.IsZero() {
+				expireMs = expireAt.UnixMilli()
+			}
+			v, ok := value.(string)
+			if !ok {
+				var err error
+				if buf, err = appendValueRecord(buf[:0], db, key, expireMs, value); err != nil {
+					return err
+				}
+				w.Write(frameWALRecord(buf))
+				return nil
+			}
+			buf = appendCommandRecord(buf[:0], seq, db, []string{"SET", key, v})
+			w.Write(frameWALRecord(buf))
+			if expireMs != 0 {
+				buf = appendCommandRecord(buf[:0], seq, db, []string{"PEXPIREAT", key, strconv.FormatInt(expireMs, 10)})
+				w.Write(frameWALRecord(buf))
+			}
+			return nil
+		})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(p.snapshotDir)
+}
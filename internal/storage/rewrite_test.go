@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// rewriteAOF runs BGREWRITEAOF on s and waits for it to finish.
+func rewriteAOF(t *testing.T, s *testServer) {
+	t.Helper()
+	s.do(t, "BGREWRITEAOF")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info := s.p.rewriteInfo()
+		if !info.running {
+			if info.lastErr != nil {
+				t.Fatalf("rewrite failed: %v", info.lastErr)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rewrite did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRewriteKeepsIntegers(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestServer(t, dir)
+	s.do(t, "INCRBY", "counter", "41")
+	s.do(t, "INCRBY", "expiring", "7")
+	s.do(t, "EXPIRE", "expiring", "100")
+	s.do(t, "SET", "text", "12")
+	rewriteAOF(t, s)
+	s.p.Close()
+
+	restarted, stats := openTestServer(t, dir)
+	if stats.Failed != 0 {
+		t.Errorf("recovery stats %+v", stats)
+	}
+	for key, want := range map[string]interface{}{"counter": int64(41), "expiring": int64(7), "text": "12"} {
+		if got := restarted.do(t, "GET", key); got != want {
+			t.Errorf("GET %s = %#v after a rewrite, want %#v", key, got, want)
+		}
+	}
+	if got := restarted.do(t, "INCR", "counter"); got != int64(42) {
+		t.Errorf("INCR counter = %v after a rewrite, want 42", got)
+	}
+	if got := restarted.do(t, "INCR", "expiring"); got != int64(8) {
+		t.Errorf("INCR expiring = %v after a rewrite, want 8", got)
+	}
+	if ttl := restarted.do(t, "TTL", "expiring"); ttl == nil || ttl.(int64) <= 0 {
+		t.Errorf("TTL expiring = %v after a rewrite", ttl)
+	}
+}
+
+// TestRewriteWithConcurrentWrites changes keys while a rewrite is writing
+// its base, which must hold them as they were when it started, so that
+// replaying the commands logged meanwhile on top of it rebuilds them.
+func TestRewriteWithConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestServer(t, dir)
+	for i := 0; i < 500; i++ {
+		s.do(t, "SET", "key:"+strconv.Itoa(i), "1")
+	}
+	s.do(t, "INCRBY", "counter", "10")
+	// A value stored without being logged only survives in the base.
+	db, _ := s.h.dbs.DB(0)
+	hash := datastructures.NewHash()
+	hash.HSet("field", "value")
+	db.Set("hash", hash)
+
+	if err := s.h.StartRewriteAOF(s.p); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		s.do(t, "DEL", "key:"+strconv.Itoa(i))
+		s.do(t, "INCR", "counter")
+	}
+	s.do(t, "SETBIT", "bits", "7", "1")
+	for deadline := time.Now().Add(5 * time.Second); s.p.rewriteInfo().running; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("rewrite did not finish")
+		}
+	}
+	if err := s.p.rewriteInfo().lastErr; err != nil {
+		t.Fatal(err)
+	}
+	s.p.Close()
+
+	restarted, stats := openTestServer(t, dir)
+	if stats.Failed != 0 {
+		t.Errorf("recovery stats %+v", stats)
+	}
+	for _, c := range []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"DBSIZE"}, int64(3)},
+		{[]string{"EXISTS", "key:0", "key:499"}, int64(0)},
+		{[]string{"INCR", "counter"}, int64(511)},
+		{[]string{"HGETALL", "hash"}, "[field value]"},
+		{[]string{"BITCOUNT", "bits"}, int64(1)},
+	} {
+		if got := restarted.do(t, c.args...); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%v = %v after a rewrite, want %v", c.args, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bgsaveRetryDelay is how long save rules wait after a failed snapshot
+// before trying again, as in Redis.
+const bgsaveRetryDelay = 5 * time.Second
+
+var (
+	ErrSaveInProgress = errors.New("Background save already in progress")
+	ErrNoSnapshots    = errors.New("snapshots are disabled: no data directory configured")
+)
+
+// SaveRule asks for a background snapshot once Changes writes have been
+// made and Seconds have passed since the last successful one.
+type SaveRule struct {
+	Seconds int
+	Changes int64
+}
+
+// ParseSaveRules parses save rules written as in redis.conf, pairs of
+// seconds and changes such as "3600 1 300 100 60 10000". An empty string
+// means no rules.
+func ParseSaveRules(s string) ([]SaveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save rules must be pairs of seconds and changes: %q", s)
+	}
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid save seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save changes %q", fields[i+1])
+		}
+		rules = append(rules, SaveRule{Seconds: seconds, Changes: changes})
+	}
+	return rules, nil
+}
+
+// snapshotter runs the snapshots of a CommandHandler.
+type snapshotter struct {
+	p     *PersistenceLayer
+	rules []SaveRule
+	// dirty counts the writes made since the last successful snapshot.
+	dirty atomic.Int64
+
+	mu       sync.Mutex
+	running  bool
+	lastSave time.Time
+	lastTry  time.Time
+	lastErr  error
+	// lastDuration is how long the last snapshot took and saves the
+	// number that succeeded.
+	lastDuration time.Duration
+	saves        int64
+	// keysTotal is the number of keys in the background snapshot being
+	// written and keysDone those written so far. cowSize is the memory
+	// held by old values for the last one.
+	keysTotal int64
+	keysDone  atomic.Int64
+	cowSize   int64
+}
+
+// EnableSnapshots lets clients write snapshots to p with SAVE and BGSAVE,
+// and starts a background snapshot whenever one of rules is met. It should
+// be called after Recover and before the server accepts connections.
+func (h *CommandHandler) EnableSnapshots(p *PersistenceLayer, rules []SaveRule) {
+	s := &snapshotter{p: p, rules: rules, lastSave: time.Now()}
+	h.snapshots = s
+	if len(rules) > 0 {
+		go h.saveLoop(s)
+	}
+}
+
+// saveLoop checks the save rules once a second.
+func (h *CommandHandler) saveLoop(s *snapshotter) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if s.due(now) {
+			h.BackgroundSave()
+		}
+	}
+}
+
+// due reports whether a save rule is met at now.
+func (s *snapshotter) due(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running || (s.lastErr != nil && now.Sub(s.lastTry) < bgsaveRetryDelay) {
+		return false
+	}
+	dirty := s.dirty.Load()
+	for _, rule := range s.rules {
+		if dirty >= rule.Changes && now.Sub(s.lastSave) >= time.Duration(rule.Seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// begin marks a snapshot as running, failing if one already is.
+func (s *snapshotter) begin() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return ErrSaveInProgress
+	}
+	s.running = true
+	s.lastTry = time.Now()
+	s.keysTotal = 0
+	s.keysDone.Store(0)
+	return nil
+}
+
+// end records the outcome of a snapshot that included dirty writes.
+func (s *snapshotter) end(dirty int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.lastErr = err
+	s.lastDuration = time.Since(s.lastTry)
+	if err == nil {
+		s.dirty.Add(-dirty)
+		s.lastSave = time.Now()
+		s.saves++
+	}
+}
+
+// Save writes a snapshot and waits for it to finish.
+func (h *CommandHandler) Save() error {
+	s := h.snapshots
+	if s == nil {
+		return ErrNoSnapshots
+	}
+	if err := s.begin(); err != nil {
+		return err
+	}
+	dirty := s.dirty.Load()
+	err := h.SaveSnapshot(s.p)
+	s.end(dirty, err)
+	return err
+}
+
+// BackgroundSave starts writing a snapshot and returns without waiting
+// for it. Logged writes are paused only while a Snapshot of every database
+// is taken; the snapshot file is written from it while writes continue.
+func (h *CommandHandler) BackgroundSave() error {
+	s := h.snapshots
+	if s == nil {
+		return ErrNoSnapshots
+	}
+	if err := s.begin(); err != nil {
+		return err
+	}
+
+	p := s.p
+	p.snapshotMu.Lock()
+	unlock := h.dbs.writeLocks.lockAll()
+	seq, keepFrom, err := p.startSnapshot()
+	if err != nil {
+		unlock()
+		p.snapshotMu.Unlock()
+		s.end(0, err)
+		return err
+	}
+	dirty := s.dirty.Load()
+	snap := h.dbs.OpenSnapshot()
+	unlock()
+
+	s.mu.Lock()
+	s.keysTotal = snap.Keys()
+	s.mu.Unlock()
+
+	go func() {
+		defer p.snapshotMu.Unlock()
+
+		var cowSize int64
+		err := p.writeSnapshot(seq, snap.Len(), func(i int, fn func(string, interface{}, time.Time) error) error {
+			size, err := snap.drain(i, func(key string, value interface{}, expireAt time.Time) error {
+				s.keysDone.Add(1)
+				return fn(key, value, expireAt)
+			})
+			cowSize += size
+			return err
+		})
+		snap.Release()
+		if err == nil {
+			err = p.checkpoint(seq, keepFrom)
+		}
+
+		s.mu.Lock()
+		s.cowSize = cowSize
+		s.mu.Unlock()
+		s.end(dirty, err)
+	}()
+	return nil
+}
+
+func (h *CommandHandler) handleSave(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("wrong number of arguments for SAVE")
+	}
+	if err := h.Save(); err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
+
+func (h *CommandHandler) handleBgSave(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("wrong number of arguments for BGSAVE")
+	}
+	if err := h.BackgroundSave(); err != nil {
+		return nil, err
+	}
+	return "Background saving started", nil
+}
+
+func (h *CommandHandler) handleLastSave(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("wrong number of arguments for LASTSAVE")
+	}
+	if h.snapshots == nil {
+		return nil, ErrNoSnapshots
+	}
+	h.snapshots.mu.Lock()
+	defer h.snapshots.mu.Unlock()
+	return h.snapshots.lastSave.Unix(), nil
+}
+
+// infoPersistence renders the persistence section of INFO.
+func (h *CommandHandler) infoPersistence() string {
+	var b strings.Builder
+	b.WriteString("# Persistence\r\n")
+	b.WriteString("loading:0\r\n")
+
+	inProgress, status := 0, "ok"
+	lastTime, currentTime := int64(-1), int64(-1)
+	var changes, lastSave, saves, cowSize, keysDone, keysTotal int64
+	if s := h.snapshots; s != nil {
+		s.mu.Lock()
+		changes = s.dirty.Load()
+		lastSave = s.lastSave.Unix()
+		if s.lastErr != nil {
+			status = "err"
+		}
+		if s.saves > 0 || s.lastErr != nil {
+			lastTime = int64(s.lastDuration.Seconds())
+		}
+		if s.running {
+			inProgress = 1
+			currentTime = int64(time.Since(s.lastTry).Seconds())
+		}
+		saves, cowSize = s.saves, s.cowSize
+		keysDone, keysTotal = s.keysDone.Load(), s.keysTotal
+		s.mu.Unlock()
+	}
+	fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", changes)
+	fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", inProgress)
+	fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", lastSave)
+	fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", status)
+	fmt.Fprintf(&b, "rdb_last_bgsave_time_sec:%d\r\n", lastTime)
+	fmt.Fprintf(&b, "rdb_current_bgsave_time_sec:%d\r\n", currentTime)
+	fmt.Fprintf(&b, "rdb_saves:%d\r\n", saves)
+	fmt.Fprintf(&b, "rdb_last_cow_size:%d\r\n", cowSize)
+	fmt.Fprintf(&b, "current_save_keys_processed:%d\r\n", keysDone)
+	fmt.Fprintf(&b, "current_save_keys_total:%d\r\n", keysTotal)
+
+	enabled, rewriting, rewriteStatus := 0, 0, "ok"
+	var currentSize, baseSize int64
+	if h.aof != nil {
+		r := h.aof.rewriteInfo()
+		enabled = 1
+		if r.running {
+			rewriting = 1
+		}
+		if r.lastErr != nil {
+			rewriteStatus = "err"
+		}
+		currentSize, baseSize = r.baseSize+r.logSize, r.baseSize
+	}
+	fmt.Fprintf(&b, "aof_enabled:%d\r\n", enabled)
+	fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", rewriting)
+	fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", rewriteStatus)
+	fmt.Fprintf(&b, "aof_current_size:%d\r\n", currentSize)
+	fmt.Fprintf(&b, "aof_base_size:%d\r\n", baseSize)
+	return b.String()
+}
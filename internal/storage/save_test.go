@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSaveRules(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want string // rules as printed, or "error"
+	}{
+		{"3600 1 300 100 60 10000", "[{3600 1} {300 100} {60 10000}]"},
+		{"  900\t1\n", "[{900 1}]"},
+		{"0 0", "[{0 0}]"},
+		{"", "[]"},
+		{"   ", "[]"},
+		{"3600", "error"},
+		{"3600 1 300", "error"},
+		{"-1 1", "error"},
+		{"60 -1", "error"},
+		{"an hour 1", "error"},
+		{"60 1e3", "error"},
+	} {
+		rules, err := ParseSaveRules(c.s)
+		got := fmt.Sprint(rules)
+		if err != nil {
+			got = "error"
+		}
+		if got != c.want {
+			t.Errorf("ParseSaveRules(%q) = %s, %v, want %s", c.s, got, err, c.want)
+		}
+	}
+}
+
+func TestSaveRulesDue(t *testing.T) {
+	start := time.Now()
+	rules, err := ParseSaveRules("3600 1 300 100 60 10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		dirty   int64
+		elapsed time.Duration
+		want    bool
+	}{
+		{0, 24 * time.Hour, false},
+		{1, 3599 * time.Second, false},
+		{1, time.Hour, true},
+		{99, 3599 * time.Second, false},
+		{100, 299 * time.Second, false},
+		{100, 300 * time.Second, true},
+		{9999, 299 * time.Second, false},
+		{10000, 59 * time.Second, false},
+		{10000, 60 * time.Second, true},
+	} {
+		s := &snapshotter{rules: rules, lastSave: start}
+		s.dirty.Store(c.dirty)
+		if got := s.due(start.Add(c.elapsed)); got != c.want {
+			t.Errorf("due after %d changes in %v = %v, want %v", c.dirty, c.elapsed, got, c.want)
+		}
+	}
+
+	s := &snapshotter{rules: rules, lastSave: start}
+	s.dirty.Store(10000)
+	now := start.Add(time.Hour)
+	s.running = true
+	if s.due(now) {
+		t.Errorf("due while a snapshot is running")
+	}
+	s.running = false
+	s.lastTry, s.lastErr = now.Add(-time.Second), errors.New("disk full")
+	if s.due(now) {
+		t.Errorf("due %v after a failed snapshot", time.Second)
+	}
+	if !s.due(now.Add(bgsaveRetryDelay)) {
+		t.Errorf("not due %v after a failed snapshot", bgsaveRetryDelay+time.Second)
+	}
+
+	// Without rules nothing is ever due, which "" configures.
+	none, err := ParseSaveRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = &snapshotter{rules: none, lastSave: start}
+	s.dirty.Store(1 << 40)
+	if s.due(start.Add(365 * 24 * time.Hour)) {
+		t.Errorf("due without save rules")
+	}
+}
+
+func TestSaveCountsChanges(t *testing.T) {
+	s, _ := openTestServer(t, t.TempDir())
+	s.h.EnableSnapshots(s.p, nil)
+	s.do(t, "SET", "a", "1")
+	s.do(t, "SET", "b", "1")
+	s.do(t, "GET", "a")
+	if got := s.h.snapshots.dirty.Load(); got != 2 {
+		t.Errorf("%d changes counted after two writes and a read, want 2", got)
+	}
+	s.do(t, "SAVE")
+	if got := s.h.snapshots.dirty.Load(); got != 0 {
+		t.Errorf("%d changes counted after SAVE, want 0", got)
+	}
+}
+
+func TestLastSave(t *testing.T) {
+	if _, err := NewCommandHandler(NewDatabases(1, 4)).HandleCommand(context.Background(), []string{"LASTSAVE"}); !errors.Is(err, ErrNoSnapshots) {
+		t.Errorf("LASTSAVE without snapshots returned %v, want %v", err, ErrNoSnapshots)
+	}
+
+	s, _ := openTestServer(t, t.TempDir())
+	before := time.Now().Unix()
+	s.h.EnableSnapshots(s.p, nil)
+	if got := s.do(t, "LASTSAVE").(int64); got < before || got > time.Now().Unix() {
+		t.Errorf("LASTSAVE after startup = %d, want about %d", got, before)
+	}
+
+	// Only a successful snapshot moves it.
+	long := time.Now().Add(-time.Hour)
+	s.h.snapshots.lastSave = long
+	s.h.snapshots.running = true
+	if _, err := s.h.HandleCommand(s.ctx, []string{"SAVE"}); !errors.Is(err, ErrSaveInProgress) {
+		t.Fatalf("SAVE during a snapshot returned %v, want %v", err, ErrSaveInProgress)
+	}
+	s.h.snapshots.running = false
+	if got := s.do(t, "LASTSAVE"); got != long.Unix() {
+		t.Errorf("LASTSAVE after a refused SAVE = %v, want %d", got, long.Unix())
+	}
+	before = time.Now().Unix()
+	s.do(t, "SET", "key", "value")
+	s.do(t, "SAVE")
+	if got := s.do(t, "LASTSAVE").(int64); got < before || got > time.Now().Unix() {
+		t.Errorf("LASTSAVE after SAVE = %d, want about %d", got, before)
+	}
+	if _, err := s.h.HandleCommand(s.ctx, []string{"LASTSAVE", "now"}); err == nil {
+		t.Errorf("LASTSAVE with an argument succeeded")
+	}
+}
+
+// databaseContents returns every key of dbs with its value and expiry
+// time, as "db/key" mapped to a printed pair.
+func databaseContents(t *testing.T, dbs *Databases) map[string]string {
+	t.Helper()
+	contents := map[string]string{}
+	for i := 0; i < dbs.Len(); i++ {
+		if err := dbs.forEach(i, func(key string, value interface{}, expireAt time.Time) error {
+			var ms int64
+			if !expireAt.IsZero() {
+				ms = expireAt.UnixMilli()
+			}
+			contents[fmt.Sprintf("%d/%s", i, key)] = fmt.Sprintf("%v %d", value, ms)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return contents
+}
+
+// infoField returns the value of field in an INFO reply.
+func infoField(info, field string) string {
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestBackgroundSaveIsPointInTime(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestServer(t, dir)
+	s.h.EnableSnapshots(s.p, nil)
+	db0, _ := s.h.dbs.DB(0)
+	db1, _ := s.h.dbs.DB(1)
+	const keys = 20000
+	for i := 0; i < keys; i++ {
+		db0.Set("key:"+strconv.Itoa(i), "old")
+	}
+	// held is a shard of database 1, which the snapshot drains after
+	// database 0. Holding its lock stops the drain there.
+	held := db1.shardFor("held")
+	var other []string
+	for i := 0; len(other) < 10; i++ {
+		if key := "other:" + strconv.Itoa(i); db1.shardFor(key) != held {
+			other = append(other, key)
+		}
+	}
+	s.do(t, "SELECT", "1")
+	s.do(t, "SET", "held", "old")
+	for _, key := range other[:5] {
+		s.do(t, "SET", key, "old")
+	}
+	s.do(t, "EXPIRE", other[0], "1000")
+	before := databaseContents(t, s.h.dbs)
+
+	info := s.do(t, "INFO", "persistence").(string)
+	if got := infoField(info, "rdb_changes_since_last_save"); got != "7" {
+		t.Errorf("rdb_changes_since_last_save = %s before BGSAVE, want 7", got)
+	}
+	if got := infoField(info, "rdb_bgsave_in_progress"); got != "0" {
+		t.Errorf("rdb_bgsave_in_progress = %s before BGSAVE, want 0", got)
+	}
+
+	s.do(t, "BGSAVE")
+	held.mu.Lock()
+	if done := s.h.snapshots.keysDone.Load(); done >= keys {
+		held.mu.Unlock()
+		t.Fatalf("the snapshot wrote %d keys before its drain could be held", done)
+	}
+	s.do(t, "SET", other[0], "new")
+	s.do(t, "DEL", other[1])
+	s.do(t, "EXPIRE", other[2], "1000")
+	s.do(t, "SET", other[5], "new")
+	s.do(t, "SELECT", "0")
+	s.do(t, "DEL", "key:0", "key:"+strconv.Itoa(keys-1))
+	s.do(t, "SET", "key:1", "new")
+	s.do(t, "SET", "new", "new")
+	if _, err := s.h.HandleCommand(s.ctx, []string{"BGSAVE"}); !errors.Is(err, ErrSaveInProgress) {
+		t.Errorf("BGSAVE during a background save returned %v, want %v", err, ErrSaveInProgress)
+	}
+	info = s.do(t, "INFO", "persistence").(string)
+	held.mu.Unlock()
+	if got := infoField(info, "rdb_bgsave_in_progress"); got != "1" {
+		t.Errorf("rdb_bgsave_in_progress = %s during BGSAVE, want 1", got)
+	}
+	if got := infoField(info, "rdb_changes_since_last_save"); got != "14" {
+		t.Errorf("rdb_changes_since_last_save = %s during BGSAVE, want 14", got)
+	}
+	if got := infoField(info, "current_save_keys_total"); got != strconv.Itoa(keys+6) {
+		t.Errorf("current_save_keys_total = %s, want %d", got, keys+6)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		info = s.do(t, "INFO", "persistence").(string)
+		if infoField(info, "rdb_bgsave_in_progress") == "0" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("BGSAVE did not finish")
+		}
+	}
+	for field, want := range map[string]string{
+		"rdb_last_bgsave_status":      "ok",
+		"rdb_changes_since_last_save": "7",
+		"rdb_saves":                   "1",
+		"current_save_keys_processed": strconv.Itoa(keys + 6),
+	} {
+		if got := infoField(info, field); got != want {
+			t.Errorf("%s = %s after BGSAVE, want %s", field, got, want)
+		}
+	}
+	if size, _ := strconv.ParseInt(infoField(info, "rdb_last_cow_size"), 10, 64); size <= 0 {
+		t.Errorf("rdb_last_cow_size = %d after writes during BGSAVE", size)
+	}
+
+	// The file holds the databases as they were when BGSAVE ran, and the
+	// WAL the writes made since.
+	loaded := NewDatabases(4, 4)
+	if _, err := loaded.LoadSnapshotFile(s.p.snapshotPath()); err != nil {
+		t.Fatal(err)
+	}
+	if got := databaseContents(t, loaded); !reflect.DeepEqual(got, before) {
+		t.Errorf("the snapshot holds %d keys, %d differing from those at BGSAVE", len(got), diffCount(got, before))
+	}
+	after := databaseContents(t, s.h.dbs)
+	s.p.Close()
+	restarted, _ := openTestServer(t, dir)
+	if got := databaseContents(t, restarted.h.dbs); !reflect.DeepEqual(got, after) {
+		t.Errorf("after a restart %d keys differ from those before it", diffCount(got, after))
+	}
+}
+
+// diffCount returns the number of keys whose contents differ between a
+// and b.
+func diffCount(a, b map[string]string) int {
+	n := 0
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			n++
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+const (
+	defaultScanCount   = 10
+	minScanBuckets     = 16
+	scanBucketLoad     = 4
+	maxScanBucketShift = 64
+)
+
+type scanEntry struct {
+	hash uint64
+	key  string
+}
+
+// scanIndex buckets a shard's keys by their scan hash. Every key in a
+// shard shares the same top prefix bits; bucket i holds the keys whose
+// next bits equal i, so walking the buckets in order visits keys in hash
+// order. A SCAN cursor is simply the next hash to visit, which stays
+// meaningful when the index grows or shrinks between calls.
+type scanIndex struct {
+	buckets [][]scanEntry
+	prefix  uint
+	shift   uint
+	count   int
+}
+
+func newScanIndex(prefix uint) *scanIndex {
+	idx := &scanIndex{prefix: prefix}
+	idx.resize(minScanBuckets)
+	return idx
+}
+
+func (idx *scanIndex) resize(size int) {
+	old := idx.buckets
+	idx.buckets = make([][]scanEntry, size)
+	idx.shift = maxScanBucketShift
+	for n := size; n > 1; n >>= 1 {
+		idx.shift--
+	}
+	for _, bucket := range old {
+		for _, e := range bucket {
+			b := idx.bucketFor(e.hash)
+			idx.buckets[b] = append(idx.buckets[b], e)
+		}
+	}
+}
+
+func (idx *scanIndex) bucketFor(hash uint64) int {
+	return int(hash << idx.prefix >> idx.shift)
+}
+
+func (idx *scanIndex) add(key string) {
+	if idx.count+1 > len(idx.buckets)*scanBucketLoad {
+		idx.resize(len(idx.buckets) * 2)
+	}
+	hash := datastructures.ScanHash(key)
+	b := idx.bucketFor(hash)
+	idx.buckets[b] = append(idx.buckets[b], scanEntry{hash, key})
+	idx.count++
+}
+
+func (idx *scanIndex) remove(key string) {
+	hash := datastructures.ScanHash(key)
+	b := idx.bucketFor(hash)
+	bucket := idx.buckets[b]
+	for i, e := range bucket {
+		if e.key == key {
+			bucket[i] = bucket[len(bucket)-1]
+			bucket[len(bucket)-1] = scanEntry{}
+			idx.buckets[b] = bucket[:len(bucket)-1]
+			idx.count--
+			break
+		}
+	}
+	if len(idx.buckets) > minScanBuckets && idx.count < len(idx.buckets)*scanBucketLoad/8 {
+		idx.resize(len(idx.buckets) / 2)
+	}
+}
+
+// scan calls fn for keys in hash order starting at cursor, a hash within
+// this index's prefix, until at least count keys were visited. Whole
+// buckets are visited at a time. It returns the number of keys visited and
+// the cursor to resume from; done is set once the last bucket was visited.
+func (idx *scanIndex) scan(cursor uint64, count int, fn func(key string)) (visited int, next uint64, done bool) {
+	base := uint64(0)
+	if idx.prefix > 0 {
+		base = cursor >> (64 - idx.prefix) << (64 - idx.prefix)
+	}
+	for b := idx.bucketFor(cursor); b < len(idx.buckets); b++ {
+		for _, e := range idx.buckets[b] {
+			if e.hash >= cursor {
+				fn(e.key)
+				visited++
+			}
+		}
+		if b+1 == len(idx.buckets) {
+			break
+		}
+		cursor = base | uint64(b+1)<<idx.shift>>idx.prefix
+		if visited >= count {
+			return visited, cursor, false
+		}
+	}
+	return visited, 0, true
+}
+
+// Scan returns keys matching pattern and, if typ is non-empty, of that
+// type, starting at cursor. count is a hint for how much work to do.
+// Shards are visited one at a time, so a scan never holds more than one
+// shard lock.
+func (s *InMemoryStore) Scan(cursor uint64, count int, pattern, typ string) ([]string, uint64) {
+	keys := make([]string, 0, count)
+	visited := 0
+	for i := s.shardIndexForCursor(cursor); i < len(s.shards); i++ {
+		sh := s.shards[i]
+		sh.mu.RLock()
+		n, next, done := sh.index.scan(cursor, count-visited, func(key string) {
+			if pattern != "" && !matchPattern(pattern, key) {
+				return
+			}
+			if sh.expired(key) {
+				return
+			}
+			if typ != "" && !strings.EqualFold(sh.typeOf(key), typ) {
+				return
+			}
+			keys = append(keys, key)
+		})
+		sh.mu.RUnlock()
+
+		visited += n
+		if !done {
+			return keys, next
+		}
+		if i+1 == len(s.shards) {
+			break
+		}
+		cursor = uint64(i+1) << (64 - s.shardBits)
+		if visited >= count {
+			return keys, cursor
+		}
+	}
+	return keys, 0
+}
+
+func (s *InMemoryStore) shardIndexForCursor(cursor uint64) int {
+	if s.shardBits == 0 {
+		return 0
+	}
+	return int(cursor >> (64 - s.shardBits))
+}
+
+// HScan scans the fields of the hash stored at key, returning field and
+// value pairs flattened into a single slice.
+func (s *InMemoryStore) HScan(key string, cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists := sh.lookup(key)
+	if !exists {
+		return []string{}, 0, nil
+	}
+	return scanHash(value, cursor, count, pattern)
+}
+
+func (s *InMemoryStore) SScan(key string, cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists := sh.lookup(key)
+	if !exists {
+		return []string{}, 0, nil
+	}
+	return scanSet(value, cursor, count, pattern)
+}
+
+// ZScan scans the members of the sorted set stored at key, returning
+// member and score pairs flattened into a single slice.
+func (s *InMemoryStore) ZScan(key string, cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	sh := s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists := sh.lookup(key)
+	if !exists {
+		return []string{}, 0, nil
+	}
+	return scanSortedSet(value, cursor, count, pattern)
+}
+
+// scanHash, scanSet and scanSortedSet scan the value of a key for HSCAN,
+// SSCAN and ZSCAN.
+func scanHash(value interface{}, cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	hash, ok := value.(*datastructures.Hash)
+	if !ok {
+		return nil, 0, ErrWrongType
+	}
+
+	fields, values, next := hash.Scan(cursor, count)
+	result := make([]string, 0, len(fields)*2)
+	for i, field := range fields {
+		if pattern != "" && !matchPattern(pattern, field) {
+			continue
+		}
+		result = append(result, field, formatValue(values[i]))
+	}
+	return result, next, nil
+}
+
+// hashFields returns every field of a hash followed by its value, with
+// the fields in order.
+func hashFields(value interface{}) ([]string, error) {
+	hash, ok := value.(*datastructures.Hash)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	all := hash.HGetAll()
+	fields := make([]string, 0, len(all))
+	for field := range all {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	result := make([]string, 0, len(fields)*2)
+	for _, field := range fields {
+		result = append(result, field, formatValue(all[field]))
+	}
+	return result, nil
+}
+
+func scanSet(value interface{}, cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	set, ok := value.(*datastructures.Set)
+	if !ok {
+		return nil, 0, ErrWrongType
+	}
+
+	members, next := set.Scan(cursor, count)
+	result := make([]string, 0, len(members))
+	for _, member := range members {
+		name := formatValue(member)
+		if pattern != "" && !matchPattern(pattern, name) {
+			continue
+		}
+		result = append(result, name)
+	}
+	return result, next, nil
+}
+
+func scanSortedSet(value interface{}, cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	zset, ok := value.(*datastructures.SortedSet)
+	if !ok {
+		return nil, 0, ErrWrongType
+	}
+
+	members, scores, next := zset.Scan(cursor, count)
+	result := make([]string, 0, len(members)*2)
+	for i, member := range members {
+		if pattern != "" && !matchPattern(pattern, member) {
+			continue
+		}
+		result = append(result, member, formatScore(scores[i]))
+	}
+	return result, next, nil
+}
+
+func formatValue(value interface{}) string {
+	if str, ok := stringValue(value); ok {
+		return str
+	}
+	return fmt.Sprint(value)
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// scanOptions holds the optional arguments shared by the SCAN family.
+type scanOptions struct {
+	cursor  uint64
+	count   int
+	pattern string
+	typ     string
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count] [TYPE type]"
+// from args. TYPE is only accepted when allowType is set.
+func parseScanArgs(args []string, allowType bool) (scanOptions, error) {
+	opts := scanOptions{count: defaultScanCount}
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return opts, fmt.Errorf("invalid cursor")
+	}
+	opts.cursor = cursor
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			opts.pattern = args[i+1]
+			if opts.pattern == "*" {
+				opts.pattern = ""
+			}
+		case "COUNT":
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return opts, fmt.Errorf("value is not an integer or out of range")
+			}
+			if count < 1 {
+				return opts, fmt.Errorf("syntax error")
+			}
+			opts.count = count
+		case "TYPE":
+			if !allowType {
+				return opts, fmt.Errorf("syntax error")
+			}
+			opts.typ = args[i+1]
+		default:
+			return opts, fmt.Errorf("syntax error")
+		}
+	}
+	return opts, nil
+}
+
+func scanReply(next uint64, items []string) []interface{} {
+	return []interface{}{strconv.FormatUint(next, 10), items}
+}
+
+func (h *CommandHandler) handleScan(store *InMemoryStore, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("wrong number of arguments for SCAN")
+	}
+	opts, err := parseScanArgs(args[1:], true)
+	if err != nil {
+		return nil, err
+	}
+	keys, next := store.Scan(opts.cursor, opts.count, opts.pattern, opts.typ)
+	return scanReply(next, keys), nil
+}
+
+// handleCollectionScan serves HSCAN, SSCAN and ZSCAN.
+func (h *CommandHandler) handleCollectionScan(store *InMemoryStore, command string, args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("wrong number of arguments for %s", command)
+	}
+	opts, err := parseScanArgs(args[2:], false)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		items []string
+		next  uint64
+	)
+	switch command {
+	case "HSCAN":
+		items, next, err = store.HScan(args[1], opts.cursor, opts.count, opts.pattern)
+	case "SSCAN":
+		items, next, err = store.SScan(args[1], opts.cursor, opts.count, opts.pattern)
+	case "ZSCAN":
+		items, next, err = store.ZScan(args[1], opts.cursor, opts.count, opts.pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanReply(next, items), nil
+}
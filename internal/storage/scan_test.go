@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// scanAll runs a command of the SCAN family from cursor 0 until it
+// returns cursor 0, calling between after every call but the last, and
+// counts how many times each item was returned.
+func scanAll(t *testing.T, do func(args ...string) interface{}, between func(), command []string, options ...string) map[string]int {
+	t.Helper()
+	seen := map[string]int{}
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 10000 {
+			t.Fatalf("%v did not finish", command)
+		}
+		args := append(append(append([]string(nil), command...), cursor), options...)
+		page, ok := do(args...).([]interface{})
+		if !ok || len(page) != 2 {
+			t.Fatalf("%v returned %v", args, page)
+		}
+		for _, item := range page[1].([]string) {
+			seen[item]++
+		}
+		if cursor = page[0].(string); cursor == "0" {
+			return seen
+		}
+		between()
+	}
+}
+
+func TestScanWhileResizing(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		start int // keys not kept, stored before the scan
+		step  int // keys added, or removed if negative, between calls
+	}{
+		{"growing", 0, 40},
+		{"shrinking", 4000, -40},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h, do := newTestHandler(t)
+			db, _ := h.dbs.DB(0)
+			for i := 0; i < 500; i++ {
+				db.Set("kept:"+strconv.Itoa(i), "1")
+			}
+			for i := 0; i < c.start; i++ {
+				db.Set("other:"+strconv.Itoa(i), "1")
+			}
+			n := c.start
+			between := func() {
+				for i := 0; i < c.step; i++ {
+					db.Set("other:"+strconv.Itoa(n), "1")
+					n++
+				}
+				for i := 0; i > c.step && n > 0; i-- {
+					n--
+					db.Delete("other:" + strconv.Itoa(n))
+				}
+			}
+
+			seen := scanAll(t, do, between, []string{"SCAN"}, "COUNT", "20")
+			for i := 0; i < 500; i++ {
+				if key := "kept:" + strconv.Itoa(i); seen[key] != 1 {
+					t.Fatalf("SCAN returned %s %d times, want once", key, seen[key])
+				}
+			}
+			for key, times := range seen {
+				if times != 1 {
+					t.Errorf("SCAN returned %s %d times", key, times)
+				}
+			}
+			if c.step < 0 && n > c.start/2 {
+				t.Errorf("only %d of %d keys were removed during the scan", c.start-n, c.start)
+			}
+		})
+	}
+}
+
+func TestScanMatchAndType(t *testing.T) {
+	h, do := newTestHandler(t)
+	db, _ := h.dbs.DB(0)
+	for i := 0; i < 100; i++ {
+		db.Set("user:"+strconv.Itoa(i), "1")
+		db.Set("item:"+strconv.Itoa(i), datastructures.NewHash())
+	}
+	db.Set("user:counter", int64(1))
+
+	none := func() {}
+	if seen := scanAll(t, do, none, []string{"SCAN"}, "MATCH", "user:?", "COUNT", "7"); len(seen) != 10 {
+		t.Errorf("SCAN MATCH user:? returned %d keys, want 10", len(seen))
+	}
+	if seen := scanAll(t, do, none, []string{"SCAN"}, "TYPE", "string"); len(seen) != 101 || seen["user:counter"] != 1 {
+		t.Errorf("SCAN TYPE string returned %d keys, want 101 with user:counter", len(seen))
+	}
+	if seen := scanAll(t, do, none, []string{"SCAN"}, "TYPE", "HASH", "MATCH", "item:1*"); len(seen) != 11 {
+		t.Errorf("SCAN TYPE HASH MATCH item:1* returned %d keys, want 11", len(seen))
+	}
+}
+
+func TestCollectionScan(t *testing.T) {
+	for _, n := range []int{5, 1000} {
+		h, do := newTestHandler(t)
+		db, _ := h.dbs.DB(0)
+		hash := datastructures.NewHash()
+		ints, strs := datastructures.NewSet(), datastructures.NewSet()
+		zset := datastructures.NewSortedSet()
+		for i := 0; i < n; i++ {
+			hash.HSet("field:"+strconv.Itoa(i), "value:"+strconv.Itoa(i))
+			ints.Add(int64(i))
+			strs.Add("member:" + strconv.Itoa(i))
+			zset.Add("member:"+strconv.Itoa(i), float64(i)/2)
+		}
+		db.Set("hash", hash)
+		db.Set("ints", ints)
+		db.Set("strs", strs)
+		db.Set("zset", zset)
+
+		none := func() {}
+		for _, c := range []struct {
+			command []string
+			pairs   bool
+			item    func(i int) string
+		}{
+			{[]string{"HSCAN", "hash"}, true, func(i int) string { return fmt.Sprintf("field:%d=value:%d", i, i) }},
+			{[]string{"SSCAN", "ints"}, false, strconv.Itoa},
+			{[]string{"SSCAN", "strs"}, false, func(i int) string { return "member:" + strconv.Itoa(i) }},
+			{[]string{"ZSCAN", "zset"}, true, func(i int) string { return "member:" + strconv.Itoa(i) + "=" + formatScore(float64(i)/2) }},
+		} {
+			name := fmt.Sprintf("%v of %d elements encoded as %v", c.command, n, do("OBJECT", "ENCODING", c.command[1]))
+			items := map[string]int{}
+			var flat []string
+			cursor := "0"
+			for {
+				page := do(append(append([]string(nil), c.command...), cursor, "COUNT", "10")...).([]interface{})
+				flat = append(flat, page[1].([]string)...)
+				if cursor = page[0].(string); cursor == "0" {
+					break
+				}
+			}
+			if c.pairs {
+				if len(flat)%2 != 0 {
+					t.Fatalf("%s returned %d items, not pairs", name, len(flat))
+				}
+				for i := 0; i < len(flat); i += 2 {
+					items[flat[i]+"="+flat[i+1]]++
+				}
+			} else {
+				for _, item := range flat {
+					items[item]++
+				}
+			}
+			for i := 0; i < n; i++ {
+				if items[c.item(i)] != 1 {
+					t.Fatalf("%s returned %s %d times, want once", name, c.item(i), items[c.item(i)])
+				}
+			}
+			if len(items) != n {
+				t.Errorf("%s returned %d elements, want %d", name, len(items), n)
+			}
+
+			// MATCH filters the elements returned, not those visited.
+			if c.command[1] == "ints" {
+				continue
+			}
+			want := 1
+			if c.pairs {
+				want = 2
+			}
+			if matched := scanAll(t, do, none, c.command, "MATCH", "*:1", "COUNT", "10"); len(matched) != want {
+				t.Errorf("%s MATCH *:1 returned %v", name, matched)
+			}
+		}
+	}
+
+	_, do := newTestHandler(t)
+	if got := do("HSCAN", "missing", "0"); fmt.Sprint(got) != "[0 []]" {
+		t.Errorf("HSCAN of a missing key = %v", got)
+	}
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// DefaultShards is the number of independently locked partitions of a
+// keyspace used when the configuration does not specify one.
+const DefaultShards = 32
+
+// entry is a stored value together with the metadata used for memory
+// accounting and eviction. The access fields are updated atomically so
+// that reads holding only a shard's read lock can record them.
+type entry struct {
+	value interface{}
+	size  int64
+
+	// accessed is the time of the last access in Unix milliseconds.
+	accessed atomic.Int64
+	// lfu packs the minutes timestamp of the last decrement in its upper
+	// 16 bits and a logarithmic access counter in its lower 8 bits.
+	lfu atomic.Uint32
+}
+
+func newEntry(value interface{}, size int64) *entry {
+	e := &entry{value: value, size: size}
+	e.accessed.Store(time.Now().UnixMilli())
+	e.lfu.Store(lfuMinutes()<<8 | lfuInitVal)
+	return e
+}
+
+// touch records an access to the entry.
+func (e *entry) touch() {
+	e.accessed.Store(time.Now().UnixMilli())
+	for {
+		old := e.lfu.Load()
+		counter := lfuLogIncr(lfuDecay(old))
+		if e.lfu.CompareAndSwap(old, lfuMinutes()<<8|uint32(counter)) {
+			return
+		}
+	}
+}
+
+// shard is one lock-striped partition of a keyspace. A key lives in the
+// shard selected by the high bits of its scan hash, so shards cover
+// consecutive ranges of SCAN cursors.
+type shard struct {
+	data  map[string]*entry
+	ttls  map[string]time.Time
+	index *scanIndex
+	used  int64
+	mem   *memoryTracker
+	// cows keep, for each open snapshot, the keys changed since it was
+	// taken as they were.
+	cows []*shardCOW
+	// cold holds the keys whose values have been demoted to tier, which
+	// is nil unless tiering is enabled. tierPrefix prefixes the store's
+	// keys in the tier.
+	cold       map[string]coldEntry
+	tier       *tier
+	tierPrefix string
+	// ordered keeps the keys sorted for KEYRANGE, and is nil unless the
+	// ordered index is enabled.
+	ordered *orderedIndex
+	mu      sync.RWMutex
+}
+
+func newShard(prefixBits uint, mem *memoryTracker, tierPrefix string) *shard {
+	return &shard{
+		data:       make(map[string]*entry),
+		ttls:       make(map[string]time.Time),
+		index:      newScanIndex(prefixBits),
+		mem:        mem,
+		tierPrefix: tierPrefix,
+	}
+}
+
+// expired reports whether key has a TTL that has passed. Such a key no
+// longer exists for commands, although it stays in the shard until it is
+// written or deleted. The caller must hold sh.mu.
+func (sh *shard) expired(key string) bool {
+	at, ok := sh.ttls[key]
+	return ok && !time.Now().Before(at)
+}
+
+// expiredKeys returns how many keys of the shard have expired. The caller
+// must hold sh.mu.
+func (sh *shard) expiredKeys() int64 {
+	now := time.Now()
+	var n int64
+	for _, at := range sh.ttls {
+		if !now.Before(at) {
+			n++
+		}
+	}
+	return n
+}
+
+// find returns the value stored at key, recording the access for the
+// eviction policies if touch is set. Expired keys are not found, and cold
+// values are read from the tier. The caller must hold sh.mu.
+func (sh *shard) find(key string, touch bool) (interface{}, bool, error) {
+	if sh.expired(key) {
+		return nil, false, nil
+	}
+	if e, exists := sh.data[key]; exists {
+		if touch {
+			e.touch()
+		}
+		return e.value, true, nil
+	}
+	if _, cold := sh.cold[key]; !cold {
+		return nil, false, nil
+	}
+	value, err := sh.coldValue(key)
+	if err != nil {
+		return nil, false, err
+	}
+	sh.tier.reads.Add(1)
+	return value, true, nil
+}
+
+// get returns the value stored at key without recording an access. A cold
+// value that cannot be read is logged and reported missing. The caller
+// must hold sh.mu.
+func (sh *shard) get(key string) (interface{}, bool) {
+	value, exists, err := sh.find(key, false)
+	if err != nil {
+		log.Printf("tiering: %v", err)
+	}
+	return value, exists
+}
+
+// lookup is get that records the access for the eviction policies. The
+// caller must hold sh.mu.
+func (sh *shard) lookup(key string) (interface{}, bool) {
+	value, exists, err := sh.find(key, true)
+	if err != nil {
+		log.Printf("tiering: %v", err)
+	}
+	return value, exists
+}
+
+// set stores value at key, keeping the scan index and memory accounting in
+// sync. Overwriting a key keeps its access history, unless it had expired:
+// the expired key is deleted first, TTL included. With the lsm engine the
+// value goes to the engine instead of memory. The caller must hold sh.mu
+// for writing.
+func (sh *shard) set(key string, value interface{}) {
+	if sh.expired(key) {
+		sh.delete(key)
+	}
+	sh.preserve(key)
+	if sh.tier != nil && sh.tier.kind == EngineLSM && sh.spill(key, value) {
+		return
+	}
+	size := estimateSize(key, value)
+	if e, exists := sh.data[key]; exists {
+		sh.account(size - e.size)
+		e.value = value
+		e.size = size
+		e.touch()
+		return
+	}
+	if _, cold := sh.cold[key]; cold {
+		sh.uncold(key)
+	} else {
+		sh.indexKey(key)
+	}
+	sh.data[key] = newEntry(value, size)
+	sh.account(size)
+}
+
+// delete removes key and its TTL. The caller must hold sh.mu for writing.
+func (sh *shard) delete(key string) bool {
+	e, exists := sh.data[key]
+	if !exists {
+		if _, cold := sh.cold[key]; !cold {
+			return false
+		}
+		sh.preserve(key)
+		sh.uncold(key)
+		delete(sh.ttls, key)
+		sh.unindexKey(key)
+		return true
+	}
+	sh.preserve(key)
+	delete(sh.data, key)
+	delete(sh.ttls, key)
+	sh.unindexKey(key)
+	sh.account(-e.size)
+	return true
+}
+
+// reset empties the shard. The caller must hold sh.mu for writing.
+func (sh *shard) reset() {
+	for key := range sh.data {
+		sh.preserve(key)
+	}
+	if len(sh.cold) > 0 {
+		sh.dropCold()
+	}
+	sh.data = make(map[string]*entry)
+	sh.ttls = make(map[string]time.Time)
+	sh.index = newScanIndex(sh.index.prefix)
+	if sh.ordered != nil {
+		sh.ordered = &orderedIndex{}
+	}
+	sh.account(-sh.used)
+}
+
+// indexKey adds a new key to the shard's indexes. The caller must hold
+// sh.mu for writing.
+func (sh *shard) indexKey(key string) {
+	sh.index.add(key)
+	if sh.ordered != nil {
+		sh.ordered.add(key)
+	}
+}
+
+// unindexKey removes a deleted key from the shard's indexes. The caller
+// must hold sh.mu for writing.
+func (sh *shard) unindexKey(key string) {
+	sh.index.remove(key)
+	if sh.ordered != nil {
+		sh.ordered.remove(key)
+	}
+}
+
+func (sh *shard) account(delta int64) {
+	sh.used += delta
+	sh.mem.add(delta)
+}
+
+// shardBitsFor returns log2 of the smallest power of two >= n.
+func shardBitsFor(n int) uint {
+	bits := uint(0)
+	for 1<<bits < n {
+		bits++
+	}
+	return bits
+}
+
+func (s *InMemoryStore) shardIndex(key string) int {
+	if s.shardBits == 0 {
+		return 0
+	}
+	return int(datastructures.ScanHash(key) >> (64 - s.shardBits))
+}
+
+func (s *InMemoryStore) shardFor(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// shardIndexes returns the sorted, de-duplicated shard indexes of keys.
+// Locking shards in this order is what keeps multi-key commands free of
+// deadlocks.
+func (s *InMemoryStore) shardIndexes(keys []string) []int {
+	seen := make(map[int]bool, len(keys))
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		i := s.shardIndex(key)
+		if !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// lockKeys write-locks the shards holding keys and returns the function
+// that unlocks them.
+func (s *InMemoryStore) lockKeys(keys ...string) func() {
+	indexes := s.shardIndexes(keys)
+	for _, i := range indexes {
+		s.shards[i].mu.Lock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			s.shards[indexes[j]].mu.Unlock()
+		}
+	}
+}
+
+// rlockKeys is the read-only counterpart of lockKeys.
+func (s *InMemoryStore) rlockKeys(keys ...string) func() {
+	indexes := s.shardIndexes(keys)
+	for _, i := range indexes {
+		s.shards[i].mu.RLock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			s.shards[indexes[j]].mu.RUnlock()
+		}
+	}
+}
+
+// lockAll write-locks every shard, for operations on the whole keyspace.
+func (s *InMemoryStore) lockAll() func() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+	return func() {
+		for j := len(s.shards) - 1; j >= 0; j-- {
+			s.shards[j].mu.Unlock()
+		}
+	}
+}
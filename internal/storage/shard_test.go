@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// benchShards are the shard counts the store benchmarks compare. A single
+// shard behaves like the original store guarded by one global lock.
+var benchShards = []int{1, 8, 32, 128}
+
+const benchKeys = 100000
+
+// benchStore runs a concurrent workload in which writes is the fraction of
+// operations that write; one write in sixteen is a two-key MSET.
+func benchStore(b *testing.B, writes float64) {
+	names := make([]string, benchKeys)
+	for i := range names {
+		names[i] = "key:" + strconv.Itoa(i)
+	}
+	for _, shards := range benchShards {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			store := NewShardedStore(shards)
+			for _, name := range names {
+				store.Set(name, "value")
+			}
+			var seeds atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(seeds.Add(1)))
+				for n := 0; pb.Next(); n++ {
+					key := names[rng.Intn(len(names))]
+					switch {
+					case rng.Float64() >= writes:
+						store.Get(key)
+					case n%16 == 0:
+						store.MSet(key, "value", names[rng.Intn(len(names))], "value")
+					default:
+						store.Set(key, "value")
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStoreWriteHeavy(b *testing.B) {
+	benchStore(b, 0.8)
+}
+
+func BenchmarkStoreReadHeavy(b *testing.B) {
+	benchStore(b, 0.1)
+}
@@ -0,0 +1,449 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const snapshotFileName = "dump.rdx"
+
+// A snapshot file holds every database at one point in time. Like Redis'
+// RDB it is a sequence of opcodes:
+//
+//	header  "REDIX" and the format version as four decimal digits
+//	aux     0xFA, name string, value string: metadata such as the WAL
+//	        sequence number the snapshot includes
+//	select  0xFE, database uvarint: the database of the keys that follow
+//	expiry  0xFC, Unix milliseconds as little endian int64: the expiry
+//	        time of the next key
+//	key     value type tag, key string, value as in appendValueBody
+//	eof     0xFF, then the CRC32C of every preceding byte as little
+//	        endian uint32
+//
+// Strings are uvarint lengths followed by their bytes. Since version 2
+// everything after the header is cut into blocks of 64KB written by a
+// blockWriter, each compressed and checksummed on its own, so damage is
+// found at the block it is in.
+const (
+	snapshotMagic   = "REDIX"
+	snapshotVersion = 2
+	// snapshotVersionUnframed is the version of snapshots written as a
+	// plain opcode stream, which are still read.
+	snapshotVersionUnframed = 1
+
+	snapshotAux      byte = 0xFA
+	snapshotExpireMs byte = 0xFC
+	snapshotSelectDB byte = 0xFE
+	snapshotEOF      byte = 0xFF
+)
+
+// Aux fields written to every snapshot.
+const (
+	auxCreated = "ctime"
+	auxWALSeq  = "wal-seq"
+)
+
+func (p *PersistenceLayer) snapshotPath() string {
+	return filepath.Join(p.snapshotDir, snapshotFileName)
+}
+
+// forEach calls fn for every key of the store with its value and expiry
+// time, which is zero for keys without a TTL. Each shard is read-locked
+// while it is visited, and its cold values are read from the tier.
+func (s *InMemoryStore) forEach(fn func(key string, value interface{}, expireAt time.Time) error) error {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, e := range sh.data {
+			if err := fn(key, e.value, sh.ttls[key]); err != nil {
+				sh.mu.RUnlock()
+				return err
+			}
+		}
+		for key := range sh.cold {
+			value, err := sh.coldValue(key)
+			if err == nil {
+				err = fn(key, value, sh.ttls[key])
+			}
+			if err != nil {
+				sh.mu.RUnlock()
+				return err
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return nil
+}
+
+// forEach calls fn for every key of database i, like InMemoryStore.forEach.
+func (d *Databases) forEach(i int, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	db, err := d.DB(i)
+	if err != nil {
+		return err
+	}
+	return db.forEach(fn)
+}
+
+// snapshotSource calls fn for every key of database db with its value and
+// expiry time.
+type snapshotSource func(db int, fn func(key string, value interface{}, expireAt time.Time) error) error
+
+// writeSnapshot writes databases databases, read from source, to the
+// snapshot file, atomically replacing the previous one. seq is the
+// sequence number of the last logged command whose effects the snapshot
+// contains.
+func (p *PersistenceLayer) writeSnapshot(seq uint64, databases int, source snapshotSource) error {
+	p.mutex.Lock()
+	codec := p.compression
+	p.mutex.Unlock()
+	return writeSnapshotFile(p.snapshotPath(), codec, seq, databases, source)
+}
+
+// SetCompression changes the codec snapshots are compressed with. The
+// default is CompressionNone.
+func (p *PersistenceLayer) SetCompression(codec Compression) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.compression = codec
+}
+
+// SaveSnapshotFile writes every database to a snapshot file at path, as
+// the server does to seed a data directory with. The snapshot is given
+// sequence number 0, so it should not be placed next to an existing WAL.
+func (d *Databases) SaveSnapshotFile(path string) error {
+	return writeSnapshotFile(path, CompressionNone, 0, d.Len(), d.forEach)
+}
+
+func writeSnapshotFile(path string, codec Compression, seq uint64, databases int, source snapshotSource) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	crc := crc32.New(crc32c)
+	header := fmt.Sprintf("%s%04d", snapshotMagic, snapshotVersion)
+	crc.Write([]byte(header))
+	fw := bufio.NewWriter(file)
+	fw.WriteString(header)
+	blocks := newBlockWriter(fw, codec)
+	w := bufio.NewWriter(io.MultiWriter(blocks, crc))
+	var buf []byte
+	for _, aux := range [][2]string{
+		{auxCreated, strconv.FormatInt(time.Now().Unix(), 10)},
+		{auxWALSeq, strconv.FormatUint(seq, 10)},
+	} {
+		buf = append(buf[:0], snapshotAux)
+		buf = appendString(buf, aux[0])
+		buf = appendString(buf, aux[1])
+		w.Write(buf)
+	}
+
+	for i := 0; i < databases; i++ {
+		selected := false
+		err := source(i, func(key string, value interface{}, expireAt time.Time) error {
+			buf = buf[:0]
+			if !selected {
+				buf = append(buf, snapshotSelectDB)
+				buf = binary.AppendUvarint(buf, uint64(i))
+				selected = true
+			}
+			if !expireAt.IsZero() {
+				buf = append(buf, snapshotExpireMs)
+				buf = binary.LittleEndian.AppendUint64(buf, uint64(expireAt.UnixMilli()))
+			}
+			tag, err := valueTag(value)
+			if err != nil {
+				return fmt.Errorf("key %q: %v", key, err)
+			}
+			buf = append(buf, tag)
+			buf = appendString(buf, key)
+			if buf, err = appendValueBody(buf, value); err != nil {
+				return fmt.Errorf("key %q: %v", key, err)
+			}
+			_, err = w.Write(buf)
+			return err
+		})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	w.WriteByte(snapshotEOF)
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	binary.Write(blocks, binary.LittleEndian, crc.Sum32())
+	if err := blocks.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := fw.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// startSnapshot moves the WAL on to a new segment for a background
+// snapshot of the dataset as it is now, and returns the sequence number of
+// the last command logged before it and the first segment logged after.
+// Logged writes must be paused until the dataset has been captured.
+func (p *PersistenceLayer) startSnapshot() (uint64, string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.rewrite.closed {
+		return 0, "", ErrPersistenceClosed
+	}
+	if err := p.rotate(); err != nil {
+		return 0, "", err
+	}
+	return p.seq, p.manifest.segments[len(p.manifest.segments)-1], nil
+}
+
+// checksumReader computes the CRC32C of the bytes read through it.
+type checksumReader struct {
+	r   *bufio.Reader
+	crc uint32
+	one [1]byte
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc32.Update(c.crc, crc32c, p[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.one[0] = b
+		c.crc = crc32.Update(c.crc, crc32c, c.one[:])
+	}
+	return b, err
+}
+
+// snapshotReader reads a snapshot file.
+type snapshotReader struct {
+	file *os.File
+	r    *checksumReader
+	// seq is the WAL sequence number from the aux fields, and op the
+	// opcode that followed them.
+	seq uint64
+	op  byte
+}
+
+// openSnapshot opens the snapshot file and reads its header and aux
+// fields. It returns nil if there is no snapshot.
+func (p *PersistenceLayer) openSnapshot() (*snapshotReader, error) {
+	return openSnapshotFile(p.snapshotPath())
+}
+
+func openSnapshotFile(path string) (*snapshotReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s := &snapshotReader{file: file, r: &checksumReader{r: bufio.NewReader(file)}}
+	if err := s.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *snapshotReader) readHeader() error {
+	header := make([]byte, len(snapshotMagic)+4)
+	if _, err := io.ReadFull(s.r, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("not a snapshot file")
+	}
+	version, err := strconv.Atoi(string(header[len(snapshotMagic):]))
+	if err != nil {
+		return fmt.Errorf("invalid snapshot version %q", header[len(snapshotMagic):])
+	}
+	if version > snapshotVersion {
+		return fmt.Errorf("snapshot version %d is newer than the supported version %d", version, snapshotVersion)
+	}
+	if version > snapshotVersionUnframed {
+		s.r.r = bufio.NewReader(&blockReader{r: s.r.r, offset: int64(len(header))})
+	}
+
+	for {
+		op, err := s.r.ReadByte()
+		if err != nil {
+			return truncatedSnapshot(err)
+		}
+		if op != snapshotAux {
+			s.op = op
+			return nil
+		}
+		name, err := readString(s.r)
+		if err != nil {
+			return truncatedSnapshot(err)
+		}
+		value, err := readString(s.r)
+		if err != nil {
+			return truncatedSnapshot(err)
+		}
+		// Unknown aux fields are skipped, as in Redis.
+		if name == auxWALSeq {
+			if s.seq, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return fmt.Errorf("invalid %s %q", auxWALSeq, value)
+			}
+		}
+	}
+}
+
+// snapshotSeq returns the sequence number of the snapshot file, or 0 if
+// there is none.
+func (p *PersistenceLayer) snapshotSeq() (uint64, error) {
+	s, err := p.openSnapshot()
+	if s == nil {
+		return 0, err
+	}
+	s.file.Close()
+	return s.seq, nil
+}
+
+// loadSnapshot loads the snapshot file into dbs and returns the sequence
+// number of the last command it contains and the number of keys loaded.
+// Keys that expired while the server was down are skipped. A missing
+// snapshot loads nothing; a damaged one is an error, and may have been
+// partly loaded.
+func (p *PersistenceLayer) loadSnapshot(dbs *Databases) (uint64, int, error) {
+	s, err := p.openSnapshot()
+	if s == nil {
+		return 0, 0, err
+	}
+	defer s.file.Close()
+
+	keys, err := s.load(dbs)
+	if err != nil {
+		return 0, keys, fmt.Errorf("%s: %v", p.snapshotPath(), err)
+	}
+	return s.seq, keys, nil
+}
+
+// LoadSnapshotFile loads the snapshot file at path into d and returns the
+// number of keys loaded. Keys that have already expired are skipped.
+func (d *Databases) LoadSnapshotFile(path string) (int, error) {
+	s, err := openSnapshotFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if s == nil {
+		return 0, fmt.Errorf("%s: no such file", path)
+	}
+	defer s.file.Close()
+
+	keys, err := s.load(d)
+	if err != nil {
+		return keys, fmt.Errorf("%s: %v", path, err)
+	}
+	return keys, nil
+}
+
+func (s *snapshotReader) load(dbs *Databases) (int, error) {
+	now := time.Now().UnixMilli()
+	keys := 0
+	db, _ := dbs.DB(0)
+	var expireMs int64
+	for op := s.op; ; {
+		switch op {
+		case snapshotEOF:
+			want := s.r.crc
+			var got uint32
+			if err := binary.Read(s.r.r, binary.LittleEndian, &got); err != nil {
+				return keys, fmt.Errorf("truncated snapshot: missing checksum")
+			}
+			if got != want {
+				return keys, fmt.Errorf("checksum mismatch")
+			}
+			return keys, nil
+
+		case snapshotSelectDB:
+			index, err := binary.ReadUvarint(s.r)
+			if err != nil {
+				return keys, truncatedSnapshot(err)
+			}
+			if db, err = dbs.DB(int(index)); err != nil {
+				return keys, fmt.Errorf("snapshot uses database %d: %v", index, err)
+			}
+
+		case snapshotExpireMs:
+			var ms [8]byte
+			if _, err := io.ReadFull(s.r, ms[:]); err != nil {
+				return keys, truncatedSnapshot(err)
+			}
+			expireMs = int64(binary.LittleEndian.Uint64(ms[:]))
+
+		default:
+			key, err := readString(s.r)
+			if err != nil {
+				return keys, truncatedSnapshot(err)
+			}
+			value, err := readValueBody(s.r, op)
+			if err != nil {
+				return keys, fmt.Errorf("key %q: %v", key, err)
+			}
+			if expireMs == 0 || expireMs > now {
+				db.Set(key, value)
+				if expireMs != 0 {
+					db.ExpireAt(key, time.UnixMilli(expireMs))
+				}
+				keys++
+				dbs.demoteIfNeeded()
+			}
+			expireMs = 0
+		}
+
+		var err error
+		if op, err = s.r.ReadByte(); err != nil {
+			return keys, truncatedSnapshot(err)
+		}
+	}
+}
+
+// truncatedSnapshot describes an error reading a snapshot, which was cut
+// short unless one of its blocks failed its checks.
+func truncatedSnapshot(err error) error {
+	var damaged *blockError
+	if errors.As(err, &damaged) {
+		return err
+	}
+	return fmt.Errorf("truncated snapshot: %v", err)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
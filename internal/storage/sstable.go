@@ -0,0 +1,558 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// An SSTable is an immutable file of entries sorted by key:
+//
+//	data blocks  entries of about sstableBlockSize bytes each
+//	index block  the smallest key of the table and the number of data
+//	             blocks, then for each block its last key, offset and
+//	             size, and last the length and bytes of the Bloom filter
+//	             of the table's keys
+//	footer       offset and size of the index block as little endian
+//	             uint64 and uint32, the format version as uint32, and
+//	             sstableMagic
+//
+// Data blocks are compressed with the codec of the tree and every block,
+// the index included, is framed with its codec and a checksum as in
+// appendBlock. Offsets and sizes are those of the framed blocks.
+//
+// An entry is its key, a kind byte and, for values, the length of the
+// rest followed by the expiry in Unix milliseconds as a varint (zero for
+// none) and the value as in appendValue. Deleted keys are written as
+// tombstones so that they hide older versions in other tables.
+// Strings are uvarint lengths followed by their bytes.
+const (
+	sstableMagic   = "REDIXSST"
+	sstableVersion = 3
+	// Tables written before blocks were framed (version 2), and before
+	// they had Bloom filters (version 1), are still read.
+	sstableVersionUnframed = 2
+	sstableVersionNoFilter = 1
+	sstableFooterLen       = 8 + 4 + 4 + len(sstableMagic)
+	sstableBlockSize       = 4 << 10
+
+	sstableValue     byte = 0
+	sstableTombstone byte = 1
+)
+
+// lsmEntry is a version of a key in the LSM tree: a value with its expiry
+// time, zero for none, or a tombstone.
+type lsmEntry struct {
+	value    interface{}
+	expireAt time.Time
+	deleted  bool
+}
+
+// expired reports whether the entry is a value whose TTL has passed.
+func (e lsmEntry) expired(now time.Time) bool {
+	return !e.deleted && !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// appendSSTableEntry appends the encoding of a key and its entry.
+func appendSSTableEntry(buf []byte, key string, e lsmEntry) ([]byte, error) {
+	if e.deleted {
+		return appendSSTableRecord(buf, key, sstableTombstone, nil), nil
+	}
+	var expireMs int64
+	if !e.expireAt.IsZero() {
+		expireMs = e.expireAt.UnixMilli()
+	}
+	body, err := appendValue(binary.AppendVarint(nil, expireMs), e.value)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %v", key, err)
+	}
+	return appendSSTableRecord(buf, key, sstableValue, body), nil
+}
+
+// appendSSTableRecord appends an entry whose value is already encoded.
+func appendSSTableRecord(buf []byte, key string, kind byte, body []byte) []byte {
+	buf = appendString(buf, key)
+	buf = append(buf, kind)
+	if kind == sstableTombstone {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(body)))
+	return append(buf, body...)
+}
+
+// sstableBlock is the index entry of a data block.
+type sstableBlock struct {
+	lastKey string
+	offset  int64
+	size    int64
+}
+
+// sstable is an open SSTable file.
+type sstable struct {
+	path     string
+	file     *os.File
+	num      int
+	size     int64
+	smallest string
+	largest  string
+	blocks   []sstableBlock
+	version  uint32
+	// filter is nil for tables written without one.
+	filter bloomFilter
+	// id identifies the table in cache, the block cache it shares with
+	// the other tables of its tree, if any.
+	id    uint64
+	cache *blockCache
+	// refs counts the views pinning the table, and obsolete is set once a
+	// compaction has replaced it; both are guarded by the tree's d.mu.
+	refs     int
+	obsolete bool
+}
+
+// sstableWriter writes a new SSTable from entries added in key order.
+type sstableWriter struct {
+	file   *os.File
+	w      *bufio.Writer
+	offset int64
+	block  []byte
+	last   string
+	first  string
+	count  int
+	blocks []sstableBlock
+	// hashes are the Bloom filter hashes of the keys added.
+	hashes []uint64
+	// limiter, if set, paces the writes of a compaction.
+	limiter *rateLimiter
+	codec   Compression
+	frame   []byte
+}
+
+// newSSTableWriter creates a table whose data blocks are compressed with
+// codec.
+func newSSTableWriter(path string, codec Compression) (*sstableWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sstableWriter{file: file, w: bufio.NewWriter(file), codec: codec}, nil
+}
+
+// add appends an entry. Keys must be added in increasing order.
+func (w *sstableWriter) add(key string, e lsmEntry) error {
+	if err := w.checkOrder(key); err != nil {
+		return err
+	}
+	var err error
+	if w.block, err = appendSSTableEntry(w.block, key, e); err != nil {
+		return err
+	}
+	return w.added(key)
+}
+
+// addRecord appends an entry whose value is already encoded, as read by
+// an sstableIterator.
+func (w *sstableWriter) addRecord(key string, kind byte, body []byte) error {
+	if err := w.checkOrder(key); err != nil {
+		return err
+	}
+	w.block = appendSSTableRecord(w.block, key, kind, body)
+	return w.added(key)
+}
+
+func (w *sstableWriter) checkOrder(key string) error {
+	if w.count > 0 && key <= w.last {
+		return fmt.Errorf("sstable keys out of order: %q after %q", key, w.last)
+	}
+	if w.count == 0 {
+		w.first = key
+	}
+	return nil
+}
+
+// added accounts for the entry just appended to the current block.
+func (w *sstableWriter) added(key string) error {
+	w.hashes = append(w.hashes, bloomHash(key))
+	w.last = key
+	w.count++
+	if len(w.block) >= sstableBlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *sstableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.frame = appendBlock(w.frame[:0], w.codec, w.block)
+	if w.limiter != nil {
+		if err := w.limiter.wait(len(w.frame)); err != nil {
+			return err
+		}
+	}
+	if _, err := w.w.Write(w.frame); err != nil {
+		return err
+	}
+	w.blocks = append(w.blocks, sstableBlock{lastKey: w.last, offset: w.offset, size: int64(len(w.frame))})
+	w.offset += int64(len(w.frame))
+	w.block = w.block[:0]
+	return nil
+}
+
+// size returns the number of bytes written so far, including the block
+// being filled.
+func (w *sstableWriter) size() int64 {
+	return w.offset + int64(len(w.block))
+}
+
+// finish writes the index block and footer and makes the file durable.
+func (w *sstableWriter) finish() error {
+	if err := w.flushBlock(); err != nil {
+		w.file.Close()
+		return err
+	}
+	index := appendString(nil, w.first)
+	index = binary.AppendUvarint(index, uint64(len(w.blocks)))
+	for _, b := range w.blocks {
+		index = appendString(index, b.lastKey)
+		index = binary.AppendUvarint(index, uint64(b.offset))
+		index = binary.AppendUvarint(index, uint64(b.size))
+	}
+	index = appendString(index, string(newBloomFilter(w.hashes)))
+	index = appendBlock(nil, CompressionNone, index)
+	footer := binary.LittleEndian.AppendUint64(nil, uint64(w.offset))
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(index)))
+	footer = binary.LittleEndian.AppendUint32(footer, sstableVersion)
+	footer = append(footer, sstableMagic...)
+	w.w.Write(index)
+	w.w.Write(footer)
+
+	if err := w.w.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// abort discards a table that will not be finished.
+func (w *sstableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// openSSTable opens an SSTable file and reads its index.
+func openSSTable(path string, num int) (*sstable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readSSTableIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	t.path, t.num, t.id = path, num, tableIDs.Add(1)
+	return t, nil
+}
+
+func readSSTableIndex(file *os.File) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < int64(sstableFooterLen) {
+		return nil, fmt.Errorf("file of %d bytes is too short for an SSTable", size)
+	}
+	footer := make([]byte, sstableFooterLen)
+	if _, err := file.ReadAt(footer, size-int64(sstableFooterLen)); err != nil {
+		return nil, err
+	}
+	if string(footer[16:]) != sstableMagic {
+		return nil, fmt.Errorf("not an SSTable")
+	}
+	version := binary.LittleEndian.Uint32(footer[12:16])
+	if version < sstableVersionNoFilter || version > sstableVersion {
+		return nil, fmt.Errorf("unsupported SSTable version %d", version)
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	indexSize := int64(binary.LittleEndian.Uint32(footer[8:12]))
+	if indexOffset < 0 || indexOffset+indexSize != size-int64(sstableFooterLen) {
+		return nil, fmt.Errorf("index block at offset %d: invalid position", indexOffset)
+	}
+
+	index := make([]byte, indexSize)
+	if _, err := file.ReadAt(index, indexOffset); err != nil {
+		return nil, err
+	}
+	if version >= sstableVersion {
+		if index, err = readFramedBlock(index); err != nil {
+			return nil, fmt.Errorf("index block at offset %d: %w", indexOffset, err)
+		}
+	}
+	t := &sstable{file: file, size: size, version: version}
+	r := bytes.NewReader(index)
+	corrupt := func(err error) error {
+		return fmt.Errorf("index block at offset %d: %v", indexOffset, err)
+	}
+	if t.smallest, err = readString(r); err != nil {
+		return nil, corrupt(err)
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+	var offset int64
+	for i := uint64(0); i < n; i++ {
+		var b sstableBlock
+		if b.lastKey, err = readString(r); err != nil {
+			return nil, corrupt(err)
+		}
+		blockOffset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		blockSize, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		b.offset, b.size = int64(blockOffset), int64(blockSize)
+		if b.offset != offset || b.offset+b.size > indexOffset {
+			return nil, corrupt(fmt.Errorf("block %d is out of place", i))
+		}
+		offset += b.size
+		t.blocks = append(t.blocks, b)
+	}
+	if len(t.blocks) > 0 {
+		t.largest = t.blocks[len(t.blocks)-1].lastKey
+	}
+	if version >= sstableVersionUnframed {
+		filter, err := readString(r)
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		t.filter = bloomFilter(filter)
+	}
+	return t, nil
+}
+
+// readBlock reads the data block at index i, checking and decompressing
+// it.
+func (t *sstable) readBlock(i int) ([]byte, error) {
+	b := t.blocks[i]
+	block := make([]byte, b.size)
+	if _, err := t.file.ReadAt(block, b.offset); err != nil {
+		return nil, fmt.Errorf("%s: block at offset %d: %v", t.path, b.offset, err)
+	}
+	if t.version < sstableVersion {
+		return block, nil
+	}
+	block, err := readFramedBlock(block)
+	if err != nil {
+		return nil, fmt.Errorf("%s: block at offset %d: %w", t.path, b.offset, err)
+	}
+	return block, nil
+}
+
+// cachedBlock returns the data block at index i from the block cache,
+// reading and caching it on a miss.
+func (t *sstable) cachedBlock(i int) ([]byte, error) {
+	if t.cache == nil {
+		return t.readBlock(i)
+	}
+	key := blockCacheKey{table: t.id, block: i}
+	if block, ok := t.cache.get(key); ok {
+		return block, nil
+	}
+	block, err := t.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+	t.cache.add(key, block)
+	return block, nil
+}
+
+// get returns the entry for key, and false if the table has none.
+func (t *sstable) get(key string) (lsmEntry, bool, error) {
+	if key < t.smallest || key > t.largest {
+		return lsmEntry{}, false, nil
+	}
+	i := sort.Search(len(t.blocks), func(i int) bool {
+		return t.blocks[i].lastKey >= key
+	})
+	if i == len(t.blocks) {
+		return lsmEntry{}, false, nil
+	}
+	block, err := t.cachedBlock(i)
+	if err != nil {
+		return lsmEntry{}, false, err
+	}
+
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		k, e, err := readSSTableEntry(r, func(k string) bool { return k == key })
+		if err != nil {
+			return lsmEntry{}, false, fmt.Errorf("%s: block at offset %d: %v", t.path, t.blocks[i].offset, err)
+		}
+		if k == key {
+			return e, true, nil
+		}
+		if k > key {
+			break
+		}
+	}
+	return lsmEntry{}, false, nil
+}
+
+// readSSTableEntry reads the next entry of a data block. The value is only
+// decoded if want reports that the key is wanted.
+func readSSTableEntry(r *bytes.Reader, want func(key string) bool) (string, lsmEntry, error) {
+	key, kind, n, err := readSSTableHeader(r)
+	if err != nil {
+		return "", lsmEntry{}, err
+	}
+	if kind == sstableTombstone {
+		return key, lsmEntry{deleted: true}, nil
+	}
+	if !want(key) {
+		r.Seek(int64(n), io.SeekCurrent)
+		return key, lsmEntry{}, nil
+	}
+	body := make([]byte, n)
+	io.ReadFull(r, body)
+	e, err := decodeSSTableValue(body)
+	if err != nil {
+		return "", lsmEntry{}, fmt.Errorf("key %q: %v", key, err)
+	}
+	return key, e, nil
+}
+
+// readSSTableHeader reads the key and kind of the next entry of a data
+// block, and for values the length of the encoded value that follows.
+func readSSTableHeader(r *bytes.Reader) (string, byte, uint64, error) {
+	key, err := readString(r)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	kind, err := r.ReadByte()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	switch kind {
+	case sstableTombstone:
+		return key, kind, 0, nil
+	case sstableValue:
+	default:
+		return "", 0, 0, fmt.Errorf("unknown entry kind %d", kind)
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if n > uint64(r.Len()) {
+		return "", 0, 0, io.ErrUnexpectedEOF
+	}
+	return key, kind, n, nil
+}
+
+// decodeSSTableValue decodes the encoded value of an entry: its expiry
+// and the value itself.
+func decodeSSTableValue(body []byte) (lsmEntry, error) {
+	br := bytes.NewReader(body)
+	expireMs, err := binary.ReadVarint(br)
+	if err != nil {
+		return lsmEntry{}, err
+	}
+	value, err := readValue(br)
+	if err != nil {
+		return lsmEntry{}, err
+	}
+	e := lsmEntry{value: value}
+	if expireMs != 0 {
+		e.expireAt = time.UnixMilli(expireMs)
+	}
+	return e, nil
+}
+
+// sstableExpireAt returns the expiry in Unix milliseconds of an encoded
+// value, zero for none.
+func sstableExpireAt(body []byte) int64 {
+	expireMs, _ := binary.Varint(body)
+	return expireMs
+}
+
+// sstableIterator reads the entries of a table in key order without
+// decoding their values, for compactions to copy. It reads past the block
+// cache, so that a compaction does not push out the blocks lookups use.
+type sstableIterator struct {
+	t       *sstable
+	limiter *rateLimiter
+	next    int
+	r       *bytes.Reader
+	offset  int64
+
+	key  string
+	kind byte
+	body []byte
+	err  error
+}
+
+func (t *sstable) iterator(limiter *rateLimiter) *sstableIterator {
+	return &sstableIterator{t: t, limiter: limiter}
+}
+
+// iteratorFrom returns an iterator that starts at the block that may hold
+// start, for reads of a key range.
+func (t *sstable) iteratorFrom(start string) *sstableIterator {
+	next := sort.Search(len(t.blocks), func(i int) bool {
+		return t.blocks[i].lastKey >= start
+	})
+	return &sstableIterator{t: t, next: next}
+}
+
+// advance moves to the next entry, returning false at the end of the
+// table or on an error.
+func (it *sstableIterator) advance() bool {
+	if it.err != nil {
+		return false
+	}
+	for it.r == nil || it.r.Len() == 0 {
+		if it.next == len(it.t.blocks) {
+			return false
+		}
+		if it.limiter != nil {
+			if it.err = it.limiter.wait(int(it.t.blocks[it.next].size)); it.err != nil {
+				return false
+			}
+		}
+		block, err := it.t.readBlock(it.next)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.r, it.offset = bytes.NewReader(block), it.t.blocks[it.next].offset
+		it.next++
+	}
+
+	key, kind, n, err := readSSTableHeader(it.r)
+	if err != nil {
+		it.err = fmt.Errorf("%s: block at offset %d: %v", it.t.path, it.offset, err)
+		return false
+	}
+	it.key, it.kind, it.body = key, kind, nil
+	if kind == sstableValue {
+		it.body = make([]byte, n)
+		io.ReadFull(it.r, it.body)
+	}
+	return true
+}
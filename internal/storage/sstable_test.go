@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+func TestSSTableWriteRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table.sst")
+	w, err := newSSTableWriter(path, CompressionSnappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := datastructures.NewHash()
+	hash.HSet("field", "value")
+	expireAt := time.UnixMilli(4102444800000)
+	entries := map[string]lsmEntry{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key:%04d", i)
+		switch {
+		case i%7 == 0:
+			entries[key] = lsmEntry{deleted: true}
+		case i%11 == 0:
+			entries[key] = lsmEntry{value: hash}
+		case i%13 == 0:
+			entries[key] = lsmEntry{value: int64(i), expireAt: expireAt}
+		default:
+			entries[key] = lsmEntry{value: strings.Repeat("v", i%100)}
+		}
+		if err := w.add(key, entries[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.add("key:0500", lsmEntry{value: "again"}); err == nil {
+		t.Error("adding a key out of order succeeded")
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := openSSTable(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.file.Close()
+	if table.smallest != "key:0000" || table.largest != "key:0999" {
+		t.Errorf("key range [%s, %s]", table.smallest, table.largest)
+	}
+	for key, want := range entries {
+		e, ok, err := table.get(key)
+		if err != nil || !ok {
+			t.Fatalf("get %s = %v, %v", key, ok, err)
+		}
+		if e.deleted != want.deleted || !e.expireAt.Equal(want.expireAt) {
+			t.Errorf("%s = %+v, want %+v", key, e, want)
+		}
+		switch v := e.value.(type) {
+		case *datastructures.Hash:
+			if got, _ := v.HGet("field"); got != "value" {
+				t.Errorf("%s field = %v", key, got)
+			}
+		default:
+			if v != want.value {
+				t.Errorf("%s = %v, want %v", key, v, want.value)
+			}
+		}
+	}
+	for _, key := range []string{"a", "key:", "key:0500x", "zzz"} {
+		if _, ok, err := table.get(key); ok || err != nil {
+			t.Errorf("get %s = %v, %v", key, ok, err)
+		}
+	}
+
+	it, n, last := table.iterator(nil), 0, ""
+	for it.advance() {
+		if it.key <= last {
+			t.Fatalf("iterator returned %s after %s", it.key, last)
+		}
+		if (it.kind == sstableTombstone) != entries[it.key].deleted {
+			t.Errorf("iterator returned kind %d for %s", it.kind, it.key)
+		}
+		last = it.key
+		n++
+	}
+	if it.err != nil || n != len(entries) {
+		t.Errorf("iterator returned %d entries, want %d: %v", n, len(entries), it.err)
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Engine returns the store as an Engine, which commands made of plain
+// reads and writes run against: the store keeps its values in
+// memory, in a tier or in an LSM tree according to the storage.engine
+// setting, so reads and writes through it behave the same under every
+// setting. Values of expired keys are not returned, as for any Engine.
+func (s *InMemoryStore) Engine() Engine {
+	return storeEngine{s}
+}
+
+// storeEngine is an InMemoryStore seen as an Engine. Its writes lock the
+// shards of their keys like the store's own methods, so they mix with
+// commands that do not go through the engine.
+type storeEngine struct {
+	s *InMemoryStore
+}
+
+// Get returns the value stored at key and its expiry time, recording the
+// access for the eviction policies. A cold value that cannot be read is an
+// error rather than a missing key.
+func (e storeEngine) Get(key string) (interface{}, time.Time, bool, error) {
+	sh := e.s.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	value, exists, err := sh.find(key, true)
+	if err != nil || !exists {
+		return nil, time.Time{}, false, err
+	}
+	return value, sh.ttls[key], true, nil
+}
+
+// Ascend calls fn for every key from start onwards in key order. It reads
+// the store as it was when Ascend was called, from a snapshot, so fn may
+// write to it.
+func (e storeEngine) Ascend(start string, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	snap := storeSnapshot{openSnapshot([]*InMemoryStore{e.s})}
+	defer snap.Release()
+	return snap.Ascend(start, fn)
+}
+
+// Apply writes every operation of b with the shards of its keys locked, so
+// that commands see all of them or none. Values must be of a type that can
+// be written to disk, as for the other engines, whichever setting the
+// store runs under.
+func (e storeEngine) Apply(b *Batch) error {
+	keys := make([]string, 0, len(b.ops))
+	for _, op := range b.ops {
+		if !op.entry.deleted {
+			if _, err := valueTag(op.entry.value); err != nil {
+				return fmt.Errorf("key %q: %v", op.key, err)
+			}
+		}
+		keys = append(keys, op.key)
+	}
+
+	unlock := e.s.lockKeys(keys...)
+	defer unlock()
+
+	for _, op := range b.ops {
+		sh := e.s.shardFor(op.key)
+		if op.entry.deleted {
+			sh.delete(op.key)
+			continue
+		}
+		// set leaves the TTL of a key that has not expired in place.
+		sh.set(op.key, op.entry.value)
+		switch {
+		case op.keepTTL:
+		case op.entry.expireAt.IsZero():
+			delete(sh.ttls, op.key)
+		default:
+			sh.ttls[op.key] = op.entry.expireAt
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a copy-on-write view of the store as it is now.
+func (e storeEngine) Snapshot() (EngineSnapshot, error) {
+	return storeSnapshot{openSnapshot([]*InMemoryStore{e.s})}, nil
+}
+
+// Close does nothing: the store belongs to its Databases, which close the
+// engine it keeps values in.
+func (e storeEngine) Close() error {
+	return nil
+}
+
+// storeSnapshot is a snapshot of a single store, seen as an EngineSnapshot.
+type storeSnapshot struct {
+	*Snapshot
+}
+
+func (s storeSnapshot) Get(key string) (interface{}, time.Time, bool, error) {
+	return s.Snapshot.Get(0, key)
+}
+
+// Ascend collects and sorts the keys of the snapshot from start onwards,
+// then reads them one at a time.
+func (s storeSnapshot) Ascend(start string, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	var keys []string
+	err := s.forEachKey(0, func(key string) {
+		if key >= start {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, expireAt, found, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if err := fn(key, value, expireAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// coldEntry stands in for a key whose value has been demoted to the tier.
+// The key itself, its TTL and its scan index slot stay in memory.
+type coldEntry struct {
+	typ string
+	// size is the accounted size the key had before it was demoted.
+	size int64
+}
+
+// tier is the engine that a keyspace keeps cold values in. It only holds
+// values whose keys are cold in some shard, so the snapshot and the WAL,
+// not the tier, are what the dataset is recovered from.
+type tier struct {
+	engine Engine
+	kind   EngineKind
+
+	demotions  atomic.Int64
+	promotions atomic.Int64
+	// reads counts values read from the tier without being promoted.
+	reads  atomic.Int64
+	errors atomic.Int64
+	// coldKeys and coldBytes count the demoted keys and the accounted
+	// size they had in memory.
+	coldKeys  atomic.Int64
+	coldBytes atomic.Int64
+}
+
+// tierMarkerFileName marks a directory as one that OpenTier created.
+const tierMarkerFileName = "TIER"
+
+// OpenTier opens the LSM tree in dir for a keyspace using the given
+// engine kind. The directory must be missing, empty or marked as a tier by
+// an earlier OpenTier; any other directory is refused rather than emptied.
+// The tiered engine's tree is scratch space, so the tables an earlier run
+// left there are discarded; the lsm engine's tree is kept, and PruneTier
+// drops what recovery did not claim.
+func OpenTier(dir string, kind EngineKind, opts LSMOptions) (*LSMTree, error) {
+	if err := claimTierDir(dir); err != nil {
+		return nil, err
+	}
+	if kind == EngineLSM {
+		return NewLSMTree(dir, opts)
+	}
+	for _, pattern := range []string{"*.sst", lsmManifestFileName, lsmManifestFileName + ".tmp"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, path := range matches {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return NewLSMTree(dir, opts)
+}
+
+// claimTierDir checks that dir is a tier directory, creating it and its
+// marker if dir is missing or empty.
+func claimTierDir(dir string) error {
+	marker := filepath.Join(dir, tierMarkerFileName)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty and was not created as a tier directory", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return replaceFile(marker, []byte("redix tier\n"))
+}
+
+// storeIDs numbers the stores of the process. A store's id prefixes its
+// keys in the tier, which databases swapped by SWAPDB share.
+var storeIDs atomic.Uint64
+
+func tierPrefix(id uint64) string {
+	return string(binary.BigEndian.AppendUint64(nil, id))
+}
+
+// coldEntryOverhead approximates the bytes spent per cold key outside of
+// the key itself: the map slot, the cold entry and its scan index slot.
+const coldEntryOverhead = 64
+
+// coldStubSize is the memory accounted for a cold key.
+func coldStubSize(key string) int64 {
+	return coldEntryOverhead + int64(len(key))
+}
+
+// coldValue reads the value of a cold key from the tier. The caller must
+// hold sh.mu.
+func (sh *shard) coldValue(key string) (interface{}, error) {
+	value, _, found, err := sh.tier.engine.Get(sh.tierPrefix + key)
+	if err == nil && !found {
+		err = fmt.Errorf("value of %q is missing from the tier", key)
+	}
+	if err != nil {
+		sh.tier.errors.Add(1)
+		return nil, err
+	}
+	return value, nil
+}
+
+// typeOf returns the type name of the value at key, without reading cold
+// values. The caller must hold sh.mu.
+func (sh *shard) typeOf(key string) string {
+	if e, exists := sh.data[key]; exists {
+		return typeName(e.value)
+	}
+	return sh.cold[key].typ
+}
+
+// demote moves the value of key to the tier, leaving a cold entry in its
+// place. Demoting does not change what the key holds, so nothing is saved
+// for a running snapshot. The caller must hold sh.mu for writing.
+func (sh *shard) demote(key string) bool {
+	e, exists := sh.data[key]
+	if !exists {
+		return false
+	}
+	if err := sh.tier.put(sh.tierPrefix+key, e.value); err != nil {
+		sh.tier.errors.Add(1)
+		log.Printf("tiering: demoting %q: %v", key, err)
+		return false
+	}
+	delete(sh.data, key)
+	sh.cold[key] = coldEntry{typ: typeName(e.value), size: e.size}
+	sh.account(coldStubSize(key) - e.size)
+	sh.tier.demotions.Add(1)
+	sh.tier.coldKeys.Add(1)
+	sh.tier.coldBytes.Add(e.size)
+	return true
+}
+
+// promote moves the value of a cold key back into memory. The caller must
+// hold sh.mu for writing.
+func (sh *shard) promote(key string) {
+	if _, cold := sh.cold[key]; !cold {
+		return
+	}
+	value, err := sh.coldValue(key)
+	if err != nil {
+		log.Printf("tiering: promoting %q: %v", key, err)
+		return
+	}
+	sh.uncold(key)
+	size := estimateSize(key, value)
+	sh.data[key] = newEntry(value, size)
+	sh.account(size)
+	sh.tier.promotions.Add(1)
+}
+
+// uncold drops the cold entry of key and its value in the tier. The key
+// stays in the scan index. The caller must hold sh.mu for writing.
+func (sh *shard) uncold(key string) {
+	c := sh.cold[key]
+	delete(sh.cold, key)
+	sh.account(-coldStubSize(key))
+	sh.tier.coldKeys.Add(-1)
+	sh.tier.coldBytes.Add(-c.size)
+	var b Batch
+	b.Delete(sh.tierPrefix + key)
+	if err := sh.tier.engine.Apply(&b); err != nil {
+		sh.tier.errors.Add(1)
+		log.Printf("tiering: dropping %q: %v", key, err)
+	}
+}
+
+// put writes value at key in the engine.
+func (t *tier) put(key string, value interface{}) error {
+	var b Batch
+	b.Set(key, value, time.Time{})
+	return t.engine.Apply(&b)
+}
+
+// spill stores value at key in the engine only, as the lsm engine does for
+// every write. The caller must hold sh.mu for writing and have preserved
+// key. It returns false, leaving the key as it was, if the engine cannot
+// take the value.
+func (sh *shard) spill(key string, value interface{}) bool {
+	if err := sh.tier.put(sh.tierPrefix+key, value); err != nil {
+		sh.tier.errors.Add(1)
+		log.Printf("tiering: storing %q: %v", key, err)
+		return false
+	}
+	if e, exists := sh.data[key]; exists {
+		delete(sh.data, key)
+		sh.account(-e.size)
+	} else if c, cold := sh.cold[key]; cold {
+		sh.account(-coldStubSize(key))
+		sh.tier.coldKeys.Add(-1)
+		sh.tier.coldBytes.Add(-c.size)
+	} else {
+		sh.indexKey(key)
+	}
+	size := estimateSize(key, value)
+	sh.cold[key] = coldEntry{typ: typeName(value), size: size}
+	sh.account(coldStubSize(key))
+	sh.tier.coldKeys.Add(1)
+	sh.tier.coldBytes.Add(size)
+	return true
+}
+
+// dropCold drops every cold key of the shard, with a single batch of
+// deletions in the engine. The caller must hold sh.mu for writing.
+func (sh *shard) dropCold() {
+	var b Batch
+	for key, c := range sh.cold {
+		sh.preserve(key)
+		b.Delete(sh.tierPrefix + key)
+		sh.account(-coldStubSize(key))
+		sh.tier.coldKeys.Add(-1)
+		sh.tier.coldBytes.Add(-c.size)
+	}
+	sh.cold = make(map[string]coldEntry)
+	if err := sh.tier.engine.Apply(&b); err != nil {
+		sh.tier.errors.Add(1)
+		log.Printf("tiering: dropping %d keys: %v", b.Len(), err)
+	}
+}
+
+// UseEngine selects where the databases keep their values. EngineTiered
+// makes eviction demote values to e instead of deleting them, and commands
+// promote the demoted values they name; the eviction policy still picks
+// which keys are demoted, and noeviction demotes the least recently used.
+// EngineLSM stores every value in e as it is written. It must be called
+// before any key is stored.
+func (d *Databases) UseEngine(kind EngineKind, e Engine) {
+	if kind == EngineMemory {
+		return
+	}
+	t := &tier{engine: e, kind: kind}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tier = t
+	for _, db := range d.dbs {
+		unlock := db.lockAll()
+		for _, sh := range db.shards {
+			sh.tier = t
+			sh.cold = make(map[string]coldEntry)
+		}
+		unlock()
+	}
+}
+
+// PruneTier deletes the values in the tier that no key refers to, such as
+// those the lsm engine's tree kept for keys deleted before a restart. It is
+// meant to run once the dataset has been recovered, and returns how many
+// values it deleted.
+func (d *Databases) PruneTier() (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.tier == nil {
+		return 0, nil
+	}
+	stores := make(map[string]*InMemoryStore, len(d.dbs))
+	for _, db := range d.dbs {
+		stores[db.shards[0].tierPrefix] = db
+	}
+	var b Batch
+	err := d.tier.engine.Ascend("", func(key string, _ interface{}, _ time.Time) error {
+		n := len(tierPrefix(0))
+		if db, ok := stores[key[:min(n, len(key))]]; ok && len(key) >= n {
+			name := key[n:]
+			sh := db.shardFor(name)
+			sh.mu.RLock()
+			_, cold := sh.cold[name]
+			sh.mu.RUnlock()
+			if cold {
+				return nil
+			}
+		}
+		b.Delete(key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if b.Len() == 0 {
+		return 0, nil
+	}
+	return b.Len(), d.tier.engine.Apply(&b)
+}
+
+// demoteIfNeeded demotes keys while a dataset that does not fit in memory
+// is loaded. Without tiering, loading never evicts.
+func (d *Databases) demoteIfNeeded() {
+	if d.tier != nil {
+		d.freeMemoryIfNeeded()
+	}
+}
+
+// promote brings the cold keys among keys back into memory before a
+// command uses them.
+func (s *InMemoryStore) promote(keys []string) {
+	unlock := s.lockKeys(keys...)
+	defer unlock()
+	for _, key := range keys {
+		s.shardFor(key).promote(key)
+	}
+}
+
+// demoteKey demotes key if it is in memory and, for volatile policies,
+// has a TTL.
+func (s *InMemoryStore) demoteKey(key string, volatile bool) bool {
+	sh := s.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, hasTTL := sh.ttls[key]; volatile && !hasTTL {
+		return false
+	}
+	return sh.demote(key)
+}
+
+func (h *CommandHandler) infoTiering() string {
+	var b strings.Builder
+	b.WriteString("# Tiering\r\n")
+	t := h.dbs.tier
+	if t == nil {
+		b.WriteString("storage_engine:memory\r\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "storage_engine:%s\r\n", t.kind)
+	fmt.Fprintf(&b, "tiering_cold_keys:%d\r\n", t.coldKeys.Load())
+	fmt.Fprintf(&b, "tiering_cold_bytes:%d\r\n", t.coldBytes.Load())
+	fmt.Fprintf(&b, "tiering_cold_bytes_human:%s\r\n", formatMemory(t.coldBytes.Load()))
+	fmt.Fprintf(&b, "tiering_demotions:%d\r\n", t.demotions.Load())
+	fmt.Fprintf(&b, "tiering_promotions:%d\r\n", t.promotions.Load())
+	fmt.Fprintf(&b, "tiering_reads:%d\r\n", t.reads.Load())
+	fmt.Fprintf(&b, "tiering_errors:%d\r\n", t.errors.Load())
+	return b.String()
+}
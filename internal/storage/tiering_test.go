@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenTierRefusesOtherDirectories(t *testing.T) {
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(keep, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if lsm, err := OpenTier(dir, EngineTiered, DefaultLSMOptions()); err == nil {
+		lsm.Close()
+		t.Fatal("OpenTier used a directory it did not create")
+	}
+	if b, err := os.ReadFile(keep); err != nil || string(b) != "mine" {
+		t.Fatalf("OpenTier changed a file it does not own: %q, %v", b, err)
+	}
+}
+
+func TestOpenTierDiscardsTables(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "lsm")
+	lsm, err := OpenTier(dir, EngineTiered, DefaultLSMOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.Set("key", "value", time.Time{})
+	if err := lsm.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err = OpenTier(dir, EngineTiered, DefaultLSMOptions())
+	if err != nil {
+		t.Fatalf("reopening a tier directory: %v", err)
+	}
+	defer lsm.Close()
+	if _, _, found, err := lsm.Get("key"); err != nil || found {
+		t.Errorf("a value from the last run is still there: %v, %v", found, err)
+	}
+}
+
+// TestLSMEngineKeepsTree restarts an lsm keyspace without persistence, so
+// nothing claims the values the tree kept, and PruneTier deletes them.
+func TestLSMEngineKeepsTree(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "lsm")
+	lsm, err := OpenTier(dir, EngineLSM, DefaultLSMOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs := NewDatabases(1, 4)
+	dbs.UseEngine(EngineLSM, lsm)
+	db, _ := dbs.DB(0)
+	db.Set("kept", "1")
+	db.Set("deleted", "2")
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err = OpenTier(dir, EngineLSM, DefaultLSMOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	prefix := db.shards[0].tierPrefix
+	if _, _, found, err := lsm.Get(prefix + "kept"); err != nil || !found {
+		t.Fatalf("the lsm engine's tree was not kept: %v, %v", found, err)
+	}
+
+	dbs = NewDatabases(1, 4)
+	dbs.UseEngine(EngineLSM, lsm)
+	db, _ = dbs.DB(0)
+	db.Set("kept", "3")
+	pruned, err := dbs.PruneTier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Errorf("pruned %d values, want the 2 of the last run", pruned)
+	}
+	if value, _ := db.Get("kept"); value != "3" {
+		t.Errorf("kept = %v after pruning", value)
+	}
+	n := 0
+	if err := lsm.Ascend("", func(string, interface{}, time.Time) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("the tree holds %d values, want 1", n)
+	}
+}
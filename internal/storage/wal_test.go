@@ -0,0 +1,512 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TejasSathe010/Redix-A-modern-twist-on-Redis/internal/datastructures"
+)
+
+// writeWALFile writes a WAL file holding the given framed records followed
+// by tail.
+func writeWALFile(t *testing.T, path string, records [][]byte, tail []byte) {
+	t.Helper()
+	buf := appendWALHeader(nil)
+	for _, record := range records {
+		buf = append(buf, record...)
+	}
+	if err := os.WriteFile(path, append(buf, tail...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commandFrames(n int) [][]byte {
+	frames := make([][]byte, n)
+	for i := range frames {
+		key := "key:" + strconv.Itoa(i)
+		frames[i] = frameWALRecord(appendCommandRecord(nil, uint64(i+1), 0, []string{"SET", key, "value"}))
+	}
+	return frames
+}
+
+func TestReplayWALDamage(t *testing.T) {
+	frames := commandFrames(3)
+	intact := int64(walHeaderLen + len(frames[0]) + len(frames[1]) + len(frames[2]))
+	corrupt := append([]byte(nil), frames[1]...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		records [][]byte
+		tail    []byte
+		// want is the repair, nil for an intact WAL; its Reason is
+		// matched as a prefix.
+		want    *WALRepair
+		replays int
+	}{
+		{"intact", frames, nil, nil, 3},
+		{"torn header", frames, frames[0][:5], &WALRepair{
+			Offset: intact, Skipped: 5, Records: 3, Reason: "incomplete record header"}, 3},
+		{"torn payload", frames, frames[0][:walFrameLen+3], &WALRepair{
+			Offset: intact, Skipped: walFrameLen + 3, Records: 3, Reason: "incomplete record ("}, 3},
+		{"checksum mismatch", [][]byte{frames[0], corrupt, frames[2]}, nil, &WALRepair{
+			Offset:  int64(walHeaderLen + len(frames[0])),
+			Skipped: int64(len(corrupt) + len(frames[2])),
+			Records: 1, Reason: "checksum mismatch"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal.log")
+			writeWALFile(t, path, tt.records, tt.tail)
+			replayed := 0
+			last, repair, err := replayWAL(path, func(walRecord) error {
+				replayed++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replayed != tt.replays {
+				t.Errorf("replayed %d records, want %d", replayed, tt.replays)
+			}
+			if want := uint64(tt.replays); last != want {
+				t.Errorf("last sequence number %d, want %d", last, want)
+			}
+			if tt.want == nil {
+				if repair != nil {
+					t.Fatalf("unexpected repair: %v", repair)
+				}
+				return
+			}
+			if repair == nil {
+				t.Fatal("damage was not reported")
+			}
+			if repair.Offset != tt.want.Offset || repair.Skipped != tt.want.Skipped || repair.Records != tt.want.Records ||
+				!strings.HasPrefix(repair.Reason, tt.want.Reason) {
+				t.Errorf("repair = %+v, want %+v", *repair, *tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayWALUnknownOperation(t *testing.T) {
+	payload := binary.AppendUvarint(nil, uint64(time.Now().UnixNano()))
+	payload = append(payload, 'X')
+	path := filepath.Join(t.TempDir(), "wal.log")
+	writeWALFile(t, path, [][]byte{commandFrames(1)[0], frameWALRecord(payload)}, nil)
+
+	_, repair, err := replayWAL(path, func(walRecord) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "unknown operation") {
+		t.Fatalf("replay returned %v, want an unknown operation error", err)
+	}
+	if repair != nil {
+		t.Errorf("a record with a valid checksum was treated as damage: %v", repair)
+	}
+}
+
+func TestReplayWALBadHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	if err := os.WriteFile(path, []byte("NOTAWAL!!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := replayWAL(path, func(walRecord) error { return nil }); err == nil {
+		t.Fatal("a file without the WAL header was replayed")
+	}
+}
+
+func TestValueRecordRoundTrip(t *testing.T) {
+	list := datastructures.NewList()
+	list.PushBack("a")
+	list.PushBack(int64(2))
+	set := datastructures.NewSet()
+	set.Add("member")
+	zset := datastructures.NewSortedSet()
+	zset.Add("one", 1.5)
+	hash := datastructures.NewHash()
+	hash.HSet("field", "value")
+
+	for _, value := range []interface{}{"string", int64(-7), list, set, zset, hash} {
+		payload, err := appendValueRecord(nil, 3, "key", 1700000000123, value)
+		if err != nil {
+			t.Fatalf("%T: %v", value, err)
+		}
+		record, err := decodeWALRecord(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("%T: %v", value, err)
+		}
+		if record.op != 'V' || record.db != 3 || record.key != "key" || record.expireMs != 1700000000123 {
+			t.Errorf("%T: decoded %+v", value, record)
+		}
+		if record.time == 0 {
+			t.Errorf("%T: record lost its timestamp", value)
+		}
+		want, _ := dumpValue(value)
+		got, err := dumpValue(record.data)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%T: value did not survive the round trip: %v", value, err)
+		}
+	}
+}
+
+// testServer is a command handler persisting to a WAL in dir, as the server
+// runs it.
+type testServer struct {
+	p   *PersistenceLayer
+	h   *CommandHandler
+	ctx context.Context
+}
+
+func openTestServer(t *testing.T, dir string) (*testServer, RecoveryStats) {
+	t.Helper()
+	p, err := NewPersistenceLayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewCommandHandler(NewDatabases(4, 4))
+	stats, err := h.Recover(p)
+	if err != nil {
+		p.Close()
+		t.Fatal(err)
+	}
+	h.EnablePersistence(p)
+	t.Cleanup(func() { p.Close() })
+	return &testServer{p: p, h: h, ctx: h.NewSession(context.Background())}, stats
+}
+
+func (s *testServer) do(t *testing.T, args ...string) interface{} {
+	t.Helper()
+	reply, err := s.h.HandleCommand(s.ctx, args)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return reply
+}
+
+// walCommands returns the commands logged in the WAL files of p.
+func walCommands(t *testing.T, p *PersistenceLayer) [][]string {
+	t.Helper()
+	var commands [][]string
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, err := p.replayFiles(0, func(record walRecord) error {
+		if record.op == 'C' {
+			commands = append(commands, record.args)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return commands
+}
+
+func TestExpireIsLoggedAsPExpireAt(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestServer(t, dir)
+	s.do(t, "SET", "session", "data")
+	before := time.Now()
+	s.do(t, "EXPIRE", "session", "100")
+	s.do(t, "EXPIRE", "missing", "100")
+
+	commands := walCommands(t, s.p)
+	if len(commands) != 2 {
+		t.Fatalf("logged %v, want SET and one PEXPIREAT", commands)
+	}
+	logged := commands[1]
+	if logged[0] != "PEXPIREAT" || logged[1] != "session" {
+		t.Fatalf("EXPIRE was logged as %v", logged)
+	}
+	ms, _ := strconv.ParseInt(logged[2], 10, 64)
+	if at := time.UnixMilli(ms); at.Before(before.Add(99*time.Second)) || at.After(time.Now().Add(100*time.Second)) {
+		t.Errorf("logged expiry %v is not 100s after the command", at)
+	}
+	s.p.Close()
+
+	// Replayed later, the key keeps its original deadline instead of
+	// getting a fresh 100 seconds.
+	restarted, stats := openTestServer(t, dir)
+	if stats.Replayed != 2 || stats.Failed != 0 {
+		t.Errorf("recovery stats %+v", stats)
+	}
+	db, _ := restarted.h.dbs.DB(0)
+	at, ok := db.ExpireTime("session")
+	if !ok || at.UnixMilli() != ms {
+		t.Errorf("recovered expiry %v, %v, want %v", at, ok, time.UnixMilli(ms))
+	}
+}
+
+func TestRecoverTruncatesDamagedTail(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestServer(t, dir)
+	s.do(t, "SET", "a", "1")
+	s.do(t, "SET", "b", "2")
+	s.p.Close()
+
+	segment := filepath.Join(dir, s.p.manifest.segments[len(s.p.manifest.segments)-1])
+	info, _ := os.Stat(segment)
+	file, _ := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write(commandFrames(1)[0][:6])
+	file.Close()
+
+	restarted, stats := openTestServer(t, dir)
+	if stats.WALRepair == nil || stats.WALRepair.Offset != info.Size() || stats.WALRepair.Skipped != 6 {
+		t.Fatalf("repair %v, want 6 bytes dropped at offset %d", stats.WALRepair, info.Size())
+	}
+	if after, _ := os.Stat(segment); after.Size() != info.Size() {
+		t.Errorf("segment is %d bytes after repair, want %d", after.Size(), info.Size())
+	}
+	if got := restarted.do(t, "GET", "b"); got != "2" {
+		t.Errorf("GET b = %v after repair", got)
+	}
+
+	// Writes after the repair follow the last intact record.
+	restarted.do(t, "SET", "c", "3")
+	restarted.p.Close()
+	again, stats := openTestServer(t, dir)
+	if stats.WALRepair != nil || stats.Replayed != 3 {
+		t.Errorf("second recovery stats %+v", stats)
+	}
+	if got := again.do(t, "GET", "c"); got != "3" {
+		t.Errorf("GET c = %v", got)
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	m := &walManifest{base: "base-000003.log", baseSeq: 40, segments: []string{"wal-000004.log", "wal-000007.log"},
+		hold: "wal-000007.log", holdSeq: 52}
+	if err := m.write(dir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.base != m.base || got.baseSeq != m.baseSeq || !reflect.DeepEqual(got.segments, m.segments) ||
+		got.hold != m.hold || got.holdSeq != m.holdSeq {
+		t.Errorf("read back %+v, want %+v", got, m)
+	}
+	if name := got.newFile("wal"); name != "wal-000008.log" {
+		t.Errorf("next file is %s, want wal-000008.log", name)
+	}
+
+	for _, bad := range []string{"segment\n", "base base-1.log x\n", "hold wal-1.log\n", "tail wal-1.log\n"} {
+		os.WriteFile(filepath.Join(dir, manifestFileName), []byte(bad), 0644)
+		if _, err := readManifest(dir); err == nil {
+			t.Errorf("manifest %q was accepted", bad)
+		}
+	}
+}
+
+func TestManifestTrimKeepsHold(t *testing.T) {
+	m := &walManifest{segments: []string{"wal-1.log", "wal-2.log", "wal-3.log", "wal-4.log"}, hold: "wal-2.log"}
+	m.trim("wal-4.log")
+	if want := []string{"wal-2.log", "wal-3.log", "wal-4.log"}; !reflect.DeepEqual(m.segments, want) {
+		t.Errorf("trimmed to %v, want %v", m.segments, want)
+	}
+	m.hold = ""
+	m.trim("wal-4.log")
+	if want := []string{"wal-4.log"}; !reflect.DeepEqual(m.segments, want) {
+		t.Errorf("trimmed to %v, want %v", m.segments, want)
+	}
+}
+
+func TestSegmentsAndCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestServer(t, dir)
+	for i := 0; i < 3; i++ {
+		s.do(t, "SET", "key:"+strconv.Itoa(i), "value")
+		s.p.mutex.Lock()
+		if err := s.p.rotate(); err != nil {
+			t.Fatal(err)
+		}
+		s.p.mutex.Unlock()
+	}
+	s.do(t, "SET", "key:3", "value")
+	if n := len(s.p.manifest.segments); n != 4 {
+		t.Fatalf("%d segments, want 4", n)
+	}
+	stray := filepath.Join(dir, "wal-000099.log")
+	os.WriteFile(stray, appendWALHeader(nil), 0644)
+
+	// Recovery reads the segments in order.
+	s.p.Close()
+	restarted, stats := openTestServer(t, dir)
+	if stats.Replayed != 4 {
+		t.Errorf("replayed %d commands, want 4", stats.Replayed)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Error("a segment missing from the manifest was kept")
+	}
+
+	// A snapshot checkpoints the WAL down to one new segment.
+	old := append([]string(nil), restarted.p.manifest.segments...)
+	if err := restarted.h.SaveSnapshot(restarted.p); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.segments) != 1 || m.segments[0] == old[len(old)-1] {
+		t.Fatalf("manifest lists %v after a checkpoint", m.segments)
+	}
+	for _, name := range old {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s survived the checkpoint", name)
+		}
+	}
+	restarted.do(t, "SET", "key:4", "value")
+	restarted.p.Close()
+	again, stats := openTestServer(t, dir)
+	if stats.SnapshotKeys != 4 || stats.Replayed != 1 {
+		t.Errorf("recovery after checkpoint: %+v", stats)
+	}
+	if got := again.do(t, "DBSIZE"); got != int64(5) {
+		t.Errorf("DBSIZE = %v, want 5", got)
+	}
+}
+
+func TestDamageBeforeLastSegmentIsAnError(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := openTestServer(t, dir)
+	s.do(t, "SET", "a", "1")
+	first := s.p.manifest.segments[0]
+	s.p.mutex.Lock()
+	s.p.rotate()
+	s.p.mutex.Unlock()
+	s.do(t, "SET", "b", "2")
+	s.p.Close()
+
+	path := filepath.Join(dir, first)
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	p, err := NewPersistenceLayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := NewCommandHandler(NewDatabases(4, 4)).Recover(p); err == nil || !strings.Contains(err.Error(), first) {
+		t.Fatalf("Recover returned %v, want an error naming %s", err, first)
+	}
+}
+
+// walFilesOnDisk returns the WAL base and segment files in dir.
+func walFilesOnDisk(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	for _, pattern := range []string{"base-*.log", "wal-*.log"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range matches {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	return names
+}
+
+// checkWALFiles checks that the manifest in dir lists exactly the WAL
+// files there.
+func checkWALFiles(t *testing.T, dir string) *walManifest {
+	t.Helper()
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	if m.base != "" {
+		listed = append(listed, m.base)
+	}
+	listed = append(listed, m.segments...)
+	if onDisk := walFilesOnDisk(t, dir); !reflect.DeepEqual(listed, onDisk) {
+		t.Fatalf("manifest lists %v, directory holds %v", listed, onDisk)
+	}
+	return m
+}
+
+// TestRotationAcrossRestarts writes enough to rotate the WAL several
+// times, with a snapshot and a rewrite in between, and checks the files
+// left and the state recovered after each restart.
+func TestRotationAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *testServer {
+		s, stats := openTestServer(t, dir)
+		if stats.Failed != 0 || stats.WALRepair != nil {
+			t.Fatalf("recovery stats %+v", stats)
+		}
+		s.p.mutex.Lock()
+		s.p.segmentSize = 1 << 10
+		s.p.mutex.Unlock()
+		return s
+	}
+	increments := 0
+	write := func(s *testServer, n int) {
+		for i := 0; i < n; i++ {
+			s.do(t, "INCR", "counter")
+			s.do(t, "SET", "key:"+strconv.Itoa(increments), strings.Repeat("v", 32))
+			increments++
+		}
+	}
+	check := func(s *testServer) {
+		t.Helper()
+		if got := s.do(t, "TYPE", "counter"); got != "string" {
+			t.Fatalf("TYPE counter = %v", got)
+		}
+		if got := s.do(t, "GET", "counter"); got != int64(increments) {
+			t.Fatalf("counter = %v, want %d", got, increments)
+		}
+		if got := s.do(t, "DBSIZE"); got != int64(increments+1) {
+			t.Fatalf("DBSIZE = %v, want %d", got, increments+1)
+		}
+	}
+
+	s := open()
+	first := s.p.manifest.segments[0]
+	write(s, 40)
+	if n := len(s.p.manifest.segments); n < 3 {
+		t.Fatalf("%d segments after 80 writes, want several", n)
+	}
+	checkWALFiles(t, dir)
+	s.p.Close()
+
+	s = open()
+	check(s)
+	if err := s.h.SaveSnapshot(s.p); err != nil {
+		t.Fatal(err)
+	}
+	if m := checkWALFiles(t, dir); len(m.segments) != 1 || m.segments[0] == first {
+		t.Fatalf("the snapshot left segments %v", m.segments)
+	}
+	write(s, 40)
+	s.p.Close()
+
+	s = open()
+	check(s)
+	rewriteAOF(t, s)
+	m := checkWALFiles(t, dir)
+	if m.base == "" || len(m.segments) != 1 {
+		t.Fatalf("the rewrite left base %q and segments %v", m.base, m.segments)
+	}
+	write(s, 40)
+	if m := checkWALFiles(t, dir); len(m.segments) < 3 {
+		t.Fatalf("%d segments after the rewrite, want several", len(m.segments))
+	}
+	s.p.Close()
+
+	s = open()
+	check(s)
+	if got := s.do(t, "INCR", "counter"); got != int64(increments+1) {
+		t.Fatalf("INCR counter = %v, want %d", got, increments+1)
+	}
+}